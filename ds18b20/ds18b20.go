@@ -27,6 +27,7 @@ import (
 	"github.com/sdoque/mbaigo/components"
 	"github.com/sdoque/mbaigo/forms"
 	"github.com/sdoque/mbaigo/usecases"
+	"github.com/sdoque/systems/internal/coapserver"
 )
 
 func main() {
@@ -74,6 +75,7 @@ func main() {
 
 	// start the requests handlers and servers
 	go usecases.SetoutServers(&sys)
+	go coapserver.Setout(sys.Ctx, sys.Name, sys.Husk.ProtoPort["coap"], coapserver.Assets(sys.UAssets), map[string]time.Duration{"temperature": 2 * time.Second}) // the temperature can be observed over CoAP
 
 	// wait for shutdown signal, and gracefully close properly goroutines with context
 	<-sys.Sigs // wait for a SIGINT (Ctrl+C) signal
@@ -0,0 +1,146 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/systems/internal/registrar"
+)
+
+//*********************Secondary indexes of the registry map*********************
+
+// A local cloud with thousands of records (e.g., one per Modbus register or OPC UA node) would make every discovery scan
+// the whole registry. The registry map is therefore indexed by service definition, by system, by IP address and by detail value.
+// The indexes are updated with the map (the caller holds the registry lock), so a quest only evaluates the records of its smallest candidate set.
+
+// idSet is a set of record ids
+type idSet map[int]struct{}
+
+// registryIndex holds the secondary indexes of the registry map
+type registryIndex struct {
+	byDefinition map[string]idSet
+	bySystem     map[string]idSet
+	byAddress    map[string]idSet            // by IP address
+	byDetail     map[string]map[string]idSet // by detail key, then by value
+}
+
+// newRegistryIndex creates empty indexes
+func newRegistryIndex() *registryIndex {
+	return &registryIndex{
+		byDefinition: make(map[string]idSet),
+		bySystem:     make(map[string]idSet),
+		byAddress:    make(map[string]idSet),
+		byDetail:     make(map[string]map[string]idSet),
+	}
+}
+
+// insert adds an id to the set of a key
+func insert(sets map[string]idSet, key string, id int) {
+	set, exists := sets[key]
+	if !exists {
+		set = make(idSet)
+		sets[key] = set
+	}
+	set[id] = struct{}{}
+}
+
+// remove deletes an id from the set of a key, and the set once empty
+func remove(sets map[string]idSet, key string, id int) {
+	if set, exists := sets[key]; exists {
+		delete(set, id)
+		if len(set) == 0 {
+			delete(sets, key)
+		}
+	}
+}
+
+// add indexes a record
+func (x *registryIndex) add(rec forms.ServiceRecord_v1) {
+	insert(x.byDefinition, rec.ServiceDefinition, rec.Id)
+	insert(x.bySystem, rec.SystemName, rec.Id)
+	for _, ip := range rec.IPAddresses {
+		insert(x.byAddress, ip, rec.Id)
+	}
+	for key, values := range rec.Details {
+		byValue, exists := x.byDetail[key]
+		if !exists {
+			byValue = make(map[string]idSet)
+			x.byDetail[key] = byValue
+		}
+		for _, value := range values {
+			insert(byValue, value, rec.Id)
+		}
+	}
+}
+
+// drop removes a record from the indexes
+func (x *registryIndex) drop(rec forms.ServiceRecord_v1) {
+	remove(x.byDefinition, rec.ServiceDefinition, rec.Id)
+	remove(x.bySystem, rec.SystemName, rec.Id)
+	for _, ip := range rec.IPAddresses {
+		remove(x.byAddress, ip, rec.Id)
+	}
+	for key, values := range rec.Details {
+		for _, value := range values {
+			remove(x.byDetail[key], value, rec.Id)
+		}
+		if len(x.byDetail[key]) == 0 {
+			delete(x.byDetail, key)
+		}
+	}
+}
+
+// candidates returns the smallest set of records that may match a quest, or false if the quest cannot use the indexes.
+// Only the service definition and the details with exact values (see matching.Requirements) narrow the search,
+// the records of the set are still checked against the complete quest.
+func (x *registryIndex) candidates(m *registrar.QuestMatcher) (idSet, bool) {
+	var best idSet
+	indexed := false
+	narrow := func(set idSet) {
+		if !indexed || len(set) < len(best) {
+			best, indexed = set, true
+		}
+	}
+	if definition := m.Definition(); definition != "" {
+		narrow(x.byDefinition[definition])
+	}
+	for _, req := range m.Requirements() {
+		var sets map[string]idSet
+		switch req.Key {
+		case "SystemName":
+			sets = x.bySystem
+		case "Definition":
+			sets = x.byDefinition
+		case "ACost", "CUnit", "SubPath":
+			continue // fields that are not indexed
+		default:
+			sets = x.byDetail[req.Key]
+		}
+		if len(req.Values) == 1 {
+			narrow(sets[req.Values[0]])
+			continue
+		}
+		union := make(idSet)
+		for _, value := range req.Values {
+			for id := range sets[value] {
+				union[id] = struct{}{}
+			}
+		}
+		narrow(union)
+	}
+	return best, indexed
+}
@@ -0,0 +1,193 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/systems/internal/registrar"
+)
+
+// indexedRecord returns a record for the index tests
+func indexedRecord(definition, system string, details map[string][]string, aCost float64) forms.ServiceRecord_v1 {
+	return forms.ServiceRecord_v1{
+		ServiceDefinition: definition,
+		SystemName:        system,
+		SubPath:           "asset/" + definition,
+		IPAddresses:       []string{"192.168.1.10"},
+		ProtoPort:         map[string]int{"http": 20150},
+		Details:           details,
+		RegLife:           30,
+		ACost:             aCost,
+	}
+}
+
+// TestCandidatesKeepMatches checks that the candidate set of the indexes never leaves out a record that the matcher accepts,
+// and that find answers a quest as a scan of the whole registry would
+func TestCandidatesKeepMatches(t *testing.T) {
+	pick := func(r *rand.Rand, values ...string) string { return values[r.Intn(len(values))] }
+	r := rand.New(rand.NewSource(1))
+	s := newMemoryStore()
+	for i := 0; i < 500; i++ {
+		details := map[string][]string{}
+		if location := pick(r, "Kitchen", "Kitchenette", "Attic", "Garage", ""); location != "" {
+			details["Location"] = []string{location}
+		}
+		details["Unit"] = []string{pick(r, "Celsius", "Kelvin")}
+		if r.Intn(4) == 0 {
+			details["Deprecated"] = []string{"true"}
+		}
+		if r.Intn(3) == 0 {
+			details["Location"] = append(details["Location"], "Basement") // a record with several values of a key
+		}
+		rec := indexedRecord(pick(r, "temperature", "setpoint"), "thermo-"+strconv.Itoa(r.Intn(8)), details, float64(r.Intn(4)))
+		rec.IPAddresses = []string{"192.168.1." + strconv.Itoa(i)} // distinct instances, none replaces another
+		if _, err := s.Register(&rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	quests := []struct {
+		definition string
+		details    map[string][]string
+	}{
+		{"temperature", nil},
+		{"temperature", map[string][]string{"Location": {"Kitchen"}}},
+		{"temperature", map[string][]string{"Location": {"Kitchen", "Attic"}, "Unit": {"Kelvin"}}},
+		{"temperature", map[string][]string{"Location": {"Basement"}}},
+		{"temperature", map[string][]string{"Location": {}}},
+		{"temperature", map[string][]string{"Location": {"Kitchen*"}}},
+		{"temperature", map[string][]string{"Location": {"Kit*"}, "!Unit": {"Kelvin"}}},
+		{"temperature", map[string][]string{"SystemName": {"thermo-1"}}},
+		{"temperature", map[string][]string{"SystemName": {"thermo-1", "thermo-2"}, "Unit": {"Celsius"}}},
+		{"setpoint", map[string][]string{"Definition": {"setpoint"}, "Unit": {"Celsius"}}},
+		{"setpoint", map[string][]string{"Definition": {"temperature"}}},
+		{"temperature", map[string][]string{"ACost": {"2"}, "Location": {"Garage"}}},
+		{"temperature", map[string][]string{"CUnit": {"kWh"}}},
+		{"temperature", map[string][]string{"!Deprecated": {}, "Location": {"Attic"}}},
+		{"temperature", map[string][]string{"!Location": {"Kitchen"}, "Unit": {"Kelvin"}}},
+		// a top-level query node combined with negated keys
+		{"temperature", map[string][]string{"Query": {"Location=Kitchen OR Location=Garage"}, "!Deprecated": {}}},
+		{"temperature", map[string][]string{"Query": {"SystemName=thermo-2"}, "!Location": {"Attic"}}},
+		{"temperature", map[string][]string{"Query": {"NOT Deprecated AND Unit=Celsius"}, "!Deprecated": {}, "Location": {"Garage"}}},
+		{"setpoint", map[string][]string{"Query": {"NOT Location"}, "!Unit": {}, "Unit": {"Celsius"}}},
+		{"setpoint", map[string][]string{"Query": {"ACost<=1 AND Location!=Kitchen*"}, "!Deprecated": {"true"}, "SystemName": {"thermo-3"}}},
+	}
+
+	all, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range quests {
+		name := fmt.Sprintf("%s %v", q.definition, q.details)
+		m, err := registrar.CompileQuest(q.definition, q.details)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		want := make(map[int]bool)
+		for _, rec := range all {
+			if rec.ServiceDefinition == q.definition && m.Matches(rec) {
+				want[rec.Id] = true
+			}
+		}
+		if candidates, indexed := s.index.candidates(m); indexed {
+			for id := range want {
+				if _, ok := candidates[id]; !ok {
+					t.Errorf("%s: the indexes leave out the matching record %d", name, id)
+				}
+			}
+		}
+		found, err := s.Find(q.definition, m)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got := make(map[int]bool)
+		for _, rec := range found {
+			got[rec.Id] = true
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s: found %d records, a scan finds %d", name, len(got), len(want))
+		}
+		for id := range want {
+			if !got[id] {
+				t.Errorf("%s: find misses the matching record %d", name, id)
+			}
+		}
+	}
+}
+
+// benchmarkMatches is the number of records answering each lookup of BenchmarkFind, whatever the size of the registry
+const benchmarkMatches = 10
+
+// benchmarkStore fills a registry with n records, of which benchmarkMatches have the definition pressure,
+// benchmarkMatches belong to the system gateway and benchmarkMatches are located in the vault
+func benchmarkStore(b *testing.B, n int) *memoryStore {
+	s := newMemoryStore()
+	for i := 0; i < n; i++ {
+		definition, system, location := "temperature", "node-"+strconv.Itoa(i/50), "Room-"+strconv.Itoa(i%100)
+		switch i / benchmarkMatches {
+		case 0:
+			definition = "pressure"
+		case 1:
+			system = "gateway"
+		case 2:
+			location = "Vault"
+		}
+		rec := indexedRecord(definition, system, map[string][]string{"Location": {location}, "Unit": {"Celsius"}}, 0)
+		rec.SubPath = "sensor" + strconv.Itoa(i) + "/" + definition
+		if _, err := s.Register(&rec); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return s
+}
+
+func BenchmarkFind(b *testing.B) {
+	lookups := []struct {
+		name       string
+		definition string
+		details    map[string][]string
+	}{
+		{"definition", "pressure", nil},
+		{"system", "temperature", map[string][]string{"SystemName": {"gateway"}}},
+		{"detail", "temperature", map[string][]string{"Location": {"Vault"}}},
+	}
+	for _, n := range []int{1000, 10000, 100000} {
+		s := benchmarkStore(b, n)
+		for _, lookup := range lookups {
+			m, err := registrar.CompileQuest(lookup.definition, lookup.details)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(fmt.Sprintf("%s/%d", lookup.name, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					found, err := s.Find(lookup.definition, m)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if len(found) != benchmarkMatches {
+						b.Fatalf("found %d records, want %d", len(found), benchmarkMatches)
+					}
+				}
+			})
+		}
+	}
+}
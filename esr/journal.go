@@ -0,0 +1,218 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+//*********************Write-ahead journal of the ephemeral registry*********************
+
+// With "journal": "esr.journal" in the configuration file, every change of the registry map (add, renew, delete, expire)
+// is appended to the journal file and flushed to disk before the request is answered. The journal is compacted periodically
+// into a snapshot file (the journal's name with the suffix .snapshot) holding the records and the record counter.
+// On restart, the registry is rebuilt from the snapshot and the journal: the records still valid are restored with their
+// expiration checks, and the record counter continues after the highest id ever assigned, so that ids are never reused.
+
+// journalEntry is a line of the journal
+type journalEntry struct {
+	Time   string                  `json:"time"`
+	Action string                  `json:"action"` // add, renew, delete or expire
+	Id     int                     `json:"id"`
+	Record *forms.ServiceRecord_v1 `json:"record,omitempty"` // the record added or renewed
+}
+
+// journalSnapshot is the content of the snapshot file
+type journalSnapshot struct {
+	Taken    string                   `json:"taken"`
+	RecCount int64                    `json:"recCount"` // next id to assign
+	Records  []forms.ServiceRecord_v1 `json:"records"`
+}
+
+// journal appends the changes of the registry to a file (a nil journal records nothing)
+type journal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	size int64 // length of the complete entries
+}
+
+// openJournal opens the journal file for appending after its complete entries (see replayJournal), cutting off an incomplete last one
+func openJournal(path string, complete int64) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(complete); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &journal{path: path, file: file, size: complete}, nil
+}
+
+// append writes a change of the registry to the journal and flushes it to disk before the change is applied.
+// A partly written entry is cut off, so that the next one starts on its own line.
+func (j *journal) append(action string, rec forms.ServiceRecord_v1) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entry := journalEntry{Time: time.Now().Format(time.RFC3339), Action: action, Id: rec.Id}
+	if action == "add" || action == "renew" {
+		entry.Record = &rec
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error journaling the %s of record %d: %w", action, rec.Id, err)
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		j.file.Truncate(j.size)
+		return fmt.Errorf("error journaling the %s of record %d: %w", action, rec.Id, err)
+	}
+	if err := j.file.Sync(); err != nil {
+		j.file.Truncate(j.size)
+		return fmt.Errorf("error flushing the journal: %w", err)
+	}
+	j.size += int64(len(line) + 1)
+	return nil
+}
+
+// compact writes the snapshot of the registry and empties the journal (the caller holds the registry lock).
+// The snapshot replaces the previous one atomically, so that a crash during the compaction loses nothing.
+func (j *journal) compact(recCount int64, registry map[int]forms.ServiceRecord_v1) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	snap := journalSnapshot{Taken: time.Now().Format(time.RFC3339), RecCount: recCount, Records: make([]forms.ServiceRecord_v1, 0, len(registry))}
+	for _, rec := range registry {
+		snap.Records = append(snap.Records, rec)
+	}
+	payload, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	temporary := j.path + ".snapshot.tmp"
+	file, err := os.Create(temporary)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(payload); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temporary, j.path+".snapshot"); err != nil {
+		return err
+	}
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	j.size = 0
+	return j.file.Sync()
+}
+
+// close releases the journal file
+func (j *journal) close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// replayJournal rebuilds the registry from the snapshot and the journal at a path.
+// It returns the records, the next id to assign and the length of the complete entries of the journal.
+// A truncated last line (a crash while writing) ends the replay.
+func replayJournal(path string) (registry map[int]forms.ServiceRecord_v1, recCount int64, complete int64, err error) {
+	registry = make(map[int]forms.ServiceRecord_v1)
+	recCount = 1 // 0 is used for non registered services
+
+	payload, err := os.ReadFile(path + ".snapshot")
+	switch {
+	case err == nil:
+		var snap journalSnapshot
+		if err := json.Unmarshal(payload, &snap); err != nil {
+			return nil, 0, 0, fmt.Errorf("error reading the journal snapshot: %w", err)
+		}
+		for _, rec := range snap.Records {
+			registry[rec.Id] = rec
+		}
+		if snap.RecCount > recCount {
+			recCount = snap.RecCount
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, 0, 0, err
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return registry, recCount, 0, nil
+	} else if err != nil {
+		return nil, 0, 0, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		text, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(text) > 0 { // an entry is complete with its line feed
+				log.Printf("the journal ends with an incomplete entry at line %d, which is ignored\n", line)
+			}
+			break
+		} else if err != nil {
+			return nil, 0, 0, err
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(text, &entry); err != nil {
+			log.Printf("the journal ends with an incomplete entry at line %d, which is ignored\n", line)
+			break
+		}
+		complete += int64(len(text))
+		switch entry.Action {
+		case "add", "renew":
+			if entry.Record != nil {
+				registry[entry.Id] = *entry.Record
+			}
+		case "delete", "expire":
+			delete(registry, entry.Id)
+		}
+		if int64(entry.Id) >= recCount {
+			recCount = int64(entry.Id) + 1
+		}
+	}
+	return registry, recCount, complete, nil
+}
@@ -0,0 +1,362 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/systems/internal/registrar"
+)
+
+//*********************In-memory storage backend*********************
+
+// memoryStore keeps the registry in a map with its secondary indexes (index.go).
+// With a journal (journal.go), every change is journaled before the method returns and the map is rebuilt on restart.
+type memoryStore struct {
+	mu      sync.RWMutex
+	records map[int]forms.ServiceRecord_v1
+	index   *registryIndex
+	nextId  int      // next id to assign, ids are not reused
+	journal *journal // write-ahead journal of the changes (none if nil)
+
+	registrar.EventLog // the audit trail is kept in memory only, it is not journaled
+}
+
+// newMemoryStore creates an empty registry
+func newMemoryStore() *memoryStore {
+	return &memoryStore{records: make(map[int]forms.ServiceRecord_v1), index: newRegistryIndex(), nextId: 1} // 0 is used for non registered services
+}
+
+// openMemoryStore creates the registry from the journal at a path (see replayJournal) and keeps journaling its changes
+func openMemoryStore(path string) (*memoryStore, error) {
+	registry, nextId, complete, err := replayJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	m := newMemoryStore()
+	for _, rec := range registry {
+		m.put(rec)
+	}
+	if int(nextId) > m.nextId {
+		m.nextId = int(nextId)
+	}
+	if m.journal, err = openJournal(path, complete); err != nil {
+		return nil, err
+	}
+	log.Printf("%d service records read from the journal %s, the next id is %d\n", len(m.records), path, m.nextId)
+	return m, nil
+}
+
+// put adds or replaces a record of the map and updates the indexes (the lock is held by the caller)
+func (m *memoryStore) put(rec forms.ServiceRecord_v1) {
+	if old, exists := m.records[rec.Id]; exists {
+		m.index.drop(old)
+	}
+	m.records[rec.Id] = rec
+	m.index.add(rec)
+	if rec.Id >= m.nextId {
+		m.nextId = rec.Id + 1 // so that a promoted registrar does not reuse the id
+	}
+}
+
+// drop deletes a record from the map and the indexes (the lock is held by the caller)
+func (m *memoryStore) drop(id int) (forms.ServiceRecord_v1, bool) {
+	rec, exists := m.records[id]
+	if exists {
+		delete(m.records, id)
+		m.index.drop(rec)
+	}
+	return rec, exists
+}
+
+// insert stores a complete record and deletes the previous records of the same service (the lock is held by the caller).
+// Each change is journaled before it is applied, and a journal error stops the insertion.
+func (m *memoryStore) insert(rec *forms.ServiceRecord_v1) (replaced []forms.ServiceRecord_v1, err error) {
+	for id := range m.index.bySystem[rec.SystemName] {
+		if old := m.records[id]; id != rec.Id && registrar.SameService(old, *rec) {
+			if err := m.journal.append("delete", old); err != nil {
+				return replaced, err
+			}
+			m.drop(id)
+			replaced = append(replaced, old)
+		}
+	}
+	if rec.Id == 0 {
+		for {
+			if _, exists := m.records[m.nextId]; !exists {
+				break
+			}
+			m.nextId++
+		}
+		rec.Id = m.nextId
+	}
+	if err := m.journal.append("add", *rec); err != nil {
+		return replaced, err
+	}
+	m.put(*rec)
+	return replaced, nil
+}
+
+// Register stores a complete record and deletes the previous records of the same service
+func (m *memoryStore) Register(rec *forms.ServiceRecord_v1) ([]forms.ServiceRecord_v1, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.insert(rec)
+}
+
+// renew extends the validity of an existing record if it matches the stored one (the lock is held by the caller)
+func (m *memoryStore) renew(rec *forms.ServiceRecord_v1, now time.Time) (bool, error) {
+	stored, exists := m.records[rec.Id]
+	if !exists || !registrar.SameCreation(*rec, stored) || stored.SystemName != rec.SystemName || stored.ServiceDefinition != rec.ServiceDefinition || stored.SubPath != rec.SubPath {
+		return false, nil
+	}
+	stored.Updated = now.Format(time.RFC3339)
+	stored.EndOfValidity = now.Add(time.Duration(stored.RegLife) * time.Second).Format(time.RFC3339)
+	if err := m.journal.append("renew", stored); err != nil {
+		return false, err
+	}
+	m.records[rec.Id] = stored // the indexed fields are unchanged
+	rec.RegLife = stored.RegLife
+	rec.Updated = stored.Updated
+	rec.EndOfValidity = stored.EndOfValidity
+	return true, nil
+}
+
+// Extend renews an existing record and updates its validity
+func (m *memoryStore) Extend(rec *forms.ServiceRecord_v1, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	renewed, err := m.renew(rec, now)
+	if err != nil {
+		return err
+	}
+	if !renewed {
+		return registrar.ErrUnknownRecord
+	}
+	return nil
+}
+
+// SetValidity applies the validity of a renewal made by the leading registrar
+func (m *memoryStore) SetValidity(id int, updated, endOfValidity string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, exists := m.records[id]
+	if !exists {
+		return false, nil
+	}
+	stored.Updated = updated
+	stored.EndOfValidity = endOfValidity
+	if err := m.journal.append("renew", stored); err != nil {
+		return false, err
+	}
+	m.records[id] = stored
+	return true, nil
+}
+
+// Delete removes a record
+func (m *memoryStore) Delete(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, exists := m.records[id]
+	if !exists {
+		return nil
+	}
+	if err := m.journal.append("delete", rec); err != nil {
+		return err
+	}
+	m.drop(id)
+	return nil
+}
+
+// Expire removes a record whose validity ended before now, so that a renewal cannot slip in between the check and the deletion
+func (m *memoryStore) Expire(id int, now time.Time) (*forms.ServiceRecord_v1, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, exists := m.records[id]
+	if !exists {
+		return nil, nil
+	}
+	expiration, err := time.Parse(time.RFC3339, rec.EndOfValidity)
+	if err != nil {
+		return nil, err
+	}
+	if !now.After(expiration) {
+		return nil, nil
+	}
+	if err := m.journal.append("expire", rec); err != nil {
+		return nil, err
+	}
+	m.drop(id)
+	return &rec, nil
+}
+
+// Get retrieves a record
+func (m *memoryStore) Get(id int) (*forms.ServiceRecord_v1, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rec, exists := m.records[id]
+	if !exists {
+		return nil, registrar.ErrUnknownRecord
+	}
+	return &rec, nil
+}
+
+// Find returns the records with the service definition that pass the matcher, evaluating only the smallest candidate set of the indexes
+func (m *memoryStore) Find(definition string, matcher *registrar.QuestMatcher) ([]forms.ServiceRecord_v1, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var serviceRecords []forms.ServiceRecord_v1
+	if ids, indexed := m.index.candidates(matcher); indexed {
+		for id := range ids {
+			if rec := m.records[id]; rec.ServiceDefinition == definition && matcher.Matches(rec) {
+				serviceRecords = append(serviceRecords, rec)
+			}
+		}
+		return serviceRecords, nil
+	}
+	for _, rec := range m.records {
+		if rec.ServiceDefinition == definition && matcher.Matches(rec) {
+			serviceRecords = append(serviceRecords, rec)
+		}
+	}
+	return serviceRecords, nil
+}
+
+// List returns all the records
+func (m *memoryStore) List() ([]forms.ServiceRecord_v1, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	records := make([]forms.ServiceRecord_v1, 0, len(m.records))
+	for _, rec := range m.records {
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// RecordsOf returns the records of a system and those announcing an IP address, from the indexes
+func (m *memoryStore) RecordsOf(system, ip string) ([]forms.ServiceRecord_v1, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var records []forms.ServiceRecord_v1
+	for id := range m.index.bySystem[system] {
+		records = append(records, m.records[id])
+	}
+	for id := range m.index.byAddress[ip] {
+		if m.records[id].SystemName != system {
+			records = append(records, m.records[id])
+		}
+	}
+	return records, nil
+}
+
+// ListSystems returns the systems that have registered services with the http protocol
+func (m *memoryStore) ListSystems() (*forms.SystemRecordList_v1, error) {
+	records, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	return registrar.SystemList(records), nil
+}
+
+// StoreBatch registers or renews the records of a system at once
+func (m *memoryStore) StoreBatch(records []forms.ServiceRecord_v1, replace bool, now time.Time) (renewed []bool, retired []forms.ServiceRecord_v1, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	renewed = make([]bool, len(records))
+	kept := make(map[int]bool)
+	for i := range records {
+		rec := &records[i]
+		if rec.Id != 0 {
+			if renewed[i], err = m.renew(rec, now); err != nil {
+				return nil, nil, err
+			}
+		}
+		if !renewed[i] {
+			rec.Id = 0
+			rec.Created = now.Format(time.RFC3339)
+			rec.Updated = now.Format(time.RFC3339)
+			rec.EndOfValidity = now.Add(time.Duration(rec.RegLife) * time.Second).Format(time.RFC3339)
+			replaced, err := m.insert(rec)
+			if err != nil {
+				return nil, nil, err
+			}
+			retired = append(retired, replaced...)
+		}
+		kept[rec.Id] = true
+	}
+	if replace {
+		for id := range m.index.bySystem[records[0].SystemName] {
+			if !kept[id] {
+				old := m.records[id]
+				if err := m.journal.append("delete", old); err != nil {
+					return nil, nil, err
+				}
+				m.drop(id)
+				retired = append(retired, old)
+			}
+		}
+	}
+	return renewed, retired, nil
+}
+
+// Reload deletes the records read from the journal that expired while the registrar was down, compacts the journal and returns the others
+func (m *memoryStore) Reload(now time.Time) ([]forms.ServiceRecord_v1, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	restored := make([]forms.ServiceRecord_v1, 0, len(m.records))
+	for id, rec := range m.records {
+		expiration, err := time.Parse(time.RFC3339, rec.EndOfValidity)
+		if err != nil || !expiration.After(now) {
+			m.drop(id)
+			continue
+		}
+		restored = append(restored, rec)
+	}
+	return restored, m.journal.compact(int64(m.nextId), m.records)
+}
+
+// Unconfirmed returns no record since the records restored from the journal were confirmed by their journaled renewals
+func (m *memoryStore) Unconfirmed() (map[int]bool, error) {
+	return make(map[int]bool), nil
+}
+
+// compactEvery compacts the journal periodically
+func (m *memoryStore) compactEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.mu.Lock()
+		err := m.journal.compact(int64(m.nextId), m.records)
+		m.mu.Unlock()
+		if err != nil {
+			log.Printf("error compacting the journal: %v\n", err)
+		}
+	}
+}
+
+// Close compacts the journal and releases it
+func (m *memoryStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.journal.compact(int64(m.nextId), m.records); err != nil {
+		log.Printf("error compacting the journal: %v\n", err)
+	}
+	return m.journal.close()
+}
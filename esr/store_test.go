@@ -0,0 +1,256 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/systems/internal/registrar"
+	"github.com/sdoque/systems/internal/registrar/registrartest"
+)
+
+// backends are the storage backends that must pass the conformance suite
+var backends = []struct {
+	name string
+	open func(t *testing.T) registrar.Store
+}{
+	{"memory", func(t *testing.T) registrar.Store { return newMemoryStore() }},
+	{"journaled memory", func(t *testing.T) registrar.Store {
+		s, err := openMemoryStore(filepath.Join(t.TempDir(), "esr.journal"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}},
+}
+
+func TestStoreConformance(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			registrartest.Run(t, b.open)
+		})
+	}
+}
+
+// TestJournalRestore checks that a journaled registry is rebuilt after a restart without its expired records and without reusing ids
+func TestJournalRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "esr.journal")
+	now := time.Now()
+	record := func(subPath string, life time.Duration) *forms.ServiceRecord_v1 {
+		return journalRecord(subPath, now, life)
+	}
+
+	s, err := openMemoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, deleted, expired := record("t1/temperature", time.Hour), record("t2/temperature", time.Hour), record("t3/temperature", time.Second)
+	for _, rec := range []*forms.ServiceRecord_v1{kept, deleted, expired} {
+		if _, err := s.Register(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete(deleted.Id); err != nil {
+		t.Fatal(err)
+	}
+	s.journal.close() // a crash: the journal is not compacted
+
+	s, err = openMemoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	restored, err := s.Reload(now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 1 || restored[0].Id != kept.Id {
+		t.Fatalf("restored %v, want only record %d", restored, kept.Id)
+	}
+	fresh := record("t4/temperature", time.Hour)
+	if _, err := s.Register(fresh); err != nil {
+		t.Fatal(err)
+	}
+	if fresh.Id <= expired.Id {
+		t.Fatalf("the new record got the id %d, which was already assigned", fresh.Id)
+	}
+}
+
+// journalRecord returns a record of the thermo system valid for a lifetime
+func journalRecord(subPath string, now time.Time, life time.Duration) *forms.ServiceRecord_v1 {
+	return &forms.ServiceRecord_v1{
+		ServiceDefinition: "temperature",
+		SystemName:        "thermo",
+		SubPath:           subPath,
+		IPAddresses:       []string{"192.168.1.10"},
+		ProtoPort:         map[string]int{"http": 20150},
+		RegLife:           int(life.Seconds()),
+		Created:           now.Format(time.RFC3339),
+		Updated:           now.Format(time.RFC3339),
+		EndOfValidity:     now.Add(life).Format(time.RFC3339),
+	}
+}
+
+// TestJournalRecovery checks the registry rebuilt from a journal left by a crash at the worst moments
+func TestJournalRecovery(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		crash func(t *testing.T, s *memoryStore, path string) // leaves the journal files as a crash would
+		want  []string                                        // subpaths of the rebuilt registry
+	}{
+		{"torn last entry", func(t *testing.T, s *memoryStore, path string) {
+			s.journal.close()
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			if _, err := file.WriteString(`{"time":"` + now.Format(time.RFC3339) + `","action":"add","id":9,"record":{"ser`); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"t1/temperature", "t2/temperature"}},
+		{"snapshot renamed, journal not truncated", func(t *testing.T, s *memoryStore, path string) {
+			entries, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.mu.Lock()
+			err = s.journal.compact(int64(s.nextId), s.records)
+			s.mu.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.journal.close()
+			if err := os.WriteFile(path, entries, 0o644); err != nil { // the entries are replayed again over the snapshot
+				t.Fatal(err)
+			}
+		}, []string{"t1/temperature", "t2/temperature"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "esr.journal")
+			s, err := openMemoryStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			deleted := journalRecord("t0/temperature", now, time.Hour)
+			for _, rec := range []*forms.ServiceRecord_v1{deleted, journalRecord("t1/temperature", now, time.Hour), journalRecord("t2/temperature", now, time.Hour)} {
+				if _, err := s.Register(rec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Delete(deleted.Id); err != nil {
+				t.Fatal(err)
+			}
+			tt.crash(t, s, path)
+
+			s, err = openMemoryStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fresh := journalRecord("t3/temperature", now, time.Hour) // journaled after the recovered entries
+			if _, err := s.Register(fresh); err != nil {
+				t.Fatal(err)
+			}
+			if fresh.Id != 4 {
+				t.Errorf("the new record got the id %d, want 4", fresh.Id)
+			}
+			s.journal.close() // the journal is replayed as is, without the compaction of Close
+
+			registry, _, _, err := replayJournal(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, rec := range registry {
+				got = append(got, rec.SubPath)
+			}
+			sort.Strings(got)
+			if want := append(tt.want, fresh.SubPath); !reflect.DeepEqual(got, want) {
+				t.Errorf("rebuilt registry %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestJournalFailure checks that a change that cannot be journaled is reported and not applied
+func TestJournalFailure(t *testing.T) {
+	now := time.Now()
+	s, err := openMemoryStore(filepath.Join(t.TempDir(), "esr.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := journalRecord("t1/temperature", now, time.Hour)
+	if _, err := s.Register(kept); err != nil {
+		t.Fatal(err)
+	}
+	s.journal.close() // the writes fail from now on
+
+	if _, err := s.Register(journalRecord("t2/temperature", now, time.Hour)); err == nil {
+		t.Error("the registration succeeded without its journal entry")
+	}
+	if err := s.Extend(kept, now.Add(time.Minute)); err == nil || errors.Is(err, registrar.ErrUnknownRecord) {
+		t.Errorf("the renewal returned %v, want the journal error", err)
+	}
+	if err := s.Delete(kept.Id); err == nil {
+		t.Error("the deletion succeeded without its journal entry")
+	}
+	records, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].EndOfValidity != kept.EndOfValidity {
+		t.Errorf("the registry holds %v, want only the unchanged record %d", records, kept.Id)
+	}
+}
+
+// TestRecordsOf checks that the records counted in the quotas of a system and of an IP address follow the registry
+func TestRecordsOf(t *testing.T) {
+	record := func(system, subPath, ip string) *forms.ServiceRecord_v1 {
+		return &forms.ServiceRecord_v1{ServiceDefinition: "temperature", SystemName: system, SubPath: subPath, IPAddresses: []string{ip}, ProtoPort: map[string]int{"http": 20150}}
+	}
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			s := b.open(t)
+			defer s.Close()
+			thermo, heater, proxied := record("thermo", "kitchen/temperature", "192.168.1.10"), record("heater", "valve/setpoint", "192.168.1.20"), record("gateway", "modbus/register", "192.168.1.10")
+			for _, rec := range []*forms.ServiceRecord_v1{thermo, heater, proxied} {
+				if _, err := s.Register(rec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Delete(proxied.Id); err != nil {
+				t.Fatal(err)
+			}
+			records, err := s.RecordsOf("thermo", "192.168.1.10")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 1 || records[0].Id != thermo.Id {
+				t.Fatalf("records %v, want only record %d of thermo", records, thermo.Id)
+			}
+		})
+	}
+}
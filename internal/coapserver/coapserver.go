@@ -0,0 +1,431 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+// Package coapserver serves the services of a system over CoAP (RFC 7252, over UDP) for the constrained nodes that cannot afford HTTP.
+//
+// The services are reached at the same paths as over HTTP (/SystemName/UnitAsset/SubPath), and the CoAP requests GET, PUT, POST and
+// DELETE are handed to the same Serving function as their HTTP counterparts. The content formats are translated to and from
+// the Content-Type and Accept headers. The observable services accept the Observe option (RFC 7641): the server samples them
+// periodically and notifies the observers when their representation changes.
+//
+// The package does not depend on the unit assets of the mbaigo module: a system gives a Locator that finds the Handler of a service,
+// which Assets builds from the unit assets of the system, e.g.,
+//
+//	go coapserver.Setout(sys.Ctx, sys.Name, sys.Husk.ProtoPort["coap"], coapserver.Assets(sys.UAssets), nil)
+package coapserver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/plgd-dev/go-coap/v3/mux"
+	coapNet "github.com/plgd-dev/go-coap/v3/net"
+	"github.com/plgd-dev/go-coap/v3/options"
+	"github.com/plgd-dev/go-coap/v3/udp"
+)
+
+// Handler serves the requests of a service, as the unit assets do over HTTP
+type Handler interface {
+	Serving(w http.ResponseWriter, r *http.Request, servicePath string)
+}
+
+// Locator returns the handler of a service of a unit asset, if the system has it
+type Locator func(asset, service string) (Handler, bool)
+
+// Asset is a unit asset serving the services keyed by their sub-path, as the unit assets of the mbaigo components do
+type Asset[S ~map[string]V, V any] interface {
+	Handler
+	GetServices() S
+}
+
+// Assets locates the services among the unit assets of a system, keyed by their name (the UAssets of a components.System)
+func Assets[A Asset[S, V], S ~map[string]V, V any](assets map[string]*A) Locator {
+	return func(asset, service string) (Handler, bool) {
+		ua, exists := assets[asset]
+		if !exists || ua == nil {
+			return nil, false
+		}
+		if _, exists := (*ua).GetServices()[service]; !exists {
+			return nil, false
+		}
+		return *ua, true
+	}
+}
+
+// Server hands the CoAP requests to the services of a system
+type Server struct {
+	ctx        context.Context // context of the system, which ends the observations when it stops
+	name       string          // name of the system, the first segment of the paths
+	locate     Locator
+	observable map[string]time.Duration // sampling period of the observable services, by sub-path
+	mu         sync.Mutex
+	observers  map[string]*observation // by remote address and token
+}
+
+// observation is the registration of an observer, ended by its cancel function
+type observation struct {
+	cancel context.CancelFunc
+}
+
+// New creates the CoAP server of a system, whose observable services are sampled at their period
+func New(ctx context.Context, name string, locate Locator, observable map[string]time.Duration) *Server {
+	return &Server{ctx: ctx, name: name, locate: locate, observable: observable, observers: make(map[string]*observation)}
+}
+
+// methods are the CoAP request codes and their HTTP methods
+var methods = map[codes.Code]string{
+	codes.GET:    http.MethodGet,
+	codes.POST:   http.MethodPost,
+	codes.PUT:    http.MethodPut,
+	codes.DELETE: http.MethodDelete,
+}
+
+// formats are the content formats of CoAP and their media types
+var formats = map[string]message.MediaType{
+	"text/plain":               message.TextPlain,
+	"application/link-format":  message.AppLinkFormat,
+	"application/xml":          message.AppXML,
+	"application/octet-stream": message.AppOctets,
+	"application/json":         message.AppJSON,
+	"application/cbor":         message.AppCBOR,
+}
+
+// errorCodes are the CoAP response codes of the HTTP error statuses
+var errorCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.BadRequest,
+	http.StatusUnauthorized:          codes.Unauthorized,
+	http.StatusForbidden:             codes.Forbidden,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusMethodNotAllowed:      codes.MethodNotAllowed,
+	http.StatusNotAcceptable:         codes.NotAcceptable,
+	http.StatusConflict:              codes.PreconditionFailed,
+	http.StatusPreconditionFailed:    codes.PreconditionFailed,
+	http.StatusRequestEntityTooLarge: codes.RequestEntityTooLarge,
+	http.StatusUnsupportedMediaType:  codes.UnsupportedMediaType,
+	http.StatusTooManyRequests:       codes.ServiceUnavailable, // 4.29 (RFC 8516) is not known to most CoAP clients
+	http.StatusInternalServerError:   codes.InternalServerError,
+	http.StatusNotImplemented:        codes.NotImplemented,
+	http.StatusBadGateway:            codes.BadGateway,
+	http.StatusServiceUnavailable:    codes.ServiceUnavailable,
+	http.StatusGatewayTimeout:        codes.GatewayTimeout,
+}
+
+// ListenAndServe serves the services over CoAP at a udp port until the context of the system ends or the server fails
+func (s *Server) ListenAndServe(port int) error {
+	l, err := coapNet.NewListenUDP("udp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	srv := udp.NewServer(options.WithMux(mux.HandlerFunc(s.serve)))
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			srv.Stop()
+		case <-stopped:
+		}
+	}()
+	log.Printf("CoAP server listening on udp port %d\n", port)
+	if err := srv.Serve(l); err != nil && s.ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// Setout serves the services of a system over CoAP at its coap port until the context of the system ends, if the port is not zero
+func Setout(ctx context.Context, name string, port int, locate Locator, observable map[string]time.Duration) {
+	if port == 0 {
+		return
+	}
+	if err := New(ctx, name, locate, observable).ListenAndServe(port); err != nil {
+		log.Printf("CoAP server error: %v\n", err)
+	}
+}
+
+// serve hands a CoAP request to the service at its path and answers with the service's response
+func (s *Server) serve(w mux.ResponseWriter, r *mux.Message) {
+	method, supported := methods[r.Code()]
+	if !supported {
+		w.SetResponse(codes.MethodNotAllowed, message.TextPlain, nil)
+		return
+	}
+	path, err := r.Path()
+	if err != nil {
+		w.SetResponse(codes.NotFound, message.TextPlain, nil)
+		return
+	}
+	handler, servicePath, found := s.find(path)
+	if !found {
+		w.SetResponse(codes.NotFound, message.TextPlain, strings.NewReader("no such service: "+path))
+		return
+	}
+	req, err := newServiceRequest(s.ctx, method, path, r, w.Conn().RemoteAddr())
+	if err != nil {
+		w.SetResponse(codes.BadRequest, message.TextPlain, strings.NewReader(err.Error()))
+		return
+	}
+
+	// an observation is registered (0) or cancelled (1) with a GET request carrying the Observe option
+	key := w.Conn().RemoteAddr().String() + "/" + string(r.Token())
+	observe, err := r.Observe()
+	observing := err == nil && method == http.MethodGet
+	if observing {
+		s.cancel(key)
+	}
+
+	resp := newResponse()
+	handler.Serving(resp, req, servicePath)
+	code := resp.code(method)
+	if err := w.SetResponse(code, resp.contentFormat(), bytes.NewReader(resp.body.Bytes())); err != nil {
+		log.Printf("error answering the CoAP request %s %s: %v\n", method, path, err)
+		return
+	}
+
+	period, isObservable := s.observable[servicePath]
+	if observing && observe == 0 && isObservable && code == codes.Content {
+		w.Message().SetObserve(1)
+		s.watch(key, w.Conn(), r.Token(), handler, servicePath, req, period, resp.body.Bytes())
+	}
+}
+
+// find returns the handler and the service sub-path of a request path (/SystemName/UnitAsset/SubPath[/...])
+func (s *Server) find(path string) (Handler, string, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 3 || parts[0] != s.name {
+		return nil, "", false
+	}
+	handler, found := s.locate(parts[1], parts[2])
+	return handler, parts[2], found
+}
+
+// newServiceRequest translates a CoAP request into the HTTP request expected by the Serving function
+func newServiceRequest(ctx context.Context, method, path string, r *mux.Message, remote net.Addr) (*http.Request, error) {
+	var payload []byte
+	if body := r.Body(); body != nil {
+		var err error
+		if payload, err = io.ReadAll(body); err != nil {
+			return nil, err
+		}
+	}
+	queries, _ := r.Queries() // no query option is no query
+	target := url.URL{Scheme: "coap", Path: path, RawQuery: strings.Join(queries, "&")}
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.RemoteAddr = remote.String()
+	if format, err := r.ContentFormat(); err == nil {
+		req.Header.Set("Content-Type", mediaTypeOf(format))
+	} else if len(payload) > 0 {
+		req.Header.Set("Content-Type", "application/json") // the default form encoding of the systems
+	}
+	if format, err := r.Accept(); err == nil {
+		req.Header.Set("Accept", mediaTypeOf(format))
+	}
+	return req, nil
+}
+
+// mediaTypeOf returns the media type of a CoAP content format
+func mediaTypeOf(format message.MediaType) string {
+	for mediaType, f := range formats {
+		if f == format {
+			return mediaType
+		}
+	}
+	return "application/octet-stream"
+}
+
+// response records the response of a Serving function to translate it into a CoAP response
+type response struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// newResponse creates an empty response
+func newResponse() *response {
+	return &response{header: make(http.Header)}
+}
+
+// Header returns the headers of the response
+func (resp *response) Header() http.Header {
+	return resp.header
+}
+
+// WriteHeader records the status of the response
+func (resp *response) WriteHeader(status int) {
+	if resp.status == 0 {
+		resp.status = status
+	}
+}
+
+// Write records the body of the response
+func (resp *response) Write(p []byte) (int, error) {
+	resp.WriteHeader(http.StatusOK)
+	return resp.body.Write(p)
+}
+
+// code translates the HTTP status into a CoAP response code
+func (resp *response) code(method string) codes.Code {
+	status := resp.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	switch {
+	case status == http.StatusCreated:
+		return codes.Created
+	case status == http.StatusNotModified:
+		return codes.Valid
+	case status >= 200 && status < 300:
+		switch method {
+		case http.MethodGet:
+			return codes.Content
+		case http.MethodDelete:
+			return codes.Deleted
+		default:
+			return codes.Changed
+		}
+	}
+	if code, exists := errorCodes[status]; exists {
+		return code
+	}
+	if status >= 500 {
+		return codes.InternalServerError
+	}
+	return codes.BadRequest
+}
+
+// contentFormat translates the Content-Type header (or the sniffed type of the body) into a CoAP content format
+func (resp *response) contentFormat() message.MediaType {
+	contentType := resp.header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(resp.body.Bytes())
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return message.AppOctets
+	}
+	if format, exists := formats[mediaType]; exists {
+		return format
+	}
+	return message.AppOctets
+}
+
+// watch registers an observer and notifies it of the changes of the service until it cancels, goes away or the system stops.
+// A notification that is not 2.05 Content ends the observation (RFC 7641).
+func (s *Server) watch(key string, conn mux.Conn, token message.Token, handler Handler, servicePath string, req *http.Request, period time.Duration, last []byte) {
+	ctx, obs := s.observe(key)
+	target, header := req.URL.String(), req.Header.Clone()
+	token = append(message.Token{}, token...)
+
+	go func() {
+		defer s.end(key, obs)
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		seq := uint32(1)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-conn.Context().Done():
+				return
+			case <-ticker.C:
+			}
+			sample, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+			if err != nil {
+				return
+			}
+			sample.Header = header.Clone()
+			sample.RemoteAddr = conn.RemoteAddr().String()
+			resp := newResponse()
+			handler.Serving(resp, sample, servicePath)
+			code := resp.code(http.MethodGet)
+			if code == codes.Content && bytes.Equal(resp.body.Bytes(), last) {
+				continue
+			}
+			seq = (seq + 1) & 0xFFFFFF // the Observe option has 24 bits
+			if err := notify(conn, token, seq, code, resp); err != nil {
+				log.Printf("error notifying the observer %s: %v\n", conn.RemoteAddr(), err)
+				return
+			}
+			if code != codes.Content {
+				return
+			}
+			last = resp.body.Bytes()
+		}
+	}()
+}
+
+// notify sends a notification to an observer
+func notify(conn mux.Conn, token message.Token, seq uint32, code codes.Code, resp *response) error {
+	m := conn.AcquireMessage(conn.Context())
+	defer conn.ReleaseMessage(m)
+	m.SetCode(code)
+	m.SetToken(token)
+	if code == codes.Content {
+		m.SetObserve(seq)
+	}
+	m.SetContentFormat(resp.contentFormat())
+	m.SetBody(bytes.NewReader(resp.body.Bytes()))
+	return conn.WriteMessage(m)
+}
+
+// observe registers the observation of a key, which replaces a previous one, and returns the context that ends it
+func (s *Server) observe(key string) (context.Context, *observation) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	obs := &observation{cancel: cancel}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if previous, exists := s.observers[key]; exists {
+		previous.cancel()
+	}
+	s.observers[key] = obs
+	return ctx, obs
+}
+
+// cancel ends the observation of a key
+func (s *Server) cancel(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if obs, exists := s.observers[key]; exists {
+		obs.cancel()
+		delete(s.observers, key)
+	}
+}
+
+// end removes an observation that ended, unless a newer observation of the same key replaced it
+func (s *Server) end(key string, obs *observation) {
+	obs.cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.observers[key] == obs {
+		delete(s.observers, key)
+	}
+}
@@ -0,0 +1,190 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package coapserver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+)
+
+// service is a handler answering with a fixed status
+type service int
+
+func (s service) Serving(w http.ResponseWriter, r *http.Request, servicePath string) {
+	w.WriteHeader(int(s))
+}
+
+func TestFind(t *testing.T) {
+	s := New(context.Background(), "thermo", func(asset, service string) (Handler, bool) {
+		return nil, asset == "sensor" && service == "temperature"
+	}, nil)
+	tests := []struct {
+		path        string
+		found       bool
+		servicePath string
+	}{
+		{"/thermo/sensor/temperature", true, "temperature"},
+		{"/thermo/sensor/temperature/history", true, "temperature"},
+		{"thermo/sensor/temperature/", true, "temperature"},
+		{"/heater/sensor/temperature", false, ""},
+		{"/thermo/sensor/humidity", false, ""},
+		{"/thermo/sensor", false, ""},
+	}
+	for _, tt := range tests {
+		_, servicePath, found := s.find(tt.path)
+		if found != tt.found || (found && servicePath != tt.servicePath) {
+			t.Errorf("find(%q) = %q, %t, want %q, %t", tt.path, servicePath, found, tt.servicePath, tt.found)
+		}
+	}
+}
+
+func TestResponseCode(t *testing.T) {
+	tests := []struct {
+		method string
+		status int // 0 if the service writes no status
+		want   codes.Code
+	}{
+		{http.MethodGet, 0, codes.Content},
+		{http.MethodGet, http.StatusOK, codes.Content},
+		{http.MethodPost, http.StatusOK, codes.Changed},
+		{http.MethodPut, http.StatusNoContent, codes.Changed},
+		{http.MethodDelete, http.StatusOK, codes.Deleted},
+		{http.MethodPost, http.StatusCreated, codes.Created},
+		{http.MethodGet, http.StatusNotModified, codes.Valid},
+		{http.MethodGet, http.StatusNotFound, codes.NotFound},
+		{http.MethodPost, http.StatusTooManyRequests, codes.ServiceUnavailable},
+		{http.MethodPost, http.StatusTeapot, codes.BadRequest},
+		{http.MethodGet, http.StatusInsufficientStorage, codes.InternalServerError},
+	}
+	for _, tt := range tests {
+		resp := newResponse()
+		if tt.status != 0 {
+			service(tt.status).Serving(resp, nil, "")
+		}
+		if got := resp.code(tt.method); got != tt.want {
+			t.Errorf("%s answered %d gives %v, want %v", tt.method, tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestContentFormat(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        message.MediaType
+	}{
+		{"application/json; charset=utf-8", `{}`, message.AppJSON},
+		{"application/xml", `<a/>`, message.AppXML},
+		{"application/cbor", "\xa0", message.AppCBOR},
+		{"image/png", "", message.AppOctets},
+		{"", "21.5", message.TextPlain}, // sniffed
+	}
+	for _, tt := range tests {
+		resp := newResponse()
+		if tt.contentType != "" {
+			resp.Header().Set("Content-Type", tt.contentType)
+		}
+		resp.Write([]byte(tt.body))
+		if got := resp.contentFormat(); got != tt.want {
+			t.Errorf("content type %q gives the format %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+	for mediaType, format := range formats {
+		if got := mediaTypeOf(format); got != mediaType {
+			t.Errorf("the format %v is the media type %q, want %q", format, got, mediaType)
+		}
+	}
+}
+
+// TestReplacedObservation checks that an observation that ends does not remove the one that replaced it
+func TestReplacedObservation(t *testing.T) {
+	s := New(context.Background(), "thermo", nil, nil)
+	firstCtx, first := s.observe("10.0.0.5:5683/a")
+	secondCtx, second := s.observe("10.0.0.5:5683/a") // the client observes again with the same token
+	if firstCtx.Err() == nil {
+		t.Fatal("the replaced observation was not cancelled")
+	}
+	s.end("10.0.0.5:5683/a", first) // the goroutine of the first observation returns
+	if s.observers["10.0.0.5:5683/a"] != second || secondCtx.Err() != nil {
+		t.Fatal("the end of the replaced observation removed the new one")
+	}
+	s.cancel("10.0.0.5:5683/a") // the client cancels with Observe 1
+	if secondCtx.Err() == nil || len(s.observers) != 0 {
+		t.Fatal("the cancelled observation is still registered")
+	}
+	s.end("10.0.0.5:5683/a", second)
+	if len(s.observers) != 0 {
+		t.Fatal("the end of a cancelled observation registered it again")
+	}
+}
+
+// services and unitAsset mirror the unit assets of the mbaigo components
+type services map[string]*struct{}
+
+type unitAsset interface {
+	Handler
+	GetServices() services
+}
+
+// asset is a unit asset with its services keyed by their sub-path
+type asset struct {
+	service
+	name     string
+	services services
+}
+
+func (a *asset) GetServices() services { return a.services }
+
+func TestAssets(t *testing.T) {
+	var sensor unitAsset = &asset{service: http.StatusOK, name: "sensor", services: services{"temperature": {}}}
+	locate := Assets(map[string]*unitAsset{"sensor": &sensor})
+	tests := []struct {
+		asset, service string
+		found          bool
+	}{
+		{"sensor", "temperature", true},
+		{"sensor", "humidity", false},
+		{"heater", "temperature", false},
+	}
+	for _, tt := range tests {
+		h, found := locate(tt.asset, tt.service)
+		if found != tt.found || (found && h.(*asset).name != tt.asset) {
+			t.Errorf("locate(%s, %s) = %v, %v, want found %v", tt.asset, tt.service, h, found, tt.found)
+		}
+	}
+}
+
+func TestListenAndServeStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- New(ctx, "thermo", nil, nil).ListenAndServe(0) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("the server stopped with %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server kept on serving after the end of the context")
+	}
+}
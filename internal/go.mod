@@ -0,0 +1,5 @@
+module github.com/sdoque/systems/internal
+
+go 1.21
+
+require github.com/plgd-dev/go-coap/v3 v3.3.6
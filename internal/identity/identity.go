@@ -0,0 +1,296 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+// Package identity verifies the identity of the systems calling the service registrars (sregistrar and esr)
+// and signs the requests that the registrars send to each other.
+//
+// A system proves its identity either with the client certificate of a mutual TLS connection,
+// or by signing its request with the private key of its certificate. A signed request carries the headers
+//
+//   - X-Registration-Timestamp: the time of the request (RFC 3339),
+//   - X-Registration-Nonce: a value that is never used twice (e.g., 16 random bytes in hexadecimal),
+//   - X-Registration-Signature: the base64 signature of the message described below,
+//   - X-Registration-Certificate: the base64 DER certificate, if the request body does not hold it (e.g., in a service record).
+//
+// The signed message is the HTTP method, the request URI (path and query), the timestamp, the nonce and the body, separated by new lines.
+// It is signed with SHA-256 (PKCS #1 v1.5 for RSA keys, ASN.1 for ECDSA keys) or with Ed25519.
+// A request whose timestamp is more than SignatureWindow away from the registrar's clock, or whose nonce was already seen, is rejected,
+// so that a captured request cannot be replayed nor its signature reused on another method or path.
+// The certificate must be issued by the configured certificate authority and its common name is the system's name.
+package identity
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// SignatureWindow is the largest difference between the timestamp of a signed request and the clock of the registrar
+const SignatureWindow = 2 * time.Minute
+
+// Headers of a signed request
+const (
+	HeaderSignature   = "X-Registration-Signature"
+	HeaderTimestamp   = "X-Registration-Timestamp"
+	HeaderNonce       = "X-Registration-Nonce"
+	HeaderCertificate = "X-Registration-Certificate"
+)
+
+// Message returns the message that is signed for a request
+func Message(method, requestURI, timestamp, nonce string, body []byte) []byte {
+	var message bytes.Buffer
+	for _, field := range []string{method, requestURI, timestamp, nonce} {
+		message.WriteString(field)
+		message.WriteByte('\n')
+	}
+	message.Write(body)
+	return message.Bytes()
+}
+
+//*********************Verification*********************
+
+// Authority verifies the certificates and the signatures of the requests against the certificate authority
+type Authority struct {
+	roots  *x509.CertPool
+	now    func() time.Time
+	mu     sync.Mutex
+	nonces map[nonceKey]time.Time // nonces seen within the signature window, with their timestamp
+	pruned time.Time              // last time the expired nonces were forgotten
+}
+
+// LoadAuthority reads the PEM encoded certificate(s) of the certificate authority
+func LoadAuthority(caFile string) (*Authority, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the certificate authority file: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return NewAuthority(roots, time.Now), nil
+}
+
+// NewAuthority creates an authority from the certificate pool of the certificate authority and a clock
+func NewAuthority(roots *x509.CertPool, now func() time.Time) *Authority {
+	return &Authority{roots: roots, now: now, nonces: make(map[nonceKey]time.Time)}
+}
+
+// nonceKey identifies a nonce used by the owner of a certificate
+type nonceKey struct {
+	cert  [sha256.Size]byte // fingerprint of the certificate
+	nonce string
+}
+
+// Identify returns the verified name of the system making the request.
+// certField is the PEM certificate submitted in the request body (e.g., the Certificate field of a service record), if any.
+func (a *Authority) Identify(r *http.Request, body []byte, certField string) (string, error) {
+	var leaf *x509.Certificate
+	intermediates := x509.NewCertPool()
+	mutualTLS := r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+	if mutualTLS {
+		leaf = r.TLS.PeerCertificates[0]
+		for _, c := range r.TLS.PeerCertificates[1:] {
+			intermediates.AddCert(c)
+		}
+	} else {
+		cert, err := submittedCertificate(r, certField)
+		if err != nil {
+			return "", err
+		}
+		leaf = cert
+	}
+	opts := x509.VerifyOptions{
+		Roots:         a.roots,
+		Intermediates: intermediates,
+		CurrentTime:   a.now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		return "", fmt.Errorf("certificate not issued by the local cloud's authority: %w", err)
+	}
+	if leaf.Subject.CommonName == "" {
+		return "", errors.New("the certificate has no common name")
+	}
+	if !mutualTLS {
+		if err := a.verifySignature(r, body, leaf); err != nil {
+			return "", err
+		}
+	}
+	return leaf.Subject.CommonName, nil
+}
+
+// submittedCertificate reads the certificate of the body or of the X-Registration-Certificate header
+func submittedCertificate(r *http.Request, certField string) (*x509.Certificate, error) {
+	var der []byte
+	if certField != "" {
+		block, _ := pem.Decode([]byte(certField))
+		if block == nil {
+			return nil, errors.New("invalid PEM certificate in the request")
+		}
+		der = block.Bytes
+	} else if header := r.Header.Get(HeaderCertificate); header != "" {
+		var err error
+		if der, err = base64.StdEncoding.DecodeString(header); err != nil {
+			return nil, fmt.Errorf("invalid %s header: %w", HeaderCertificate, err)
+		}
+	} else {
+		return nil, errors.New("no client certificate nor certificate in the request")
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate in the request: %w", err)
+	}
+	return cert, nil
+}
+
+// verifySignature checks the signature, the timestamp and the nonce of a request
+func (a *Authority) verifySignature(r *http.Request, body []byte, cert *x509.Certificate) error {
+	signature, err := base64.StdEncoding.DecodeString(r.Header.Get(HeaderSignature))
+	if err != nil || len(signature) == 0 {
+		return fmt.Errorf("missing or invalid %s header", HeaderSignature)
+	}
+	timestamp, nonce := r.Header.Get(HeaderTimestamp), r.Header.Get(HeaderNonce)
+	signedAt, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return fmt.Errorf("missing or invalid %s header", HeaderTimestamp)
+	}
+	now := a.now()
+	if signedAt.Before(now.Add(-SignatureWindow)) || signedAt.After(now.Add(SignatureWindow)) {
+		return fmt.Errorf("the request was signed at %s, outside the %s window of the registrar", timestamp, SignatureWindow)
+	}
+	if nonce == "" {
+		return fmt.Errorf("missing %s header", HeaderNonce)
+	}
+	algorithm, err := signatureAlgorithm(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	message := Message(r.Method, r.URL.RequestURI(), timestamp, nonce, body)
+	if err := cert.CheckSignature(algorithm, message, signature); err != nil {
+		return fmt.Errorf("the request is not signed by the certificate's owner: %w", err)
+	}
+	if !a.remember(cert, nonce, signedAt, now) {
+		return errors.New("the nonce of the request was already used (replayed request)")
+	}
+	return nil
+}
+
+// remember records the nonce of a verified signature, returning false if the certificate's owner already used it
+func (a *Authority) remember(cert *x509.Certificate, nonce string, signedAt, now time.Time) bool {
+	key := nonceKey{cert: sha256.Sum256(cert.Raw), nonce: nonce}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.pruned) > SignatureWindow {
+		for k, t := range a.nonces {
+			if now.Sub(t) > SignatureWindow {
+				delete(a.nonces, k) // its timestamp is now rejected anyway
+			}
+		}
+		a.pruned = now
+	}
+	if _, seen := a.nonces[key]; seen {
+		return false
+	}
+	a.nonces[key] = signedAt
+	return true
+}
+
+// signatureAlgorithm is the algorithm of the signatures made with a key
+func signatureAlgorithm(pub interface{}) (x509.SignatureAlgorithm, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA, nil
+	case *ecdsa.PublicKey:
+		return x509.ECDSAWithSHA256, nil
+	case ed25519.PublicKey:
+		return x509.PureEd25519, nil
+	default:
+		return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+//*********************Signature*********************
+
+// Signer signs the requests of a registrar to its peers with the registrar's certificate
+type Signer struct {
+	cert tls.Certificate
+	now  func() time.Time
+}
+
+// LoadSigner reads the PEM encoded certificate and private key of the registrar
+func LoadSigner(certFile, keyFile string) (*Signer, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading the certificate of the registrar: %w", err)
+	}
+	return NewSigner(cert, time.Now)
+}
+
+// NewSigner creates a signer from a certificate with its private key and a clock
+func NewSigner(cert tls.Certificate, now func() time.Time) (*Signer, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("the certificate chain is empty")
+	}
+	if _, ok := cert.PrivateKey.(crypto.Signer); !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", cert.PrivateKey)
+	}
+	return &Signer{cert: cert, now: now}, nil
+}
+
+// Sign adds the signature headers to a request with its body.
+// A nil signer leaves the request unsigned (no certificate configured).
+func (s *Signer) Sign(req *http.Request, body []byte) error {
+	if s == nil {
+		return nil
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	timestamp, nonceHex := s.now().UTC().Format(time.RFC3339), hex.EncodeToString(nonce)
+	message := Message(req.Method, req.URL.RequestURI(), timestamp, nonceHex, body)
+	key := s.cert.PrivateKey.(crypto.Signer)
+	digest, opts := message, crypto.SignerOpts(crypto.Hash(0))
+	if _, pure := key.Public().(ed25519.PublicKey); !pure {
+		sum := sha256.Sum256(message)
+		digest, opts = sum[:], crypto.SHA256
+	}
+	signature, err := key.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return fmt.Errorf("error signing the request: %w", err)
+	}
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonceHex)
+	req.Header.Set(HeaderSignature, base64.StdEncoding.EncodeToString(signature))
+	req.Header.Set(HeaderCertificate, base64.StdEncoding.EncodeToString(s.cert.Certificate[0]))
+	return nil
+}
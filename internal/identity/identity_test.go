@@ -0,0 +1,277 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package identity
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// testCA is a certificate authority issuing the certificates of the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "local cloud authority"},
+		NotBefore:             epoch.Add(-time.Hour),
+		NotAfter:              epoch.Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate of the authority with its private key for a system
+func (ca *testCA) issue(t *testing.T, name string, key crypto.Signer) tls.Certificate {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    epoch.Add(-time.Hour),
+		NotAfter:     epoch.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func newECDSAKey(t *testing.T) crypto.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// clock is a settable clock
+type clock struct{ now time.Time }
+
+func (c *clock) Now() time.Time { return c.now }
+
+// signedRequest returns a request signed by a certificate at a time
+func signedRequest(t *testing.T, cert tls.Certificate, at time.Time, method, target string, body []byte) *http.Request {
+	t.Helper()
+	signer, err := NewSigner(cert, func() time.Time { return at })
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	if err := signer.Sign(r, body); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestIdentifySignedRequests(t *testing.T) {
+	ca := newTestCA(t)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range map[string]crypto.Signer{"ecdsa": newECDSAKey(t), "ed25519": edKey, "rsa": rsaKey} {
+		t.Run(name, func(t *testing.T) {
+			a := NewAuthority(ca.pool, (&clock{epoch}).Now)
+			cert := ca.issue(t, "thermo", key)
+			body := []byte(`{"registryID":1}`)
+			r := signedRequest(t, cert, epoch, "POST", "/serviceregistrar/registry/register", body)
+			system, err := a.Identify(r, body, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if system != "thermo" {
+				t.Fatalf("identified as %q, want thermo", system)
+			}
+		})
+	}
+}
+
+func TestIdentifyRejects(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, "thermo", newECDSAKey(t))
+	stranger := newTestCA(t).issue(t, "thermo", newECDSAKey(t))
+	body := []byte(`{"registryID":1}`)
+	target := "/serviceregistrar/registry/register"
+
+	tests := []struct {
+		name    string
+		request func() (*http.Request, []byte)
+		reason  string
+	}{
+		{"other body", func() (*http.Request, []byte) {
+			return signedRequest(t, cert, epoch, "POST", target, body), []byte(`{"registryID":2}`)
+		}, "not signed"},
+		{"other method", func() (*http.Request, []byte) {
+			r := signedRequest(t, cert, epoch, "POST", target, body)
+			r.Method = "PUT"
+			return r, body
+		}, "not signed"},
+		{"other path", func() (*http.Request, []byte) {
+			signed := signedRequest(t, cert, epoch, "DELETE", "/serviceregistrar/registry/unregister/1", nil)
+			r := httptest.NewRequest("DELETE", "/serviceregistrar/registry/unregister/2", nil)
+			r.Header = signed.Header
+			return r, nil
+		}, "not signed"},
+		{"stale timestamp", func() (*http.Request, []byte) {
+			return signedRequest(t, cert, epoch.Add(-SignatureWindow-time.Second), "POST", target, body), body
+		}, "window"},
+		{"future timestamp", func() (*http.Request, []byte) {
+			return signedRequest(t, cert, epoch.Add(SignatureWindow+time.Second), "POST", target, body), body
+		}, "window"},
+		{"missing nonce", func() (*http.Request, []byte) {
+			r := signedRequest(t, cert, epoch, "POST", target, body)
+			r.Header.Del(HeaderNonce)
+			return r, body
+		}, HeaderNonce},
+		{"missing signature", func() (*http.Request, []byte) {
+			r := signedRequest(t, cert, epoch, "POST", target, body)
+			r.Header.Del(HeaderSignature)
+			return r, body
+		}, HeaderSignature},
+		{"no certificate", func() (*http.Request, []byte) {
+			r := signedRequest(t, cert, epoch, "POST", target, body)
+			r.Header.Del(HeaderCertificate)
+			return r, body
+		}, "no client certificate"},
+		{"other authority", func() (*http.Request, []byte) {
+			return signedRequest(t, stranger, epoch, "POST", target, body), body
+		}, "authority"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAuthority(ca.pool, (&clock{epoch}).Now)
+			r, received := tt.request()
+			_, err := a.Identify(r, received, "")
+			if err == nil {
+				t.Fatal("the request was accepted")
+			}
+			if !strings.Contains(err.Error(), tt.reason) {
+				t.Fatalf("rejected with %q, want a reason containing %q", err, tt.reason)
+			}
+		})
+	}
+}
+
+func TestIdentifyRejectsReplays(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, "thermo", newECDSAKey(t))
+	c := &clock{epoch}
+	a := NewAuthority(ca.pool, c.Now)
+	body := []byte(`{"registryID":1}`)
+	r := signedRequest(t, cert, epoch, "POST", "/serviceregistrar/registry/register", body)
+	if _, err := a.Identify(r, body, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same request within the window is a replay
+	c.now = epoch.Add(SignatureWindow / 2)
+	if _, err := a.Identify(r, body, ""); err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Fatalf("a replayed request was not rejected (%v)", err)
+	}
+
+	// after the window, the nonce is forgotten but the timestamp is stale
+	c.now = epoch.Add(2*SignatureWindow + time.Second)
+	fresh := signedRequest(t, cert, c.now, "POST", "/serviceregistrar/registry/register", body)
+	if _, err := a.Identify(fresh, body, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.nonces) != 1 {
+		t.Fatalf("%d nonces remembered, want only the fresh one", len(a.nonces))
+	}
+	if _, err := a.Identify(r, body, ""); err == nil {
+		t.Fatal("a replayed request was accepted once its nonce was forgotten")
+	}
+
+}
+
+func TestIdentifyCertificateSources(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, "thermo", newECDSAKey(t))
+	a := NewAuthority(ca.pool, (&clock{epoch}).Now)
+
+	// the certificate of the service record
+	body := []byte(`{"registryID":1}`)
+	r := signedRequest(t, cert, epoch, "POST", "/serviceregistrar/registry/register", body)
+	r.Header.Del(HeaderCertificate)
+	certField := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}))
+	if system, err := a.Identify(r, body, certField); err != nil || system != "thermo" {
+		t.Fatalf("identified as %q (%v), want thermo", system, err)
+	}
+
+	// the client certificate of a mutual TLS connection needs no signature
+	r = httptest.NewRequest("DELETE", "/serviceregistrar/registry/unregister/1", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}}
+	if system, err := a.Identify(r, nil, ""); err != nil || system != "thermo" {
+		t.Fatalf("identified as %q (%v), want thermo", system, err)
+	}
+}
+
+func TestNilSigner(t *testing.T) {
+	var s *Signer
+	r := httptest.NewRequest("POST", "/serviceregistrar/registry/replicate", nil)
+	if err := s.Sign(r, nil); err != nil {
+		t.Fatal(err)
+	}
+	if r.Header.Get(HeaderSignature) != "" {
+		t.Fatal("a nil signer signed the request")
+	}
+}
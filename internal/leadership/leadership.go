@@ -0,0 +1,71 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+// Package leadership holds the structured status of the service registrars (sregistrar and esr),
+// which they return from their status service, and the client with which the other systems
+// (orchestrator, modeler and kgrapher) find the leading registrar of the local cloud.
+package leadership
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// RegistrarStatus_v1 is the structured form of a service registrar's role returned by its status service
+type RegistrarStatus_v1 struct {
+	Role        string `json:"role"` // leader, follower or candidate
+	Term        int64  `json:"term"`
+	Leader      string `json:"leader"`
+	LeaderSince string `json:"leaderSince,omitempty"`
+	Registrar   string `json:"registrar"`
+	Version     string `json:"version"`
+}
+
+// Status asks the service registrar at a URL for its structured status
+func Status(registrarURL string) (RegistrarStatus_v1, error) {
+	var status RegistrarStatus_v1
+	req, err := http.NewRequest(http.MethodGet, registrarURL+"/status", nil)
+	if err != nil {
+		return status, err
+	}
+	req.Header.Set("Accept", "application/json")
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return status, err
+	}
+	if err := json.Unmarshal(bodyBytes, &status); err != nil {
+		return status, fmt.Errorf("unable to read the status of the registrar %s: %w", registrarURL, err)
+	}
+	return status, nil
+}
+
+// Leads reports if the service registrar at a URL is the leading registrar
+func Leads(registrarURL string) (bool, error) {
+	status, err := Status(registrarURL)
+	if err != nil {
+		return false, err
+	}
+	return status.Role == "leader", nil
+}
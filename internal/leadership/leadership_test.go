@@ -0,0 +1,65 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package leadership
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLeads(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		leads   bool
+		wantErr bool
+	}{
+		{"leader", `{"role":"leader","term":3,"leader":"http://a","registrar":"http://a","version":"RegistrarStatus_v1"}`, true, false},
+		{"follower", `{"role":"follower","term":3,"leader":"http://a","registrar":"http://b","version":"RegistrarStatus_v1"}`, false, false},
+		{"candidate", `{"role":"candidate","term":4,"leader":"","registrar":"http://b","version":"RegistrarStatus_v1"}`, false, false},
+		{"text status", `On standby`, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/serviceregistrar/registry/status" || r.Header.Get("Accept") != "application/json" {
+					http.Error(w, "Not Found", http.StatusNotFound)
+					return
+				}
+				w.Write([]byte(tt.reply))
+			}))
+			defer srv.Close()
+			leads, err := Leads(srv.URL + "/serviceregistrar/registry")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want an error: %t", err, tt.wantErr)
+			}
+			if leads != tt.leads {
+				t.Fatalf("leads %t, want %t", leads, tt.leads)
+			}
+		})
+	}
+}
+
+func TestLeadsUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+	if _, err := Leads(url); err == nil {
+		t.Fatal("an unreachable registrar was reported")
+	}
+}
@@ -0,0 +1,350 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+// Package loadgen simulates the systems of a local cloud to measure how many a service registrar (sregistrar or esr) can sustain.
+// Each simulated system registers its services, renews them every registration period, and unregisters them when it shuts down.
+// Meanwhile, service quests are sent to the registrar and to the orchestrator at the configured rate and mix.
+// Some systems may crash (stop renewing without unregistering) to measure how accurately the registrar expires their records.
+//
+// The registrar under test is a Target: the loadtest tool drives a registrar over HTTP, and the registrars run the same
+// simulation in process against their storage backends (go test -run Load -load 1m in sregistrar or esr).
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Service is a service of a simulated system
+type Service struct {
+	Definition string
+	System     string
+	SubPath    string
+	Address    string // IP address of the system
+	Port       int    // http port of the system
+	Location   string // value of the Location detail
+	RegLife    time.Duration
+}
+
+// Registration is the record of a service in the registry
+type Registration struct {
+	Id            int
+	EndOfValidity time.Time
+	Record        any // record kept by the target for the renewals (e.g., the form returned by the registrar)
+}
+
+// Quest is a service quest for a definition at a location
+type Quest struct {
+	Definition string
+	Location   string
+}
+
+// Target is the registrar under test (and the orchestrator of the squest operation)
+type Target interface {
+	// Register registers a service
+	Register(svc Service) (Registration, error)
+	// Renew renews the registration of a service
+	Renew(svc Service, reg Registration) (Registration, error)
+	// Unregister deletes the record of a service
+	Unregister(reg Registration) error
+	// Quest sends a service quest: query (registrar), squest (orchestrator) or list (filtered listing of the registrar)
+	Quest(op string, q Quest) error
+	// Records returns the ids of the records of a system
+	Records(system string) ([]int, error)
+}
+
+// Settings are the parameters of a load test
+type Settings struct {
+	Systems   int
+	Services  int // services per system
+	Duration  time.Duration
+	RegPeriod time.Duration // time between two renewals
+	RegLife   time.Duration // registration life of the records
+	Rate      float64       // quests per second
+	Mix       map[string]float64
+	Crash     float64 // fraction of the systems that crash halfway
+}
+
+// ParseMix reads the weights of the quests, e.g., query=7,squest=3
+func ParseMix(mix string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(mix, ",") {
+		op, w, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			return nil, fmt.Errorf("%q is not op=weight", part)
+		}
+		switch op {
+		case "query", "squest", "list":
+		default:
+			return nil, fmt.Errorf("unknown quest %q (query, squest or list)", op)
+		}
+		weight, err := strconv.ParseFloat(w, 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight %q", w)
+		}
+		weights[op] = weight
+	}
+	return weights, nil
+}
+
+// loadTest is a running load test
+type loadTest struct {
+	Settings
+	target  Target
+	stats   *recorder
+	expired chan crashedSystem
+}
+
+// crashedSystem is a system that stopped without unregistering its services
+type crashedSystem struct {
+	name string
+	regs []Registration
+}
+
+// Run carries out the load test against a target and reports the results
+func Run(s Settings, target Target) *Report {
+	lt := &loadTest{
+		Settings: s,
+		target:   target,
+		stats:    newRecorder(),
+		expired:  make(chan crashedSystem, s.Systems),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.Duration)
+	defer cancel()
+
+	var systems sync.WaitGroup
+	for i := 0; i < s.Systems; i++ {
+		systems.Add(1)
+		go func(i int) {
+			defer systems.Done()
+			lt.simulate(ctx, i, float64(i) < s.Crash*float64(s.Systems))
+		}(i)
+	}
+
+	var checks sync.WaitGroup
+	accuracy := newExpiryRecorder()
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		for crashed := range lt.expired {
+			checks.Add(1)
+			go func(crashed crashedSystem) {
+				defer checks.Done()
+				lt.checkExpiry(crashed, accuracy)
+			}(crashed)
+		}
+	}()
+
+	lt.quests(ctx)
+	systems.Wait()
+	close(lt.expired)
+	<-dispatched
+	checks.Wait()
+	return lt.report(accuracy)
+}
+
+//-------------------------------------Simulated systems
+
+// simulate runs the life cycle of a system: registration, renewals and shutdown (or crash halfway)
+func (lt *loadTest) simulate(ctx context.Context, i int, crashes bool) {
+	// spread the registrations over the first registration period
+	select {
+	case <-time.After(time.Duration(i) * lt.RegPeriod / time.Duration(lt.Systems)):
+	case <-ctx.Done():
+		return
+	}
+	services := make([]Service, lt.Services)
+	regs := make([]Registration, lt.Services)
+	for k := range services {
+		services[k] = SimulatedService(i, k, lt.RegLife)
+		lt.register(services[k], &regs[k])
+	}
+
+	var crash <-chan time.Time
+	if crashes {
+		crash = time.After(lt.Duration / 2)
+	}
+	ticker := time.NewTicker(lt.RegPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for k := range services {
+				lt.register(services[k], &regs[k])
+			}
+		case <-crash:
+			lt.expired <- crashedSystem{name: SimulatedService(i, 0, lt.RegLife).System, regs: regs} // the system stops without unregistering its services
+			return
+		case <-ctx.Done():
+			for _, reg := range regs {
+				lt.unregister(reg)
+			}
+			return
+		}
+	}
+}
+
+// SimulatedService describes the service k of the simulated system i
+func SimulatedService(i, k int, regLife time.Duration) Service {
+	return Service{
+		Definition: fmt.Sprintf("load%d", k),
+		System:     fmt.Sprintf("loadtest%04d", i),
+		SubPath:    fmt.Sprintf("asset%d/load%d", i, k),
+		Address:    fmt.Sprintf("10.99.%d.%d", i/250, i%250+1),
+		Port:       30000 + i%30000,
+		Location:   fmt.Sprintf("Room%d", i%10),
+		RegLife:    regLife,
+	}
+}
+
+// register registers a service, or renews it once registered, and keeps the registration
+func (lt *loadTest) register(svc Service, reg *Registration) {
+	op := "register"
+	start := time.Now()
+	var updated Registration
+	var err error
+	if reg.Id == 0 {
+		updated, err = lt.target.Register(svc)
+	} else {
+		op = "renew"
+		updated, err = lt.target.Renew(svc, *reg)
+	}
+	if err == nil {
+		*reg = updated
+	}
+	lt.stats.observe(op, time.Since(start), err)
+}
+
+// unregister deletes the record of a service when its system shuts down
+func (lt *loadTest) unregister(reg Registration) {
+	if reg.Id == 0 {
+		return
+	}
+	start := time.Now()
+	err := lt.target.Unregister(reg)
+	lt.stats.observe("unregister", time.Since(start), err)
+}
+
+//-------------------------------------Service quests
+
+// quests sends service quests at the configured rate until the end of the test
+func (lt *loadTest) quests(ctx context.Context) {
+	if lt.Rate <= 0 {
+		<-ctx.Done()
+		return
+	}
+	var total float64
+	for _, w := range lt.Mix {
+		total += w
+	}
+	if total == 0 {
+		<-ctx.Done()
+		return
+	}
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / lt.Rate))
+	defer ticker.Stop()
+	inflight := make(chan struct{}, 256) // bounds the concurrent quests if the registrar falls behind
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		select {
+		case <-ticker.C:
+			op := pick(lt.Mix, total)
+			select {
+			case inflight <- struct{}{}:
+			default:
+				lt.stats.observe(op, 0, fmt.Errorf("too many quests in flight"))
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer func() { <-inflight; wg.Done() }()
+				lt.quest(op)
+			}()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pick draws a quest from the mix
+func pick(mix map[string]float64, total float64) string {
+	ops := make([]string, 0, len(mix))
+	for op := range mix {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	draw := rand.Float64() * total
+	for _, op := range ops {
+		if draw < mix[op] {
+			return op
+		}
+		draw -= mix[op]
+	}
+	return ops[len(ops)-1]
+}
+
+// quest sends a service quest to the registrar or to the orchestrator
+func (lt *loadTest) quest(op string) {
+	q := Quest{Definition: fmt.Sprintf("load%d", rand.Intn(lt.Services)), Location: fmt.Sprintf("Room%d", rand.Intn(10))}
+	start := time.Now()
+	err := lt.target.Quest(op, q)
+	lt.stats.observe(op, time.Since(start), err)
+}
+
+//-------------------------------------Expiration accuracy
+
+// checkExpiry waits for the records of a crashed system to expire and measures how late the registrar deleted them
+func (lt *loadTest) checkExpiry(crashed crashedSystem, accuracy *expiryRecorder) {
+	pending := make(map[int]time.Time)
+	for _, reg := range crashed.regs {
+		if reg.Id != 0 && !reg.EndOfValidity.IsZero() {
+			pending[reg.Id] = reg.EndOfValidity
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+	deadline := time.Now().Add(2 * lt.RegLife)
+	for len(pending) > 0 {
+		time.Sleep(250 * time.Millisecond)
+		if time.Now().After(deadline) {
+			accuracy.missed(len(pending))
+			return
+		}
+		ids, err := lt.target.Records(crashed.name)
+		if err != nil {
+			continue
+		}
+		present := make(map[int]bool)
+		for _, id := range ids {
+			present[id] = true
+		}
+		now := time.Now()
+		for id, end := range pending {
+			if !present[id] {
+				accuracy.observe(now.Sub(end))
+				delete(pending, id)
+			}
+		}
+	}
+}
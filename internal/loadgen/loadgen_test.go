@@ -0,0 +1,124 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package loadgen
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRegistry is a registry that deletes the records at their end of validity
+type fakeRegistry struct {
+	mu      sync.Mutex
+	nextId  int
+	records map[int]Registration
+	systems map[int]string
+	quests  map[string]int
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{records: make(map[int]Registration), systems: make(map[int]string), quests: make(map[string]int)}
+}
+
+func (f *fakeRegistry) Register(svc Service) (Registration, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextId++
+	reg := Registration{Id: f.nextId, EndOfValidity: time.Now().Add(svc.RegLife)}
+	f.records[reg.Id], f.systems[reg.Id] = reg, svc.System
+	return reg, nil
+}
+
+func (f *fakeRegistry) Renew(svc Service, reg Registration) (Registration, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, exists := f.records[reg.Id]; !exists {
+		return reg, fmt.Errorf("unknown record %d", reg.Id)
+	}
+	reg.EndOfValidity = time.Now().Add(svc.RegLife)
+	f.records[reg.Id] = reg
+	return reg, nil
+}
+
+func (f *fakeRegistry) Unregister(reg Registration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.records, reg.Id)
+	return nil
+}
+
+func (f *fakeRegistry) Quest(op string, q Quest) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.quests[op]++
+	return nil
+}
+
+func (f *fakeRegistry) Records(system string) ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids []int
+	for id, reg := range f.records {
+		if f.systems[id] == system && time.Now().Before(reg.EndOfValidity) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func TestRun(t *testing.T) {
+	target := newFakeRegistry()
+	s := Settings{Systems: 4, Services: 2, Duration: 2 * time.Second, RegPeriod: 400 * time.Millisecond, RegLife: time.Second, Rate: 50, Mix: map[string]float64{"query": 1}, Crash: 0.5}
+	report := Run(s, target)
+
+	if ops := report.Operations["register"]; ops.Count != 8 || ops.Errors != 0 {
+		t.Fatalf("registrations %+v, want 8 without error", ops)
+	}
+	if ops := report.Operations["renew"]; ops.Count == 0 || ops.Errors != 0 {
+		t.Fatalf("renewals %+v, want some without error", ops)
+	}
+	if ops := report.Operations["unregister"]; ops.Count != 4 {
+		t.Fatalf("%d unregistrations, want the 4 services of the 2 systems that did not crash", ops.Count)
+	}
+	if report.Expiry.Expired+report.Expiry.Missed != 4 || report.Expiry.Missed != 0 {
+		t.Fatalf("expiry %+v, want the 4 services of the crashed systems expired", report.Expiry)
+	}
+	if target.quests["query"] == 0 || report.Operations["query"].Count != target.quests["query"] {
+		t.Fatalf("%d quests reported, %d received", report.Operations["query"].Count, target.quests["query"])
+	}
+	if report.Version != "LoadReport_v1" {
+		t.Fatalf("version %s", report.Version)
+	}
+}
+
+func TestParseMix(t *testing.T) {
+	mix, err := ParseMix("query=7, squest=3,list=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]float64{"query": 7, "squest": 3, "list": 0}; !reflect.DeepEqual(mix, want) {
+		t.Fatalf("mix %v, want %v", mix, want)
+	}
+	for _, invalid := range []string{"query", "watch=1", "query=-1", "query=x"} {
+		if _, err := ParseMix(invalid); err == nil {
+			t.Errorf("the mix %q was accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package loadgen
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+//*********************Measurements and JSON report of a load test*********************
+
+// recorder collects the latencies and the errors of the operations
+type recorder struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+	lastError map[string]string
+}
+
+// newRecorder creates an empty recorder
+func newRecorder() *recorder {
+	return &recorder{latencies: make(map[string][]time.Duration), errors: make(map[string]int), lastError: make(map[string]string)}
+}
+
+// observe records the outcome of an operation
+func (r *recorder) observe(op string, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.errors[op]++
+		r.lastError[op] = err.Error()
+		return
+	}
+	r.latencies[op] = append(r.latencies[op], latency)
+}
+
+// expiryRecorder collects the delays between the end of validity of the records and their deletion
+type expiryRecorder struct {
+	mu     sync.Mutex
+	lags   []time.Duration
+	misses int
+}
+
+// newExpiryRecorder creates an empty expiry recorder
+func newExpiryRecorder() *expiryRecorder {
+	return &expiryRecorder{}
+}
+
+// observe records the deletion of an expired record
+func (e *expiryRecorder) observe(lag time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lags = append(e.lags, lag)
+}
+
+// missed records expired records that were still in the registry long after their end of validity
+func (e *expiryRecorder) missed(n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.misses += n
+}
+
+// LatencySummary gives the percentiles of a series of durations in milliseconds
+type LatencySummary struct {
+	P50 float64 `json:"p50Ms"`
+	P90 float64 `json:"p90Ms"`
+	P99 float64 `json:"p99Ms"`
+	Max float64 `json:"maxMs"`
+}
+
+// OperationReport is the outcome of an operation of the load test
+type OperationReport struct {
+	Count     int            `json:"count"`
+	Errors    int            `json:"errors"`
+	LastError string         `json:"lastError,omitempty"`
+	PerSecond float64        `json:"perSecond"` // successful operations per second
+	Latency   LatencySummary `json:"latency"`
+}
+
+// ExpiryReport is the accuracy of the expiration of the records of the crashed systems
+type ExpiryReport struct {
+	Expired int            `json:"expired"` // records deleted by the registrar
+	Missed  int            `json:"missed"`  // records still present twice their registration life after their end of validity
+	Lag     LatencySummary `json:"lag"`     // delay between the end of validity and the deletion (at a polling resolution of 250 ms)
+}
+
+// Report is the JSON report of a load test (LoadReport_v1)
+type Report struct {
+	Registrar    string                     `json:"registrar"`    // URL of the registrar, or the registrar and backend run in process
+	Orchestrator string                     `json:"orchestrator"` // URL of the orchestrator (empty in process)
+	Systems      int                        `json:"systems"`
+	Services     int                        `json:"servicesPerSystem"`
+	Duration     float64                    `json:"durationSeconds"`
+	RegPeriod    float64                    `json:"regPeriodSeconds"`
+	Rate         float64                    `json:"questRate"`
+	Mix          map[string]float64         `json:"mix"`
+	Operations   map[string]OperationReport `json:"operations"`
+	Expiry       ExpiryReport               `json:"expiry"`
+	Version      string                     `json:"version"`
+}
+
+// summarize computes the percentiles of a series of durations
+func summarize(series []time.Duration) LatencySummary {
+	if len(series) == 0 {
+		return LatencySummary{}
+	}
+	sorted := append([]time.Duration{}, series...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return float64(sorted[i]) / float64(time.Millisecond)
+	}
+	return LatencySummary{P50: percentile(0.50), P90: percentile(0.90), P99: percentile(0.99), Max: percentile(1)}
+}
+
+// report gathers the measurements of the load test (the caller names the registrar and the orchestrator)
+func (lt *loadTest) report(accuracy *expiryRecorder) *Report {
+	lt.stats.mu.Lock()
+	defer lt.stats.mu.Unlock()
+	accuracy.mu.Lock()
+	defer accuracy.mu.Unlock()
+
+	report := &Report{
+		Systems:    lt.Systems,
+		Services:   lt.Services,
+		Duration:   lt.Duration.Seconds(),
+		RegPeriod:  lt.RegPeriod.Seconds(),
+		Rate:       lt.Rate,
+		Mix:        lt.Mix,
+		Operations: make(map[string]OperationReport),
+		Expiry: ExpiryReport{
+			Expired: len(accuracy.lags),
+			Missed:  accuracy.misses,
+			Lag:     summarize(accuracy.lags),
+		},
+		Version: "LoadReport_v1",
+	}
+	ops := make(map[string]bool)
+	for op := range lt.stats.latencies {
+		ops[op] = true
+	}
+	for op := range lt.stats.errors {
+		ops[op] = true
+	}
+	for op := range ops {
+		latencies := lt.stats.latencies[op]
+		report.Operations[op] = OperationReport{
+			Count:     len(latencies) + lt.stats.errors[op],
+			Errors:    lt.stats.errors[op],
+			LastError: lt.stats.lastError[op],
+			PerSecond: float64(len(latencies)) / lt.Duration.Seconds(),
+			Latency:   summarize(latencies),
+		}
+	}
+	return report
+}
+
+// Marshal encodes the report in JSON
+func (r *Report) Marshal() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
@@ -0,0 +1,543 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+// Package matching is the service quest matching engine shared by the service registrars (sregistrar and esr),
+// so that a quest returns the same providers whichever registrar leads.
+//
+// A record matches a service quest if it has the quest's service definition and satisfies all the quest's details:
+//
+//   - "Key": ["v1", "v2"]  the record must have the detail Key with at least one of the values (an empty list only requires the key),
+//   - values may contain the wildcards * (any sequence) and ? (any character), e.g., "Location": ["Kitchen*"],
+//   - "!Key": []           the record must not have the detail Key,
+//   - "!Key": ["v1"]       the record must not have the value v1 for the detail Key,
+//   - "Query": ["expr"]    the record must satisfy the boolean expression expr.
+//
+// The expression combines terms with AND, OR, NOT and parentheses (AND binds tighter than OR), e.g.,
+//
+//	Location=Kitchen* AND (Unit=Celsius OR Unit=Kelvin) AND NOT Deprecated AND ACost<=5 AND Version>=1.2
+//
+// A term is either a key alone (the record has it) or a key, an operator (=, !=, <, <=, >, >=) and a value (quoted if it contains spaces).
+// The keys ACost, CUnit, SystemName, SubPath and Definition refer to the record's fields, all other keys to its details.
+// = and != compare with wildcards, the other operators compare ACost numerically and the other keys as versions (e.g., v1.10 > v1.9).
+// A term on a detail is true if at least one of the detail's values satisfies it (!= if none is equal).
+package matching
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Record holds the fields of a service record (ServiceRecord_v1) that a quest refers to.
+// The registrars convert their records, so that the package does not depend on a release of the mbaigo forms.
+type Record struct {
+	Definition string
+	SystemName string
+	SubPath    string
+	ACost      float64
+	CUnit      string
+	Details    map[string][]string
+}
+
+// ErrInvalidQuest is returned when a service quest cannot be compiled into a matcher
+var ErrInvalidQuest = errors.New("invalid service quest")
+
+// Matcher is the compiled form of a service quest
+type Matcher struct {
+	definition string
+	conditions []queryNode
+}
+
+// Compile compiles the service definition and the details of a service quest
+func Compile(definition string, details map[string][]string) (*Matcher, error) {
+	m := &Matcher{definition: definition}
+	for key, values := range details {
+		switch {
+		case key == "Query":
+			for _, expr := range values {
+				node, err := parseQuery(expr)
+				if err != nil {
+					return nil, err
+				}
+				m.conditions = append(m.conditions, node)
+			}
+		case strings.HasPrefix(key, "!"):
+			if len(key) == 1 {
+				return nil, fmt.Errorf("%w: empty negated detail key", ErrInvalidQuest)
+			}
+			m.conditions = append(m.conditions, notNode{detailNode{key: key[1:], values: values}})
+		default:
+			m.conditions = append(m.conditions, detailNode{key: key, values: values})
+		}
+	}
+	return m, nil
+}
+
+// Matches checks a service record against the compiled quest (a nil matcher accepts every record)
+func (m *Matcher) Matches(rec Record) bool {
+	if m == nil {
+		return true
+	}
+	if m.definition != "" && rec.Definition != m.definition {
+		return false
+	}
+	for _, c := range m.conditions {
+		if !c.eval(rec) {
+			return false
+		}
+	}
+	return true
+}
+
+// Definition returns the service definition of the quest (empty if any)
+func (m *Matcher) Definition() string {
+	return m.definition
+}
+
+// Requirement is a key that every matching record has with one of the values (compared exactly)
+type Requirement struct {
+	Key    string
+	Values []string
+}
+
+// Requirements returns the details of the quest that every matching record has with one of their exact values,
+// so that a registrar can narrow the search with its indexes before checking the records with Matches.
+// The negated details, the query expressions and the values with wildcards are left out, since they do not narrow the search.
+func (m *Matcher) Requirements() []Requirement {
+	var reqs []Requirement
+	for _, c := range m.conditions {
+		node, ok := c.(detailNode)
+		if !ok || len(node.values) == 0 || !exactValues(node.values) {
+			continue
+		}
+		reqs = append(reqs, Requirement{Key: node.key, Values: node.values})
+	}
+	return reqs
+}
+
+// exactValues checks that none of the values has a wildcard
+func exactValues(values []string) bool {
+	for _, value := range values {
+		if strings.ContainsAny(value, "*?") {
+			return false
+		}
+	}
+	return true
+}
+
+// queryNode is a node of a compiled quest condition
+type queryNode interface {
+	eval(rec Record) bool
+}
+
+type andNode []queryNode
+type orNode []queryNode
+type notNode struct{ node queryNode }
+
+// detailNode requires the key and, if values are given, at least one of them (with wildcards)
+type detailNode struct {
+	key    string
+	values []string
+}
+
+// compareNode compares the values of a key with an operator
+type compareNode struct {
+	key   string
+	op    string
+	value string
+}
+
+func (n andNode) eval(rec Record) bool {
+	for _, c := range n {
+		if !c.eval(rec) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n orNode) eval(rec Record) bool {
+	for _, c := range n {
+		if c.eval(rec) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n notNode) eval(rec Record) bool {
+	return !n.node.eval(rec)
+}
+
+func (n detailNode) eval(rec Record) bool {
+	recValues := recordValues(rec, n.key)
+	if len(recValues) == 0 {
+		return false
+	}
+	if len(n.values) == 0 {
+		return true
+	}
+	for _, pattern := range n.values {
+		for _, v := range recValues {
+			if wildcardMatch(pattern, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (n compareNode) eval(rec Record) bool {
+	recValues := recordValues(rec, n.key)
+	if n.op == "!=" {
+		for _, v := range recValues {
+			if wildcardMatch(n.value, v) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, v := range recValues {
+		if n.op == "=" {
+			if wildcardMatch(n.value, v) {
+				return true
+			}
+			continue
+		}
+		var cmp int
+		var ok bool
+		if n.key == "ACost" {
+			cmp, ok = compareNumbers(v, n.value)
+		} else {
+			cmp, ok = compareVersions(v, n.value)
+		}
+		if !ok {
+			continue
+		}
+		switch n.op {
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// recordValues returns the values of a record's field or detail
+func recordValues(rec Record, key string) []string {
+	switch key {
+	case "ACost":
+		return []string{strconv.FormatFloat(rec.ACost, 'f', -1, 64)}
+	case "CUnit":
+		return nonEmpty(rec.CUnit)
+	case "SystemName":
+		return nonEmpty(rec.SystemName)
+	case "SubPath":
+		return nonEmpty(rec.SubPath)
+	case "Definition":
+		return nonEmpty(rec.Definition)
+	}
+	return rec.Details[key]
+}
+
+// nonEmpty turns a field into a list of values
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+// wildcardMatch matches a value against a pattern where * is any sequence and ? any single character
+func wildcardMatch(pattern, value string) bool {
+	p, v := []rune(pattern), []rune(value)
+	pi, vi := 0, 0
+	star, mark := -1, 0
+	for vi < len(v) {
+		switch {
+		case pi < len(p) && p[pi] == '*':
+			star, mark = pi, vi
+			pi++
+		case pi < len(p) && (p[pi] == '?' || p[pi] == v[vi]):
+			pi++
+			vi++
+		case star >= 0:
+			pi = star + 1
+			mark++
+			vi = mark
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// compareNumbers compares two decimal numbers
+func compareNumbers(a, b string) (int, bool) {
+	x, err := strconv.ParseFloat(a, 64)
+	if err != nil {
+		return 0, false
+	}
+	y, err := strconv.ParseFloat(b, 64)
+	if err != nil {
+		return 0, false
+	}
+	switch {
+	case x < y:
+		return -1, true
+	case x > y:
+		return 1, true
+	}
+	return 0, true
+}
+
+// compareVersions compares two dotted versions such as 1.2, v1.10 or 2 (missing parts are zeros)
+func compareVersions(a, b string) (int, bool) {
+	x, ok := versionParts(a)
+	if !ok {
+		return 0, false
+	}
+	y, ok := versionParts(b)
+	if !ok {
+		return 0, false
+	}
+	for i := 0; i < len(x) || i < len(y); i++ {
+		var xi, yi int
+		if i < len(x) {
+			xi = x[i]
+		}
+		if i < len(y) {
+			yi = y[i]
+		}
+		if xi != yi {
+			if xi < yi {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, true
+}
+
+// versionParts splits a version into its numeric parts
+func versionParts(s string) ([]int, bool) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "v"), "V")
+	if s == "" {
+		return nil, false
+	}
+	var parts []int
+	for _, p := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, false
+		}
+		parts = append(parts, n)
+	}
+	return parts, true
+}
+
+//-------------------------------------Query expression parser
+
+// queryParser is a recursive descent parser of the query expressions
+type queryParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseQuery compiles a query expression
+func parseQuery(expr string) (queryNode, error) {
+	tokens, err := tokenizeQuery(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%w: empty query", ErrInvalidQuest)
+	}
+	p := &queryParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("%w: unexpected %q in query", ErrInvalidQuest, p.tokens[p.pos])
+	}
+	return node, nil
+}
+
+// peek returns the next token or an empty string at the end of the expression
+func (p *queryParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// parseOr parses and-expressions separated by OR
+func (p *queryParser) parseOr() (queryNode, error) {
+	var nodes orNode
+	for {
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+		if !strings.EqualFold(p.peek(), "OR") {
+			break
+		}
+		p.pos++
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+// parseAnd parses unary expressions separated by AND
+func (p *queryParser) parseAnd() (queryNode, error) {
+	var nodes andNode
+	for {
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+		if !strings.EqualFold(p.peek(), "AND") {
+			break
+		}
+		p.pos++
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+// parseUnary parses a negation, a parenthesized expression or a term
+func (p *queryParser) parseUnary() (queryNode, error) {
+	tok := p.peek()
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("%w: unexpected end of query", ErrInvalidQuest)
+	case strings.EqualFold(tok, "NOT"):
+		p.pos++
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node}, nil
+	case tok == "(":
+		p.pos++
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("%w: missing closing parenthesis", ErrInvalidQuest)
+		}
+		p.pos++
+		return node, nil
+	case isQueryOperator(tok) || tok == ")" || strings.EqualFold(tok, "AND") || strings.EqualFold(tok, "OR"):
+		return nil, fmt.Errorf("%w: unexpected %q in query", ErrInvalidQuest, tok)
+	}
+	p.pos++
+	key := unquote(tok)
+	op := p.peek()
+	if !isQueryOperator(op) {
+		return detailNode{key: key}, nil
+	}
+	p.pos++
+	value := p.peek()
+	if value == "" || value == "(" || value == ")" || isQueryOperator(value) {
+		return nil, fmt.Errorf("%w: missing value after %s%s", ErrInvalidQuest, key, op)
+	}
+	p.pos++
+	return compareNode{key: key, op: op, value: unquote(value)}, nil
+}
+
+// isQueryOperator checks if a token is a comparison operator
+func isQueryOperator(tok string) bool {
+	switch tok {
+	case "=", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+// unquote removes the double quotes around a value
+func unquote(tok string) string {
+	if len(tok) >= 2 && tok[0] == '"' && tok[len(tok)-1] == '"' {
+		return tok[1 : len(tok)-1]
+	}
+	return tok
+}
+
+// tokenizeQuery splits an expression into parentheses, operators, quoted strings and words
+func tokenizeQuery(expr string) ([]string, error) {
+	var tokens []string
+	r := []rune(expr)
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '!' || c == '<' || c == '>' || c == '=':
+			if i+1 < len(r) && r[i+1] == '=' {
+				tokens = append(tokens, string(r[i:i+2]))
+				i += 2
+				continue
+			}
+			if c == '!' {
+				return nil, fmt.Errorf("%w: use NOT instead of ! in query", ErrInvalidQuest)
+			}
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(r) && r[j] != '"' {
+				j++
+			}
+			if j == len(r) {
+				return nil, fmt.Errorf("%w: unterminated quoted value", ErrInvalidQuest)
+			}
+			tokens = append(tokens, string(r[i:j+1]))
+			i = j + 1
+		default:
+			j := i
+			for j < len(r) && !unicode.IsSpace(r[j]) && !strings.ContainsRune("()!<>=\"", r[j]) {
+				j++
+			}
+			tokens = append(tokens, string(r[i:j]))
+			i = j
+		}
+	}
+	return tokens, nil
+}
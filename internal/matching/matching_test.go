@@ -0,0 +1,191 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package matching
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// records are the providers the quests of the conformance table are matched against
+var records = map[string]Record{
+	"kitchen": {Definition: "temperature", SystemName: "ds18b20", SubPath: "sensor1/temperature", ACost: 2, CUnit: "SEK",
+		Details: map[string][]string{"Location": {"Kitchen"}, "Unit": {"Celsius"}, "Version": {"v1.10"}}},
+	"kitchenette": {Definition: "temperature", SystemName: "ds18b20", SubPath: "sensor2/temperature", ACost: 7,
+		Details: map[string][]string{"Location": {"Kitchenette"}, "Unit": {"Kelvin"}, "Version": {"1.9"}}},
+	"garage": {Definition: "temperature", SystemName: "thermostat", SubPath: "controller/temperature", ACost: 0.5,
+		Details: map[string][]string{"Location": {"Garage", "Workshop"}, "Unit": {"Fahrenheit"}, "Deprecated": {"true"}}},
+	"setpoint": {Definition: "setpoint", SystemName: "thermostat", SubPath: "controller/setpoint",
+		Details: map[string][]string{"Location": {"Garage"}, "Version": {"2"}}},
+}
+
+// TestConformance checks which records each quest matches, and thus which ones it does not
+func TestConformance(t *testing.T) {
+	tests := []struct {
+		name       string
+		definition string
+		details    map[string][]string
+		want       []string // the records that match, all the others must not
+	}{
+		{"definition only", "temperature", nil, []string{"garage", "kitchen", "kitchenette"}},
+		{"no definition", "", nil, []string{"garage", "kitchen", "kitchenette", "setpoint"}},
+		{"unknown definition", "humidity", nil, nil},
+		{"detail value", "temperature", map[string][]string{"Location": {"Kitchen"}}, []string{"kitchen"}},
+		{"any of the values", "temperature", map[string][]string{"Location": {"Kitchen", "Workshop"}}, []string{"garage", "kitchen"}},
+		{"all the keys", "temperature", map[string][]string{"Location": {"Kitchen*"}, "Unit": {"Kelvin"}}, []string{"kitchenette"}},
+		{"key only", "", map[string][]string{"Version": {}}, []string{"kitchen", "kitchenette", "setpoint"}},
+		{"wildcard *", "temperature", map[string][]string{"Location": {"Kitchen*"}}, []string{"kitchen", "kitchenette"}},
+		{"wildcard ?", "temperature", map[string][]string{"Unit": {"?elvin"}}, []string{"kitchenette"}},
+		{"wildcard on a field", "", map[string][]string{"SubPath": {"controller/*"}}, []string{"garage", "setpoint"}},
+		{"must not have the key", "temperature", map[string][]string{"!Deprecated": {}}, []string{"kitchen", "kitchenette"}},
+		{"must not have the value", "temperature", map[string][]string{"!Location": {"Garage"}}, []string{"kitchen", "kitchenette"}},
+		{"AND", "", map[string][]string{"Query": {"SystemName=thermostat AND Location=Garage"}}, []string{"garage", "setpoint"}},
+		{"OR", "temperature", map[string][]string{"Query": {"Unit=Celsius OR Unit=Kelvin"}}, []string{"kitchen", "kitchenette"}},
+		{"NOT", "temperature", map[string][]string{"Query": {"NOT Deprecated"}}, []string{"kitchen", "kitchenette"}},
+		{"AND binds tighter than OR", "", map[string][]string{"Query": {"Unit=Celsius OR Location=Garage AND Version"}}, []string{"kitchen", "setpoint"}},
+		{"parentheses", "", map[string][]string{"Query": {"(Unit=Celsius OR Location=Garage) AND Version"}}, []string{"kitchen", "setpoint"}},
+		{"lower case operators", "temperature", map[string][]string{"Query": {"not deprecated and unit=k*"}}, nil},
+		{"lower case keywords", "temperature", map[string][]string{"Query": {"not Deprecated and Unit=K*"}}, []string{"kitchenette"}},
+		{"!= on a detail", "temperature", map[string][]string{"Query": {"Location!=Kitchen*"}}, []string{"garage"}},
+		{"!= without the detail", "temperature", map[string][]string{"Query": {"Version!=2"}}, []string{"garage", "kitchen", "kitchenette"}},
+		{"ACost <=", "temperature", map[string][]string{"Query": {"ACost<=2"}}, []string{"garage", "kitchen"}},
+		{"ACost >", "", map[string][]string{"Query": {"ACost>0.5"}}, []string{"kitchen", "kitchenette"}},
+		{"ACost = ", "", map[string][]string{"Query": {"ACost=0"}}, []string{"setpoint"}},
+		{"CUnit", "", map[string][]string{"CUnit": {"SEK"}}, []string{"kitchen"}},
+		{"version >= with prefix", "", map[string][]string{"Query": {"Version>=v1.10"}}, []string{"kitchen", "setpoint"}},
+		{"version < numeric parts", "", map[string][]string{"Query": {"Version<1.10"}}, []string{"kitchenette"}},
+		{"version missing parts", "", map[string][]string{"Query": {"Version>=2.0.0"}}, []string{"setpoint"}},
+		{"quoted value", "", map[string][]string{"Query": {`SubPath="sensor1/temperature"`}}, []string{"kitchen"}},
+		{"several queries", "", map[string][]string{"Query": {"Location=Garage", "NOT Deprecated"}}, []string{"setpoint"}},
+		{"query and details", "temperature", map[string][]string{"Query": {"ACost<5"}, "!Deprecated": {}}, []string{"kitchen"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Compile(tt.definition, tt.details)
+			if err != nil {
+				t.Fatalf("Compile: %v", err)
+			}
+			want := make(map[string]bool)
+			for _, name := range tt.want {
+				want[name] = true
+			}
+			for name, rec := range records {
+				if got := m.Matches(rec); got != want[name] {
+					t.Errorf("Matches(%s) = %v, want %v", name, got, want[name])
+				}
+			}
+		})
+	}
+}
+
+// TestInvalidQuests checks that malformed quests are rejected with ErrInvalidQuest
+func TestInvalidQuests(t *testing.T) {
+	tests := []map[string][]string{
+		{"!": {}},
+		{"Query": {""}},
+		{"Query": {"Location="}},
+		{"Query": {"(Location=Garage"}},
+		{"Query": {"Location=Garage)"}},
+		{"Query": {"Location=Garage AND"}},
+		{"Query": {"OR Location=Garage"}},
+		{"Query": {"!Deprecated"}},
+		{"Query": {`Location="Garage`}},
+		{"Query": {"Location Garage"}},
+	}
+	for _, details := range tests {
+		if _, err := Compile("", details); !errors.Is(err, ErrInvalidQuest) {
+			t.Errorf("Compile(%v) = %v, want ErrInvalidQuest", details, err)
+		}
+	}
+}
+
+// TestNilMatcher checks that a nil matcher accepts every record
+func TestNilMatcher(t *testing.T) {
+	var m *Matcher
+	for name, rec := range records {
+		if !m.Matches(rec) {
+			t.Errorf("nil matcher rejects %s", name)
+		}
+	}
+}
+
+// TestRequirements checks that only the details with exact values narrow a search
+func TestRequirements(t *testing.T) {
+	m, err := Compile("temperature", map[string][]string{
+		"Location":    {"Kitchen", "Garage"},
+		"Unit":        {"C*"},
+		"Version":     {},
+		"!Deprecated": {},
+		"Query":       {"SystemName=ds18b20"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Requirement{{Key: "Location", Values: []string{"Kitchen", "Garage"}}}
+	if got := m.Requirements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Requirements() = %v, want %v", got, want)
+	}
+	if m.Definition() != "temperature" {
+		t.Errorf("Definition() = %q", m.Definition())
+	}
+}
+
+// TestWildcardMatch checks the wildcard patterns
+func TestWildcardMatch(t *testing.T) {
+	tests := []struct {
+		pattern, value string
+		want           bool
+	}{
+		{"Kitchen", "Kitchen", true},
+		{"Kitchen", "kitchen", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"K*n", "Kitchen", true},
+		{"K*n", "Kitchenette", false},
+		{"*e*e*", "Kitchenette", true},
+		{"?", "", false},
+		{"K?tchen", "Kitchen", true},
+		{"Küche*", "Küchenzeile", true},
+	}
+	for _, tt := range tests {
+		if got := wildcardMatch(tt.pattern, tt.value); got != tt.want {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", tt.pattern, tt.value, got, tt.want)
+		}
+	}
+}
+
+// TestCompareVersions checks the ordering of the versions
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+		ok   bool
+	}{
+		{"1.10", "1.9", 1, true},
+		{"v1.2", "1.2.0", 0, true},
+		{"V2", "v10", -1, true},
+		{"1.2-beta", "1.2", 0, false},
+		{"", "1", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := compareVersions(tt.a, tt.b)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("compareVersions(%q, %q) = %d, %v, want %d, %v", tt.a, tt.b, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+// Package negotiation chooses the media type of a response from the Accept header of the request (RFC 9110, section 12.5.1).
+//
+// The header is a list of media ranges (type/subtype, type/* or */*), each with an optional quality value q between 0 and 1
+// (1 by default), e.g., a browser sends "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8".
+// The quality of an offered media type is the one of the most specific range that matches it, and q=0 means "not acceptable".
+package negotiation
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// mediaRange is a media range of an Accept header with its quality
+type mediaRange struct {
+	mainType, subType string
+	quality           float64
+}
+
+// parseAccept returns the valid media ranges of an Accept header
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, field := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(field))
+		if err != nil {
+			continue
+		}
+		mainType, subType, found := strings.Cut(mediaType, "/")
+		if !found || (mainType == "*" && subType != "*") {
+			continue
+		}
+		quality := 1.0
+		if q, given := params["q"]; given {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil || quality < 0 || quality > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{mainType: mainType, subType: subType, quality: quality})
+	}
+	return ranges
+}
+
+// quality returns the quality of a media type in the ranges, and -1 if no range matches it
+func quality(ranges []mediaRange, mediaType string) float64 {
+	mainType, subType, _ := strings.Cut(mediaType, "/")
+	best, specificity := -1.0, 0
+	for _, r := range ranges {
+		var s int
+		switch {
+		case r.mainType == mainType && r.subType == subType:
+			s = 3
+		case r.mainType == mainType && r.subType == "*":
+			s = 2
+		case r.mainType == "*":
+			s = 1
+		default:
+			continue
+		}
+		if s > specificity {
+			best, specificity = r.quality, s
+		}
+	}
+	return best
+}
+
+// Prefer returns the offered media type with the highest quality in the Accept header, the first one of the offers in case of a tie.
+// It returns the first offer if the header is empty or invalid, and an empty string if none of the offers is acceptable.
+func Prefer(accept string, offers ...string) string {
+	ranges := parseAccept(accept)
+	if len(ranges) == 0 {
+		if len(offers) == 0 {
+			return ""
+		}
+		return offers[0]
+	}
+	chosen, best := "", 0.0
+	for _, offer := range offers {
+		if q := quality(ranges, offer); q > best {
+			chosen, best = offer, q
+		}
+	}
+	return chosen
+}
@@ -0,0 +1,57 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package negotiation
+
+import "testing"
+
+func TestPrefer(t *testing.T) {
+	offers := []string{"text/html", "application/json", "application/xml", "text/xml"}
+	tests := []struct {
+		name   string
+		accept string
+		want   string
+	}{
+		{"no header", "", "text/html"},
+		{"invalid header", ";;;", "text/html"},
+		{"firefox", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html"},
+		{"chrome", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7", "text/html"},
+		{"safari", "application/xml,application/xhtml+xml,text/html;q=0.9,text/plain;q=0.8,*/*;q=0.5", "application/xml"},
+		{"curl", "*/*", "text/html"},
+		{"json", "application/json", "application/json"},
+		{"json with parameters", "application/json; charset=utf-8", "application/json"},
+		{"xml", "application/xml", "application/xml"},
+		{"text xml", "text/xml", "text/xml"},
+		{"json preferred", "application/xml;q=0.5, application/json", "application/json"},
+		{"xml preferred", "application/json;q=0.4, application/xml;q=0.6", "application/xml"},
+		{"same quality", "application/xml, application/json", "application/json"},
+		{"case of the ranges", "Application/JSON", "application/json"},
+		{"type range", "application/*", "application/json"},
+		{"specific range wins", "text/*;q=0.2, text/html;q=0, application/xml;q=0.1", "text/xml"},
+		{"excluded html", "*/*, text/html;q=0", "application/json"},
+		{"nothing acceptable", "image/png", ""},
+		{"all excluded", "*/*;q=0", ""},
+		{"invalid quality", "application/json;q=2, application/xml;q=0.3", "application/xml"},
+		{"invalid range", "*/json, application/xml;q=0.3", "application/xml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Prefer(tt.accept, offers...); got != tt.want {
+				t.Fatalf("Prefer(%q) = %q, want %q", tt.accept, got, tt.want)
+			}
+		})
+	}
+}
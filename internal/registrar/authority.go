@@ -0,0 +1,70 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/sdoque/systems/internal/identity"
+)
+
+//*********************Verification of the registering system's identity*********************
+
+// A system proves its identity either with the client certificate of a mutual TLS connection, or by signing its request
+// (method, path, timestamp, nonce and body) with the private key of the certificate in the Certificate field of its service record.
+// The certificate must be issued by the configured certificate authority and its common name is the system's name.
+// Stale timestamps and reused nonces are rejected (see the package internal/identity).
+// The peer registrars sign their replication and election messages with the registrar's own certificate, whose common name is the registrar's system name.
+
+// authority verifies the certificates of the registering systems against the certificate authority
+type authority struct {
+	verifier *identity.Authority
+}
+
+// loadAuthority reads the PEM encoded certificate(s) of the certificate authority
+func loadAuthority(caFile string) (*authority, error) {
+	verifier, err := identity.LoadAuthority(caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &authority{verifier: verifier}, nil
+}
+
+// authorize checks that the request comes from the owning system, otherwise it responds with 401 or 403 and returns false.
+// body is the request body that was signed (nil if the request has none) and certField the certificate of the submitted record, if any.
+// Without a configured certificate authority, all requests are authorized.
+func (a *authority) authorize(w http.ResponseWriter, r *http.Request, body []byte, certField, owner string) bool {
+	if a == nil {
+		return true
+	}
+	name, err := a.verifier.Identify(r, body, certField)
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	if name != owner {
+		http.Error(w, fmt.Sprintf("Forbidden: the system %s does not own the records of %s", name, owner), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authorizePeer checks that the request comes from a peer registrar of the local cloud, i.e., that it is signed with a certificate of the registrar's system
+func (a *authority) authorizePeer(w http.ResponseWriter, r *http.Request, body []byte, ua *UnitAsset) bool {
+	return a.authorize(w, r, body, "", ua.Owner.Name)
+}
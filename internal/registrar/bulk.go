@@ -0,0 +1,157 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/mbaigo/usecases"
+)
+
+//*********************Bulk registration of a system's services*********************
+
+// A system with many unit assets registers (and renews) all its services at once with a ServiceRecordList_v1 form.
+// Records without id are registered, those with an id are renewed (or registered anew if unknown), and with
+// the URL query parameter replace=true the other services of the system are unregistered, all at once (in one transaction with the database).
+
+// bulkSystem checks that the list holds the services of one system and returns its name
+func bulkSystem(recList *forms.ServiceRecordList_v1) (string, error) {
+	if len(recList.List) == 0 {
+		return "", errors.New("the service record list is empty")
+	}
+	systemName := recList.List[0].SystemName
+	for _, rec := range recList.List[1:] {
+		if rec.SystemName != systemName {
+			return "", fmt.Errorf("the list mixes the services of %s and %s", systemName, rec.SystemName)
+		}
+	}
+	return systemName, nil
+}
+
+// bulkRegister registers or renews (POST or PUT) all the services of a system given as a ServiceRecordList_v1 form
+func (ua *UnitAsset) bulkRegister(w http.ResponseWriter, r *http.Request) {
+	if !ua.isLeading() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Service Unavailable"))
+		return
+	}
+	switch r.Method {
+	case "POST", "PUT":
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+		defer r.Body.Close()
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		listForm, err := usecases.Unpack(bodyBytes, mediaType)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		recList, ok := listForm.(*forms.ServiceRecordList_v1)
+		if !ok {
+			http.Error(w, "Bad Request, a ServiceRecordList_v1 form is expected", http.StatusBadRequest)
+			return
+		}
+		systemName, err := bulkSystem(recList)
+		if err != nil {
+			http.Error(w, "Bad Request, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Verify that the request comes from the system owning the records
+		if !ua.authority.authorize(w, r, bodyBytes, recList.List[0].Certificate, systemName) {
+			return
+		}
+		previousIds := make([]int, len(recList.List))
+		for i, rec := range recList.List {
+			previousIds[i] = rec.Id
+			ua.limits.clampRegLife(&recList.List[i])
+			if reservedDetail(w, rec) {
+				return
+			}
+			if ua.imported.has(rec.Id) {
+				http.Error(w, fmt.Sprintf("Forbidden: the record %d is imported from DNS-SD and read-only", rec.Id), http.StatusForbidden)
+				return
+			}
+			if rec.Id != 0 && ua.authority != nil {
+				if stored, err := ua.store.Get(rec.Id); err == nil && stored.SystemName != systemName {
+					http.Error(w, fmt.Sprintf("Forbidden: the record %d belongs to %s", rec.Id, stored.SystemName), http.StatusForbidden)
+					return
+				}
+			}
+		}
+		release := ua.withinQuotas(w, r, recList.List, ua.known)
+		if release == nil {
+			return
+		}
+		defer release() // the count of the records stays valid until they are stored
+
+		renewed, retired, err := registerBatch(ua, recList.List, r.URL.Query().Get("replace") == "true")
+		if err != nil {
+			log.Printf("error registering the services of %s: %v\n", systemName, err)
+			http.Error(w, "Error registering services", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%d services from system %s have been registered or renewed, %d retired\n", len(recList.List), systemName, len(retired))
+		ua.reportBatch(r, recList.List, previousIds, renewed, retired)
+
+		payload, err := usecases.Pack(recList, mediaType)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", mediaType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(payload)
+	default:
+		http.Error(w, "Unsupported HTTP request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// reportBatch replicates the changes of a bulk registration to the standby registrars and records them in the history
+func (ua *UnitAsset) reportBatch(r *http.Request, records []forms.ServiceRecord_v1, previousIds []int, renewed []bool, retired []forms.ServiceRecord_v1) {
+	source := sourceIP(r)
+	for _, old := range retired {
+		ua.replicate("unregister", forms.ServiceRecord_v1{Id: old.Id})
+		logEvent(ua, "unregister", old, source, "retired by a bulk registration")
+	}
+	for i, rec := range records {
+		switch {
+		case renewed[i]:
+			ua.replicate("extend", rec)
+			logEvent(ua, "extend", rec, source, "valid until "+rec.EndOfValidity)
+		case previousIds[i] != 0:
+			ua.replicate("register", rec)
+			logEvent(ua, "re-register", rec, source, fmt.Sprintf("previous record id %d", previousIds[i]))
+		default:
+			ua.replicate("register", rec)
+			logEvent(ua, "register", rec, source, "")
+		}
+	}
+}
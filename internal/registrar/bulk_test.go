@@ -0,0 +1,159 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+// bulkList returns the ServiceRecordList_v1 form of the records
+func bulkList(records ...forms.ServiceRecord_v1) forms.ServiceRecordList_v1 {
+	return forms.ServiceRecordList_v1{List: records, Version: "ServiceRecordList_v1"}
+}
+
+// storedPaths returns the sorted subpaths of the records of a system in the registry
+func storedPaths(t *testing.T, ua *UnitAsset, system string) []string {
+	t.Helper()
+	records, err := ua.store.RecordsOf(system, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make([]string, 0, len(records))
+	for _, rec := range records {
+		paths = append(paths, rec.SubPath)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// TestBulkRegister sends the successive bulk registrations of a system and checks the registry after each one
+func TestBulkRegister(t *testing.T) {
+	ua := servingRegistrar(t, NewMemoryStore())
+	var ids map[string]int // record ids by subpath, as replied to the previous step
+	withId := func(rec forms.ServiceRecord_v1) forms.ServiceRecord_v1 {
+		rec.Id = ids[rec.SubPath]
+		return rec
+	}
+	coil := func(n int) forms.ServiceRecord_v1 { return testRecord("modboss", fmt.Sprintf("coil%d/state", n)) }
+	tests := []struct {
+		name    string
+		query   string
+		list    func() forms.ServiceRecordList_v1
+		status  int
+		renewed []bool // whether the records of the list keep their ids
+		stored  []string
+	}{
+		{"register", "", func() forms.ServiceRecordList_v1 { return bulkList(coil(1), coil(2), coil(3)) },
+			http.StatusOK, []bool{false, false, false}, []string{"coil1/state", "coil2/state", "coil3/state"}},
+		{"renew", "", func() forms.ServiceRecordList_v1 { return bulkList(withId(coil(1)), withId(coil(2)), withId(coil(3))) },
+			http.StatusOK, []bool{true, true, true}, []string{"coil1/state", "coil2/state", "coil3/state"}},
+		{"renew and add", "", func() forms.ServiceRecordList_v1 { return bulkList(withId(coil(1)), coil(4)) },
+			http.StatusOK, []bool{true, false}, []string{"coil1/state", "coil2/state", "coil3/state", "coil4/state"}},
+		{"replace", "?replace=true", func() forms.ServiceRecordList_v1 { return bulkList(withId(coil(2)), coil(5)) },
+			http.StatusOK, []bool{true, false}, []string{"coil2/state", "coil5/state"}},
+		{"refused record", "", func() forms.ServiceRecordList_v1 {
+			imported := coil(6)
+			imported.Details = map[string][]string{announcedKey: {"_ipp._tcp"}}
+			return bulkList(coil(7), imported)
+		}, http.StatusBadRequest, nil, []string{"coil2/state", "coil5/state"}},
+		{"mixed systems", "?replace=true", func() forms.ServiceRecordList_v1 {
+			return bulkList(coil(8), testRecord("uaclient", "node1/value"))
+		}, http.StatusBadRequest, nil, []string{"coil2/state", "coil5/state"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := tt.list()
+			w := serve(ua, http.MethodPost, "/bulkregister"+tt.query, list)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if got := storedPaths(t, ua, "modboss"); fmt.Sprint(got) != fmt.Sprint(tt.stored) {
+				t.Errorf("stored %v, want %v", got, tt.stored)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var reply forms.ServiceRecordList_v1
+			if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+				t.Fatal(err)
+			}
+			if len(reply.List) != len(list.List) {
+				t.Fatalf("%d records in the reply, want %d", len(reply.List), len(list.List))
+			}
+			next := make(map[string]int)
+			for i, rec := range reply.List {
+				if rec.Id == 0 {
+					t.Errorf("the record %s has no id", rec.SubPath)
+				}
+				if kept := rec.Id == list.List[i].Id; kept != tt.renewed[i] {
+					t.Errorf("the record %s got the id %d for %d, want it renewed: %t", rec.SubPath, rec.Id, list.List[i].Id, tt.renewed[i])
+				}
+				next[rec.SubPath] = rec.Id
+			}
+			for path, id := range ids {
+				if _, listed := next[path]; !listed && tt.query == "" {
+					next[path] = id // unchanged by the step
+				}
+			}
+			ids = next
+		})
+	}
+}
+
+// TestBulkRegisterIsAtomic checks that a concurrent reader sees either none or all of the records of a bulk registration
+func TestBulkRegisterIsAtomic(t *testing.T) {
+	ua := servingRegistrar(t, NewMemoryStore())
+	const size = 50
+	records := make([]forms.ServiceRecord_v1, size)
+	for i := range records {
+		records[i] = testRecord("modboss", fmt.Sprintf("coil%d/state", i))
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if n := len(storedPaths(t, ua, "modboss")); n != 0 && n != size {
+				t.Errorf("a reader saw %d of the %d records", n, size)
+				return
+			}
+		}
+	}()
+	w := serve(ua, http.MethodPost, "/bulkregister", bulkList(records...))
+	close(done)
+	wg.Wait()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if n := len(storedPaths(t, ua, "modboss")); n != size {
+		t.Fatalf("%d records stored, want %d", n, size)
+	}
+}
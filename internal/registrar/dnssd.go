@@ -0,0 +1,382 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/sdoque/mbaigo/forms"
+)
+
+//*********************DNS-SD advertisement and browsing (multicast DNS)*********************
+
+// With "advertise": true, the leading registrar announces each system with registered services on the local network as an
+// instance of _arrowhead._tcp, whose TXT record lists the services of the system with their definition, record id, ports and details,
+// so that the registry can be browsed with DNS-SD tools (e.g., avahi-browse or dns-sd).
+// A single responder runs per system and its TXT record is refreshed in place as the services of the system come and go.
+// With "browse": ["_ipp._tcp", ...], the leading registrar also imports the services announced by other devices
+// as read-only records (with the reserved detail "_dnssd" naming the browsed service type), which expire when they are no longer announced.
+// The reserved detail lets the standby registrars recognize the replicated imports; the records submitted by the systems may not carry it.
+
+const (
+	dnssdService = "_arrowhead._tcp" // service type of the advertised systems
+	dnssdDomain  = "local."
+	announcedKey = "_dnssd"         // reserved detail marking the records imported from DNS-SD
+	browsePeriod = 60 * time.Second // time between two browsing rounds
+	browseWindow = 5 * time.Second  // time spent collecting the announcements of a service type
+)
+
+// importedRecords is the set of the records imported from DNS-SD, which are read-only
+type importedRecords struct {
+	mu  sync.Mutex
+	ids map[int]bool
+}
+
+func newImportedRecords() *importedRecords {
+	return &importedRecords{ids: make(map[int]bool)}
+}
+
+// has checks if a record was imported from DNS-SD
+func (m *importedRecords) has(id int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ids[id]
+}
+
+// mark flags a record as imported from DNS-SD
+func (m *importedRecords) mark(id int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ids[id] = true
+}
+
+// forget removes a record that no longer exists
+func (m *importedRecords) forget(id int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.ids, id)
+}
+
+// track flags a record replicated by the leading registrar if it imported it from DNS-SD (the leader is the only one setting the detail)
+func (m *importedRecords) track(rec forms.ServiceRecord_v1) {
+	if announced(rec) {
+		m.mark(rec.Id)
+	}
+}
+
+// reset flags the records imported from DNS-SD among those of a registry that was reloaded or synchronized
+func (m *importedRecords) reset(records []forms.ServiceRecord_v1) {
+	m.mu.Lock()
+	m.ids = make(map[int]bool)
+	m.mu.Unlock()
+	for _, rec := range records {
+		m.track(rec)
+	}
+}
+
+// announced checks if a record has the reserved detail of the records imported from DNS-SD
+func announced(rec forms.ServiceRecord_v1) bool {
+	_, found := rec.Details[announcedKey]
+	return found
+}
+
+// reservedDetail answers 400 Bad Request to a system submitting a record with the reserved detail of the DNS-SD imports
+func reservedDetail(w http.ResponseWriter, rec forms.ServiceRecord_v1) bool {
+	if !announced(rec) {
+		return false
+	}
+	http.Error(w, fmt.Sprintf("Bad Request: the detail %s of %s is reserved for the records imported from DNS-SD", announcedKey, rec.SubPath), http.StatusBadRequest)
+	return true
+}
+
+// hostLabel turns a system name into a valid host name label
+var hostLabel = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// recordPort returns the port of a service record, preferring https
+func recordPort(rec forms.ServiceRecord_v1) int {
+	if p, ok := rec.ProtoPort["https"]; ok && p != 0 {
+		return p
+	}
+	return rec.ProtoPort["http"]
+}
+
+// serviceText builds the TXT entry of a service, keyed by its path: definition;id=12;http=20150;Unit=Celsius
+func serviceText(rec forms.ServiceRecord_v1) string {
+	fields := []string{rec.ServiceDefinition, fmt.Sprintf("id=%d", rec.Id)}
+	protocols := make([]string, 0, len(rec.ProtoPort))
+	for protocol := range rec.ProtoPort {
+		protocols = append(protocols, protocol)
+	}
+	sort.Strings(protocols)
+	for _, protocol := range protocols {
+		fields = append(fields, fmt.Sprintf("%s=%d", protocol, rec.ProtoPort[protocol]))
+	}
+	keys := make([]string, 0, len(rec.Details))
+	for key := range rec.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fields = append(fields, key+"="+strings.Join(rec.Details[key], ","))
+	}
+	return rec.SubPath + "=" + strings.Join(fields, ";")
+}
+
+// systemText builds the TXT record of an advertised system, with one entry per service in the order of the record ids
+func systemText(systemName string, records map[int]forms.ServiceRecord_v1) []string {
+	ids := make([]int, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	text := []string{"system=" + systemName}
+	for _, id := range ids {
+		text = append(text, serviceText(records[id]))
+	}
+	return text
+}
+
+// responder announces a DNS-SD instance (a zeroconf server)
+type responder interface {
+	SetText(text []string)
+	Shutdown()
+}
+
+// registerResponder starts the multicast DNS responder of a system
+func registerResponder(instance, host string, port int, ips, text []string) (responder, error) {
+	return zeroconf.RegisterProxy(instance, dnssdService, dnssdDomain, port, host, ips, text, nil)
+}
+
+// advertisedSystem is a system announced over DNS-SD with its services
+type advertisedSystem struct {
+	server    responder
+	addresses string // IP addresses of the announcement, to follow a system that moved
+	records   map[int]forms.ServiceRecord_v1
+}
+
+// advertiser announces the registered services, one responder per system
+type advertiser struct {
+	register func(instance, host string, port int, ips, text []string) (responder, error)
+	imported func(id int) bool
+	systems  map[string]*advertisedSystem
+	owners   map[int]string // system of each advertised record
+}
+
+func newAdvertiser(imported func(id int) bool) *advertiser {
+	return &advertiser{register: registerResponder, imported: imported, systems: make(map[string]*advertisedSystem), owners: make(map[int]string)}
+}
+
+// advertise adds a service record to the announcement of its system, starting the system's responder if needed
+func (a *advertiser) advertise(rec forms.ServiceRecord_v1) {
+	if _, exists := a.owners[rec.Id]; exists || a.imported(rec.Id) || len(rec.IPAddresses) == 0 || recordPort(rec) == 0 {
+		return
+	}
+	addresses := strings.Join(rec.IPAddresses, ",")
+	sys, exists := a.systems[rec.SystemName]
+	if exists && sys.addresses != addresses {
+		sys.server.Shutdown() // the system moved, it is announced anew at its new address
+		delete(a.systems, rec.SystemName)
+		exists = false
+	}
+	if exists {
+		sys.records[rec.Id] = rec
+		a.owners[rec.Id] = rec.SystemName
+		sys.server.SetText(systemText(rec.SystemName, sys.records))
+		return
+	}
+	records := map[int]forms.ServiceRecord_v1{rec.Id: rec}
+	if sys != nil {
+		records = sys.records
+		records[rec.Id] = rec
+	}
+	host := strings.Trim(hostLabel.ReplaceAllString(rec.SystemName, "-"), "-") + "." + dnssdDomain
+	server, err := a.register(rec.SystemName, host, recordPort(rec), rec.IPAddresses, systemText(rec.SystemName, records))
+	if err != nil {
+		log.Printf("error advertising the system %s over DNS-SD: %v\n", rec.SystemName, err)
+		for id := range records {
+			delete(a.owners, id)
+		}
+		return
+	}
+	a.systems[rec.SystemName] = &advertisedSystem{server: server, addresses: addresses, records: records}
+	a.owners[rec.Id] = rec.SystemName
+}
+
+// withdraw removes a service record from the announcement of its system, stopping the responder with the last one
+func (a *advertiser) withdraw(id int) {
+	name, exists := a.owners[id]
+	if !exists {
+		return
+	}
+	delete(a.owners, id)
+	sys := a.systems[name]
+	delete(sys.records, id)
+	if len(sys.records) == 0 {
+		sys.server.Shutdown()
+		delete(a.systems, name)
+		return
+	}
+	sys.server.SetText(systemText(name, sys.records))
+}
+
+// reconcile advertises the current records and withdraws the others
+func (a *advertiser) reconcile(records []forms.ServiceRecord_v1) {
+	current := make(map[int]bool)
+	for _, rec := range records {
+		current[rec.Id] = true
+		a.advertise(rec)
+	}
+	for id := range a.owners {
+		if !current[id] {
+			a.withdraw(id)
+		}
+	}
+}
+
+// runAdvertiser follows the changes of the registry to advertise the records while the registrar is leading.
+// The advertised records are reconciled with the registry periodically, e.g., after a change of leadership.
+func runAdvertiser(hub *watchHub, leading func() bool, list func() ([]forms.ServiceRecord_v1, error), imported func(id int) bool) {
+	_, notices := hub.subscribe(listingFilter{})
+	a := newAdvertiser(imported)
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case notice := <-notices:
+			if !leading() {
+				continue
+			}
+			switch notice.Event {
+			case "added":
+				a.advertise(notice.Record)
+			case "unregistered", "expired":
+				a.withdraw(notice.Record.Id)
+			}
+		case <-ticker.C:
+			if !leading() {
+				a.reconcile(nil)
+				continue
+			}
+			records, err := list()
+			if err != nil {
+				log.Printf("error listing the services to advertise: %v\n", err)
+				continue
+			}
+			a.reconcile(records)
+		}
+	}
+}
+
+// announcedRecord converts a DNS-SD announcement into a read-only service record
+func announcedRecord(entry *zeroconf.ServiceEntry, service string) forms.ServiceRecord_v1 {
+	name := strings.TrimPrefix(strings.SplitN(service, ".", 2)[0], "_")
+	rec := forms.ServiceRecord_v1{
+		ServiceDefinition: name,
+		SystemName:        entry.Instance,
+		ProtoPort:         map[string]int{name: entry.Port},
+		Details:           map[string][]string{announcedKey: {service}},
+		RegLife:           int((3 * browsePeriod).Seconds()), // expires if missed by three browsing rounds
+		Version:           "ServiceRecord_v1",
+	}
+	for _, ip := range entry.AddrIPv4 {
+		rec.IPAddresses = append(rec.IPAddresses, ip.String())
+	}
+	for _, kv := range entry.Text {
+		key, value, found := strings.Cut(kv, "=")
+		switch {
+		case key == "" || key == announcedKey:
+			continue
+		case key == "path" && found:
+			rec.SubPath = value
+		case key == "definition" && found:
+			rec.ServiceDefinition = value
+		default:
+			rec.Details[key] = append(rec.Details[key], value)
+		}
+	}
+	return rec
+}
+
+// runBrowser imports the services announced over DNS-SD while the registrar is leading.
+// The import function registers a new record or renews the one imported by the previous round (when its id is set).
+func runBrowser(services []string, leading func() bool, importRecord func(rec *forms.ServiceRecord_v1) error) {
+	imported := make(map[string]forms.ServiceRecord_v1) // records by announced instance
+	for {
+		if leading() {
+			for _, service := range services {
+				if service == dnssdService {
+					continue // these are the records advertised by the registrars themselves
+				}
+				for _, entry := range browse(service) {
+					rec := announcedRecord(entry, service)
+					if len(rec.IPAddresses) == 0 {
+						continue
+					}
+					key := entry.Instance + "." + service
+					if previous, known := imported[key]; known {
+						rec.Id = previous.Id
+						rec.Created = previous.Created
+					}
+					if err := importRecord(&rec); err != nil {
+						log.Printf("error importing the DNS-SD service %s: %v\n", key, err)
+						delete(imported, key) // registered anew at the next round
+						continue
+					}
+					imported[key] = rec
+				}
+			}
+		}
+		time.Sleep(browsePeriod)
+	}
+}
+
+// browse collects the announcements of a service type
+func browse(service string) []*zeroconf.ServiceEntry {
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		log.Printf("error creating the DNS-SD resolver: %v\n", err)
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), browseWindow)
+	defer cancel()
+	entries := make(chan *zeroconf.ServiceEntry)
+	if err := resolver.Browse(ctx, service, dnssdDomain, entries); err != nil {
+		log.Printf("error browsing the DNS-SD services %s: %v\n", service, err)
+		return nil
+	}
+	var found []*zeroconf.ServiceEntry
+	for {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				return found
+			}
+			found = append(found, entry)
+		case <-ctx.Done():
+			return found
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+// fakeResponder records the announcement of a system
+type fakeResponder struct {
+	instance string
+	ips      []string
+	text     []string
+	stopped  bool
+}
+
+func (f *fakeResponder) SetText(text []string) { f.text = text }
+func (f *fakeResponder) Shutdown()             { f.stopped = true }
+
+// testAdvertiser returns an advertiser recording its responders, with record 99 imported from DNS-SD
+func testAdvertiser() (*advertiser, *[]*fakeResponder) {
+	started := new([]*fakeResponder)
+	a := newAdvertiser(func(id int) bool { return id == 99 })
+	a.register = func(instance, host string, port int, ips, text []string) (responder, error) {
+		r := &fakeResponder{instance: instance, ips: ips, text: text}
+		*started = append(*started, r)
+		return r, nil
+	}
+	return a, started
+}
+
+func TestAdvertiserOneResponderPerSystem(t *testing.T) {
+	a, started := testAdvertiser()
+	temperature := testRecord("thermo", "kitchen/temperature")
+	temperature.Id = 1
+	setpoint := testRecord("thermo", "kitchen/setpoint")
+	setpoint.Id = 2
+	setpoint.ServiceDefinition = "setpoint"
+	setpoint.Details = map[string][]string{"Unit": {"Celsius"}}
+	valve := testRecord("heater", "valve/position")
+	valve.Id = 3
+	printer := testRecord("printer", "ipp")
+	printer.Id = 99
+	for _, rec := range []forms.ServiceRecord_v1{temperature, setpoint, valve, printer, temperature} {
+		a.advertise(rec)
+	}
+	if len(*started) != 2 {
+		t.Fatalf("%d responders started, want one for thermo and one for heater", len(*started))
+	}
+	thermo := (*started)[0]
+	want := []string{"system=thermo", "kitchen/temperature=temperature;id=1;http=20150", "kitchen/setpoint=setpoint;id=2;http=20150;Unit=Celsius"}
+	if thermo.instance != "thermo" || !reflect.DeepEqual(thermo.text, want) {
+		t.Fatalf("thermo announced as %q with %q, want %q", thermo.instance, thermo.text, want)
+	}
+
+	a.withdraw(1)
+	if want := []string{"system=thermo", "kitchen/setpoint=setpoint;id=2;http=20150;Unit=Celsius"}; thermo.stopped || !reflect.DeepEqual(thermo.text, want) {
+		t.Fatalf("thermo announced with %q (stopped: %t) after the withdrawal of record 1, want %q", thermo.text, thermo.stopped, want)
+	}
+	a.reconcile([]forms.ServiceRecord_v1{valve})
+	if !thermo.stopped || (*started)[1].stopped || len(a.systems) != 1 {
+		t.Fatal("the responder of thermo should stop with its last record, the one of heater keep running")
+	}
+}
+
+func TestAdvertiserFollowsMovedSystem(t *testing.T) {
+	a, started := testAdvertiser()
+	old := testRecord("thermo", "kitchen/temperature")
+	old.Id = 1
+	a.advertise(old)
+	moved := testRecord("thermo", "kitchen/temperature")
+	moved.Id = 2
+	moved.IPAddresses = []string{"192.168.1.11"}
+	a.advertise(moved)
+	if len(*started) != 2 || !(*started)[0].stopped || !reflect.DeepEqual((*started)[1].ips, moved.IPAddresses) {
+		t.Fatal("the system should be announced anew at its new address")
+	}
+}
+
+func TestImportedRecords(t *testing.T) {
+	m := newImportedRecords()
+	announced := testRecord("printer", "ipp")
+	announced.Id = 4
+	announced.Details = map[string][]string{announcedKey: {"_ipp._tcp"}}
+	local := testRecord("thermo", "kitchen/temperature")
+	local.Id = 5
+	m.reset([]forms.ServiceRecord_v1{announced, local})
+	if !m.has(4) || m.has(5) {
+		t.Fatal("only the record imported by the leading registrar should be read-only")
+	}
+	m.forget(4)
+	if m.has(4) {
+		t.Fatal("a forgotten record is still read-only")
+	}
+
+	// the details of the systems are their own, only the reserved detail is refused
+	for _, details := range []map[string][]string{{"Source": {"dns-sd"}, "Unit": {"Celsius"}}, {announcedKey: {"_ipp._tcp"}}} {
+		submitted := testRecord("thermo", "kitchen/temperature")
+		submitted.Details = details
+		w := httptest.NewRecorder()
+		refused := reservedDetail(w, submitted)
+		if _, reserved := details[announcedKey]; refused != reserved || (reserved && w.Code != http.StatusBadRequest) {
+			t.Errorf("record with details %v refused %v (%d), want %v", details, refused, w.Code, reserved)
+		}
+		if len(submitted.Details) != len(details) {
+			t.Errorf("details %v of a submitted record were edited", submitted.Details)
+		}
+	}
+}
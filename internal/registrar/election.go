@@ -0,0 +1,498 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sdoque/mbaigo/components"
+	"github.com/sdoque/systems/internal/leadership"
+)
+
+//*********************Term based leader election among the service registrars*********************
+
+// The registrars listed as serviceregistrar core systems elect a leader for a term with a majority quorum.
+// The leader renews its lease with heartbeats and steps down if it cannot reach a quorum within a lease,
+// so that a registrar on the minority side of a network partition never keeps on leading (split brain).
+// The followers refuse to vote for another candidate during leaseDuration after the leader's last heartbeat,
+// while the leader's own lease ends a heartbeat period earlier and is checked before and after each heartbeat,
+// so that it has stepped down before another registrar can be elected.
+// The election timeout grows with the rank of the registrar's URL so that simultaneous starts are resolved deterministically.
+const (
+	heartbeatPeriod = 1 * time.Second                 // period of the leader's heartbeats
+	leaseDuration   = 4 * time.Second                 // time without heartbeat before a follower considers the lead lost
+	rankDelay       = 1 * time.Second                 // additional election timeout per rank of the registrar
+	leaderLease     = leaseDuration - heartbeatPeriod // time after the last heartbeat acknowledged by a quorum before the leader steps down
+)
+
+// electionMessage is either a vote request from a candidate or a heartbeat from the leader
+type electionMessage struct {
+	Type   string `json:"type"` // vote or heartbeat
+	Term   int64  `json:"term"`
+	Sender string `json:"sender"`
+}
+
+// electionReply answers an election message with the term of the receiver
+type electionReply struct {
+	Term    int64 `json:"term"`
+	Granted bool  `json:"granted"`
+}
+
+// election holds the state of the registrar in the election protocol
+type election struct {
+	mu         sync.Mutex
+	self       string
+	rank       int // position of self in the sorted list of registrars
+	peers      []*components.CoreSystem
+	quorum     int
+	term       int64
+	votedFor   string
+	role       string
+	leader     string
+	lastHeard  time.Time // last heartbeat from the leader or vote granted (follower)
+	lastQuorum time.Time // sending time of the last heartbeat (or vote request) acknowledged by a majority (leader)
+	now        func() time.Time
+}
+
+// newElection prepares the election state from the configured core systems
+func newElection(ua *UnitAsset) (*election, error) {
+	peers, err := peersList(ua.Owner)
+	if err != nil {
+		return nil, err
+	}
+	e := &election{
+		self:      selfIdentity(ua),
+		peers:     peers,
+		quorum:    (len(peers)+1)/2 + 1,
+		role:      "follower",
+		lastHeard: time.Now(),
+		now:       time.Now,
+	}
+	members := []string{e.self}
+	for _, p := range peers {
+		members = append(members, p.Url)
+	}
+	sort.Strings(members)
+	for i, m := range members {
+		if m == e.self {
+			e.rank = i
+		}
+	}
+	return e, nil
+}
+
+// selfIdentity is the URL of the registrar as it appears in the configuration of its peers
+func selfIdentity(ua *UnitAsset) string {
+	sys := ua.Owner
+	for _, cs := range sys.CoreS {
+		if cs.Name != "serviceregistrar" {
+			continue
+		}
+		u, err := url.Parse(cs.Url)
+		if err != nil {
+			continue
+		}
+		uPort, _ := strconv.Atoi(u.Port())
+		if (u.Hostname() == sys.Host.IPAddresses[0] || u.Hostname() == "localhost") && uPort == sys.Husk.ProtoPort[u.Scheme] {
+			return cs.Url
+		}
+	}
+	return "http://" + sys.Host.IPAddresses[0] + ":" + strconv.Itoa(sys.Husk.ProtoPort["http"]) + "/" + sys.Name + "/" + ua.Name
+}
+
+// Role runs the election protocol to determine which service registrar in the local cloud is the leading service registrar
+func (ua *UnitAsset) Role() {
+	e, err := newElection(ua)
+	if err != nil {
+		panic(err)
+	}
+	ua.election = e
+	go func() {
+		ticker := time.NewTicker(heartbeatPeriod)
+		defer ticker.Stop()
+		for {
+			e.mu.Lock()
+			role := e.role
+			electionTimeout := leaseDuration + time.Duration(e.rank)*rankDelay
+			due := e.now().Sub(e.lastHeard) > electionTimeout
+			e.mu.Unlock()
+
+			switch {
+			case role == "leader":
+				ua.sendHeartbeats()
+			case due || len(e.peers) == 0:
+				ua.campaign()
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// campaign starts a new term and asks the peers for their votes
+func (ua *UnitAsset) campaign() {
+	e := ua.election
+	e.mu.Lock()
+	e.term++
+	term := e.term
+	e.role = "candidate"
+	e.votedFor = e.self
+	e.lastHeard = e.now() // retry after a new election timeout if the vote is split
+	requested := e.lastHeard
+	e.mu.Unlock()
+	ua.setLeader("")
+
+	votes := 1 + ua.broadcast(electionMessage{Type: "vote", Term: term, Sender: e.self})
+
+	e.mu.Lock()
+	won := e.role == "candidate" && e.term == term && votes >= e.quorum
+	if won {
+		e.role = "leader"
+		e.leader = e.self
+		e.lastQuorum = requested // the voters heard from the candidate after this time
+	}
+	e.mu.Unlock()
+	if won {
+		ua.setLeader(e.self)
+		_, since, _ := ua.leadership()
+		fmt.Printf("taking the service registry lead for term %d at %s\n", term, since)
+	}
+}
+
+// sendHeartbeats renews the lease of the leader or steps down when it expires without a quorum
+func (ua *UnitAsset) sendHeartbeats() {
+	e := ua.election
+	e.mu.Lock()
+	term, sent := e.term, e.now()
+	expired := sent.Sub(e.lastQuorum) > leaderLease
+	e.mu.Unlock()
+	if expired {
+		ua.stepDown(term)
+		return
+	}
+
+	acks := 1 + ua.broadcast(electionMessage{Type: "heartbeat", Term: term, Sender: e.self})
+
+	e.mu.Lock()
+	if e.role != "leader" || e.term != term {
+		e.mu.Unlock()
+		return
+	}
+	if acks >= e.quorum {
+		e.lastQuorum = sent // the followers heard from the leader after this time
+		e.mu.Unlock()
+		return
+	}
+	expired = e.now().Sub(e.lastQuorum) > leaderLease
+	e.mu.Unlock()
+	if expired {
+		ua.stepDown(term)
+	}
+}
+
+// stepDown gives up the lead of a term whose lease expired
+func (ua *UnitAsset) stepDown(term int64) {
+	e := ua.election
+	e.mu.Lock()
+	if e.role != "leader" || e.term != term {
+		e.mu.Unlock()
+		return
+	}
+	e.role = "follower"
+	e.leader = ""
+	e.lastHeard = e.now()
+	e.mu.Unlock()
+	log.Printf("stepping down from the service registry lead, no quorum for term %d\n", term)
+	ua.setLeader("")
+}
+
+// broadcast sends an election message to all peers and counts the positive replies
+func (ua *UnitAsset) broadcast(msg electionMessage) int {
+	e := ua.election
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("error marshalling the election message: %v\n", err)
+		return 0
+	}
+	client := &http.Client{Timeout: heartbeatPeriod / 2}
+	replies := make(chan electionReply, len(e.peers))
+	var wg sync.WaitGroup
+	for _, peer := range e.peers {
+		wg.Add(1)
+		go func(peer *components.CoreSystem) {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodPost, peer.Url+"/election", bytes.NewReader(payload))
+			if err != nil {
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if err := ua.credentials.Sign(req, payload); err != nil {
+				log.Printf("error signing the election message: %v\n", err)
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return // that registrar is not reachable
+			}
+			defer resp.Body.Close()
+			var reply electionReply
+			if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+				return
+			}
+			replies <- reply
+		}(peer)
+	}
+	wg.Wait()
+	close(replies)
+
+	granted := 0
+	for reply := range replies {
+		if reply.Term > msg.Term {
+			ua.observeTerm(reply.Term)
+			continue
+		}
+		if reply.Granted {
+			granted++
+		}
+	}
+	return granted
+}
+
+// observeTerm adopts a newer term seen in a reply and steps down if needed
+func (ua *UnitAsset) observeTerm(term int64) {
+	e := ua.election
+	e.mu.Lock()
+	if term <= e.term {
+		e.mu.Unlock()
+		return
+	}
+	wasLeading := e.role == "leader"
+	e.term = term
+	e.votedFor = ""
+	e.role = "follower"
+	e.lastHeard = e.now()
+	e.mu.Unlock()
+	if wasLeading {
+		log.Printf("stepping down from the service registry lead, newer term %d observed\n", term)
+		ua.setLeader("")
+	}
+}
+
+// electionHandler answers the vote requests and heartbeats of the other registrars
+func (ua *UnitAsset) electionHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		defer r.Body.Close()
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if !ua.authority.authorizePeer(w, r, bodyBytes, ua) {
+			return
+		}
+		var msg electionMessage
+		if err := json.Unmarshal(bodyBytes, &msg); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		var reply electionReply
+		switch msg.Type {
+		case "vote":
+			reply = ua.handleVote(msg)
+		case "heartbeat":
+			reply = ua.handleHeartbeat(msg)
+		default:
+			http.Error(w, "Unknown election message", http.StatusBadRequest)
+			return
+		}
+		payload, err := json.Marshal(reply)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(payload)
+	default:
+		http.Error(w, "Unsupported HTTP request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleVote grants the vote to a candidate once per term, unless a live leader is known
+func (ua *UnitAsset) handleVote(msg electionMessage) electionReply {
+	e := ua.election
+	e.mu.Lock()
+	now := e.now()
+	leaderAlive := (e.role == "leader" && now.Sub(e.lastQuorum) <= leaderLease) ||
+		(e.role == "follower" && e.leader != "" && now.Sub(e.lastHeard) <= leaseDuration)
+	if msg.Term < e.term || (leaderAlive && e.leader != msg.Sender) {
+		reply := electionReply{Term: e.term, Granted: false}
+		e.mu.Unlock()
+		return reply
+	}
+	stepDown := false
+	if msg.Term > e.term {
+		stepDown = e.role == "leader"
+		e.term = msg.Term
+		e.votedFor = ""
+		e.role = "follower"
+		e.leader = ""
+	}
+	reply := electionReply{Term: e.term, Granted: false}
+	if e.votedFor == "" || e.votedFor == msg.Sender {
+		e.votedFor = msg.Sender
+		e.lastHeard = now
+		reply.Granted = true
+	}
+	e.mu.Unlock()
+	if stepDown {
+		ua.setLeader("")
+	}
+	return reply
+}
+
+// handleHeartbeat follows the leader of the current (or a newer) term
+func (ua *UnitAsset) handleHeartbeat(msg electionMessage) electionReply {
+	e := ua.election
+	e.mu.Lock()
+	if msg.Term < e.term {
+		reply := electionReply{Term: e.term, Granted: false}
+		e.mu.Unlock()
+		return reply
+	}
+	if msg.Term > e.term {
+		e.votedFor = ""
+	}
+	e.term = msg.Term
+	e.role = "follower"
+	e.leader = msg.Sender
+	e.lastHeard = e.now()
+	reply := electionReply{Term: e.term, Granted: true}
+	e.mu.Unlock()
+	ua.setLeader(msg.Sender)
+	return reply
+}
+
+// leadState is the role of the unit asset, set by the election goroutine and the election handler and read by the other handlers
+type leadState struct {
+	mu        sync.Mutex
+	leading   bool
+	since     time.Time              // start of the lead
+	registrar *components.CoreSystem // if not leading this is the current leader
+}
+
+// leadership returns whether the unit asset is leading and since when, or else the leading registrar if it is known
+func (ua *UnitAsset) leadership() (leading bool, since time.Time, leader *components.CoreSystem) {
+	l := ua.lead
+	if l == nil {
+		return false, time.Time{}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leading, l.since, l.registrar
+}
+
+// isLeading reports whether the unit asset is the leading registrar
+func (ua *UnitAsset) isLeading() bool {
+	leading, _, _ := ua.leadership()
+	return leading
+}
+
+// setLeader updates the role of the unit asset after an election event
+func (ua *UnitAsset) setLeader(leader string) {
+	l := ua.lead
+	l.mu.Lock()
+	wasLeading := l.leading
+	var newLeader *components.CoreSystem
+	unknown := false
+	switch {
+	case leader != "" && leader == ua.election.self:
+		if !l.leading {
+			l.leading = true
+			l.since = time.Now()
+			l.registrar = nil
+		}
+	case leader == "":
+		l.leading = false
+		l.since = time.Time{} // reset lead timer
+		l.registrar = nil
+	default:
+		l.leading = false
+		l.since = time.Time{}
+		if l.registrar == nil || l.registrar.Url != leader {
+			l.registrar = nil
+			for _, cSys := range ua.election.peers {
+				if cSys.Url == leader {
+					l.registrar = cSys
+					newLeader = cSys
+					break
+				}
+			}
+			unknown = l.registrar == nil
+		}
+	}
+	leading := l.leading
+	l.mu.Unlock()
+
+	switch {
+	case leading && !wasLeading:
+		ua.logLeadership("lead-taken", fmt.Sprintf("term %d", ua.election.currentTerm()))
+	case wasLeading && !leading:
+		ua.logLeadership("lead-lost", fmt.Sprintf("term %d, new leader %q", ua.election.currentTerm(), leader))
+	}
+	if newLeader != nil {
+		go ua.synchronize(newLeader) // copy the registry of the new leader
+	}
+	if unknown {
+		log.Printf("the leading registrar %s is not in the configuration\n", leader)
+	}
+}
+
+// currentTerm returns the term of the election
+func (e *election) currentTerm() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.term
+}
+
+// status fills out the structured status form of the registrar
+func (ua *UnitAsset) status() leadership.RegistrarStatus_v1 {
+	e := ua.election
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	st := leadership.RegistrarStatus_v1{
+		Role:      e.role,
+		Term:      e.term,
+		Leader:    e.leader,
+		Registrar: e.self,
+		Version:   "RegistrarStatus_v1",
+	}
+	if leading, since, _ := ua.leadership(); leading && e.role == "leader" {
+		st.LeaderSince = since.Format(time.RFC3339)
+	}
+	return st
+}
@@ -0,0 +1,183 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sdoque/mbaigo/components"
+	"github.com/sdoque/systems/internal/scheduler"
+)
+
+// fakeClock is the clock of the election, moved by the test
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// electionRegistrar creates a registrar in term 1 of an election with peers at the URLs, which last heard from the leader now
+func electionRegistrar(self, role, leader string, peers []string, clock *fakeClock) *UnitAsset {
+	e := &election{
+		self:       self,
+		quorum:     (len(peers)+1)/2 + 1,
+		term:       1,
+		role:       role,
+		leader:     leader,
+		lastHeard:  clock.Now(),
+		lastQuorum: clock.Now(),
+		now:        clock.Now,
+	}
+	for _, url := range peers {
+		e.peers = append(e.peers, &components.CoreSystem{Name: "serviceregistrar", Url: url})
+	}
+	return &UnitAsset{election: e, lead: &leadState{leading: role == "leader"}, store: NewMemoryStore(), stats: newRegistryMetrics()}
+}
+
+// unreachable returns the URL of a registrar that is down
+func unreachable() string {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return srv.URL
+}
+
+func TestLeaderStepsDownBeforeAnotherIsElected(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	start := clock.Now()
+	// the leader a is cut off from b and c, which can still reach each other
+	a := electionRegistrar("http://a", "leader", "http://a", []string{unreachable(), unreachable()}, clock)
+	b := electionRegistrar("http://b", "follower", "http://a", []string{"http://a", "http://c"}, clock)
+	vote := electionMessage{Type: "vote", Term: 2, Sender: "http://c"}
+
+	step := heartbeatPeriod / 10
+	for elapsed := step; elapsed <= 2*leaseDuration; elapsed += step {
+		clock.Advance(step)
+		if elapsed%heartbeatPeriod == 0 {
+			a.sendHeartbeats()
+		}
+		if elapsed <= leaderLease && !a.isLeading() {
+			t.Fatalf("the leader stepped down %s after its last quorum, before the end of its lease", elapsed)
+		}
+		if reply := b.handleVote(vote); reply.Granted {
+			if a.isLeading() || a.election.role == "leader" {
+				t.Fatalf("c was elected %s after the partition while a was still leading", clock.Now().Sub(start))
+			}
+			if elapsed <= leaseDuration {
+				t.Fatalf("b voted %s after the last heartbeat, before the end of the lease", elapsed)
+			}
+			return
+		}
+	}
+	t.Fatal("b never voted for c")
+}
+
+func TestLeaderKeepsLeadWithQuorum(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	follower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg electionMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(electionReply{Term: msg.Term, Granted: true})
+	}))
+	defer follower.Close()
+	a := electionRegistrar("http://a", "leader", "http://a", []string{follower.URL, unreachable()}, clock)
+
+	for i := 0; i < 10; i++ {
+		clock.Advance(heartbeatPeriod)
+		sent := clock.Now()
+		a.sendHeartbeats()
+		if !a.isLeading() || a.election.role != "leader" {
+			t.Fatalf("the leader stepped down with a quorum at heartbeat %d", i)
+		}
+		if !a.election.lastQuorum.Equal(sent) {
+			t.Fatalf("lease renewed at %s, want the sending time of the heartbeat %s", a.election.lastQuorum, sent)
+		}
+	}
+}
+
+// TestElectionWhileServing runs elections concurrently with the handlers, which read the role while it changes (go test -race)
+func TestElectionWhileServing(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	peer := httptest.NewServer(http.NotFoundHandler()) // refuses the synchronization of a new leader
+	defer peer.Close()
+	ua := electionRegistrar("http://a", "follower", "", []string{peer.URL}, clock)
+	ua.Owner = &components.System{Name: "serviceregistrar"}
+	ua.sched = scheduler.New()
+	go ua.sched.Run()
+	defer ua.sched.Stop()
+
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				f(i)
+			}
+		}()
+	}
+	election := func(msg electionMessage) {
+		body, _ := json.Marshal(msg)
+		ua.Serving(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/election", bytes.NewReader(body)), "election")
+	}
+	run(func(i int) { election(electionMessage{Type: "heartbeat", Term: int64(2 * i), Sender: "http://a"}) })
+	run(func(i int) { election(electionMessage{Type: "heartbeat", Term: int64(2*i + 1), Sender: peer.URL}) })
+	run(func(i int) { election(electionMessage{Type: "vote", Term: int64(i), Sender: peer.URL}) })
+	run(func(int) { ua.campaign() })
+	run(func(int) { ua.sendHeartbeats() })
+	for _, path := range []string{"status", "metrics", "register", "bulkregister"} {
+		path := path
+		run(func(int) {
+			ua.Serving(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/"+path, nil), path)
+		})
+	}
+	run(func(int) {
+		r := httptest.NewRequest(http.MethodGet, "/status", nil)
+		r.Header.Set("Accept", "application/json")
+		ua.Serving(httptest.NewRecorder(), r, "status")
+	})
+	wg.Wait()
+
+	// the role read by the handlers agrees with the election once it settles
+	ua.setLeader(ua.election.self)
+	if leading, since, leader := ua.leadership(); !leading || since.IsZero() || leader != nil {
+		t.Fatalf("leadership = %v since %v with leader %v, want leading since now", leading, since, leader)
+	}
+	ua.setLeader(peer.URL)
+	if leading, _, leader := ua.leadership(); leading || leader == nil || leader.Url != peer.URL {
+		t.Fatalf("leadership = %v with leader %v, want standby behind %s", leading, leader, peer.URL)
+	}
+}
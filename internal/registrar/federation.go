@@ -0,0 +1,244 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/mbaigo/usecases"
+)
+
+//*********************Federated discovery across local clouds*********************
+
+// A registrar configured with peer clouds acts as the gateway of its local cloud. A service quest is forwarded to the
+// gateway registrars of the peer clouds when it has the detail "InterCloud": ["true"] or when nothing matches locally.
+// The remote records are merged with the local ones and tagged with the detail "Cloud": [name of the originating cloud].
+// A forwarded quest carries the name of the forwarding cloud ("ForwardedBy") and is never forwarded again.
+// The detail is only trusted from the gateway registrar of that cloud, whose request is signed with a certificate of the peer cloud's
+// authority (caFile of the peer cloud) or, without one, comes from the host of its URL. Other clients cannot set it: it is dropped
+// and their quest is handled as a local one.
+// The allow and deny lists of a peer cloud name the service definitions shared with it, in both directions.
+
+// Reserved details of a service quest, which are removed before matching the records
+const (
+	interCloudKey  = "InterCloud"  // forwards the quest to the peer clouds even if it is matched locally
+	forwardedByKey = "ForwardedBy" // name of the cloud that forwarded the quest
+	cloudKey       = "Cloud"       // originating cloud of a remote record
+)
+
+// peerCloud is a neighbouring local cloud reached through its gateway registrar
+type peerCloud struct {
+	Name  string   `json:"name"`  // name of the peer cloud (its registrar's cloudName)
+	Url   string   `json:"url"`   // URL of its registrar's unit asset, e.g., http://192.168.2.10:20102/serviceregistrar/registry
+	Allow []string `json:"allow"` // service definitions shared with the peer cloud (all if empty)
+	Deny  []string `json:"deny"`  // service definitions never shared with the peer cloud
+	// CAFile is the certificate authority of the peer cloud, verifying the signature of the quests its registrar forwards (the source host is checked if empty)
+	CAFile    string     `json:"caFile,omitempty"`
+	authority *authority // loaded from CAFile
+}
+
+// loadPeerClouds loads the certificate authorities of the peer clouds
+func loadPeerClouds(peers []peerCloud) ([]peerCloud, error) {
+	for i := range peers {
+		if peers[i].CAFile == "" {
+			continue
+		}
+		a, err := loadAuthority(peers[i].CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("peer cloud %s: %w", peers[i].Name, err)
+		}
+		peers[i].authority = a
+	}
+	return peers, nil
+}
+
+// forwardedFrom checks that a quest with the ForwardedBy detail comes from the gateway registrar of that peer cloud
+func (ua *UnitAsset) forwardedFrom(r *http.Request, body []byte, forwardedBy string) bool {
+	for _, peer := range ua.PeerClouds {
+		if peer.Name != forwardedBy {
+			continue
+		}
+		if peer.authority == nil {
+			return peer.hostedAt(sourceIP(r))
+		}
+		name, err := peer.authority.verifier.Identify(r, body, "")
+		if err != nil {
+			log.Printf("the quest forwarded by the cloud %s is not signed by its registrar: %v\n", forwardedBy, err)
+			return false
+		}
+		return name == ua.Owner.Name
+	}
+	return false
+}
+
+// hostedAt checks that an IP address is one of the addresses of the peer cloud's registrar
+func (p peerCloud) hostedAt(ip string) bool {
+	u, err := url.Parse(p.Url)
+	if err != nil {
+		return false
+	}
+	addresses, err := net.LookupHost(u.Hostname())
+	if err != nil {
+		return false
+	}
+	for _, address := range addresses {
+		if address == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// shares checks that a service definition may be discovered across the border with the peer cloud
+func (p peerCloud) shares(definition string) bool {
+	for _, denied := range p.Deny {
+		if denied == definition {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, allowed := range p.Allow {
+		if allowed == definition {
+			return true
+		}
+	}
+	return false
+}
+
+// extractFederation removes the reserved details from a quest and returns them
+func extractFederation(quest *forms.ServiceQuest_v1) (interCloud bool, forwardedBy string) {
+	details := make(map[string][]string, len(quest.Details))
+	for key, values := range quest.Details {
+		switch key {
+		case interCloudKey:
+			interCloud = len(values) > 0 && values[0] == "true"
+		case forwardedByKey:
+			if len(values) > 0 {
+				forwardedBy = values[0]
+			}
+		default:
+			details[key] = values
+		}
+	}
+	quest.Details = details
+	return interCloud, forwardedBy
+}
+
+// federate completes the local results of a quest with those of the peer clouds, or restricts them to what is shared with the forwarding cloud
+func (ua *UnitAsset) federate(quest forms.ServiceQuest_v1, interCloud bool, forwardedBy string, local []forms.ServiceRecord_v1) []forms.ServiceRecord_v1 {
+	if forwardedBy != "" {
+		for _, peer := range ua.PeerClouds {
+			if peer.Name == forwardedBy && peer.shares(quest.ServiceDefinition) {
+				return local
+			}
+		}
+		log.Printf("the quest for %s forwarded by the cloud %s is not shared\n", quest.ServiceDefinition, forwardedBy)
+		return []forms.ServiceRecord_v1{}
+	}
+	if len(ua.PeerClouds) == 0 || (!interCloud && len(local) > 0) {
+		return local
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	merged := append([]forms.ServiceRecord_v1{}, local...)
+	for _, peer := range ua.PeerClouds {
+		if !peer.shares(quest.ServiceDefinition) {
+			continue
+		}
+		wg.Add(1)
+		go func(peer peerCloud) {
+			defer wg.Done()
+			remote, err := ua.askPeerCloud(peer, quest)
+			if err != nil {
+				log.Printf("error forwarding the quest for %s to the cloud %s: %v\n", quest.ServiceDefinition, peer.Name, err)
+				return
+			}
+			mu.Lock()
+			merged = append(merged, remote...)
+			mu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+	return merged
+}
+
+// askPeerCloud forwards a quest to the gateway registrar of a peer cloud and tags the records it returns
+func (ua *UnitAsset) askPeerCloud(peer peerCloud, quest forms.ServiceQuest_v1) ([]forms.ServiceRecord_v1, error) {
+	details := make(map[string][]string, len(quest.Details)+1)
+	for key, values := range quest.Details {
+		details[key] = values
+	}
+	details[forwardedByKey] = []string{ua.CloudName}
+	quest.Details = details
+	payload, err := usecases.Pack(&quest, "application/json")
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer.Url+"/query", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := ua.credentials.Sign(req, payload); err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the registrar answered %s", resp.Status)
+	}
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	form, err := usecases.Unpack(bodyBytes, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	recList, ok := form.(*forms.ServiceRecordList_v1)
+	if !ok {
+		return nil, fmt.Errorf("a ServiceRecordList_v1 form is expected")
+	}
+	for i := range recList.List {
+		tagged := make(map[string][]string, len(recList.List[i].Details)+1)
+		for key, values := range recList.List[i].Details {
+			tagged[key] = values
+		}
+		tagged[cloudKey] = []string{peer.Name}
+		recList.List[i].Details = tagged
+	}
+	return recList.List, nil
+}
@@ -0,0 +1,49 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedFrom(t *testing.T) {
+	ua := &UnitAsset{PeerClouds: []peerCloud{
+		{Name: "plant", Url: "http://127.0.0.1:20102/serviceregistrar/registry"},
+		{Name: "office", Url: "http://192.0.2.7:20102/serviceregistrar/registry"},
+	}}
+	tests := []struct {
+		name        string
+		remoteAddr  string
+		forwardedBy string
+		want        bool
+	}{
+		{"peer registrar", "127.0.0.1:40000", "plant", true},
+		{"other host", "127.0.0.1:40000", "office", false},
+		{"unknown cloud", "127.0.0.1:40000", "warehouse", false},
+		{"client claiming a cloud", "192.0.2.99:40000", "plant", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/serviceregistrar/registry/query", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if got := ua.forwardedFrom(r, nil, tt.forwardedBy); got != tt.want {
+				t.Fatalf("forwardedFrom(%s, %q) = %t, want %t", tt.remoteAddr, tt.forwardedBy, got, tt.want)
+			}
+		})
+	}
+}
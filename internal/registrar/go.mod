@@ -0,0 +1,7 @@
+module github.com/sdoque/systems/internal/registrar
+
+go 1.21
+
+require github.com/sdoque/systems/internal v0.0.0-00010101000000-000000000000
+
+replace github.com/sdoque/systems/internal => ../
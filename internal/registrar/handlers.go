@@ -0,0 +1,412 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/sdoque/mbaigo/components"
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/mbaigo/usecases"
+)
+
+//*********************Services of the registry*********************
+
+// Serving handles the resources services. NOTE: it exepcts those names from the request URL path
+func (ua *UnitAsset) Serving(w http.ResponseWriter, r *http.Request, servicePath string) {
+	switch servicePath {
+	case "register":
+		ua.updateDB(w, r)
+	case "query":
+		ua.queryDB(w, r)
+	case "unregister":
+		ua.cleanDB(w, r)
+	case "status":
+		ua.roleStatus(w, r)
+	case "syslist":
+		ua.systemList(w, r)
+	case "replicate":
+		ua.replication(w, r)
+	case "election":
+		ua.electionHandler(w, r)
+	case "watch":
+		ua.watch(w, r)
+	case "history":
+		ua.history(w, r)
+	case "bulkregister":
+		ua.bulkRegister(w, r)
+	case "snapshot":
+		ua.snapshot(w, r)
+	case "metrics":
+		ua.exportMetrics(w, r)
+	case "quotas":
+		ua.quotas(w, r)
+	default:
+		http.Error(w, "Invalid service request [Do not modify the services subpath in the configurration file]", http.StatusBadRequest)
+	}
+}
+
+// updateDB is used to add a new service record or to extend its registration life
+func (ua *UnitAsset) updateDB(w http.ResponseWriter, r *http.Request) {
+	if !ua.isLeading() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Service Unavailable"))
+		return
+	}
+	switch r.Method {
+	case "POST", "PUT":
+		contentType := r.Header.Get("Content-Type")
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			fmt.Println("Error parsing media type:", err)
+			return
+		}
+		defer r.Body.Close()
+		bodyBytes, err := io.ReadAll(r.Body) // Use io.ReadAll instead of ioutil.ReadAll
+		if err != nil {
+			log.Printf("error reading registration request body: %v", err)
+			return
+		}
+
+		regRec, err := usecases.Unpack(bodyBytes, mediaType)
+		if err != nil {
+			log.Printf("error extracting the registration record relpy %v\n", err)
+		}
+
+		// Perform a type assertion to convert the returned Form to ServiceRecord_v1
+		newRecord, ok := regRec.(*forms.ServiceRecord_v1)
+		if !ok {
+			fmt.Println("error extracting registration request")
+			return
+		}
+
+		// Verify that the request comes from the system owning the record
+		if !ua.authority.authorize(w, r, bodyBytes, newRecord.Certificate, newRecord.SystemName) {
+			return
+		}
+		if reservedDetail(w, *newRecord) { // only the registrar marks the records it imports from DNS-SD
+			return
+		}
+		if newRecord.Id != 0 {
+			if ua.imported.has(newRecord.Id) {
+				http.Error(w, fmt.Sprintf("Forbidden: the record %d is imported from DNS-SD and read-only", newRecord.Id), http.StatusForbidden)
+				return
+			} else if stored, err := ua.store.Get(newRecord.Id); err == nil && ua.authority != nil && stored.SystemName != newRecord.SystemName {
+				http.Error(w, fmt.Sprintf("Forbidden: the record %d belongs to %s", newRecord.Id, stored.SystemName), http.StatusForbidden)
+				return
+			}
+		}
+
+		// Apply the registration quotas of the system and of its source IP
+		ua.limits.clampRegLife(newRecord)
+		release := ua.withinQuotas(w, r, []forms.ServiceRecord_v1{*newRecord}, ua.known)
+		if release == nil {
+			return
+		}
+		defer release() // the count of the records stays valid until they are stored
+
+		// Process request ////////////////////////////////////////////////////
+
+		if newRecord.Id == 0 {
+			replaced, err := registerService(ua, newRecord) // insert the new record into the database, replacing the previous one of the same service
+			if err != nil {
+				log.Printf("error registering the service %s from system %s: %v\n", newRecord.ServiceDefinition, newRecord.SystemName, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("the new service %s from system %s has been registered\n", newRecord.ServiceDefinition, newRecord.SystemName)
+			ua.replicate("register", *newRecord)
+			if len(replaced) > 0 {
+				logEvent(ua, "re-register", *newRecord, sourceIP(r), fmt.Sprintf("replaces record id %v", replaced))
+			} else {
+				logEvent(ua, "register", *newRecord, sourceIP(r), "")
+			}
+		} else {
+			previousId := newRecord.Id
+			err = extendServiceValidity(ua, newRecord)
+			switch {
+			case errors.Is(err, ErrUnknownRecord):
+				// insert the new record into the database since the "existing" record was not found
+				if _, err := registerService(ua, newRecord); err != nil {
+					log.Printf("error re-registering the service %s from system %s: %v\n", newRecord.ServiceDefinition, newRecord.SystemName, err)
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+				log.Printf("the service %s from system %s has been re-registered\n", newRecord.ServiceDefinition, newRecord.SystemName)
+				ua.replicate("register", *newRecord)
+				logEvent(ua, "re-register", *newRecord, sourceIP(r), fmt.Sprintf("previous record id %d", previousId))
+			case err != nil:
+				log.Printf("error extending the record %d: %v\n", previousId, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			default:
+				ua.replicate("extend", *newRecord)
+				logEvent(ua, "extend", *newRecord, sourceIP(r), "valid until "+newRecord.EndOfValidity)
+			}
+		}
+
+		jform, err := usecases.Pack(newRecord, mediaType)
+		if err != nil {
+			log.Println("registration marshall error")
+		}
+		w.Header().Set("Content-Type", mediaType)
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(jform)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		fmt.Fprintf(w, "unsupported http request method")
+	}
+}
+
+// queryDB looks for service records in the service registry
+func (ua *UnitAsset) queryDB(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		// Handle GET request - no payload, only URL query parameters
+		filter, err := parseListingFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		allServices, err := ua.store.List()
+		if err != nil {
+			log.Printf("Error querying the Service Registry: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		page, total := filter.apply(allServices)
+		if mediaType := listingMediaType(r); mediaType != "" {
+			sendListing(w, mediaType, ua.probes.annotate(page), total)
+			return
+		}
+		serviceList := listCurrentServices(ua, page)
+		text := "<!DOCTYPE html><html><body>"
+		w.Write([]byte(text))
+		text = "<p>The local cloud's currently available services are:</p><ul>"
+		w.Write([]byte(text))
+		for _, availableService := range serviceList {
+			w.Write([]byte(fmt.Sprintf("<li>%s</li>", availableService)))
+		}
+		text = "</ul></body></html>"
+		w.Write([]byte(text))
+
+	case "POST":
+		// Handle POST request - with a JSON payload from the Orchestrator
+		headerContentType := r.Header.Get("Content-Type")
+		if !strings.Contains(headerContentType, "application/json") {
+			http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		defer r.Body.Close()
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("Error reading service query request body: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		questForm, err := usecases.Unpack(bodyBytes, headerContentType)
+		if err != nil {
+			log.Printf("error extracting the discovery request %v\n", err)
+		}
+		// Perform a type assertion to convert the returned Form to SignalA_v1a
+		qf, ok := questForm.(*forms.ServiceQuest_v1)
+		if !ok {
+			fmt.Println("Problem unpacking the service discovery request form")
+			return
+		}
+		fmt.Printf("The service discovery request form is %v\n", qf)
+		interCloud, forwardedBy := extractFederation(qf)
+		if forwardedBy != "" && !ua.forwardedFrom(r, bodyBytes, forwardedBy) {
+			log.Printf("the quest from %s is not forwarded by the registrar of the cloud %s, it is handled as a local quest\n", sourceIP(r), forwardedBy)
+			forwardedBy = ""
+		}
+
+		// Process request and get a copy of the availavle services in a list of ServiceRecords
+		discoveryList, err := findServices(ua, *qf)
+		if errors.Is(err, errInvalidQuest) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Error querying the Service Registry: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		discoveryList = ua.federate(*qf, interCloud, forwardedBy, discoveryList)
+
+		// fill out the form that has the list of services that fit the request
+		dsListForm, err := usecases.FillDiscoveredServices(discoveryList, "ServiceRecordList_v1")
+		if err != nil {
+			log.Println("service record processing error")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		// package up the list into a byte array
+		payload, err := usecases.Pack(dsListForm, headerContentType)
+		if err != nil {
+			log.Println("Discovery marshalling error")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("The list of discovered services is %v+\n", dsListForm)
+
+		// send off the list back to the Orchestrator
+		w.Header().Set("Content-Type", headerContentType)
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(payload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		http.Error(w, "Unsupported HTTP request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// cleanDB deletes service records upon request (e.g., when a system shuts down)
+func (ua *UnitAsset) cleanDB(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "DELETE":
+		parts := strings.Split(r.URL.Path, "/")
+		idStr := parts[len(parts)-1]   // the ID is the last part of the URL path
+		id, err := strconv.Atoi(idStr) // convert the ID to an integer
+		if err != nil {
+			// handle the error
+			http.Error(w, "Invalid record ID", http.StatusBadRequest)
+			return
+		}
+		rec, err := ua.store.Get(id)
+		if err != nil {
+			http.Error(w, "Record not found", http.StatusNotFound)
+			return
+		}
+		if ua.imported.has(id) {
+			http.Error(w, fmt.Sprintf("Forbidden: the record %d is imported from DNS-SD and read-only", id), http.StatusForbidden)
+			return
+		}
+		if !ua.authority.authorize(w, r, nil, rec.Certificate, rec.SystemName) {
+			return
+		}
+		if err := ua.store.Delete(id); err != nil {
+			log.Printf("error deleting the record %d: %v\n", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !ua.sched.Cancel(id) {
+			log.Printf("the scheduler had no task with id %d to cancel", id)
+		}
+		ua.replicate("unregister", forms.ServiceRecord_v1{Id: id})
+		ua.watchers.publish("unregistered", *rec)
+		logEvent(ua, "unregister", *rec, sourceIP(r), "")
+	default:
+		fmt.Fprintf(w, "unsupported http request method")
+	}
+}
+
+// roleStatus rerturn the current activity of a service registrar (i.e., leading or on stand by)
+// A client asking for JSON gets the structured status form, others get the legacy text
+func (ua *UnitAsset) roleStatus(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		leading, since, leader := ua.leadership()
+		statusCode := http.StatusOK
+		if !leading {
+			statusCode = http.StatusServiceUnavailable
+		}
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			payload, err := json.Marshal(ua.status())
+			if err != nil {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(statusCode)
+			w.Write(payload)
+			return
+		}
+		if leading {
+			text := fmt.Sprintf("lead Service Registrar since %s", since)
+			fmt.Fprint(w, text)
+			return
+		}
+		if leader != nil {
+			text := fmt.Sprintf("On standby, leading registrar is %s", leader.Url)
+			http.Error(w, text, http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Service Unavailable"))
+	default:
+		fmt.Fprintf(w, "unsupported http request method")
+	}
+}
+
+// peerslist provides a list of the other service registrars in the local cloud
+func peersList(sys *components.System) (peers []*components.CoreSystem, err error) {
+	for _, cs := range sys.CoreS {
+		if cs.Name != "serviceregistrar" {
+			continue
+		}
+		u, err := url.Parse(cs.Url)
+		if err != nil {
+			return peers, err
+		}
+		uPort, err := strconv.Atoi(u.Port())
+		if err != nil {
+			fmt.Println(err)
+		}
+		if (u.Hostname() == sys.Host.IPAddresses[0] || u.Hostname() == "localhost") && uPort == sys.Husk.ProtoPort[u.Scheme] {
+			continue
+		}
+		peers = append(peers, cs)
+	}
+	return peers, nil
+}
+
+// systemList lists the systems of the local cloud, with their profiles if the URL query parameter detailed=true is given
+func (ua *UnitAsset) systemList(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if r.URL.Query().Get("detailed") == "true" {
+			ua.systemProfiles(w)
+			return
+		}
+		systemsList, err := ua.store.ListSystems()
+		if err != nil {
+			fmt.Printf("system list error, %s", err)
+		}
+		usecases.HTTPProcessGetRequest(w, r, systemsList)
+	default:
+		fmt.Fprintf(w, "unsupported http request method")
+	}
+}
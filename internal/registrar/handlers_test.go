@@ -0,0 +1,116 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/systems/internal/scheduler"
+)
+
+// servingRegistrar returns a leading registrar on a storage backend, with its scheduler running until the end of the test
+func servingRegistrar(t *testing.T, store Store) *UnitAsset {
+	sched := scheduler.New()
+	go sched.Run()
+	t.Cleanup(sched.Stop)
+	return &UnitAsset{lead: &leadState{leading: true}, store: store, sched: sched, watchers: newWatchHub(), imported: newImportedRecords(),
+		stats: newRegistryMetrics(), limits: newLimiter(quotaConfig{})}
+}
+
+// serve sends a request with a JSON body (none if nil) to the service named by the first segment of the path and returns the response
+func serve(ua *UnitAsset, method, path string, body any) *httptest.ResponseRecorder {
+	var payload []byte
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+	r := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	service, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	ua.Serving(w, r, service)
+	return w
+}
+
+// brokenStore is a storage backend whose writes fail, like a journal on a full disk
+type brokenStore struct{ Store }
+
+var errDiskFull = errors.New("no space left on device")
+
+func (brokenStore) Register(rec *forms.ServiceRecord_v1) ([]forms.ServiceRecord_v1, error) {
+	return nil, errDiskFull
+}
+
+func (brokenStore) Extend(rec *forms.ServiceRecord_v1, now time.Time) error { return errDiskFull }
+
+func (brokenStore) Delete(id int) error { return errDiskFull }
+
+// TestStorageErrors checks that a change the storage backend fails to make is answered with an error and not announced
+func TestStorageErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		record func(stored forms.ServiceRecord_v1) any
+	}{
+		{"register", http.MethodPost, "/register", func(forms.ServiceRecord_v1) any {
+			rec := testRecord("thermo", "hall/temperature")
+			rec.Version = "ServiceRecord_v1"
+			return rec
+		}},
+		{"extend", http.MethodPut, "/register", func(stored forms.ServiceRecord_v1) any {
+			stored.Version = "ServiceRecord_v1"
+			return stored
+		}},
+		{"unregister", http.MethodDelete, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory := NewMemoryStore()
+			stored := testRecord("thermo", "kitchen/temperature")
+			if _, err := memory.Register(&stored); err != nil {
+				t.Fatal(err)
+			}
+			ua := servingRegistrar(t, brokenStore{memory})
+			id, notices := ua.watchers.subscribe(listingFilter{})
+			defer ua.watchers.unsubscribe(id)
+
+			path, body := tt.path, any(nil)
+			if tt.record != nil {
+				body = tt.record(stored)
+			} else {
+				path = fmt.Sprintf("/unregister/%d", stored.Id)
+			}
+			if w := serve(ua, tt.method, path, body); w.Code != http.StatusInternalServerError {
+				t.Errorf("status %d, want %d", w.Code, http.StatusInternalServerError)
+			}
+			select {
+			case notice := <-notices:
+				t.Errorf("the watchers were notified of the %s record %d", notice.Event, notice.Record.Id)
+			default:
+			}
+		})
+	}
+}
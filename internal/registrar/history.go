@@ -0,0 +1,180 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+//*********************Audit trail of the registry*********************
+
+// HistoryEvent is an entry of the append-only audit trail
+type HistoryEvent struct {
+	Id         int64  `json:"id"`
+	Time       string `json:"time"`
+	Event      string `json:"event"` // register, re-register, extend, unregister, expire, lead-taken or lead-lost
+	RecordId   int    `json:"registryID,omitempty"`
+	SystemName string `json:"systemName,omitempty"`
+	Definition string `json:"definition,omitempty"`
+	SubPath    string `json:"subpath,omitempty"`
+	SourceIP   string `json:"sourceIP,omitempty"`
+	Note       string `json:"note,omitempty"`
+}
+
+// historyList is the reply of the history service
+type historyList struct {
+	List    []HistoryEvent `json:"list"`
+	Version string         `json:"version"`
+}
+
+// HistoryFilter holds the URL query parameters of the history service, e.g.,
+// /history?system=ds18b20&definition=temperature&event=expire&from=2024-06-01T00:00:00Z&to=2024-06-02T00:00:00Z&limit=100&before=5230
+type HistoryFilter struct {
+	SystemName string
+	Definition string
+	Event      string
+	From       time.Time
+	To         time.Time
+	Limit      int
+	Before     int64 // only the events with a smaller id, e.g., the id of the last event of the previous page (0 if not set)
+	After      int64 // only the events with a larger id, e.g., the id of the newest event already seen (0 if not set)
+}
+
+// HistoryTimeFormat is RFC 3339 in UTC so that the stored times can be compared as text
+const HistoryTimeFormat = "2006-01-02T15:04:05Z"
+
+// sourceIP extracts the address of the requesting host
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// logEvent appends an event about a service record to the audit trail
+func logEvent(rsc *UnitAsset, event string, rec forms.ServiceRecord_v1, source, note string) {
+	rsc.stats.countEvent(event)
+	err := rsc.store.AppendEvent(HistoryEvent{
+		Time:       time.Now().UTC().Format(HistoryTimeFormat),
+		Event:      event,
+		RecordId:   rec.Id,
+		SystemName: rec.SystemName,
+		Definition: rec.ServiceDefinition,
+		SubPath:    rec.SubPath,
+		SourceIP:   source,
+		Note:       note,
+	})
+	if err != nil {
+		log.Printf("error logging the %s event: %v\n", event, err)
+	}
+}
+
+// logLeadership appends a change of the registrar's role to the audit trail
+func (ua *UnitAsset) logLeadership(event, note string) {
+	logEvent(ua, event, forms.ServiceRecord_v1{}, "", note)
+}
+
+// pruneHistory periodically deletes the events older than the retention period
+func pruneHistory(rsc *UnitAsset, retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := rsc.store.PruneEvents(time.Now().Add(-retention)); err != nil {
+			log.Printf("error pruning the registry history: %v\n", err)
+		}
+		<-ticker.C
+	}
+}
+
+// parseHistoryFilter extracts the history filter from the URL query parameters
+func parseHistoryFilter(query url.Values) (f HistoryFilter, err error) {
+	f.SystemName = query.Get("system")
+	f.Definition = query.Get("definition")
+	f.Event = query.Get("event")
+	if v := query.Get("from"); v != "" {
+		if f.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, fmt.Errorf("invalid from time: %w", err)
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if f.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, fmt.Errorf("invalid to time: %w", err)
+		}
+	}
+	f.Limit = 1000
+	if v := query.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 {
+			return f, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	if v := query.Get("before"); v != "" {
+		if f.Before, err = strconv.ParseInt(v, 10, 64); err != nil || f.Before <= 0 {
+			return f, fmt.Errorf("invalid before event id %q", v)
+		}
+	}
+	if v := query.Get("after"); v != "" {
+		if f.After, err = strconv.ParseInt(v, 10, 64); err != nil || f.After < 0 {
+			return f, fmt.Errorf("invalid after event id %q", v)
+		}
+	}
+	return f, nil
+}
+
+// reverseEvents puts a page of events read from the oldest one in the newest first order of the history service
+func reverseEvents(events []HistoryEvent) {
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+}
+
+// history responds (GET) with the events of the audit trail selected by system, definition, event type, time range and event ids, the newest first
+func (ua *UnitAsset) history(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		filter, err := parseHistoryFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events, err := ua.store.QueryEvents(filter)
+		if err != nil {
+			log.Printf("Error querying the registry history: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		payload, err := json.MarshalIndent(historyList{List: events, Version: "RegistryHistory_v1"}, "", "  ")
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(payload)
+	default:
+		http.Error(w, "Unsupported HTTP request method", http.StatusMethodNotAllowed)
+	}
+}
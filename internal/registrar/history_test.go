@@ -0,0 +1,31 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseHistoryFilterRejects(t *testing.T) {
+	for _, query := range []string{"before=0", "before=x", "after=-1", "limit=0", "from=yesterday"} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parseHistoryFilter(values); err == nil {
+			t.Errorf("the query %q was accepted", query)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/mbaigo/usecases"
+	"github.com/sdoque/systems/internal/negotiation"
+)
+
+//*********************Filtered and paginated listing of the registry*********************
+
+// listingFilter holds the URL query parameters of a GET request on the query service, e.g.,
+// /query?definition=temperature&system=ds18b20&details=Location:Kitchen&expiresBefore=2024-06-01T12:00:00Z&offset=0&limit=20
+// or with a query expression of the matching engine, e.g., /query?query=Unit=Celsius%20AND%20ACost<=5
+type listingFilter struct {
+	definition    string
+	systemName    string
+	details       map[string][]string // every key and value must be present in the record
+	matcher       *QuestMatcher       // query expression or service quest
+	expiresAfter  time.Time
+	expiresBefore time.Time
+	offset        int
+	limit         int // 0 means no limit
+}
+
+// parseListingFilter extracts the listing filter from the URL query parameters
+func parseListingFilter(query url.Values) (f listingFilter, err error) {
+	f.definition = query.Get("definition")
+	f.systemName = query.Get("system")
+	f.details = make(map[string][]string)
+	for _, kv := range query["details"] {
+		key, value, found := strings.Cut(kv, ":")
+		if !found || key == "" {
+			return f, fmt.Errorf("invalid details filter %q, expected key:value", kv)
+		}
+		f.details[key] = append(f.details[key], value)
+	}
+	if v := query.Get("query"); v != "" {
+		if f.matcher, err = CompileQuest("", map[string][]string{"Query": {v}}); err != nil {
+			return f, err
+		}
+	}
+	if v := query.Get("expiresAfter"); v != "" {
+		if f.expiresAfter, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, fmt.Errorf("invalid expiresAfter time: %w", err)
+		}
+	}
+	if v := query.Get("expiresBefore"); v != "" {
+		if f.expiresBefore, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, fmt.Errorf("invalid expiresBefore time: %w", err)
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if f.offset, err = strconv.Atoi(v); err != nil || f.offset < 0 {
+			return f, fmt.Errorf("invalid offset %q", v)
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if f.limit, err = strconv.Atoi(v); err != nil || f.limit < 0 {
+			return f, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	return f, nil
+}
+
+// matches checks if a service record passes the filter
+func (f listingFilter) matches(rec forms.ServiceRecord_v1) bool {
+	if f.definition != "" && rec.ServiceDefinition != f.definition {
+		return false
+	}
+	if f.systemName != "" && rec.SystemName != f.systemName {
+		return false
+	}
+	for key, values := range f.details {
+		for _, value := range values {
+			found := false
+			for _, recValue := range rec.Details[key] {
+				if recValue == value {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	if !f.matcher.Matches(rec) {
+		return false
+	}
+	if !f.expiresAfter.IsZero() || !f.expiresBefore.IsZero() {
+		expiration, err := time.Parse(time.RFC3339, rec.EndOfValidity)
+		if err != nil {
+			return false
+		}
+		if !f.expiresAfter.IsZero() && expiration.Before(f.expiresAfter) {
+			return false
+		}
+		if !f.expiresBefore.IsZero() && expiration.After(f.expiresBefore) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply filters the records, orders them by record id (for stable pages) and returns the requested page with the total number of matches
+func (f listingFilter) apply(records []forms.ServiceRecord_v1) (page []forms.ServiceRecord_v1, total int) {
+	matching := make([]forms.ServiceRecord_v1, 0, len(records))
+	for _, rec := range records {
+		if f.matches(rec) {
+			matching = append(matching, rec)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].Id < matching[j].Id })
+	total = len(matching)
+	if f.offset >= total {
+		return []forms.ServiceRecord_v1{}, total
+	}
+	end := total
+	if f.limit > 0 && f.offset+f.limit < total {
+		end = f.offset + f.limit
+	}
+	return matching[f.offset:end], total
+}
+
+// listingMediaType returns the machine-readable media type preferred in the Accept header, or an empty string for the HTML view.
+// The media ranges are weighed by their quality values and HTML wins a tie, so that a browser listing XML among its ranges gets the HTML view.
+func listingMediaType(r *http.Request) string {
+	switch negotiation.Prefer(r.Header.Get("Accept"), "text/html", "application/json", "application/xml", "text/xml") {
+	case "application/json":
+		return "application/json"
+	case "application/xml", "text/xml":
+		return "application/xml"
+	}
+	return ""
+}
+
+// sendListing responds with the page of records as a ServiceRecordList_v1 form
+func sendListing(w http.ResponseWriter, mediaType string, page []forms.ServiceRecord_v1, total int) {
+	var slForm forms.ServiceRecordList_v1
+	slForm.NewForm()
+	slForm.List = page
+	payload, err := usecases.Pack(&slForm, mediaType)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	w.WriteHeader(http.StatusOK)
+	w.Write(payload)
+}
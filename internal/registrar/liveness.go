@@ -0,0 +1,249 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+//*********************Liveness probing of the registered services*********************
+
+// A record stays valid until its end of validity even if its provider crashed right after renewing it.
+// When configured with a probe interval, the leading registrar probes the registered endpoints in the background
+// (HEAD on the service URL, or GET on the system's husk root if the service does not answer) and excludes
+// the services that failed the configured number of consecutive probes from the discovery results.
+
+// probeState is the outcome of the probes of a service record
+type probeState struct {
+	failures int       // consecutive failed probes
+	lastSeen time.Time // time of the last successful probe
+}
+
+// liveness keeps the probe state of the registered services (a nil liveness means that probing is disabled)
+type liveness struct {
+	mu        sync.Mutex
+	states    map[int]probeState
+	threshold int // consecutive failed probes before a service is unhealthy
+	client    *http.Client
+}
+
+// probeWorkers is the number of endpoints probed concurrently
+const probeWorkers = 8
+
+// newLiveness creates the probe state of the registry
+func newLiveness(threshold int, timeout time.Duration) *liveness {
+	if threshold <= 0 {
+		threshold = 3
+	}
+	return &liveness{
+		states:    make(map[int]probeState),
+		threshold: threshold,
+		client:    &http.Client{Timeout: timeout},
+	}
+}
+
+// healthy checks that a service has not failed too many consecutive probes (the services not yet probed are healthy)
+func (l *liveness) healthy(id int) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.states[id].failures < l.threshold
+}
+
+// filter removes the unhealthy services from a list of records
+func (l *liveness) filter(records []forms.ServiceRecord_v1) []forms.ServiceRecord_v1 {
+	if l == nil {
+		return records
+	}
+	healthy := make([]forms.ServiceRecord_v1, 0, len(records))
+	for _, rec := range records {
+		if l.healthy(rec.Id) {
+			healthy = append(healthy, rec)
+		}
+	}
+	return healthy
+}
+
+// describe presents the probe state of a service for the listing (empty if probing is disabled)
+func (l *liveness) describe(id int) string {
+	if l == nil {
+		return ""
+	}
+	l.mu.Lock()
+	state, probed := l.states[id]
+	l.mu.Unlock()
+	switch {
+	case !probed:
+		return "not yet probed"
+	case state.failures >= l.threshold:
+		return fmt.Sprintf("unhealthy (%d failed probes), last seen %s", state.failures, lastSeen(state))
+	default:
+		return "healthy, last seen " + lastSeen(state)
+	}
+}
+
+// lastSeen formats the time of the last successful probe
+func lastSeen(state probeState) string {
+	if state.lastSeen.IsZero() {
+		return "never"
+	}
+	return state.lastSeen.Format(time.RFC3339)
+}
+
+// annotate adds the probe state to copies of the records of a machine-readable listing as the details Liveness and LastSeen
+func (l *liveness) annotate(records []forms.ServiceRecord_v1) []forms.ServiceRecord_v1 {
+	if l == nil {
+		return records
+	}
+	annotated := make([]forms.ServiceRecord_v1, len(records))
+	for i, rec := range records {
+		details := make(map[string][]string, len(rec.Details)+2)
+		for key, values := range rec.Details {
+			details[key] = values
+		}
+		l.mu.Lock()
+		state, probed := l.states[rec.Id]
+		l.mu.Unlock()
+		switch {
+		case !probed:
+			details["Liveness"] = []string{"unknown"}
+		case state.failures >= l.threshold:
+			details["Liveness"] = []string{"unhealthy"}
+		default:
+			details["Liveness"] = []string{"healthy"}
+		}
+		if !state.lastSeen.IsZero() {
+			details["LastSeen"] = []string{state.lastSeen.Format(time.RFC3339)}
+		}
+		rec.Details = details
+		annotated[i] = rec
+	}
+	return annotated
+}
+
+// record updates the probe state of a service after a probe
+func (l *liveness) record(rec forms.ServiceRecord_v1, alive bool, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state := l.states[rec.Id]
+	if alive {
+		if state.failures >= l.threshold {
+			log.Printf("the service %s of %s (record %d) answers the probes again\n", rec.ServiceDefinition, rec.SystemName, rec.Id)
+		}
+		state.failures = 0
+		state.lastSeen = now
+	} else {
+		state.failures++
+		if state.failures == l.threshold {
+			log.Printf("the service %s of %s (record %d) failed %d consecutive probes and is excluded from the discovery\n", rec.ServiceDefinition, rec.SystemName, rec.Id, state.failures)
+		}
+	}
+	l.states[rec.Id] = state
+}
+
+// forget drops the probe state of the records no longer in the registry
+func (l *liveness) forget(records []forms.ServiceRecord_v1) {
+	current := make(map[int]bool, len(records))
+	for _, rec := range records {
+		current[rec.Id] = true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id := range l.states {
+		if !current[id] {
+			delete(l.states, id)
+		}
+	}
+}
+
+// probe checks if the provider of a service answers on one of its addresses
+func (l *liveness) probe(rec forms.ServiceRecord_v1) bool {
+	scheme, port := "http", rec.ProtoPort["http"]
+	if p, ok := rec.ProtoPort["https"]; ok && p != 0 {
+		scheme, port = "https", p
+	}
+	if port == 0 {
+		return true // the service cannot be probed over HTTP
+	}
+	for _, ip := range rec.IPAddresses {
+		root := scheme + "://" + ip + ":" + strconv.Itoa(port) + "/" + rec.SystemName + "/"
+		if l.answers(http.MethodHead, root+rec.SubPath) || l.answers(http.MethodGet, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// answers checks if an endpoint responds without a server error
+func (l *liveness) answers(method, url string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), l.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < http.StatusInternalServerError
+}
+
+// run probes the registered services at every interval while the registrar is leading
+func (l *liveness) run(interval time.Duration, leading func() bool, list func() ([]forms.ServiceRecord_v1, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !leading() {
+			continue
+		}
+		records, err := list()
+		if err != nil {
+			log.Printf("error listing the services to probe: %v\n", err)
+			continue
+		}
+		l.probeAll(records)
+	}
+}
+
+// probeAll probes the registered services once, probeWorkers at a time
+func (l *liveness) probeAll(records []forms.ServiceRecord_v1) {
+	l.forget(records)
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, probeWorkers)
+	for _, rec := range records {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(rec forms.ServiceRecord_v1) {
+			defer wg.Done()
+			l.record(rec, l.probe(rec), time.Now())
+			<-slots
+		}(rec)
+	}
+	wg.Wait()
+}
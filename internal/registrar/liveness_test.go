@@ -0,0 +1,150 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+// provider is the HTTP server of a system whose health is switched by the test
+type provider struct {
+	*httptest.Server
+	down atomic.Bool
+}
+
+func newProvider(t *testing.T) *provider {
+	p := new(provider)
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.down.Load() {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+// record returns the record of a service of the system at the provider's address
+func (p *provider) record(t *testing.T, system string) forms.ServiceRecord_v1 {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+	rec := testRecord(system, "kitchen/temperature")
+	rec.IPAddresses = []string{u.Hostname()}
+	rec.ProtoPort = map[string]int{"http": port}
+	return rec
+}
+
+// TestLivenessExclusion probes a healthy provider and one that fails, and checks the discovery and the listing after each round
+func TestLivenessExclusion(t *testing.T) {
+	const threshold = 3
+	ua := servingRegistrar(t, NewMemoryStore())
+	ua.probes = newLiveness(threshold, time.Second)
+	healthy, failing := newProvider(t), newProvider(t)
+	for _, rec := range []forms.ServiceRecord_v1{healthy.record(t, "thermo1"), failing.record(t, "thermo2")} {
+		if _, err := ua.store.Register(&rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failing.down.Store(true)
+
+	tests := []struct {
+		name       string
+		rounds     int
+		recovered  bool     // the failing provider answers again before the rounds
+		discovered []string // systems handed out by the query service
+		liveness   string   // state of the failing provider in the listing
+	}{
+		{"not yet probed", 0, false, []string{"thermo1", "thermo2"}, "unknown"},
+		{"below the threshold", threshold - 1, false, []string{"thermo1", "thermo2"}, "healthy"},
+		{"at the threshold", 1, false, []string{"thermo1"}, "unhealthy"},
+		{"beyond the threshold", 2, false, []string{"thermo1"}, "unhealthy"},
+		{"recovered", 1, true, []string{"thermo1", "thermo2"}, "healthy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.recovered {
+				failing.down.Store(false)
+			}
+			for i := 0; i < tt.rounds; i++ {
+				records, err := ua.store.List()
+				if err != nil {
+					t.Fatal(err)
+				}
+				ua.probes.probeAll(records)
+			}
+
+			w := serve(ua, http.MethodPost, "/query", forms.ServiceQuest_v1{ServiceDefinition: "temperature", Version: "ServiceQuest_v1"})
+			if w.Code != http.StatusOK {
+				t.Fatalf("the query answered %d: %s", w.Code, w.Body)
+			}
+			var discovered forms.ServiceRecordList_v1
+			if err := json.Unmarshal(w.Body.Bytes(), &discovered); err != nil {
+				t.Fatal(err)
+			}
+			systems := make([]string, 0, len(discovered.List))
+			for _, rec := range discovered.List {
+				systems = append(systems, rec.SystemName)
+			}
+			if !sameSystems(systems, tt.discovered) {
+				t.Errorf("discovered %v, want %v", systems, tt.discovered)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/query?system=thermo2", nil)
+			r.Header.Set("Accept", "application/json")
+			listing := httptest.NewRecorder()
+			ua.Serving(listing, r, "query")
+			var listed forms.ServiceRecordList_v1
+			if err := json.Unmarshal(listing.Body.Bytes(), &listed); err != nil {
+				t.Fatal(err)
+			}
+			if len(listed.List) != 1 {
+				t.Fatalf("%d records of thermo2 listed, want 1", len(listed.List))
+			}
+			if got := listed.List[0].Details["Liveness"]; len(got) != 1 || got[0] != tt.liveness {
+				t.Errorf("listed as %v, want %s", got, tt.liveness)
+			}
+		})
+	}
+}
+
+// sameSystems compares the names of the discovered systems regardless of their order
+func sameSystems(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	seen := make(map[string]bool, len(got))
+	for _, name := range got {
+		seen[name] = true
+	}
+	for _, name := range want {
+		if !seen[name] {
+			return false
+		}
+	}
+	return true
+}
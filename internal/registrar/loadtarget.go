@@ -0,0 +1,109 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/systems/internal/loadgen"
+	"github.com/sdoque/systems/internal/scheduler"
+)
+
+//*********************In-process target of the load generator*********************
+
+// LoadTarget is the registry of a leading registrar on a storage backend, which the load generator (internal/loadgen)
+// calls in process, without HTTP, in the load tests of the registrars (go test -run Load -load 1m)
+type LoadTarget struct{ ua *UnitAsset }
+
+// NewLoadTarget creates a leading registry on a storage backend and returns it with its cleanup function
+func NewLoadTarget(store Store) (*LoadTarget, func()) {
+	sched := scheduler.New()
+	go sched.Run()
+	ua := &UnitAsset{lead: &leadState{leading: true}, store: store, sched: sched, watchers: newWatchHub(), imported: newImportedRecords(), stats: newRegistryMetrics()}
+	return &LoadTarget{ua}, func() {
+		sched.Stop()
+		store.Close()
+	}
+}
+
+// registration returns the registration of a stored record
+func registration(rec forms.ServiceRecord_v1) loadgen.Registration {
+	end, _ := time.Parse(time.RFC3339, rec.EndOfValidity)
+	return loadgen.Registration{Id: rec.Id, EndOfValidity: end, Record: rec}
+}
+
+// Register registers the service of a simulated system
+func (lt *LoadTarget) Register(svc loadgen.Service) (loadgen.Registration, error) {
+	rec := forms.ServiceRecord_v1{
+		ServiceDefinition: svc.Definition,
+		SystemName:        svc.System,
+		IPAddresses:       []string{svc.Address},
+		ProtoPort:         map[string]int{"http": svc.Port},
+		Details:           map[string][]string{"Location": {svc.Location}},
+		SubPath:           svc.SubPath,
+		RegLife:           int(svc.RegLife.Seconds()),
+		Version:           "ServiceRecord_v1",
+	}
+	if _, err := registerService(lt.ua, &rec); err != nil {
+		return loadgen.Registration{}, err
+	}
+	return registration(rec), nil
+}
+
+// Renew extends the validity of a registration
+func (lt *LoadTarget) Renew(svc loadgen.Service, reg loadgen.Registration) (loadgen.Registration, error) {
+	rec := reg.Record.(forms.ServiceRecord_v1)
+	if err := extendServiceValidity(lt.ua, &rec); err != nil {
+		return reg, err
+	}
+	return registration(rec), nil
+}
+
+// Unregister deletes a registration
+func (lt *LoadTarget) Unregister(reg loadgen.Registration) error {
+	lt.ua.sched.Cancel(reg.Id)
+	return lt.ua.store.Delete(reg.Id)
+}
+
+// Quest runs a query or a listing of the registry
+func (lt *LoadTarget) Quest(op string, q loadgen.Quest) error {
+	switch op {
+	case "query":
+		_, err := findServices(lt.ua, forms.ServiceQuest_v1{ServiceDefinition: q.Definition, Details: map[string][]string{"Location": {q.Location}}})
+		return err
+	case "list":
+		records, err := lt.ua.store.List()
+		if err == nil {
+			listingFilter{definition: q.Definition, limit: 20}.apply(records)
+		}
+		return err
+	default:
+		return fmt.Errorf("the %s quest needs an orchestrator, which is not run in process", op)
+	}
+}
+
+// Records returns the ids of the records of a system
+func (lt *LoadTarget) Records(system string) ([]int, error) {
+	records, err := lt.ua.store.RecordsOf(system, "")
+	ids := make([]int, 0, len(records))
+	for _, rec := range records {
+		ids = append(ids, rec.Id)
+	}
+	return ids, err
+}
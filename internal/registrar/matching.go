@@ -0,0 +1,64 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/systems/internal/matching"
+)
+
+//*********************Service quest matching*********************
+
+// The quests are matched by the engine of the internal/matching package, which documents the quest language.
+// The backends narrow the candidates as they can (e.g., the indexes of esr) and check them with Matches.
+
+// errInvalidQuest is returned when a service quest cannot be compiled into a matcher
+var errInvalidQuest = matching.ErrInvalidQuest
+
+// QuestMatcher is the compiled form of a service quest
+type QuestMatcher struct {
+	*matching.Matcher
+}
+
+// CompileQuest compiles the service definition and the details of a service quest
+func CompileQuest(definition string, details map[string][]string) (*QuestMatcher, error) {
+	m, err := matching.Compile(definition, details)
+	if err != nil {
+		return nil, err
+	}
+	return &QuestMatcher{m}, nil
+}
+
+// Matches checks a service record against the compiled quest (a nil matcher accepts every record)
+func (m *QuestMatcher) Matches(rec forms.ServiceRecord_v1) bool {
+	if m == nil {
+		return true
+	}
+	return m.Matcher.Matches(matchingRecord(rec))
+}
+
+// matchingRecord gives the matching engine the fields of a service record
+func matchingRecord(rec forms.ServiceRecord_v1) matching.Record {
+	return matching.Record{
+		Definition: rec.ServiceDefinition,
+		SystemName: rec.SystemName,
+		SubPath:    rec.SubPath,
+		ACost:      rec.ACost,
+		CUnit:      rec.CUnit,
+		Details:    rec.Details,
+	}
+}
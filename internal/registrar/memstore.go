@@ -0,0 +1,342 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+//*********************In-memory storage backend*********************
+
+// MemoryStore keeps the registry in a map; nothing survives a restart
+type MemoryStore struct {
+	EventLog
+	mu      sync.RWMutex
+	records map[int]forms.ServiceRecord_v1
+	nextId  int
+}
+
+// NewMemoryStore creates an empty registry
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[int]forms.ServiceRecord_v1), nextId: 1} // 0 is used for non registered services
+}
+
+// insert stores a complete record and deletes the previous records of the same service (the lock is held by the caller)
+func (m *MemoryStore) insert(rec *forms.ServiceRecord_v1) (replaced []forms.ServiceRecord_v1) {
+	for id, old := range m.records {
+		if id != rec.Id && SameService(old, *rec) {
+			delete(m.records, id)
+			replaced = append(replaced, old)
+		}
+	}
+	if rec.Id == 0 {
+		for {
+			if _, exists := m.records[m.nextId]; !exists {
+				break
+			}
+			m.nextId++
+		}
+		rec.Id = m.nextId
+		m.nextId++
+	} else if rec.Id >= m.nextId {
+		m.nextId = rec.Id + 1 // so that a promoted registrar does not reuse the id
+	}
+	m.records[rec.Id] = *rec
+	return replaced
+}
+
+// Register stores a complete record and deletes the previous records of the same service
+func (m *MemoryStore) Register(rec *forms.ServiceRecord_v1) ([]forms.ServiceRecord_v1, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.insert(rec), nil
+}
+
+// renew extends the validity of an existing record if it matches the stored one (the lock is held by the caller)
+func (m *MemoryStore) renew(rec *forms.ServiceRecord_v1, now time.Time) bool {
+	stored, exists := m.records[rec.Id]
+	if !exists || !SameCreation(*rec, stored) || stored.SystemName != rec.SystemName || stored.ServiceDefinition != rec.ServiceDefinition || stored.SubPath != rec.SubPath {
+		return false
+	}
+	rec.RegLife = stored.RegLife
+	rec.Updated = now.Format(time.RFC3339)
+	rec.EndOfValidity = now.Add(time.Duration(stored.RegLife) * time.Second).Format(time.RFC3339)
+	stored.Updated = rec.Updated
+	stored.EndOfValidity = rec.EndOfValidity
+	m.records[rec.Id] = stored
+	return true
+}
+
+// Extend renews an existing record and updates its validity
+func (m *MemoryStore) Extend(rec *forms.ServiceRecord_v1, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.renew(rec, now) {
+		return ErrUnknownRecord
+	}
+	return nil
+}
+
+// SetValidity applies the validity of a renewal made by the leading registrar
+func (m *MemoryStore) SetValidity(id int, updated, endOfValidity string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, exists := m.records[id]
+	if !exists {
+		return false, nil
+	}
+	stored.Updated = updated
+	stored.EndOfValidity = endOfValidity
+	m.records[id] = stored
+	return true, nil
+}
+
+// Delete removes a record
+func (m *MemoryStore) Delete(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, id)
+	return nil
+}
+
+// Expire removes a record whose validity ended before now
+func (m *MemoryStore) Expire(id int, now time.Time) (*forms.ServiceRecord_v1, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, exists := m.records[id]
+	if !exists {
+		return nil, nil
+	}
+	expiration, err := time.Parse(time.RFC3339, rec.EndOfValidity)
+	if err != nil {
+		return nil, err
+	}
+	if !now.After(expiration) {
+		return nil, nil // renewed in the meantime
+	}
+	delete(m.records, id)
+	return &rec, nil
+}
+
+// Get retrieves a record
+func (m *MemoryStore) Get(id int) (*forms.ServiceRecord_v1, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rec, exists := m.records[id]
+	if !exists {
+		return nil, ErrUnknownRecord
+	}
+	return &rec, nil
+}
+
+// Find returns the records with the service definition that pass the matcher
+func (m *MemoryStore) Find(definition string, matcher *QuestMatcher) ([]forms.ServiceRecord_v1, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var serviceRecords []forms.ServiceRecord_v1
+	for _, rec := range m.records {
+		if rec.ServiceDefinition == definition && matcher.Matches(rec) {
+			serviceRecords = append(serviceRecords, rec)
+		}
+	}
+	return serviceRecords, nil
+}
+
+// List returns all the records
+func (m *MemoryStore) List() ([]forms.ServiceRecord_v1, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	records := make([]forms.ServiceRecord_v1, 0, len(m.records))
+	for _, rec := range m.records {
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// RecordsOf returns the records of a system and those announcing an IP address
+func (m *MemoryStore) RecordsOf(system, ip string) ([]forms.ServiceRecord_v1, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var records []forms.ServiceRecord_v1
+	for _, rec := range m.records {
+		if rec.SystemName == system || announces(rec, ip) {
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+// ListSystems returns the systems that have registered services with the http protocol
+func (m *MemoryStore) ListSystems() (*forms.SystemRecordList_v1, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	records := make([]forms.ServiceRecord_v1, 0, len(m.records))
+	for _, rec := range m.records {
+		records = append(records, rec)
+	}
+	return SystemList(records), nil
+}
+
+// SystemList gathers the systems of the records that have the http protocol with their IP addresses
+func SystemList(records []forms.ServiceRecord_v1) *forms.SystemRecordList_v1 {
+	uniqueSystems := make(map[string]forms.SystemRecord_v1)
+	for _, rec := range records {
+		port, ok := rec.ProtoPort["http"]
+		if !ok {
+			continue
+		}
+		sysRec, exists := uniqueSystems[rec.SystemName]
+		if !exists {
+			sysRec = forms.SystemRecord_v1{SystemName: rec.SystemName, Port: port, Version: "SystemRecord_v1"}
+		}
+		for _, ipAddress := range rec.IPAddresses {
+			ipExists := false
+			for _, existingIP := range sysRec.IPAddresses {
+				if existingIP == ipAddress {
+					ipExists = true
+					break
+				}
+			}
+			if !ipExists {
+				sysRec.IPAddresses = append(sysRec.IPAddresses, ipAddress)
+			}
+		}
+		uniqueSystems[rec.SystemName] = sysRec
+	}
+
+	systemList := make([]forms.SystemRecord_v1, 0, len(uniqueSystems))
+	for _, sysRec := range uniqueSystems {
+		systemList = append(systemList, sysRec)
+	}
+	return &forms.SystemRecordList_v1{
+		List:    systemList,
+		Version: "SystemRecordList_v1",
+	}
+}
+
+// StoreBatch registers or renews the records of a system at once
+func (m *MemoryStore) StoreBatch(records []forms.ServiceRecord_v1, replace bool, now time.Time) (renewed []bool, retired []forms.ServiceRecord_v1, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	renewed = make([]bool, len(records))
+	kept := make(map[int]bool)
+	for i := range records {
+		rec := &records[i]
+		if rec.Id != 0 {
+			renewed[i] = m.renew(rec, now)
+		}
+		if !renewed[i] {
+			rec.Id = 0
+			rec.Created = now.Format(time.RFC3339)
+			rec.Updated = now.Format(time.RFC3339)
+			rec.EndOfValidity = now.Add(time.Duration(rec.RegLife) * time.Second).Format(time.RFC3339)
+			retired = append(retired, m.insert(rec)...)
+		}
+		kept[rec.Id] = true
+	}
+	if replace {
+		for id, old := range m.records {
+			if old.SystemName == records[0].SystemName && !kept[id] {
+				delete(m.records, id)
+				retired = append(retired, old)
+			}
+		}
+	}
+	return renewed, retired, nil
+}
+
+// Reload has nothing to do since nothing is inherited from a previous run
+func (m *MemoryStore) Reload(now time.Time) ([]forms.ServiceRecord_v1, error) {
+	return nil, nil
+}
+
+// Unconfirmed returns no record since nothing is inherited from a previous run
+func (m *MemoryStore) Unconfirmed() (map[int]bool, error) {
+	return make(map[int]bool), nil
+}
+
+// Close releases nothing
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// EventLog keeps the audit trail in memory for the MemoryStore and the other backends without a database (e.g., the journaled store of esr)
+type EventLog struct {
+	mu        sync.RWMutex
+	events    []HistoryEvent
+	nextEvent int64
+}
+
+// AppendEvent appends an event to the audit trail
+func (l *EventLog) AppendEvent(e HistoryEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nextEvent++
+	e.Id = l.nextEvent
+	l.events = append(l.events, e)
+	return nil
+}
+
+// QueryEvents retrieves the events of the audit trail that pass the filter, the newest first.
+// With an after id, the page holds the events right after it (the oldest ones of the range), still the newest first.
+func (l *EventLog) QueryEvents(f HistoryFilter) ([]HistoryEvent, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	events := make([]HistoryEvent, 0)
+	for k := range l.events {
+		if len(events) >= f.Limit {
+			break
+		}
+		e := l.events[len(l.events)-1-k] // the events are appended in the order of their ids
+		if f.After > 0 {
+			e = l.events[k]
+		}
+		if (f.Before > 0 && e.Id >= f.Before) || (f.After > 0 && e.Id <= f.After) {
+			continue
+		}
+		if (f.SystemName != "" && e.SystemName != f.SystemName) || (f.Definition != "" && e.Definition != f.Definition) || (f.Event != "" && e.Event != f.Event) {
+			continue
+		}
+		if !f.From.IsZero() && e.Time < f.From.UTC().Format(HistoryTimeFormat) {
+			continue
+		}
+		if !f.To.IsZero() && e.Time > f.To.UTC().Format(HistoryTimeFormat) {
+			continue
+		}
+		events = append(events, e)
+	}
+	if f.After > 0 {
+		reverseEvents(events)
+	}
+	return events, nil
+}
+
+// PruneEvents drops the events older than the cutoff time
+func (l *EventLog) PruneEvents(before time.Time) error {
+	cutoff := before.UTC().Format(HistoryTimeFormat)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := 0
+	for i < len(l.events) && l.events[i].Time < cutoff {
+		i++
+	}
+	l.events = append([]HistoryEvent(nil), l.events[i:]...)
+	return nil
+}
@@ -0,0 +1,206 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/systems/internal/scheduler"
+)
+
+//*********************Prometheus metrics of the registry*********************
+
+// The metrics service presents the load and the churn of the registry in the Prometheus text format (version 0.0.4),
+// e.g., scraped at /serviceregistrar/registry/metrics. The counters start at zero when the registrar starts.
+
+// queryBuckets are the upper bounds (in seconds) of the histogram of the discovery query latencies
+var queryBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// registryMetrics counts the registry events, the discovery queries and the leadership transitions
+type registryMetrics struct {
+	mu          sync.Mutex
+	events      map[string]uint64 // register, re-register, extend, unregister and expire events
+	transitions map[string]uint64 // lead-taken and lead-lost transitions
+	queries     uint64
+	queryErrors uint64
+	buckets     []uint64 // query latencies per bucket of queryBuckets (the last one is +Inf)
+	latencySum  float64
+}
+
+// newRegistryMetrics creates the counters of the registry
+func newRegistryMetrics() *registryMetrics {
+	return &registryMetrics{
+		events:      make(map[string]uint64),
+		transitions: make(map[string]uint64),
+		buckets:     make([]uint64, len(queryBuckets)+1),
+	}
+}
+
+// countEvent counts a registry event or a leadership transition (see the audit trail in history.go)
+func (m *registryMetrics) countEvent(event string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if strings.HasPrefix(event, "lead-") {
+		m.transitions[event]++
+		return
+	}
+	m.events[event]++
+}
+
+// observeQuery counts a discovery query with its latency
+func (m *registryMetrics) observeQuery(latency time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	seconds := latency.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queries++
+	if err != nil {
+		m.queryErrors++
+	}
+	m.latencySum += seconds
+	i := sort.SearchFloat64s(queryBuckets, seconds)
+	m.buckets[i]++
+}
+
+// registryState is the state of the registrar at the time of a scrape
+type registryState struct {
+	records   []forms.ServiceRecord_v1
+	scheduler scheduler.Metrics
+	leading   bool
+	term      int64
+}
+
+// write presents the metrics in the Prometheus text format
+func (m *registryMetrics) write(buf *bytes.Buffer, state registryState) {
+	byDefinition := make(map[string]uint64)
+	bySystem := make(map[string]uint64)
+	for _, rec := range state.records {
+		byDefinition[rec.ServiceDefinition]++
+		bySystem[rec.SystemName]++
+	}
+	writeHeader(buf, "registrar_records", "gauge", "Number of service records in the registry.")
+	fmt.Fprintf(buf, "registrar_records %d\n", len(state.records))
+	writeHeader(buf, "registrar_records_by_definition", "gauge", "Number of service records per service definition.")
+	writeLabeled(buf, "registrar_records_by_definition", "definition", byDefinition)
+	writeHeader(buf, "registrar_records_by_system", "gauge", "Number of service records per system.")
+	writeLabeled(buf, "registrar_records_by_system", "system", bySystem)
+
+	m.mu.Lock()
+	events := make(map[string]uint64, 5)
+	for _, event := range []string{"register", "re-register", "extend", "unregister", "expire"} {
+		events[event] = m.events[event]
+	}
+	transitions := map[string]uint64{"lead-taken": m.transitions["lead-taken"], "lead-lost": m.transitions["lead-lost"]}
+	queries, queryErrors, latencySum := m.queries, m.queryErrors, m.latencySum
+	buckets := append([]uint64(nil), m.buckets...)
+	m.mu.Unlock()
+
+	writeHeader(buf, "registrar_events_total", "counter", "Registrations, re-registrations, renewals, unregistrations and expirations.")
+	writeLabeled(buf, "registrar_events_total", "event", events)
+	writeHeader(buf, "registrar_queries_total", "counter", "Discovery queries of the Orchestrator.")
+	fmt.Fprintf(buf, "registrar_queries_total %d\n", queries)
+	writeHeader(buf, "registrar_query_errors_total", "counter", "Discovery queries that failed.")
+	fmt.Fprintf(buf, "registrar_query_errors_total %d\n", queryErrors)
+	writeHeader(buf, "registrar_query_duration_seconds", "histogram", "Latency of the discovery queries.")
+	var cumulative uint64
+	for i, bound := range queryBuckets {
+		cumulative += buckets[i]
+		fmt.Fprintf(buf, "registrar_query_duration_seconds_bucket{le=\"%g\"} %d\n", bound, cumulative)
+	}
+	cumulative += buckets[len(queryBuckets)]
+	fmt.Fprintf(buf, "registrar_query_duration_seconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+	fmt.Fprintf(buf, "registrar_query_duration_seconds_sum %g\n", latencySum)
+	fmt.Fprintf(buf, "registrar_query_duration_seconds_count %d\n", cumulative)
+
+	writeHeader(buf, "registrar_scheduler_queue_length", "gauge", "Expiration checks waiting in the scheduler.")
+	fmt.Fprintf(buf, "registrar_scheduler_queue_length %d\n", state.scheduler.QueueLength)
+	writeHeader(buf, "registrar_scheduler_lag_seconds", "gauge", "Delay between the deadline and the execution of the last expiration check.")
+	fmt.Fprintf(buf, "registrar_scheduler_lag_seconds %g\n", state.scheduler.Lag.Seconds())
+	writeHeader(buf, "registrar_scheduler_max_lag_seconds", "gauge", "Largest delay of an expiration check.")
+	fmt.Fprintf(buf, "registrar_scheduler_max_lag_seconds %g\n", state.scheduler.MaxLag.Seconds())
+	writeHeader(buf, "registrar_scheduler_executed_total", "counter", "Expiration checks executed.")
+	fmt.Fprintf(buf, "registrar_scheduler_executed_total %d\n", state.scheduler.Executed)
+
+	leading := 0
+	if state.leading {
+		leading = 1
+	}
+	writeHeader(buf, "registrar_leading", "gauge", "1 if this registrar is the leading registrar, 0 if it is on standby.")
+	fmt.Fprintf(buf, "registrar_leading %d\n", leading)
+	writeHeader(buf, "registrar_election_term", "gauge", "Current term of the leader election.")
+	fmt.Fprintf(buf, "registrar_election_term %d\n", state.term)
+	writeHeader(buf, "registrar_leadership_transitions_total", "counter", "Leadership taken or lost by this registrar.")
+	writeLabeled(buf, "registrar_leadership_transitions_total", "transition", transitions)
+}
+
+// writeHeader writes the help and type lines of a metric
+func writeHeader(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeLabeled writes the samples of a metric with one label, sorted by label value
+func writeLabeled(buf *bytes.Buffer, name, label string, values map[string]uint64) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(buf, "%s{%s=\"%s\"} %d\n", name, label, labelEscaper.Replace(key), values[key])
+	}
+}
+
+// labelEscaper escapes the label values as required by the text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// exportMetrics presents (GET) the metrics of the registrar in the Prometheus text format
+func (ua *UnitAsset) exportMetrics(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		records, err := ua.store.List()
+		if err != nil {
+			log.Printf("Error retrieving service records: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		var buf bytes.Buffer
+		ua.stats.write(&buf, registryState{
+			records:   records,
+			scheduler: ua.sched.Metrics(),
+			leading:   ua.isLeading(),
+			term:      ua.election.currentTerm(),
+		})
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf.Bytes())
+	default:
+		http.Error(w, "Unsupported HTTP request method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,102 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+// TestMetricsExport drives a registrar through registrations, queries and a leadership transition and checks the samples of its metrics
+func TestMetricsExport(t *testing.T) {
+	const self = "http://192.168.1.2:20102/serviceregistrar/registry"
+	ua := servingRegistrar(t, NewMemoryStore())
+	ua.election = electionRegistrar(self, "leader", self, nil, &fakeClock{now: time.Now()}).election
+	ua.lead = &leadState{}
+	ua.setLeader(self)
+
+	register := func(rec forms.ServiceRecord_v1) forms.ServiceRecord_v1 {
+		rec.Version = "ServiceRecord_v1"
+		w := serve(ua, http.MethodPost, "/register", rec)
+		if w.Code != http.StatusOK {
+			t.Fatalf("registration answered %d: %s", w.Code, w.Body)
+		}
+		var stored forms.ServiceRecord_v1
+		if err := json.Unmarshal(w.Body.Bytes(), &stored); err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+	kitchen := register(testRecord("thermo", "kitchen/temperature"))
+	register(testRecord("thermo", "hall/temperature"))
+	pressure := testRecord("baro", "roof/pressure")
+	pressure.ServiceDefinition = "pressure"
+	register(pressure)
+	register(kitchen) // renewed
+	attic := register(testRecord("thermo", "attic/temperature"))
+	if w := serve(ua, http.MethodDelete, fmt.Sprintf("/unregister/%d", attic.Id), nil); w.Code != http.StatusOK {
+		t.Fatalf("unregistration answered %d", w.Code)
+	}
+	serve(ua, http.MethodPost, "/query", forms.ServiceQuest_v1{ServiceDefinition: "temperature", Version: "ServiceQuest_v1"})
+	serve(ua, http.MethodPost, "/query", forms.ServiceQuest_v1{ServiceDefinition: "temperature", Details: map[string][]string{"Query": {"Unit=("}}, Version: "ServiceQuest_v1"})
+
+	w := serve(ua, http.MethodGet, "/metrics", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics answered %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q, want the Prometheus text format", ct)
+	}
+	samples := make(map[string]string)
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if name, value, ok := strings.Cut(line, " "); ok && !strings.HasPrefix(line, "#") {
+			samples[name] = value
+		}
+	}
+	for _, want := range []struct{ sample, value string }{
+		{"registrar_records", "3"},
+		{`registrar_records_by_definition{definition="temperature"}`, "2"},
+		{`registrar_records_by_definition{definition="pressure"}`, "1"},
+		{`registrar_records_by_system{system="thermo"}`, "2"},
+		{`registrar_records_by_system{system="baro"}`, "1"},
+		{`registrar_events_total{event="register"}`, "4"},
+		{`registrar_events_total{event="extend"}`, "1"},
+		{`registrar_events_total{event="unregister"}`, "1"},
+		{`registrar_events_total{event="expire"}`, "0"},
+		{"registrar_queries_total", "2"},
+		{"registrar_query_errors_total", "1"},
+		{`registrar_query_duration_seconds_bucket{le="+Inf"}`, "2"},
+		{"registrar_query_duration_seconds_count", "2"},
+		{"registrar_scheduler_queue_length", "3"},
+		{"registrar_leading", "1"},
+		{"registrar_election_term", "1"},
+		{`registrar_leadership_transitions_total{transition="lead-taken"}`, "1"},
+		{`registrar_leadership_transitions_total{transition="lead-lost"}`, "0"},
+	} {
+		if got, ok := samples[want.sample]; !ok {
+			t.Errorf("no sample %s", want.sample)
+		} else if got != want.value {
+			t.Errorf("%s is %s, want %s", want.sample, got, want.value)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+//*********************Registration rate limits and quotas*********************
+
+// A misconfigured system in a tight loop could fill the registry, since every registration without id creates a record.
+// The new registrations (not the renewals) of a system and of a source IP are therefore limited by token buckets,
+// and the number of their live records by a quota. The requests over the limits are answered with 429 Too Many Requests
+// and a Retry-After header, and those that exceed the burst or the quota on their own with 413 Request Entity Too Large.
+// The registration life is raised to the configured minimum.
+// The buckets of the systems and of the sources that stopped registering are evicted once they are full again.
+
+// bucketIdle is the time after which an unused bucket that is full again is evicted
+const bucketIdle = 10 * time.Minute
+
+// quotaConfig holds the limits applied to each system and to each source IP (0 means no limit)
+type quotaConfig struct {
+	RatePerMinute float64 `json:"ratePerMinute"` // new registrations per minute
+	Burst         int     `json:"burst"`         // new registrations allowed at once (the rate per minute if 0)
+	MaxRecords    int     `json:"maxRecords"`    // live records
+	MinRegLife    int     `json:"minRegLife"`    // shortest registration life in seconds
+}
+
+// bucket is the token bucket of a system or of a source IP
+type bucket struct {
+	tokens     float64
+	last       time.Time
+	registered uint64 // new registrations admitted
+	rejected   uint64 // requests rejected for exceeding the limits
+}
+
+// limiter applies the quotas to the registrations
+type limiter struct {
+	mu        sync.Mutex
+	admission sync.Mutex // serializes the count of the live records with the storage of the admitted ones
+	config    quotaConfig
+	systems   map[string]*bucket
+	sources   map[string]*bucket
+	swept     time.Time // last eviction of the idle buckets
+}
+
+// newLimiter creates the limiter of the registrations
+func newLimiter(config quotaConfig) *limiter {
+	if config.Burst <= 0 {
+		config.Burst = int(math.Max(1, math.Ceil(config.RatePerMinute)))
+	}
+	return &limiter{config: config, systems: make(map[string]*bucket), sources: make(map[string]*bucket)}
+}
+
+// clampRegLife raises the registration life of a record to the configured minimum
+func (l *limiter) clampRegLife(rec *forms.ServiceRecord_v1) {
+	if rec.RegLife < l.config.MinRegLife {
+		log.Printf("the registration life of %s from system %s is raised from %d to %d seconds\n", rec.ServiceDefinition, rec.SystemName, rec.RegLife, l.config.MinRegLife)
+		rec.RegLife = l.config.MinRegLife
+	}
+}
+
+// refill returns the bucket of a name with the tokens accumulated since its last use (the lock is held by the caller)
+func (l *limiter) refill(buckets map[string]*bucket, name string, now time.Time) *bucket {
+	b, exists := buckets[name]
+	if !exists {
+		b = &bucket{tokens: float64(l.config.Burst), last: now}
+		buckets[name] = b
+	}
+	b.tokens = l.available(b, now)
+	b.last = now
+	return b
+}
+
+// available returns the tokens of a bucket at a time, without using them
+func (l *limiter) available(b *bucket, now time.Time) float64 {
+	return math.Min(float64(l.config.Burst), b.tokens+now.Sub(b.last).Minutes()*l.config.RatePerMinute)
+}
+
+// evict drops the buckets unused for bucketIdle that are full again, since a new bucket would be the same but for its counters,
+// so that the systems and the sources that stopped registering do not accumulate (the lock is held by the caller)
+func (l *limiter) evict(now time.Time) {
+	if now.Sub(l.swept) < bucketIdle {
+		return
+	}
+	l.swept = now
+	for _, buckets := range []map[string]*bucket{l.systems, l.sources} {
+		for name, b := range buckets {
+			if now.Sub(b.last) >= bucketIdle && l.available(b, now) >= float64(l.config.Burst) {
+				delete(buckets, name)
+			}
+		}
+	}
+}
+
+// hold serializes the admissions with the storage of the admitted records while the number of records is limited,
+// so that concurrent registrations cannot all pass the count; the returned function releases the admission
+func (l *limiter) hold() func() {
+	if l.config.MaxRecords <= 0 {
+		return func() {}
+	}
+	l.admission.Lock()
+	return l.admission.Unlock
+}
+
+// rejection explains why new registrations are refused
+type rejection struct {
+	status     int           // 429 Too Many Requests, or 413 Request Entity Too Large when retrying the same request cannot help
+	retryAfter time.Duration // time to wait before retrying (429 only)
+	reason     string
+}
+
+// admit checks the new registrations of a system from a source IP against the quotas and returns nil if they are admitted.
+// Only the records of the system and of the source are read, and only if the number of records is limited.
+func (l *limiter) admit(source string, incoming []forms.ServiceRecord_v1, recordsOf func(system, ip string) ([]forms.ServiceRecord_v1, error), now time.Time) *rejection {
+	if len(incoming) == 0 {
+		return nil
+	}
+	system := incoming[0].SystemName
+	if l.config.MaxRecords > 0 {
+		if len(incoming) > l.config.MaxRecords {
+			l.reject(system, source, now)
+			return &rejection{status: http.StatusRequestEntityTooLarge, reason: fmt.Sprintf("%d records at once exceed the quota of %d live records per system and per source", len(incoming), l.config.MaxRecords)}
+		}
+		records, err := recordsOf(system, source)
+		if err != nil {
+			log.Printf("error counting the records of %s: %v\n", system, err)
+		}
+		systemCount, sourceCount := len(incoming), len(incoming)
+		var earliest time.Time // first record of the system or of the source to expire
+		for _, rec := range records {
+			replaced := false
+			for _, in := range incoming {
+				if SameService(rec, in) {
+					replaced = true // a re-registration replaces the record
+				}
+			}
+			if replaced {
+				continue
+			}
+			if rec.SystemName == system {
+				systemCount++
+			}
+			if announces(rec, source) {
+				sourceCount++
+			}
+			if expiration, err := time.Parse(time.RFC3339, rec.EndOfValidity); err == nil && (earliest.IsZero() || expiration.Before(earliest)) {
+				earliest = expiration
+			}
+		}
+		if systemCount > l.config.MaxRecords || sourceCount > l.config.MaxRecords {
+			l.reject(system, source, now)
+			retryAfter := time.Minute // the validity of the records is unknown
+			if !earliest.IsZero() {
+				retryAfter = earliest.Sub(now)
+			}
+			return &rejection{status: http.StatusTooManyRequests, retryAfter: retryAfter, reason: fmt.Sprintf("more than %d live records for system %s or source %s", l.config.MaxRecords, system, source)}
+		}
+	}
+	if l.config.RatePerMinute <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.evict(now)
+	bs := l.refill(l.systems, system, now)
+	bi := l.refill(l.sources, source, now)
+	needed := float64(len(incoming))
+	if needed > float64(l.config.Burst) {
+		bs.rejected++
+		bi.rejected++
+		return &rejection{status: http.StatusRequestEntityTooLarge, reason: fmt.Sprintf("%d new registrations at once exceed the burst of %d, they must be sent in batches of at most %d records", len(incoming), l.config.Burst, l.config.Burst)}
+	}
+	if bs.tokens < needed || bi.tokens < needed {
+		bs.rejected++
+		bi.rejected++
+		missing := needed - math.Min(bs.tokens, bi.tokens)
+		return &rejection{status: http.StatusTooManyRequests, retryAfter: time.Duration(missing / l.config.RatePerMinute * float64(time.Minute)), reason: fmt.Sprintf("more than %g registrations per minute for system %s or source %s", l.config.RatePerMinute, system, source)}
+	}
+	bs.tokens -= needed
+	bi.tokens -= needed
+	bs.registered += uint64(len(incoming))
+	bi.registered += uint64(len(incoming))
+	return nil
+}
+
+// reject counts a rejected request
+func (l *limiter) reject(system, source string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.evict(now)
+	l.refill(l.systems, system, now).rejected++
+	l.refill(l.sources, source, now).rejected++
+}
+
+// announces checks if a record has the IP address
+func announces(rec forms.ServiceRecord_v1, ip string) bool {
+	for _, address := range rec.IPAddresses {
+		if address == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// tooManyRequests answers a request over the quotas
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration, reason string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too Many Requests: "+reason, http.StatusTooManyRequests)
+}
+
+// withinQuotas admits the new registrations among the records, i.e., those without id or whose record is unknown
+// (the renewals are not limited), or answers 429 Too Many Requests (413 Request Entity Too Large if the request can never be admitted).
+// It returns the function to call once the admitted records are stored, or nil if the request was refused.
+func (ua *UnitAsset) withinQuotas(w http.ResponseWriter, r *http.Request, records []forms.ServiceRecord_v1, known func(id int) bool) (release func()) {
+	var fresh []forms.ServiceRecord_v1
+	for _, rec := range records {
+		if rec.Id == 0 || !known(rec.Id) {
+			fresh = append(fresh, rec)
+		}
+	}
+	release = ua.limits.hold()
+	refused := ua.limits.admit(sourceIP(r), fresh, ua.store.RecordsOf, time.Now())
+	if refused == nil {
+		return release
+	}
+	release()
+	log.Printf("registration from %s rejected: %s\n", sourceIP(r), refused.reason)
+	if refused.status == http.StatusRequestEntityTooLarge {
+		http.Error(w, "Request Entity Too Large: "+refused.reason, http.StatusRequestEntityTooLarge)
+		return nil
+	}
+	tooManyRequests(w, refused.retryAfter, refused.reason)
+	return nil
+}
+
+// quotaUsage is the usage of the quotas by a system or a source IP
+type quotaUsage struct {
+	Name       string  `json:"name"`
+	Records    int     `json:"records"`
+	Tokens     float64 `json:"tokens"` // new registrations currently allowed at once
+	Registered uint64  `json:"registered"`
+	Rejected   uint64  `json:"rejected"`
+}
+
+// QuotaUsage_v1 is the form of the quotas service
+type QuotaUsage_v1 struct {
+	Limits  quotaConfig  `json:"limits"`
+	Systems []quotaUsage `json:"systems"`
+	Sources []quotaUsage `json:"sources"`
+	Version string       `json:"version"`
+}
+
+// usage reports the live records and the buckets of the systems and of the source IPs
+func (l *limiter) usage(records []forms.ServiceRecord_v1, now time.Time) QuotaUsage_v1 {
+	systemRecords := make(map[string]int)
+	sourceRecords := make(map[string]int)
+	for _, rec := range records {
+		systemRecords[rec.SystemName]++
+		for _, ip := range rec.IPAddresses {
+			sourceRecords[ip]++
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.evict(now)
+	report := func(buckets map[string]*bucket, counts map[string]int) []quotaUsage {
+		list := make([]quotaUsage, 0, len(buckets))
+		for name, b := range buckets {
+			list = append(list, quotaUsage{Name: name, Records: counts[name], Tokens: math.Floor(l.available(b, now)), Registered: b.registered, Rejected: b.rejected})
+		}
+		for name, count := range counts {
+			if _, exists := buckets[name]; !exists {
+				list = append(list, quotaUsage{Name: name, Records: count, Tokens: float64(l.config.Burst)})
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		return list
+	}
+	return QuotaUsage_v1{
+		Limits:  l.config,
+		Systems: report(l.systems, systemRecords),
+		Sources: report(l.sources, sourceRecords),
+		Version: "QuotaUsage_v1",
+	}
+}
+
+// quotas presents (GET) the limits and their current usage by the systems and the source IPs
+func (ua *UnitAsset) quotas(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		records, err := ua.records()
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		payload, err := json.MarshalIndent(ua.limits.usage(records, time.Now()), "", "  ")
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(payload)
+	default:
+		http.Error(w, "Unsupported HTTP request method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,173 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/systems/internal/scheduler"
+)
+
+func TestAdmit(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	// thermo has two live records, the first one expiring in 20 seconds
+	live := []forms.ServiceRecord_v1{testRecord("thermo", "kitchen/temperature"), testRecord("thermo", "kitchen/humidity")}
+	live[0].EndOfValidity = now.Add(20 * time.Second).Format(time.RFC3339)
+	live[1].EndOfValidity = now.Add(40 * time.Second).Format(time.RFC3339)
+	undated := []forms.ServiceRecord_v1{testRecord("thermo", "kitchen/temperature"), testRecord("thermo", "kitchen/humidity")}
+	undated[0].EndOfValidity, undated[1].EndOfValidity = "", ""
+	batch := func(n int) []forms.ServiceRecord_v1 {
+		records := make([]forms.ServiceRecord_v1, n)
+		for i := range records {
+			records[i] = testRecord("thermo", "kitchen/setpoint"+string(rune('a'+i)))
+		}
+		return records
+	}
+	tests := []struct {
+		name       string
+		config     quotaConfig
+		existing   []forms.ServiceRecord_v1
+		incoming   []forms.ServiceRecord_v1
+		status     int // 0 if admitted
+		retryAfter time.Duration
+	}{
+		{"within the quotas", quotaConfig{RatePerMinute: 6, Burst: 3, MaxRecords: 5}, live, batch(3), 0, 0},
+		{"re-registration", quotaConfig{MaxRecords: 2}, live, live[:1], 0, 0},
+		{"over the burst", quotaConfig{RatePerMinute: 6, Burst: 3}, nil, batch(4), http.StatusRequestEntityTooLarge, 0},
+		{"over the quota at once", quotaConfig{MaxRecords: 3}, nil, batch(4), http.StatusRequestEntityTooLarge, 0},
+		{"over the quota", quotaConfig{MaxRecords: 3}, live, batch(2), http.StatusTooManyRequests, 20 * time.Second},
+		{"over the quota without validity", quotaConfig{MaxRecords: 3}, undated, batch(2), http.StatusTooManyRequests, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimiter(tt.config)
+			recordsOf := func(system, ip string) ([]forms.ServiceRecord_v1, error) { return tt.existing, nil }
+			refused := l.admit("192.168.1.10", tt.incoming, recordsOf, now)
+			if tt.status == 0 {
+				if refused != nil {
+					t.Fatalf("refused with %d: %s", refused.status, refused.reason)
+				}
+				return
+			}
+			if refused == nil || refused.status != tt.status || refused.retryAfter != tt.retryAfter {
+				t.Fatalf("refusal %+v, want status %d and retry after %s", refused, tt.status, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestAdmitRate(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := newLimiter(quotaConfig{RatePerMinute: 6, Burst: 2})
+	none := func(system, ip string) ([]forms.ServiceRecord_v1, error) { return nil, nil }
+	rec := []forms.ServiceRecord_v1{testRecord("thermo", "kitchen/temperature")}
+	for i := 0; i < 2; i++ {
+		if refused := l.admit("192.168.1.10", rec, none, now); refused != nil {
+			t.Fatalf("registration %d refused: %s", i, refused.reason)
+		}
+	}
+	refused := l.admit("192.168.1.10", rec, none, now)
+	if refused == nil || refused.status != http.StatusTooManyRequests || refused.retryAfter != 10*time.Second {
+		t.Fatalf("refusal %+v, want 429 with a retry after 10s (one token at 6 per minute)", refused)
+	}
+	if refused := l.admit("192.168.1.10", rec, none, now.Add(10*time.Second)); refused != nil {
+		t.Fatalf("registration refused after the refill: %s", refused.reason)
+	}
+}
+
+func TestEvictIdleBuckets(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := newLimiter(quotaConfig{RatePerMinute: 1, Burst: 30})
+	none := func(system, ip string) ([]forms.ServiceRecord_v1, error) { return nil, nil }
+	batch := func(system string, n int) []forms.ServiceRecord_v1 {
+		records := make([]forms.ServiceRecord_v1, n)
+		for i := range records {
+			records[i] = testRecord(system, "kitchen/setpoint"+string(rune('a'+i)))
+		}
+		return records
+	}
+	l.admit("192.168.1.10", batch("idle", 1), none, now)     // full again one minute later
+	l.admit("192.168.1.11", batch("drained", 30), none, now) // full again after 30 minutes
+
+	l.admit("192.168.1.12", batch("active", 1), none, now.Add(bucketIdle))
+	for _, name := range []string{"idle", "192.168.1.10"} {
+		if _, exists := l.systems[name]; exists {
+			t.Errorf("the idle bucket of system %s was kept", name)
+		}
+		if _, exists := l.sources[name]; exists {
+			t.Errorf("the idle bucket of source %s was kept", name)
+		}
+	}
+	if _, exists := l.systems["drained"]; !exists {
+		t.Error("the bucket of system drained was evicted before it was full again")
+	}
+	if _, exists := l.sources["192.168.1.11"]; !exists {
+		t.Error("the bucket of source 192.168.1.11 was evicted before it was full again")
+	}
+	if _, exists := l.systems["active"]; !exists {
+		t.Error("the bucket of system active was evicted")
+	}
+}
+
+// slowCount is a storage backend that takes its time to return the records of a system
+type slowCount struct{ Store }
+
+func (s slowCount) RecordsOf(system, ip string) ([]forms.ServiceRecord_v1, error) {
+	records, err := s.Store.RecordsOf(system, ip)
+	time.Sleep(10 * time.Millisecond)
+	return records, err
+}
+
+// TestQuotaAdmissionIsAtomic sends concurrent registrations, of which only as many as the quota may be stored
+func TestQuotaAdmissionIsAtomic(t *testing.T) {
+	sched := scheduler.New()
+	go sched.Run()
+	defer sched.Stop()
+	const maxRecords = 3
+	ua := &UnitAsset{lead: &leadState{leading: true}, store: slowCount{NewMemoryStore()}, sched: sched, watchers: newWatchHub(), imported: newImportedRecords(),
+		stats: newRegistryMetrics(), limits: newLimiter(quotaConfig{MaxRecords: maxRecords})}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := testRecord("thermo", fmt.Sprintf("kitchen/setpoint%d", i))
+			rec.Version = "ServiceRecord_v1"
+			body, _ := json.Marshal(rec)
+			r := httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			ua.Serving(httptest.NewRecorder(), r, "register")
+		}(i)
+	}
+	wg.Wait()
+	records, err := ua.store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != maxRecords {
+		t.Fatalf("%d records stored, want the quota of %d", len(records), maxRecords)
+	}
+}
@@ -0,0 +1,316 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+// Package registrar is the service registry shared by the service registrars (sregistrar and esr): the unit asset with its
+// services, the registry operations and the optional features (replication, leader election, federation, DNS-SD, quotas,
+// liveness probes, audit trail, ...).
+// Each registrar only provides its storage backend (the Store interface) and its main function.
+package registrar
+
+import (
+	"log"
+	"time"
+
+	"github.com/sdoque/mbaigo/components"
+	"github.com/sdoque/mbaigo/usecases"
+	"github.com/sdoque/systems/internal/identity"
+	"github.com/sdoque/systems/internal/scheduler"
+)
+
+//-------------------------------------Define the unit asset
+
+// UnitAsset type models the service registry, which a registrar embeds in its unit asset with the configuration of its storage backend
+type UnitAsset struct {
+	Name          string              `json:"name"`
+	Owner         *components.System  `json:"-"`
+	Details       map[string][]string `json:"details"`
+	ServicesMap   components.Services `json:"-"`
+	CervicesMap   components.Cervices `json:"-"`
+	CAFile        string              `json:"caFile"`        // certificate authority verifying the registering systems (none if empty)
+	CertFile      string              `json:"certFile"`      // certificate of the registrar signing its messages to the peer registrars (none if empty)
+	KeyFile       string              `json:"keyFile"`       // private key of the registrar's certificate
+	HistoryDays   int                 `json:"historyDays"`   // retention of the audit trail in days
+	ProbeInterval int                 `json:"probeInterval"` // seconds between the liveness probes of the registered services (0 disables them)
+	ProbeFailures int                 `json:"probeFailures"` // consecutive failed probes before a service is excluded from the discovery
+	CloudName     string              `json:"cloudName"`     // name of the local cloud in federated discovery
+	PeerClouds    []peerCloud         `json:"peerClouds"`    // gateway registrars of the neighbouring local clouds
+	Advertise     bool                `json:"advertise"`     // announce the registered services over DNS-SD (multicast DNS)
+	Browse        []string            `json:"browse"`        // DNS-SD service types imported as read-only records, e.g., _ipp._tcp
+	Quotas        quotaConfig         `json:"quotas"`        // registration limits of each system and of each source IP (0 means no limit)
+	//
+	store       Store                `json:"-"` // storage backend of the registry
+	sched       *scheduler.Scheduler `json:"-"`
+	lead        *leadState           `json:"-"` // role of the registrar set by the election (not leading if nil)
+	events      chan registryEvent   `json:"-"` // registry changes replicated to the standby registrars
+	resyncs     chan struct{}        `json:"-"` // signals that events were dropped and the standby registrars must be resynchronized
+	election    *election            `json:"-"` // state of the registrar in the leader election
+	watchers    *watchHub            `json:"-"` // clients streaming the registry changes
+	imported    *importedRecords     `json:"-"` // records imported from DNS-SD, which are read-only
+	authority   *authority           `json:"-"` // verifies the identity of the registering systems
+	credentials *identity.Signer     `json:"-"` // signs the replication and election messages (none if nil)
+	probes      *liveness            `json:"-"` // probe state of the registered services
+	stats       *registryMetrics     `json:"-"` // counters of the metrics service
+	limits      *limiter             `json:"-"` // registration quotas of the systems and of the source IPs
+}
+
+// GetName returns the name of the Resource.
+func (ua *UnitAsset) GetName() string {
+	return ua.Name
+}
+
+// GetServices returns the services of the Resource.
+func (ua *UnitAsset) GetServices() components.Services {
+	return ua.ServicesMap
+}
+
+// GetCervices returns the list of consumed services by the Resource.
+func (ua *UnitAsset) GetCervices() components.Cervices {
+	return ua.CervicesMap
+}
+
+// GetDetails returns the details of the Resource.
+func (ua *UnitAsset) GetDetails() map[string][]string {
+	return ua.Details
+}
+
+// ensure UnitAsset implements components.UnitAsset (this check is done at during the compilation)
+var _ components.UnitAsset = (*UnitAsset)(nil)
+
+//-------------------------------------Instantiate a unit asset template
+
+// Template initializes a UnitAsset with default values.
+func Template() *UnitAsset {
+	// Define the services that expose the capabilities of the unit asset(s)
+	registerService := components.Service{
+		Definition:  "register",
+		SubPath:     "register",
+		Details:     map[string][]string{"Forms": usecases.ServiceRegistrationFormsList()},
+		Description: "registers a service (POST) or updates its expiration time (PUT)",
+	}
+
+	queryService := components.Service{
+		Definition:  "query",
+		SubPath:     "query",
+		Details:     map[string][]string{"Forms": usecases.ServQuestForms()},
+		Description: "retrieves all currently available services using a GET request [accessed via a browser by a deployment technician, or as a ServiceRecordList_v1 in JSON or XML filtered by definition, system, details and expiry with offset and limit] or retrieves a specific set of services using a POST request with a payload [initiated by the Orchestrator]",
+	}
+	unregisterService := components.Service{
+		Definition:  "unregister",
+		SubPath:     "unregister",
+		Details:     map[string][]string{"Forms": {"ID only"}},
+		Description: "removes a record (DELETE) based on record ID",
+	}
+
+	statusService := components.Service{
+		Definition:  "status",
+		SubPath:     "status",
+		Details:     map[string][]string{"Forms": {"none"}},
+		Description: "reports (GET) the role of the Service Registrar as leading or on stand by",
+	}
+
+	watchService := components.Service{
+		Definition:  "watch",
+		SubPath:     "watch",
+		Details:     map[string][]string{"Forms": {"ServiceQuest_v1"}},
+		Description: "streams the added, renewed, unregistered and expired service records matching a filter (GET with URL query parameters or POST with a service quest) as Server-Sent Events",
+	}
+
+	electionService := components.Service{
+		Definition:  "election",
+		SubPath:     "election",
+		Details:     map[string][]string{"Forms": {"none"}},
+		Description: "answers the vote requests and heartbeats (POST) of the other service registrars in the leader election",
+	}
+
+	bulkService := components.Service{
+		Definition:  "bulkregister",
+		SubPath:     "bulkregister",
+		Details:     map[string][]string{"Forms": {"ServiceRecordList_v1"}},
+		Description: "registers or renews (POST) all the services of a system in one request and replaces the system's other services with ?replace=true",
+	}
+
+	historyService := components.Service{
+		Definition:  "history",
+		SubPath:     "history",
+		Details:     map[string][]string{"Forms": {"RegistryHistory_v1"}},
+		Description: "provides (GET) the audit trail of registrations, renewals, unregistrations, expirations and leadership changes filtered by system, definition, event and time range",
+	}
+
+	snapshotService := components.Service{
+		Definition:  "snapshot",
+		SubPath:     "snapshot",
+		Details:     map[string][]string{"Forms": {"RegistrySnapshot_v1"}},
+		Description: "exports (GET) the current service records with their validity or imports (POST) such a snapshot, re-basing the validity with ?rebase=true",
+	}
+
+	metricsService := components.Service{
+		Definition:  "metrics",
+		SubPath:     "metrics",
+		Details:     map[string][]string{"Forms": {"Prometheus text format"}},
+		Description: "provides (GET) the record counts, the registry events, the query latencies, the scheduler queue and the leadership state for Prometheus",
+	}
+
+	quotasService := components.Service{
+		Definition:  "quotas",
+		SubPath:     "quotas",
+		Details:     map[string][]string{"Forms": {"QuotaUsage_v1"}},
+		Description: "provides (GET) the registration limits and their usage by each system and each source IP",
+	}
+
+	replicateService := components.Service{
+		Definition:  "replicate",
+		SubPath:     "replicate",
+		Details:     map[string][]string{"Forms": {"ServiceRecordList_v1"}},
+		Description: "provides the complete registry to a standby registrar (GET) or applies the changes streamed by the leading registrar (POST)",
+	}
+
+	// var uat components.UnitAsset // this is an interface, which we then initialize
+	uat := &UnitAsset{
+		Name:          "registry",
+		Details:       map[string][]string{"Location": {"Local cloud"}},
+		CAFile:        "",
+		CertFile:      "",
+		KeyFile:       "",
+		HistoryDays:   7,
+		ProbeFailures: 3,
+		CloudName:     "LocalCloud",
+		PeerClouds:    []peerCloud{},
+		Advertise:     false,
+		Browse:        []string{},
+		Quotas:        quotaConfig{},
+		ServicesMap: components.Services{
+			registerService.SubPath:   &registerService,
+			queryService.SubPath:      &queryService,
+			unregisterService.SubPath: &unregisterService,
+			statusService.SubPath:     &statusService,
+			replicateService.SubPath:  &replicateService,
+			electionService.SubPath:   &electionService,
+			watchService.SubPath:      &watchService,
+			historyService.SubPath:    &historyService,
+			bulkService.SubPath:       &bulkService,
+			snapshotService.SubPath:   &snapshotService,
+			metricsService.SubPath:    &metricsService,
+			quotasService.SubPath:     &quotasService,
+		},
+	}
+	return uat
+}
+
+//-------------------------------------Instantiate unit asset(s) based on configuration
+
+// New creates the service registry on a storage backend based on the configuration, reloading the records inherited from a previous run if asked,
+// and returns it with its cleanup function
+func New(uac UnitAsset, sys *components.System, servs []components.Service, store Store, reload bool) (*UnitAsset, func()) {
+	// start the registration expiration check scheduler
+	cleaningScheduler := scheduler.New()
+	go cleaningScheduler.Run()
+
+	ua := &UnitAsset{
+		Name:        uac.Name,
+		Owner:       sys,
+		Details:     uac.Details,
+		store:       store,
+		sched:       cleaningScheduler,
+		lead:        &leadState{},
+		watchers:    newWatchHub(),
+		imported:    newImportedRecords(),
+		stats:       newRegistryMetrics(),
+		ServicesMap: components.CloneServices(servs),
+	}
+
+	// load the certificate authority that verifies the identity of the registering systems
+	var err error
+	if uac.CAFile != "" {
+		ua.CAFile = uac.CAFile
+		if ua.authority, err = loadAuthority(uac.CAFile); err != nil {
+			panic(err)
+		}
+	}
+
+	// load the certificate with which the registrar signs its messages to its peers, who verify them when they have a certificate authority
+	if uac.CertFile != "" {
+		ua.CertFile, ua.KeyFile = uac.CertFile, uac.KeyFile
+		if ua.credentials, err = identity.LoadSigner(uac.CertFile, uac.KeyFile); err != nil {
+			panic(err)
+		}
+	} else if ua.authority != nil {
+		log.Println("warning: without a certificate (certFile), the peer registrars reject the replication and election messages of this registrar")
+	}
+
+	// keep the audit trail for the configured number of days
+	ua.HistoryDays = uac.HistoryDays
+	if ua.HistoryDays <= 0 {
+		ua.HistoryDays = 7
+	}
+	go pruneHistory(ua, time.Duration(ua.HistoryDays)*24*time.Hour)
+
+	// limit the registrations of each system and of each source IP if configured
+	ua.Quotas = uac.Quotas
+	ua.limits = newLimiter(uac.Quotas)
+
+	// forward the quests to the neighbouring local clouds if configured
+	ua.CloudName = uac.CloudName
+	if ua.CloudName == "" {
+		ua.CloudName = sys.Name
+	}
+	if ua.PeerClouds, err = loadPeerClouds(uac.PeerClouds); err != nil {
+		panic(err)
+	}
+
+	// advertise the registered services and import the services of other devices over DNS-SD if configured
+	ua.Advertise = uac.Advertise
+	ua.Browse = uac.Browse
+	if ua.Advertise {
+		go runAdvertiser(ua.watchers, ua.isLeading, ua.store.List, ua.imported.has)
+	}
+	if len(ua.Browse) > 0 {
+		go runBrowser(ua.Browse, ua.isLeading, ua.importAnnounced)
+	}
+
+	// probe the registered services in the background if configured
+	if uac.ProbeInterval > 0 {
+		ua.ProbeInterval = uac.ProbeInterval
+		ua.ProbeFailures = uac.ProbeFailures
+		ua.probes = newLiveness(uac.ProbeFailures, 2*time.Second)
+		go ua.probes.run(time.Duration(uac.ProbeInterval)*time.Second, ua.isLeading, ua.store.List)
+	}
+
+	// reload the records inherited from the previous run
+	if reload {
+		if err := reloadRegistry(ua); err != nil {
+			panic(err)
+		}
+	}
+
+	// stream the registry changes to the standby registrars while leading
+	peers, err := peersList(sys)
+	if err != nil {
+		panic(err)
+	}
+	ua.events = make(chan registryEvent, 1000)
+	ua.resyncs = make(chan struct{}, 1)
+	go ua.streamEvents(peers)
+
+	ua.Role() // start the election of the leading registrar
+
+	return ua, func() {
+		cleaningScheduler.Stop()
+		if err := ua.store.Close(); err != nil {
+			log.Printf("error closing the service registry: %v\n", err)
+		}
+		log.Println("Closing the service registry storage")
+	}
+}
@@ -0,0 +1,279 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+// Package registrartest runs the conformance suite of the package internal/registrytest on a storage backend of the
+// service registry (registrar.Store), together with the checks of the expirations and of the audit trail.
+// Each registrar calls Run for its backends in its store_test.go.
+package registrartest
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/systems/internal/registrar"
+	"github.com/sdoque/systems/internal/registrytest"
+)
+
+// Run checks a storage backend, which open creates empty for each check
+func Run(t *testing.T, open func(t *testing.T) registrar.Store) {
+	t.Run("records", func(t *testing.T) {
+		registrytest.Run(t, func(t *testing.T) registrytest.Store { return storeAdapter{open(t)} })
+	})
+	t.Run("expire", func(t *testing.T) { testExpire(t, open(t)) })
+	t.Run("records of", func(t *testing.T) { testRecordsOf(t, open(t)) })
+	t.Run("events", func(t *testing.T) { testQueryEvents(t, open(t)) })
+}
+
+// testRecord returns the record of a service valid for a minute from now
+func testRecord(system, subPath string, now time.Time) forms.ServiceRecord_v1 {
+	return forms.ServiceRecord_v1{
+		ServiceDefinition: "temperature",
+		SystemName:        system,
+		SubPath:           subPath,
+		IPAddresses:       []string{"192.168.1.10"},
+		ProtoPort:         map[string]int{"http": 20150},
+		RegLife:           60,
+		Created:           now.Format(time.RFC3339),
+		Updated:           now.Format(time.RFC3339),
+		EndOfValidity:     now.Add(time.Minute).Format(time.RFC3339),
+	}
+}
+
+// testExpire checks that only a record whose validity ended is expired
+func testExpire(t *testing.T, s registrar.Store) {
+	defer s.Close()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	rec := testRecord("thermo", "sensor/temperature", now)
+	if _, err := s.Register(&rec); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		id      int
+		at      time.Time
+		expired bool
+	}{
+		{"still valid", rec.Id, now.Add(30 * time.Second), false},
+		{"unknown", rec.Id + 1, now.Add(2 * time.Minute), false},
+		{"ended", rec.Id, now.Add(2 * time.Minute), true},
+		{"already expired", rec.Id, now.Add(3 * time.Minute), false},
+	}
+	for _, tt := range tests {
+		expired, err := s.Expire(tt.id, tt.at)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if (expired != nil) != tt.expired {
+			t.Fatalf("%s: expired %v, want %v", tt.name, expired != nil, tt.expired)
+		}
+		if expired != nil && expired.SystemName != rec.SystemName {
+			t.Fatalf("%s: expired the record of %s", tt.name, expired.SystemName)
+		}
+	}
+	if _, err := s.Get(rec.Id); !errors.Is(err, registrar.ErrUnknownRecord) {
+		t.Fatalf("the expired record is still stored (%v)", err)
+	}
+}
+
+// testRecordsOf checks that the records counted in the quotas of a system and of a source IP are found
+func testRecordsOf(t *testing.T, s registrar.Store) {
+	defer s.Close()
+	now := time.Now()
+	thermo := testRecord("thermo", "kitchen/temperature", now)
+	heater := testRecord("heater", "valve/setpoint", now)
+	heater.IPAddresses = []string{"192.168.1.20"}
+	proxied := testRecord("gateway", "modbus/register", now)
+	proxied.IPAddresses = []string{"192.168.1.10"}
+	for _, rec := range []*forms.ServiceRecord_v1{&thermo, &heater, &proxied} {
+		if _, err := s.Register(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := s.RecordsOf("thermo", "192.168.1.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, rec := range records {
+		names = append(names, rec.SystemName)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "gateway" || names[1] != "thermo" {
+		t.Fatalf("records of %v, want those of gateway and thermo", names)
+	}
+}
+
+// testQueryEvents checks the pages and the filters of the audit trail
+func testQueryEvents(t *testing.T, s registrar.Store) {
+	defer s.Close()
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		system := "thermo"
+		if i%2 == 1 {
+			system = "heater"
+		}
+		e := registrar.HistoryEvent{Time: start.Add(time.Duration(i) * time.Minute).Format(registrar.HistoryTimeFormat), Event: "register", SystemName: system}
+		if err := s.AppendEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name   string
+		filter registrar.HistoryFilter
+		want   []int64 // ids of the events in the page
+	}{
+		{"newest first", registrar.HistoryFilter{}, []int64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}},
+		{"limit", registrar.HistoryFilter{Limit: 3}, []int64{10, 9, 8}},
+		{"next page", registrar.HistoryFilter{Limit: 3, Before: 8}, []int64{7, 6, 5}},
+		{"last page", registrar.HistoryFilter{Limit: 3, Before: 2}, []int64{1}},
+		{"after", registrar.HistoryFilter{Limit: 3, After: 4}, []int64{7, 6, 5}},
+		{"after the newest", registrar.HistoryFilter{After: 10}, []int64{}},
+		{"between", registrar.HistoryFilter{Before: 8, After: 4}, []int64{7, 6, 5}},
+		{"filtered pages", registrar.HistoryFilter{SystemName: "thermo", Limit: 2, Before: 9}, []int64{7, 5}},
+		{"filtered after", registrar.HistoryFilter{SystemName: "heater", Limit: 2, After: 2}, []int64{6, 4}},
+		{"time range", registrar.HistoryFilter{From: start.Add(2 * time.Minute), To: start.Add(4 * time.Minute)}, []int64{5, 4, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.filter.Limit == 0 {
+				tt.filter.Limit = 1000 // the default of the history service
+			}
+			events, err := s.QueryEvents(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]int64, 0, len(events))
+			for _, e := range events {
+				ids = append(ids, e.Id)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Fatalf("events %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+// storeAdapter presents a registrar.Store to the conformance suite
+type storeAdapter struct{ s registrar.Store }
+
+func (a storeAdapter) Register(rec *registrytest.Record) ([]registrytest.Record, error) {
+	form := toForm(*rec)
+	replaced, err := a.s.Register(&form)
+	rec.Id = form.Id
+	return fromForms(replaced), err
+}
+
+func (a storeAdapter) Extend(rec *registrytest.Record, now time.Time) (bool, error) {
+	form := toForm(*rec)
+	err := a.s.Extend(&form, now)
+	if errors.Is(err, registrar.ErrUnknownRecord) {
+		return false, nil
+	}
+	*rec = fromForm(form)
+	return err == nil, err
+}
+
+func (a storeAdapter) SetValidity(id int, updated, endOfValidity string) (bool, error) {
+	return a.s.SetValidity(id, updated, endOfValidity)
+}
+
+func (a storeAdapter) Delete(id int) error { return a.s.Delete(id) }
+
+func (a storeAdapter) Get(id int) (registrytest.Record, bool, error) {
+	rec, err := a.s.Get(id)
+	if errors.Is(err, registrar.ErrUnknownRecord) {
+		return registrytest.Record{}, false, nil
+	}
+	if err != nil {
+		return registrytest.Record{}, false, err
+	}
+	return fromForm(*rec), true, nil
+}
+
+func (a storeAdapter) Find(definition string, details map[string][]string) ([]registrytest.Record, error) {
+	matcher, err := registrar.CompileQuest(definition, details)
+	if err != nil {
+		return nil, err
+	}
+	found, err := a.s.Find(definition, matcher)
+	return fromForms(found), err
+}
+
+func (a storeAdapter) List() ([]registrytest.Record, error) {
+	records, err := a.s.List()
+	return fromForms(records), err
+}
+
+func (a storeAdapter) StoreBatch(records []registrytest.Record, replace bool, now time.Time) ([]bool, []registrytest.Record, error) {
+	batch := make([]forms.ServiceRecord_v1, len(records))
+	for i, rec := range records {
+		batch[i] = toForm(rec)
+	}
+	renewed, retired, err := a.s.StoreBatch(batch, replace, now)
+	for i := range batch {
+		records[i] = fromForm(batch[i])
+	}
+	return renewed, fromForms(retired), err
+}
+
+func (a storeAdapter) Close() error { return a.s.Close() }
+
+// toForm converts a record of the suite into a service record
+func toForm(rec registrytest.Record) forms.ServiceRecord_v1 {
+	return forms.ServiceRecord_v1{
+		Id:                rec.Id,
+		ServiceDefinition: rec.Definition,
+		SystemName:        rec.SystemName,
+		SubPath:           rec.SubPath,
+		IPAddresses:       rec.IPAddresses,
+		ProtoPort:         rec.ProtoPort,
+		Details:           rec.Details,
+		RegLife:           rec.RegLife,
+		Created:           rec.Created,
+		Updated:           rec.Updated,
+		EndOfValidity:     rec.EndOfValidity,
+	}
+}
+
+// fromForm converts a service record into a record of the suite
+func fromForm(rec forms.ServiceRecord_v1) registrytest.Record {
+	return registrytest.Record{
+		Id:            rec.Id,
+		Definition:    rec.ServiceDefinition,
+		SystemName:    rec.SystemName,
+		SubPath:       rec.SubPath,
+		IPAddresses:   rec.IPAddresses,
+		ProtoPort:     rec.ProtoPort,
+		Details:       rec.Details,
+		RegLife:       rec.RegLife,
+		Created:       rec.Created,
+		Updated:       rec.Updated,
+		EndOfValidity: rec.EndOfValidity,
+	}
+}
+
+// fromForms converts service records into records of the suite
+func fromForms(records []forms.ServiceRecord_v1) []registrytest.Record {
+	list := make([]registrytest.Record, 0, len(records))
+	for _, rec := range records {
+		list = append(list, fromForm(rec))
+	}
+	return list
+}
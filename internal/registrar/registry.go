@@ -0,0 +1,208 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+//*********************Registry operations on top of the storage backend*********************
+
+// registerService registers a new service in the registry.
+func registerService(rsc *UnitAsset, rec *forms.ServiceRecord_v1) (replaced []int, err error) {
+	now := time.Now()
+	rec.Created = now.Format(time.RFC3339)
+	rec.Updated = now.Format(time.RFC3339)
+	rec.EndOfValidity = now.Add(time.Duration(rec.RegLife) * time.Second).Format(time.RFC3339)
+	return admitService(rsc, rec)
+}
+
+// admitService stores a record with its validity under a new id, replacing the previous record of the same service,
+// and then schedules its expiration check and notifies the watchers
+func admitService(rsc *UnitAsset, rec *forms.ServiceRecord_v1) (replaced []int, err error) {
+	rec.Id = 0 // the storage assigns the record id
+	previous, err := rsc.store.Register(rec)
+	if err != nil {
+		return nil, err
+	}
+	replaced = retireRecords(rsc, previous)
+	scheduleExpiration(rsc, *rec)
+	rsc.watchers.publish("added", *rec)
+	return replaced, nil
+}
+
+// retireRecords cancels the expiration checks of the records replaced by a new registration and notifies the watchers
+func retireRecords(rsc *UnitAsset, previous []forms.ServiceRecord_v1) (ids []int) {
+	for _, old := range previous {
+		rsc.sched.Cancel(old.Id)
+		rsc.watchers.publish("unregistered", old)
+		log.Printf("the service record %d has been replaced by a new registration of %s from system %s\n", old.Id, old.ServiceDefinition, old.SystemName)
+		ids = append(ids, old.Id)
+	}
+	return ids
+}
+
+// extendServiceValidity extends the validity of an existing service record.
+func extendServiceValidity(rsc *UnitAsset, rec *forms.ServiceRecord_v1) error {
+	now := time.Now()
+	if err := rsc.store.Extend(rec, now); err != nil {
+		return err
+	}
+	deadline := now.Add(time.Duration(rec.RegLife) * time.Second)
+	if servId := rec.Id; !rsc.sched.Reschedule(servId, deadline) {
+		rsc.sched.Add(deadline, func() { checkExpiration(rsc, servId) }, servId)
+	}
+	rsc.watchers.publish("renewed", *rec)
+	return nil
+}
+
+// registerBatch stores the records of a system and then schedules their expiration checks and notifies the watchers
+func registerBatch(rsc *UnitAsset, records []forms.ServiceRecord_v1, replace bool) (renewed []bool, retired []forms.ServiceRecord_v1, err error) {
+	renewed, retired, err = rsc.store.StoreBatch(records, replace, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	retireRecords(rsc, retired)
+	for i, rec := range records {
+		servId := rec.Id
+		deadline, _ := time.Parse(time.RFC3339, rec.EndOfValidity)
+		if renewed[i] {
+			if !rsc.sched.Reschedule(servId, deadline) {
+				rsc.sched.Add(deadline, func() { checkExpiration(rsc, servId) }, servId)
+			}
+			rsc.watchers.publish("renewed", rec)
+		} else {
+			rsc.sched.Add(deadline, func() { checkExpiration(rsc, servId) }, servId)
+			rsc.watchers.publish("added", rec)
+		}
+	}
+	return renewed, retired, nil
+}
+
+// records returns all the records of the registry
+func (ua *UnitAsset) records() ([]forms.ServiceRecord_v1, error) {
+	return ua.store.List()
+}
+
+// known checks if the registry has a record
+func (ua *UnitAsset) known(id int) bool {
+	_, err := ua.store.Get(id)
+	return err == nil
+}
+
+// importAnnounced registers a service announced over DNS-SD or renews the record of its previous announcement
+func (ua *UnitAsset) importAnnounced(rec *forms.ServiceRecord_v1) error {
+	if rec.Id != 0 {
+		err := extendServiceValidity(ua, rec)
+		if err == nil {
+			ua.replicate("extend", *rec)
+			return nil
+		} else if !errors.Is(err, ErrUnknownRecord) {
+			return err
+		}
+		ua.imported.forget(rec.Id) // the previous announcement expired
+	}
+	if _, err := registerService(ua, rec); err != nil {
+		return err
+	}
+	ua.imported.mark(rec.Id)
+	ua.replicate("register", *rec)
+	logEvent(ua, "register", *rec, "", "announced over DNS-SD")
+	return nil
+}
+
+// findServices finds services based on the provided service description (see matching.go for the semantics of the details).
+func findServices(rsc *UnitAsset, serviceDescription forms.ServiceQuest_v1) (records []forms.ServiceRecord_v1, err error) {
+	defer func(start time.Time) { rsc.stats.observeQuery(time.Since(start), err) }(time.Now())
+	matcher, err := CompileQuest(serviceDescription.ServiceDefinition, serviceDescription.Details)
+	if err != nil {
+		return nil, err
+	}
+	records, err = rsc.store.Find(serviceDescription.ServiceDefinition, matcher)
+	if err != nil {
+		return nil, err
+	}
+	return rsc.probes.filter(records), nil // the providers failing the liveness probes are not handed out
+}
+
+// listCurrentServices presents the current services of the registry as HTML lines.
+func listCurrentServices(rsc *UnitAsset, allServices []forms.ServiceRecord_v1) []string {
+	unconfirmed, err := rsc.store.Unconfirmed()
+	if err != nil {
+		fmt.Println("Error in querying unconfirmed services")
+	}
+	sList := make([]string, 0)
+	for _, serRec := range allServices {
+		metaservice := ""
+		for key, values := range serRec.Details {
+			metaservice += key + ": " + fmt.Sprintf("%v", values) + " "
+		}
+		hyperlink := "http://" + serRec.IPAddresses[0] + ":" + strconv.Itoa(int(serRec.ProtoPort["http"])) + "/" + serRec.SystemName + "/" + serRec.SubPath
+		parts := strings.Split(serRec.SubPath, "/")
+		uaName := parts[0]
+		sLine := "<p>Service ID: " + strconv.Itoa(int(serRec.Id)) + " with definition <b><a href=\"" + hyperlink + "\">" + serRec.ServiceDefinition + "</b></a> from the <b>" + serRec.SystemName + "/" + uaName + "</b> with details " + metaservice + " will expire at: " + serRec.EndOfValidity
+		if unconfirmed[serRec.Id] {
+			sLine += " (unconfirmed, inherited from a previous run)"
+		}
+		if probe := rsc.probes.describe(serRec.Id); probe != "" {
+			sLine += " (" + probe + ")"
+		}
+		sLine += "</p>"
+		sList = append(sList, sLine)
+	}
+	return sList
+}
+
+// checkExpiration checks if a service has expired and deletes it if it has.
+func checkExpiration(rsc *UnitAsset, servId int) {
+	rec, err := rsc.store.Expire(servId, time.Now())
+	if err != nil {
+		log.Printf("error checking the expiration of record %d: %v\n", servId, err)
+		return
+	}
+	if rec == nil {
+		return // already deleted or renewed
+	}
+	rsc.imported.forget(servId)
+	rsc.replicate("expire", forms.ServiceRecord_v1{Id: servId})
+	rsc.watchers.publish("expired", *rec)
+	logEvent(rsc, "expire", *rec, "", "not renewed before "+rec.EndOfValidity)
+}
+
+// reloadRegistry goes through the records inherited from a previous run of a persistent registry.
+// Expired records are deleted, the others are marked as unconfirmed until their owner renews them and their expiration is scheduled again.
+func reloadRegistry(rsc *UnitAsset) error {
+	records, err := rsc.store.Reload(time.Now())
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		expiration, _ := time.Parse(time.RFC3339, rec.EndOfValidity)
+		servId := rec.Id
+		rsc.sched.Add(expiration, func() { checkExpiration(rsc, servId) }, servId)
+	}
+	rsc.imported.reset(records)
+	log.Printf("%d unexpired service records reloaded from the persistent registry\n", len(records))
+	return nil
+}
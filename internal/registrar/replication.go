@@ -0,0 +1,348 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/sdoque/mbaigo/components"
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/mbaigo/usecases"
+)
+
+//*********************Leader to standby replication of the registry*********************
+
+// resyncPeriod is the period at which the leading registrar sends a snapshot of the registry to the peers that missed events
+const resyncPeriod = 5 * time.Second
+
+// registryEvent is the change of the registry that the leading registrar streams to its peers
+type registryEvent struct {
+	Action   string                 `json:"action"` // register, extend, unregister, expire or resync
+	Id       int                    `json:"registryID"`
+	Record   forms.ServiceRecord_v1 `json:"record,omitempty"`
+	Snapshot *RegistrySnapshot_v1   `json:"snapshot,omitempty"` // complete registry replacing the one of the peer (resync)
+}
+
+// replicate queues a registry event to be forwarded to the standby registrars (only the leading registrar does so).
+// It never blocks the registration: when the queue is full, the event is dropped and the peers are resynchronized instead.
+func (ua *UnitAsset) replicate(action string, rec forms.ServiceRecord_v1) {
+	if !ua.isLeading() || ua.events == nil {
+		return
+	}
+	select {
+	case ua.events <- registryEvent{Action: action, Id: rec.Id, Record: rec}:
+	default:
+		select {
+		case ua.resyncs <- struct{}{}:
+		default: // a resynchronization is already pending
+		}
+	}
+}
+
+// streamEvents forwards the registry events in order to all the peers of the leading registrar.
+// A peer that misses an event (unreachable or refusing it), or every peer when events were dropped, is stale:
+// it receives no further event until it is resynchronized with a snapshot of the registry.
+func (ua *UnitAsset) streamEvents(peers []*components.CoreSystem) {
+	client := &http.Client{Timeout: 2 * time.Second}
+	stale := make([]bool, len(peers))
+	ticker := time.NewTicker(resyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-ua.events:
+			payload, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("error marshalling the registry event: %v\n", err)
+				continue
+			}
+			for i, peer := range peers {
+				if stale[i] {
+					continue // the snapshot will include the change
+				}
+				if err := ua.sendEvent(client, peer, payload); err != nil {
+					log.Printf("the registrar %s missed the %s event (%v), it will be resynchronized\n", peer.Url, event.Action, err)
+					stale[i] = true
+				}
+			}
+			continue
+		case <-ua.resyncs:
+			log.Println("registry events were dropped, the standby registrars will be resynchronized")
+			for i := range stale {
+				stale[i] = true
+			}
+		case <-ticker.C:
+		}
+		ua.resynchronize(client, peers, stale)
+	}
+}
+
+// resynchronize sends a snapshot of the registry to the stale peers while leading.
+// The events still queued are applied after the snapshot, which already includes their changes, and leave it unchanged.
+func (ua *UnitAsset) resynchronize(client *http.Client, peers []*components.CoreSystem, stale []bool) {
+	if !ua.isLeading() {
+		for i := range stale {
+			stale[i] = false // the peers synchronize with the next leader
+		}
+		return
+	}
+	var payload []byte
+	var count int
+	for i, peer := range peers {
+		if !stale[i] {
+			continue
+		}
+		if payload == nil {
+			records, err := ua.store.List()
+			if err != nil {
+				log.Printf("error listing the registry to resynchronize the peers: %v\n", err)
+				return
+			}
+			doc := RegistrySnapshot_v1{Taken: time.Now().Format(time.RFC3339), Records: records, Version: "RegistrySnapshot_v1"}
+			if payload, err = json.Marshal(registryEvent{Action: "resync", Snapshot: &doc}); err != nil {
+				log.Printf("error marshalling the registry snapshot: %v\n", err)
+				return
+			}
+			count = len(records)
+		}
+		if err := ua.sendEvent(client, peer, payload); err != nil {
+			continue // still stale, retried at the next period
+		}
+		stale[i] = false
+		log.Printf("the registrar %s was resynchronized with %d service records\n", peer.Url, count)
+	}
+}
+
+// sendEvent posts a registry event to a peer, signed with the registrar's certificate
+func (ua *UnitAsset) sendEvent(client *http.Client, peer *components.CoreSystem, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, peer.Url+"/replicate", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := ua.credentials.Sign(req, payload); err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// replication receives the events from the leading registrar (POST) or provides the complete registry to a standby registrar (GET)
+func (ua *UnitAsset) replication(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !ua.authority.authorizePeer(w, r, nil, ua) {
+			return
+		}
+		if !ua.isLeading() {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		records, err := ua.store.List()
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		var slForm forms.ServiceRecordList_v1
+		slForm.NewForm()
+		slForm.List = records
+		payload, err := usecases.Pack(&slForm, "application/json")
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(payload)
+	case "POST":
+		if ua.isLeading() {
+			http.Error(w, "Conflict, this registrar is leading", http.StatusConflict)
+			return
+		}
+		defer r.Body.Close()
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if !ua.authority.authorizePeer(w, r, bodyBytes, ua) {
+			return
+		}
+		var event registryEvent
+		if err := json.Unmarshal(bodyBytes, &event); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if err := applyEvent(ua, event); err != nil {
+			log.Printf("error applying the replicated %s event: %v\n", event.Action, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Unsupported HTTP request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// applyEvent updates the registry of a standby registrar with an event from the leading registrar
+func applyEvent(rsc *UnitAsset, event registryEvent) error {
+	switch event.Action {
+	case "register":
+		rec := event.Record
+		rsc.store.Delete(rec.Id) // in case the record was already replicated
+		previous, err := rsc.store.Register(&rec)
+		if err != nil {
+			return err
+		}
+		retireRecords(rsc, previous)
+		scheduleExpiration(rsc, rec)
+		rsc.imported.track(rec)
+		rsc.watchers.publish("added", rec)
+	case "extend":
+		rec := event.Record
+		found, err := rsc.store.SetValidity(rec.Id, rec.Updated, rec.EndOfValidity)
+		if err != nil {
+			return err
+		}
+		if !found {
+			previous, err := rsc.store.Register(&rec) // the registration was missed
+			if err != nil {
+				return err
+			}
+			retireRecords(rsc, previous)
+			rsc.imported.track(rec)
+		}
+		scheduleExpiration(rsc, rec)
+		rsc.watchers.publish("renewed", rec)
+	case "unregister", "expire":
+		rec, err := rsc.store.Get(event.Id)
+		if err != nil {
+			return nil // already deleted (e.g., expired locally)
+		}
+		if err := rsc.store.Delete(event.Id); err != nil {
+			return err
+		}
+		rsc.imported.forget(event.Id)
+		if event.Action == "unregister" {
+			rsc.watchers.publish("unregistered", *rec)
+		} else {
+			rsc.watchers.publish("expired", *rec)
+		}
+	case "resync":
+		if event.Snapshot == nil {
+			return fmt.Errorf("resync event without a snapshot")
+		}
+		if err := replaceRegistry(rsc, event.Snapshot.Records); err != nil {
+			return err
+		}
+		log.Printf("%d service records resynchronized by the leading registrar\n", len(event.Snapshot.Records))
+	default:
+		return fmt.Errorf("unknown registry event %s", event.Action)
+	}
+	return nil
+}
+
+// scheduleExpiration schedules the expiration check of a record at its end of validity
+func scheduleExpiration(rsc *UnitAsset, rec forms.ServiceRecord_v1) {
+	expiration, err := time.Parse(time.RFC3339, rec.EndOfValidity)
+	if err != nil {
+		log.Printf("time parsing problem with the end of validity of record %d\n", rec.Id)
+		return
+	}
+	servId := rec.Id
+	rsc.sched.Add(expiration, func() { checkExpiration(rsc, servId) }, servId)
+}
+
+// synchronize replaces the registry of a standby registrar with the one of the leading registrar
+func (ua *UnitAsset) synchronize(leader *components.CoreSystem) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, leader.Url+"/replicate", nil)
+	if err != nil {
+		log.Printf("error preparing the synchronization request: %v\n", err)
+		return
+	}
+	if err := ua.credentials.Sign(req, nil); err != nil {
+		log.Printf("error signing the synchronization request: %v\n", err)
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("unable to synchronize with the leading registrar %s: %v\n", leader.Url, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("the registrar %s refused the synchronization (%d)\n", leader.Url, resp.StatusCode)
+		return
+	}
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("error reading the synchronization reply: %v\n", err)
+		return
+	}
+	listForm, err := usecases.Unpack(bodyBytes, "application/json")
+	if err != nil {
+		log.Printf("error extracting the synchronization reply: %v\n", err)
+		return
+	}
+	recordList, ok := listForm.(*forms.ServiceRecordList_v1)
+	if !ok {
+		log.Println("problem asserting the type of the synchronization list form")
+		return
+	}
+
+	if err := replaceRegistry(ua, recordList.List); err != nil {
+		log.Printf("error synchronizing the registry: %v\n", err)
+		return
+	}
+	log.Printf("%d service records synchronized from the leading registrar %s\n", len(recordList.List), leader.Url)
+}
+
+// replaceRegistry replaces the registry of a standby registrar with the records of the leading registrar, keeping their ids
+func replaceRegistry(rsc *UnitAsset, records []forms.ServiceRecord_v1) error {
+	current, err := rsc.store.List()
+	if err != nil {
+		return fmt.Errorf("listing the registry before synchronization: %w", err)
+	}
+	for _, rec := range current {
+		rsc.store.Delete(rec.Id)
+		rsc.sched.Cancel(rec.Id) // the expiration of the records kept is scheduled anew
+	}
+	for _, rec := range records {
+		if _, err := rsc.store.Register(&rec); err != nil {
+			log.Printf("error storing the synchronized record %d: %v\n", rec.Id, err)
+			continue
+		}
+		scheduleExpiration(rsc, rec)
+	}
+	rsc.imported.reset(records)
+	return nil
+}
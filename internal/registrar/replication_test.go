@@ -0,0 +1,219 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sdoque/mbaigo/components"
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/systems/internal/identity"
+	"github.com/sdoque/systems/internal/scheduler"
+)
+
+// testRecord returns a valid record of a service
+func testRecord(system, subPath string) forms.ServiceRecord_v1 {
+	now := time.Now()
+	return forms.ServiceRecord_v1{
+		ServiceDefinition: "temperature",
+		SystemName:        system,
+		SubPath:           subPath,
+		IPAddresses:       []string{"192.168.1.10"},
+		ProtoPort:         map[string]int{"http": 20150},
+		RegLife:           60,
+		Created:           now.Format(time.RFC3339),
+		Updated:           now.Format(time.RFC3339),
+		EndOfValidity:     now.Add(time.Minute).Format(time.RFC3339),
+	}
+}
+
+// peerRegistrar is a standby registrar recording the events it receives
+type peerRegistrar struct {
+	mu     sync.Mutex
+	events []registryEvent
+	status int
+}
+
+func (p *peerRegistrar) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var event registryEvent
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, event)
+	w.WriteHeader(p.status)
+}
+
+func TestReplicateNeverBlocks(t *testing.T) {
+	ua := &UnitAsset{lead: &leadState{leading: true}, events: make(chan registryEvent, 1), resyncs: make(chan struct{}, 1)}
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			ua.replicate("register", testRecord("thermo", "kitchen/temperature"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("replicate blocked on a full queue")
+	}
+	if len(ua.events) != 1 || len(ua.resyncs) != 1 {
+		t.Fatalf("%d events queued and %d resynchronizations pending, want 1 and 1", len(ua.events), len(ua.resyncs))
+	}
+}
+
+func TestResynchronizeStalePeers(t *testing.T) {
+	ua := &UnitAsset{lead: &leadState{leading: true}, store: NewMemoryStore()}
+	rec := testRecord("thermo", "kitchen/temperature")
+	if _, err := ua.store.Register(&rec); err != nil {
+		t.Fatal(err)
+	}
+	registrars := []*peerRegistrar{{status: http.StatusOK}, {status: http.StatusServiceUnavailable}, {status: http.StatusOK}}
+	peers := make([]*components.CoreSystem, len(registrars))
+	for i, registrar := range registrars {
+		srv := httptest.NewServer(registrar)
+		defer srv.Close()
+		peers[i] = &components.CoreSystem{Name: "serviceregistrar", Url: srv.URL}
+	}
+
+	stale := []bool{true, true, false}
+	ua.resynchronize(&http.Client{Timeout: time.Second}, peers, stale)
+
+	if stale[0] || !stale[1] || stale[2] {
+		t.Fatalf("stale peers %v after the resynchronization, want [false true false]", stale)
+	}
+	for i, want := range []int{1, 1, 0} {
+		if len(registrars[i].events) != want {
+			t.Fatalf("peer %d received %d events, want %d", i, len(registrars[i].events), want)
+		}
+	}
+	event := registrars[0].events[0]
+	if event.Action != "resync" || event.Snapshot == nil || len(event.Snapshot.Records) != 1 || event.Snapshot.Records[0].Id != rec.Id {
+		t.Fatalf("received %+v, want a resync event with record %d", event, rec.Id)
+	}
+}
+
+func TestApplyResync(t *testing.T) {
+	sched := scheduler.New()
+	go sched.Run()
+	defer sched.Stop()
+	ua := &UnitAsset{store: NewMemoryStore(), sched: sched, watchers: newWatchHub(), imported: newImportedRecords()}
+	old := testRecord("heater", "valve/setpoint")
+	if _, err := ua.store.Register(&old); err != nil {
+		t.Fatal(err)
+	}
+	scheduleExpiration(ua, old)
+
+	kept := testRecord("thermo", "kitchen/temperature")
+	kept.Id = 7
+	doc := RegistrySnapshot_v1{Taken: time.Now().Format(time.RFC3339), Records: []forms.ServiceRecord_v1{kept}, Version: "RegistrySnapshot_v1"}
+	if err := applyEvent(ua, registryEvent{Action: "resync", Snapshot: &doc}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := ua.store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Id != 7 || records[0].SystemName != "thermo" {
+		t.Fatalf("registry %+v after the resync, want only record 7 of thermo", records)
+	}
+	if queued := sched.Metrics().QueueLength; queued != 1 || sched.Cancel(old.Id) {
+		t.Fatalf("%d expirations scheduled after the resync, want only the one of record 7", queued)
+	}
+}
+
+// peerCredentials returns the certificate authority of a local cloud and the credentials of its registrar system
+func peerCredentials(t *testing.T, name string) (*authority, *identity.Signer) {
+	t.Helper()
+	caPub, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "local cloud authority"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caPub, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDer)
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), KeyUsage: x509.KeyUsageDigitalSignature}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, pub, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	signer, err := identity.NewSigner(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	return &authority{verifier: identity.NewAuthority(roots, time.Now)}, signer
+}
+
+func TestSynchronizeIsAuthenticated(t *testing.T) {
+	sched := scheduler.New()
+	go sched.Run()
+	defer sched.Stop()
+	ca, credentials := peerCredentials(t, "serviceregistrar")
+	owner := &components.System{Name: "serviceregistrar"}
+	leader := &UnitAsset{Owner: owner, lead: &leadState{leading: true}, store: NewMemoryStore(), authority: ca}
+	rec := testRecord("thermo", "kitchen/temperature")
+	if _, err := leader.store.Register(&rec); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { leader.Serving(w, r, "replicate") }))
+	defer srv.Close()
+
+	unsigned, err := http.Get(srv.URL + "/replicate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned.Body.Close()
+	if unsigned.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unsigned copy of the registry answered with %d, want 401", unsigned.StatusCode)
+	}
+
+	standby := &UnitAsset{Owner: owner, store: NewMemoryStore(), sched: sched, imported: newImportedRecords(), credentials: credentials}
+	standby.synchronize(&components.CoreSystem{Name: "serviceregistrar", Url: srv.URL})
+	records, err := standby.store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Id != rec.Id {
+		t.Fatalf("standby registry %+v after the synchronization, want record %d", records, rec.Id)
+	}
+}
@@ -0,0 +1,160 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+//*********************Export and import of registry snapshots*********************
+
+// RegistrySnapshot_v1 is the document with the records of a registry and their validity at the time it was taken.
+// It is the same for both registrars (sregistrar and esr), so that a local cloud can be migrated from one to the other.
+type RegistrySnapshot_v1 struct {
+	Taken   string                   `json:"taken"` // RFC 3339 time of the export
+	Records []forms.ServiceRecord_v1 `json:"records"`
+	Version string                   `json:"version"`
+}
+
+// importSummary is the reply to an import
+type importSummary struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`  // records already expired
+	Existing int `json:"existing"` // records of services registered locally, whose current record is kept
+}
+
+// snapshot exports (GET) the registry as a RegistrySnapshot_v1 document or imports (POST) one.
+// With the URL query parameter rebase=true, the imported records keep the validity they had left when the snapshot was taken,
+// otherwise they keep their end of validity.
+// The imported records get new ids, so that they never overwrite a local record, and the records of services that are
+// already registered locally are left out. A system renewing with the id of the former registrar is therefore registered anew.
+func (ua *UnitAsset) snapshot(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		records, err := ua.store.List()
+		if err != nil {
+			log.Printf("Error retrieving service records: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if records == nil {
+			records = []forms.ServiceRecord_v1{}
+		}
+		sort.Slice(records, func(i, j int) bool { return records[i].Id < records[j].Id })
+		doc := RegistrySnapshot_v1{Taken: time.Now().Format(time.RFC3339), Records: records, Version: "RegistrySnapshot_v1"}
+		payload, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(payload)
+	case "POST", "PUT":
+		if !ua.isLeading() {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer r.Body.Close()
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		// Only the holder of the registrar's own certificate may import when identities are verified
+		if !ua.authority.authorize(w, r, bodyBytes, "", ua.Owner.Name) {
+			return
+		}
+		var doc RegistrySnapshot_v1
+		if err := json.Unmarshal(bodyBytes, &doc); err != nil {
+			http.Error(w, "Bad Request, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if doc.Version != "RegistrySnapshot_v1" {
+			http.Error(w, fmt.Sprintf("Bad Request, unsupported snapshot version %q", doc.Version), http.StatusBadRequest)
+			return
+		}
+		taken, err := time.Parse(time.RFC3339, doc.Taken)
+		if err != nil {
+			http.Error(w, "Bad Request, invalid time of the snapshot", http.StatusBadRequest)
+			return
+		}
+		rebase := r.URL.Query().Get("rebase") == "true"
+
+		local, err := ua.store.List()
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		now := time.Now()
+		var summary importSummary
+		for _, rec := range doc.Records {
+			expiration, err := time.Parse(time.RFC3339, rec.EndOfValidity)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request, invalid end of validity of record %d", rec.Id), http.StatusBadRequest)
+				return
+			}
+			if rebase {
+				expiration = now.Add(expiration.Sub(taken))
+				rec.EndOfValidity = expiration.Format(time.RFC3339)
+			}
+			if !expiration.After(now) {
+				summary.Skipped++
+				continue
+			}
+			if registeredLocally(local, rec) {
+				summary.Existing++
+				continue
+			}
+			exportedId := rec.Id
+			if _, err := admitService(ua, &rec); err != nil {
+				log.Printf("error importing the record %d: %v\n", exportedId, err)
+				http.Error(w, "Error importing the snapshot", http.StatusInternalServerError)
+				return
+			}
+			ua.imported.track(rec)
+			ua.replicate("register", rec)
+			logEvent(ua, "register", rec, sourceIP(r), fmt.Sprintf("imported from a snapshot (record %d of the export)", exportedId))
+			summary.Imported++
+		}
+		log.Printf("%d service records imported from a snapshot, %d expired records skipped, %d records of local services kept\n", summary.Imported, summary.Skipped, summary.Existing)
+		payload, _ := json.Marshal(summary)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(payload)
+	default:
+		http.Error(w, "Unsupported HTTP request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// registeredLocally checks if the service of an imported record is already registered
+func registeredLocally(local []forms.ServiceRecord_v1, rec forms.ServiceRecord_v1) bool {
+	for _, stored := range local {
+		if SameService(stored, rec) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sdoque/mbaigo/components"
+)
+
+// TestSnapshotRoundTrip exports a registry, as if an hour ago, and imports it into another registrar with and without rebasing the validity
+func TestSnapshotRoundTrip(t *testing.T) {
+	now := time.Now()
+	exporter := servingRegistrar(t, NewMemoryStore())
+	lives := map[string]time.Duration{"kitchen/temperature": 90 * time.Minute, "hall/temperature": 30 * time.Minute, "attic/temperature": 2 * time.Hour}
+	for path, life := range lives {
+		rec := testRecord("thermo", path)
+		rec.Details = map[string][]string{"Unit": {"Celsius"}}
+		if _, err := exporter.store.Register(&rec); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := exporter.store.SetValidity(rec.Id, rec.Updated, now.Add(life).Format(time.RFC3339)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := serve(exporter, http.MethodGet, "/snapshot", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("export answered %d", w.Code)
+	}
+	var doc RegistrySnapshot_v1
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Version != "RegistrySnapshot_v1" || len(doc.Records) != len(lives) {
+		t.Fatalf("exported %s with %d records, want RegistrySnapshot_v1 with %d", doc.Version, len(doc.Records), len(lives))
+	}
+	hourAgo := func(stamp string) string { // the document as it was exported an hour ago
+		at, err := time.Parse(time.RFC3339, stamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return at.Add(-time.Hour).Format(time.RFC3339)
+	}
+	doc.Taken = hourAgo(doc.Taken)
+	for i := range doc.Records {
+		doc.Records[i].EndOfValidity = hourAgo(doc.Records[i].EndOfValidity)
+	}
+
+	tests := []struct {
+		query   string
+		summary importSummary
+		left    map[string]time.Duration // validity left of the imported records by subpath
+	}{
+		{"", importSummary{Imported: 1, Skipped: 1, Existing: 1}, map[string]time.Duration{"kitchen/temperature": 30 * time.Minute}},
+		{"?rebase=true", importSummary{Imported: 2, Existing: 1}, map[string]time.Duration{"kitchen/temperature": 90 * time.Minute, "hall/temperature": 30 * time.Minute}},
+	}
+	for _, tt := range tests {
+		t.Run("import"+tt.query, func(t *testing.T) {
+			importer := servingRegistrar(t, NewMemoryStore())
+			importer.Owner = &components.System{Name: "serviceregistrar"}
+			local := testRecord("thermo", "attic/temperature") // registered on the importer, its record is kept
+			if _, err := importer.store.Register(&local); err != nil {
+				t.Fatal(err)
+			}
+			w := serve(importer, http.MethodPost, "/snapshot"+tt.query, doc)
+			if w.Code != http.StatusOK {
+				t.Fatalf("import answered %d: %s", w.Code, w.Body)
+			}
+			var summary importSummary
+			if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+				t.Fatal(err)
+			}
+			if summary != tt.summary {
+				t.Errorf("summary %+v, want %+v", summary, tt.summary)
+			}
+			records, err := importer.store.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != len(tt.left)+1 {
+				t.Fatalf("%d records after the import, want %d", len(records), len(tt.left)+1)
+			}
+			for _, rec := range records {
+				if rec.SubPath == local.SubPath {
+					if rec.Id != local.Id || rec.EndOfValidity != local.EndOfValidity {
+						t.Errorf("the local record became %d valid until %s", rec.Id, rec.EndOfValidity)
+					}
+					continue
+				}
+				left, ok := tt.left[rec.SubPath]
+				if !ok {
+					t.Errorf("the record %s is imported", rec.SubPath)
+					continue
+				}
+				expiration, _ := time.Parse(time.RFC3339, rec.EndOfValidity)
+				if drift := expiration.Sub(now.Add(left)); drift < -2*time.Second || drift > 2*time.Second {
+					t.Errorf("the record %s is valid until %s, want about %s", rec.SubPath, rec.EndOfValidity, now.Add(left).Format(time.RFC3339))
+				}
+				if rec.Details["Unit"][0] != "Celsius" || rec.ProtoPort["http"] != 20150 {
+					t.Errorf("the record %s lost its details or ports: %+v", rec.SubPath, rec)
+				}
+				if !importer.sched.Cancel(rec.Id) {
+					t.Errorf("the expiration of the record %s is not scheduled", rec.SubPath)
+				}
+			}
+		})
+	}
+}
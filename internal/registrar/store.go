@@ -0,0 +1,107 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"errors"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+//*********************Storage backend of the registry*********************
+
+// The registry operations (registry.go) and the HTTP services only use the Store interface, so that each registrar brings its
+// backend (the SQLite database of sregistrar, the journaled memory of esr or the MemoryStore of this package) and a new one is
+// added by implementing it. The backends run the conformance suite of the package internal/registrar/registrartest (their store_test.go).
+// The scheduling of the expirations, the replication, the notifications and the audit of the changes are left to the registry operations.
+
+// Store is the storage of the service records and of the audit trail
+type Store interface {
+	// Register stores a complete record, assigning its id unless it has one (e.g., replicated from the leading registrar),
+	// and deletes and returns the previous records of the same service (see SameService)
+	Register(rec *forms.ServiceRecord_v1) (replaced []forms.ServiceRecord_v1, err error)
+	// Extend renews an existing record and updates its validity, or returns ErrUnknownRecord if it is missing or does not match
+	Extend(rec *forms.ServiceRecord_v1, now time.Time) error
+	// SetValidity applies the validity of a renewal made by the leading registrar, returning false if the record is unknown
+	SetValidity(id int, updated, endOfValidity string) (bool, error)
+	// Delete removes a record
+	Delete(id int) error
+	// Expire removes a record whose validity ended before now and returns it, or returns nil if it is unknown or still valid
+	Expire(id int, now time.Time) (*forms.ServiceRecord_v1, error)
+	// Get retrieves a record, or returns ErrUnknownRecord
+	Get(id int) (*forms.ServiceRecord_v1, error)
+	// Find returns the records with the service definition that pass the matcher
+	Find(definition string, matcher *QuestMatcher) ([]forms.ServiceRecord_v1, error)
+	// List returns all the records
+	List() ([]forms.ServiceRecord_v1, error)
+	// RecordsOf returns the records of a system and those announcing an IP address (the usage of their quotas)
+	RecordsOf(system, ip string) ([]forms.ServiceRecord_v1, error)
+	// ListSystems returns the systems that have registered services with the http protocol
+	ListSystems() (*forms.SystemRecordList_v1, error)
+	// StoreBatch registers or renews the records of a system at once, returning which ones were renewed and the records retired
+	StoreBatch(records []forms.ServiceRecord_v1, replace bool, now time.Time) (renewed []bool, retired []forms.ServiceRecord_v1, err error)
+	// Reload deletes the expired records inherited from a previous run, marks the others as unconfirmed and returns them
+	Reload(now time.Time) ([]forms.ServiceRecord_v1, error)
+	// Unconfirmed returns the ids of the inherited records that have not yet been renewed
+	Unconfirmed() (map[int]bool, error)
+	// AppendEvent, QueryEvents and PruneEvents manage the audit trail
+	AppendEvent(e HistoryEvent) error
+	QueryEvents(f HistoryFilter) ([]HistoryEvent, error)
+	PruneEvents(before time.Time) error
+	// Close releases the storage
+	Close() error
+}
+
+// ErrUnknownRecord is returned when a record is not in the registry
+var ErrUnknownRecord = errors.New("unknown service record")
+
+// SameService checks if two records have the same natural key, i.e., the same system name and service path
+// with an IP address and a protocol port in common (the service of a system that restarted and registered again)
+func SameService(a, b forms.ServiceRecord_v1) bool {
+	if a.SystemName != b.SystemName || a.SubPath != b.SubPath {
+		return false
+	}
+	sharedIP := len(a.IPAddresses) == 0 && len(b.IPAddresses) == 0
+	for _, ipA := range a.IPAddresses {
+		for _, ipB := range b.IPAddresses {
+			if ipA == ipB {
+				sharedIP = true
+			}
+		}
+	}
+	sharedPort := len(a.ProtoPort) == 0 && len(b.ProtoPort) == 0
+	for proto, port := range a.ProtoPort {
+		if p, ok := b.ProtoPort[proto]; ok && p == port && port != 0 {
+			sharedPort = true
+		}
+	}
+	return sharedIP && sharedPort
+}
+
+// SameCreation checks that a renewed record was created at the same time as the stored one
+func SameCreation(rec, stored forms.ServiceRecord_v1) bool {
+	recCreated, err := time.Parse(time.RFC3339, rec.Created)
+	if err != nil {
+		return false
+	}
+	storedCreated, err := time.Parse(time.RFC3339, stored.Created)
+	if err != nil {
+		return false
+	}
+	return recCreated.Equal(storedCreated)
+}
@@ -0,0 +1,28 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar_test
+
+import (
+	"testing"
+
+	"github.com/sdoque/systems/internal/registrar"
+	"github.com/sdoque/systems/internal/registrar/registrartest"
+)
+
+func TestMemoryStoreConformance(t *testing.T) {
+	registrartest.Run(t, func(t *testing.T) registrar.Store { return registrar.NewMemoryStore() })
+}
@@ -0,0 +1,202 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+//*********************Detailed list of the systems of the local cloud*********************
+
+// The syslist service answers with a SystemRecordList_v1 form, which only locates the systems.
+// With the URL query parameter detailed=true, it answers with a SystemProfileList_v1 document instead, which gathers
+// from the service records what a tool like kgrapher or modeler would otherwise collect by visiting every system:
+// all the protocol ports, the certificate, the details common to its services, the unit assets and their services, and the registration times.
+// The document only holds what the service records carry: the description and the details of the system's husk are not registered.
+// The document is the same for both registrars (sregistrar and esr).
+
+// systemService is a service of a system profile
+type systemService struct {
+	Id            int                 `json:"registryID"`
+	Definition    string              `json:"definition"`
+	SubPath       string              `json:"subpath"`
+	UnitAsset     string              `json:"unitAsset"`
+	Details       map[string][]string `json:"details"`
+	EndOfValidity string              `json:"endOfValidity"`
+}
+
+// SystemProfile_v1 describes a system of the local cloud from its registered services
+type SystemProfile_v1 struct {
+	SystemName      string              `json:"systemName"`
+	Url             string              `json:"url"` // root of the system's husk (https preferred over http), empty if it has neither
+	IPAddresses     []string            `json:"ipAddresses"`
+	ProtoPort       map[string]int      `json:"protoPort"`
+	Certificate     string              `json:"certificate"`
+	SharedDetails   map[string][]string `json:"sharedDetails"` // details (and values) that all the registered services have in common
+	UnitAssets      []string            `json:"unitAssets"`
+	Services        []systemService     `json:"services"`
+	FirstRegistered string              `json:"firstRegistered"` // earliest registration of its current records
+	LastRenewed     string              `json:"lastRenewed"`     // latest registration or renewal of its records
+	Version         string              `json:"version"`
+}
+
+// SystemProfileList_v1 is the detailed answer of the syslist service
+type SystemProfileList_v1 struct {
+	List    []SystemProfile_v1 `json:"list"`
+	Version string             `json:"version"`
+}
+
+// profileSystems groups the service records by system
+func profileSystems(records []forms.ServiceRecord_v1) []SystemProfile_v1 {
+	sort.Slice(records, func(i, j int) bool { return records[i].Id < records[j].Id })
+	bySystem := make(map[string]*SystemProfile_v1)
+	var names []string
+	for _, rec := range records {
+		profile, exists := bySystem[rec.SystemName]
+		if !exists {
+			profile = &SystemProfile_v1{
+				SystemName:    rec.SystemName,
+				IPAddresses:   []string{},
+				ProtoPort:     make(map[string]int),
+				Certificate:   rec.Certificate,
+				SharedDetails: copyDetails(rec.Details),
+				UnitAssets:    []string{},
+				Version:       "SystemProfile_v1",
+			}
+			bySystem[rec.SystemName] = profile
+			names = append(names, rec.SystemName)
+		}
+		for _, ip := range rec.IPAddresses {
+			if !containsString(profile.IPAddresses, ip) {
+				profile.IPAddresses = append(profile.IPAddresses, ip)
+			}
+		}
+		for proto, port := range rec.ProtoPort {
+			if port != 0 {
+				profile.ProtoPort[proto] = port
+			}
+		}
+		profile.SharedDetails = sharedDetails(profile.SharedDetails, rec.Details)
+		unitAsset, _, _ := strings.Cut(rec.SubPath, "/")
+		if !containsString(profile.UnitAssets, unitAsset) {
+			profile.UnitAssets = append(profile.UnitAssets, unitAsset)
+		}
+		profile.Services = append(profile.Services, systemService{
+			Id:            rec.Id,
+			Definition:    rec.ServiceDefinition,
+			SubPath:       rec.SubPath,
+			UnitAsset:     unitAsset,
+			Details:       rec.Details,
+			EndOfValidity: rec.EndOfValidity,
+		})
+		if rec.Created != "" && (profile.FirstRegistered == "" || earlier(rec.Created, profile.FirstRegistered)) {
+			profile.FirstRegistered = rec.Created
+		}
+		if rec.Updated != "" && (profile.LastRenewed == "" || earlier(profile.LastRenewed, rec.Updated)) {
+			profile.LastRenewed = rec.Updated
+		}
+	}
+
+	sort.Strings(names)
+	profiles := make([]SystemProfile_v1, 0, len(names))
+	for _, name := range names {
+		profile := bySystem[name]
+		if len(profile.IPAddresses) > 0 {
+			if port := profile.ProtoPort["https"]; port != 0 {
+				profile.Url = "https://" + profile.IPAddresses[0] + ":" + strconv.Itoa(port) + "/" + name
+			} else if port := profile.ProtoPort["http"]; port != 0 {
+				profile.Url = "http://" + profile.IPAddresses[0] + ":" + strconv.Itoa(port) + "/" + name
+			}
+		}
+		profiles = append(profiles, *profile)
+	}
+	return profiles
+}
+
+// copyDetails returns a copy of the details of a record
+func copyDetails(details map[string][]string) map[string][]string {
+	copied := make(map[string][]string, len(details))
+	for key, values := range details {
+		copied[key] = append([]string{}, values...)
+	}
+	return copied
+}
+
+// sharedDetails keeps the details and values that are also in the details of another record
+func sharedDetails(shared, details map[string][]string) map[string][]string {
+	for key, values := range shared {
+		var kept []string
+		for _, value := range values {
+			if containsString(details[key], value) {
+				kept = append(kept, value)
+			}
+		}
+		if len(kept) == 0 {
+			delete(shared, key)
+		} else {
+			shared[key] = kept
+		}
+	}
+	return shared
+}
+
+// containsString checks if a list has a value
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// earlier compares two RFC 3339 times (as strings if they cannot be parsed)
+func earlier(a, b string) bool {
+	ta, errA := time.Parse(time.RFC3339, a)
+	tb, errB := time.Parse(time.RFC3339, b)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+	return ta.Before(tb)
+}
+
+// systemProfiles answers a GET request on the syslist service with the SystemProfileList_v1 document
+func (ua *UnitAsset) systemProfiles(w http.ResponseWriter) {
+	records, err := ua.records()
+	if err != nil {
+		log.Printf("Error retrieving service records: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	doc := SystemProfileList_v1{List: profileSystems(records), Version: "SystemProfileList_v1"}
+	payload, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(payload)
+}
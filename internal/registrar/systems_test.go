@@ -0,0 +1,51 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+func TestProfileSystems(t *testing.T) {
+	temperature := testRecord("thermo", "kitchen/temperature")
+	temperature.Id = 1
+	temperature.Details = map[string][]string{"Location": {"Kitchen", "Floor1"}, "Unit": {"Celsius"}}
+	humidity := testRecord("thermo", "kitchen/humidity")
+	humidity.Id = 2
+	humidity.ProtoPort = map[string]int{"http": 20150, "https": 20151}
+	humidity.Details = map[string][]string{"Location": {"Kitchen"}}
+	valve := testRecord("heater", "valve/setpoint")
+	valve.Id = 3
+
+	profiles := profileSystems([]forms.ServiceRecord_v1{humidity, valve, temperature})
+	if len(profiles) != 2 || profiles[0].SystemName != "heater" || profiles[1].SystemName != "thermo" {
+		t.Fatalf("profiles %+v, want heater and thermo", profiles)
+	}
+	thermo := profiles[1]
+	if want := map[string][]string{"Location": {"Kitchen"}}; !reflect.DeepEqual(thermo.SharedDetails, want) {
+		t.Fatalf("shared details %v, want %v", thermo.SharedDetails, want)
+	}
+	if thermo.Url != "https://192.168.1.10:20151/thermo" {
+		t.Fatalf("url %s, want the https root of the system", thermo.Url)
+	}
+	if !reflect.DeepEqual(thermo.UnitAssets, []string{"kitchen"}) || len(thermo.Services) != 2 || thermo.Services[0].Id != 1 {
+		t.Fatalf("unit assets %v and services %+v, want the kitchen with records 1 and 2", thermo.UnitAssets, thermo.Services)
+	}
+}
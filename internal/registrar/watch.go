@@ -0,0 +1,174 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/mbaigo/usecases"
+)
+
+//*********************Registry change notifications (Server-Sent Events)*********************
+
+// registryNotice is the notification sent to the watchers when a matching record changes
+type registryNotice struct {
+	Event  string                 `json:"event"` // added, renewed, unregistered or expired
+	Time   string                 `json:"time"`
+	Record forms.ServiceRecord_v1 `json:"record"`
+}
+
+// watcher is a client with an open stream and its filter
+type watcher struct {
+	filter  listingFilter
+	notices chan registryNotice
+}
+
+// watchHub keeps track of the watchers and dispatches the notices to them
+type watchHub struct {
+	mu       sync.Mutex
+	next     int
+	watchers map[int]*watcher
+}
+
+// newWatchHub creates an empty hub
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[int]*watcher)}
+}
+
+// subscribe adds a watcher with its filter and returns its id and notice channel
+func (h *watchHub) subscribe(filter listingFilter) (int, <-chan registryNotice) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.next++
+	w := &watcher{filter: filter, notices: make(chan registryNotice, 64)}
+	h.watchers[h.next] = w
+	return h.next, w.notices
+}
+
+// unsubscribe removes a watcher when its stream is closed
+func (h *watchHub) unsubscribe(id int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.watchers, id)
+}
+
+// publish sends the notice to every watcher whose filter matches the record (without waiting for slow watchers)
+func (h *watchHub) publish(event string, rec forms.ServiceRecord_v1) {
+	if h == nil {
+		return
+	}
+	notice := registryNotice{Event: event, Time: time.Now().Format(time.RFC3339), Record: rec}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, w := range h.watchers {
+		if !w.filter.matches(rec) {
+			continue
+		}
+		select {
+		case w.notices <- notice:
+		default:
+			log.Printf("watcher %d is too slow, dropping the %s notice of record %d\n", id, event, rec.Id)
+		}
+	}
+}
+
+// watch streams the changes of the matching records as Server-Sent Events.
+// The filter is given with the URL query parameters of the listing (GET) or with a ServiceQuest_v1 form (POST)
+func (ua *UnitAsset) watch(w http.ResponseWriter, r *http.Request) {
+	var filter listingFilter
+	switch r.Method {
+	case "GET":
+		var err error
+		if filter, err = parseListingFilter(r.URL.Query()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "POST":
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+		defer r.Body.Close()
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		questForm, err := usecases.Unpack(bodyBytes, mediaType)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		qf, ok := questForm.(*forms.ServiceQuest_v1)
+		if !ok {
+			http.Error(w, "Bad Request, a ServiceQuest_v1 form is expected", http.StatusBadRequest)
+			return
+		}
+		matcher, err := CompileQuest(qf.ServiceDefinition, qf.Details)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter = listingFilter{matcher: matcher}
+	default:
+		http.Error(w, "Unsupported HTTP request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	id, notices := ua.watchers.subscribe(filter)
+	defer ua.watchers.unsubscribe(id)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case notice := <-notices:
+			payload, err := json.Marshal(notice)
+			if err != nil {
+				log.Printf("error marshalling the registry notice: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", notice.Event, payload)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package registrar
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+// TestWatchEvents checks the events that a watcher of the temperature services receives as the registry changes
+func TestWatchEvents(t *testing.T) {
+	ua := servingRegistrar(t, NewMemoryStore())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { ua.Serving(w, r, "watch") }))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/watch?definition=temperature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q, want text/event-stream", ct)
+	}
+	received := make(chan registryNotice)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var notice registryNotice
+				if err := json.Unmarshal([]byte(data), &notice); err == nil {
+					received <- notice
+				}
+			}
+		}
+	}()
+
+	register := func(rec forms.ServiceRecord_v1) forms.ServiceRecord_v1 {
+		rec.Version = "ServiceRecord_v1"
+		w := serve(ua, http.MethodPost, "/register", rec)
+		if w.Code != http.StatusOK {
+			t.Fatalf("registration answered %d: %s", w.Code, w.Body)
+		}
+		var stored forms.ServiceRecord_v1
+		if err := json.Unmarshal(w.Body.Bytes(), &stored); err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+	kitchen := register(testRecord("thermo", "kitchen/temperature"))
+	pressure := testRecord("thermo", "kitchen/pressure")
+	pressure.ServiceDefinition = "pressure" // not watched
+	register(pressure)
+	register(kitchen) // renewed with its id
+	if w := serve(ua, http.MethodDelete, fmt.Sprintf("/unregister/%d", kitchen.Id), nil); w.Code != http.StatusOK {
+		t.Fatalf("unregistration answered %d", w.Code)
+	}
+	hall := register(testRecord("thermo", "hall/temperature"))
+	past := time.Now().Add(-time.Second).Format(time.RFC3339)
+	if _, err := ua.store.SetValidity(hall.Id, past, past); err != nil {
+		t.Fatal(err)
+	}
+	checkExpiration(ua, hall.Id)
+
+	want := []struct {
+		event string
+		id    int
+	}{{"added", kitchen.Id}, {"renewed", kitchen.Id}, {"unregistered", kitchen.Id}, {"added", hall.Id}, {"expired", hall.Id}}
+	for i, w := range want {
+		select {
+		case notice := <-received:
+			if notice.Event != w.event || notice.Record.Id != w.id || notice.Record.ServiceDefinition != "temperature" {
+				t.Errorf("event %d: %s of record %d (%s), want %s of record %d", i, notice.Event, notice.Record.Id, notice.Record.ServiceDefinition, w.event, w.id)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("event %d: no %s event of record %d", i, w.event, w.id)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+// Package registrytest is the conformance suite of the storage backends of the service registrars (sregistrar and esr).
+// Each registrar adapts its backends to the Store interface in its store_test.go and calls Run for each of them,
+// so that a quest, a renewal or a bulk registration gives the same result whichever backend and registrar is used.
+package registrytest
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+// Record is the part of a service record that the storage backends keep
+type Record struct {
+	Id            int
+	Definition    string
+	SystemName    string
+	SubPath       string
+	IPAddresses   []string
+	ProtoPort     map[string]int
+	Details       map[string][]string
+	RegLife       int
+	Created       string
+	Updated       string
+	EndOfValidity string
+}
+
+// Store is the adapter of a storage backend under test
+type Store interface {
+	// Register stores a complete record, assigning its id unless it has one, and returns the records of the same service it deleted
+	Register(rec *Record) (replaced []Record, err error)
+	// Extend renews a record, returning false if it is unknown or does not match the stored one
+	Extend(rec *Record, now time.Time) (bool, error)
+	// SetValidity sets the validity of a record, returning false if it is unknown
+	SetValidity(id int, updated, endOfValidity string) (bool, error)
+	// Delete removes a record
+	Delete(id int) error
+	// Get retrieves a record, returning false if it is unknown
+	Get(id int) (Record, bool, error)
+	// Find returns the records answering a service quest
+	Find(definition string, details map[string][]string) ([]Record, error)
+	// List returns all the records
+	List() ([]Record, error)
+	// StoreBatch registers or renews the records of a system at once
+	StoreBatch(records []Record, replace bool, now time.Time) (renewed []bool, retired []Record, err error)
+	// Close releases the backend
+	Close() error
+}
+
+// conformanceCase is a behaviour that every backend must have
+type conformanceCase struct {
+	name string
+	run  func(t *testing.T, s Store)
+}
+
+var cases = []conformanceCase{
+	{"register assigns distinct ids", testRegisterAssignsIds},
+	{"register keeps a given id", testRegisterKeepsId},
+	{"register replaces the same service", testRegisterReplaces},
+	{"register keeps other instances", testRegisterKeepsOthers},
+	{"extend renews a matching record", testExtend},
+	{"extend rejects unknown or mismatching records", testExtendRejects},
+	{"set validity", testSetValidity},
+	{"delete", testDelete},
+	{"find", testFind},
+	{"store batch", testStoreBatch},
+	{"store batch with replace", testStoreBatchReplace},
+}
+
+// Run runs the conformance suite on fresh stores opened by open
+func Run(t *testing.T, open func(t *testing.T) Store) {
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+			c.run(t, s)
+		})
+	}
+}
+
+// start is the time of the records of the suite
+var start = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// newRecord returns a registered record of a service of a system (as prepared by the registry layer)
+func newRecord(system, subPath, definition, ip string, details map[string][]string) Record {
+	return Record{
+		Definition:    definition,
+		SystemName:    system,
+		SubPath:       subPath,
+		IPAddresses:   []string{ip},
+		ProtoPort:     map[string]int{"http": 20150},
+		Details:       details,
+		RegLife:       30,
+		Created:       start.Format(time.RFC3339),
+		Updated:       start.Format(time.RFC3339),
+		EndOfValidity: start.Add(30 * time.Second).Format(time.RFC3339),
+	}
+}
+
+// mustRegister registers a record and fails the test on error
+func mustRegister(t *testing.T, s Store, rec Record) Record {
+	t.Helper()
+	if _, err := s.Register(&rec); err != nil {
+		t.Fatalf("register %s/%s: %v", rec.SystemName, rec.SubPath, err)
+	}
+	return rec
+}
+
+// mustGet retrieves a record and fails the test if it is missing
+func mustGet(t *testing.T, s Store, id int) Record {
+	t.Helper()
+	rec, found, err := s.Get(id)
+	if err != nil || !found {
+		t.Fatalf("get %d: found=%v, err=%v", id, found, err)
+	}
+	return rec
+}
+
+// ids returns the sorted ids of records
+func ids(records []Record) []int {
+	list := make([]int, 0, len(records))
+	for _, rec := range records {
+		list = append(list, rec.Id)
+	}
+	sort.Ints(list)
+	return list
+}
+
+// sameIds compares two sorted lists of ids
+func sameIds(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testRegisterAssignsIds(t *testing.T, s Store) {
+	a := mustRegister(t, s, newRecord("thermo", "t1/temperature", "temperature", "192.168.1.10", nil))
+	b := mustRegister(t, s, newRecord("thermo", "t2/temperature", "temperature", "192.168.1.10", nil))
+	if a.Id == 0 || b.Id == 0 || a.Id == b.Id {
+		t.Fatalf("ids %d and %d, want distinct non-zero ids", a.Id, b.Id)
+	}
+	stored := mustGet(t, s, a.Id)
+	if stored.SystemName != "thermo" || stored.SubPath != "t1/temperature" || stored.Definition != "temperature" || stored.EndOfValidity != a.EndOfValidity {
+		t.Fatalf("stored record %+v differs from the registered one %+v", stored, a)
+	}
+	all, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(all); !sameIds(got, ids([]Record{a, b})) {
+		t.Fatalf("list returned %v, want %v", got, ids([]Record{a, b}))
+	}
+}
+
+func testRegisterKeepsId(t *testing.T, s Store) {
+	rec := newRecord("thermo", "t1/temperature", "temperature", "192.168.1.10", nil)
+	rec.Id = 42 // replicated from the leading registrar
+	rec = mustRegister(t, s, rec)
+	if rec.Id != 42 {
+		t.Fatalf("id %d, want 42", rec.Id)
+	}
+	mustGet(t, s, 42)
+	next := mustRegister(t, s, newRecord("thermo", "t2/temperature", "temperature", "192.168.1.10", nil))
+	if next.Id == 42 {
+		t.Fatal("a new record took the id of a live record")
+	}
+}
+
+func testRegisterReplaces(t *testing.T, s Store) {
+	old := mustRegister(t, s, newRecord("thermo", "t1/temperature", "temperature", "192.168.1.10", nil))
+	restarted := newRecord("thermo", "t1/temperature", "temperature", "192.168.1.10", nil)
+	replaced, err := s.Register(&restarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameIds(ids(replaced), []int{old.Id}) {
+		t.Fatalf("replaced %v, want [%d]", ids(replaced), old.Id)
+	}
+	if _, found, _ := s.Get(old.Id); found {
+		t.Fatalf("the replaced record %d is still stored", old.Id)
+	}
+	mustGet(t, s, restarted.Id)
+}
+
+func testRegisterKeepsOthers(t *testing.T, s Store) {
+	first := mustRegister(t, s, newRecord("thermo", "t1/temperature", "temperature", "192.168.1.10", nil))
+	second := newRecord("thermo", "t1/temperature", "temperature", "192.168.1.11", nil) // another instance of the system
+	replaced, err := s.Register(&second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replaced) != 0 {
+		t.Fatalf("replaced %v, want none", ids(replaced))
+	}
+	mustGet(t, s, first.Id)
+}
+
+func testExtend(t *testing.T, s Store) {
+	rec := mustRegister(t, s, newRecord("thermo", "t1/temperature", "temperature", "192.168.1.10", nil))
+	now := start.Add(20 * time.Second)
+	renewal := rec
+	renewal.RegLife = 3600 // the registered lifetime applies
+	known, err := s.Extend(&renewal, now)
+	if err != nil || !known {
+		t.Fatalf("extend: known=%v, err=%v", known, err)
+	}
+	want := now.Add(30 * time.Second).Format(time.RFC3339)
+	if renewal.EndOfValidity != want || renewal.Updated != now.Format(time.RFC3339) {
+		t.Fatalf("renewal valid until %s (updated %s), want %s", renewal.EndOfValidity, renewal.Updated, want)
+	}
+	if stored := mustGet(t, s, rec.Id); stored.EndOfValidity != want {
+		t.Fatalf("stored record valid until %s, want %s", stored.EndOfValidity, want)
+	}
+}
+
+func testExtendRejects(t *testing.T, s Store) {
+	rec := mustRegister(t, s, newRecord("thermo", "t1/temperature", "temperature", "192.168.1.10", nil))
+	tests := []struct {
+		name   string
+		change func(r *Record)
+	}{
+		{"unknown id", func(r *Record) { r.Id += 1000 }},
+		{"other creation", func(r *Record) { r.Created = start.Add(time.Minute).Format(time.RFC3339) }},
+		{"other system", func(r *Record) { r.SystemName = "intruder" }},
+		{"other definition", func(r *Record) { r.Definition = "pressure" }},
+		{"other path", func(r *Record) { r.SubPath = "t9/temperature" }},
+	}
+	for _, tt := range tests {
+		renewal := rec
+		tt.change(&renewal)
+		known, err := s.Extend(&renewal, start.Add(time.Second))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if known {
+			t.Fatalf("%s: the renewal was accepted", tt.name)
+		}
+	}
+	if stored := mustGet(t, s, rec.Id); stored.EndOfValidity != rec.EndOfValidity {
+		t.Fatalf("a rejected renewal changed the validity to %s", stored.EndOfValidity)
+	}
+}
+
+func testSetValidity(t *testing.T, s Store) {
+	rec := mustRegister(t, s, newRecord("thermo", "t1/temperature", "temperature", "192.168.1.10", nil))
+	updated, end := start.Add(time.Minute).Format(time.RFC3339), start.Add(2*time.Minute).Format(time.RFC3339)
+	if found, err := s.SetValidity(rec.Id, updated, end); err != nil || !found {
+		t.Fatalf("set validity: found=%v, err=%v", found, err)
+	}
+	if stored := mustGet(t, s, rec.Id); stored.Updated != updated || stored.EndOfValidity != end {
+		t.Fatalf("stored validity %s-%s, want %s-%s", stored.Updated, stored.EndOfValidity, updated, end)
+	}
+	if found, err := s.SetValidity(rec.Id+1000, updated, end); err != nil || found {
+		t.Fatalf("set validity of an unknown record: found=%v, err=%v", found, err)
+	}
+}
+
+func testDelete(t *testing.T, s Store) {
+	rec := mustRegister(t, s, newRecord("thermo", "t1/temperature", "temperature", "192.168.1.10", nil))
+	if err := s.Delete(rec.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := s.Get(rec.Id); found || err != nil {
+		t.Fatalf("get after delete: found=%v, err=%v", found, err)
+	}
+	if err := s.Delete(rec.Id); err != nil {
+		t.Fatalf("deleting an unknown record: %v", err)
+	}
+	if all, _ := s.List(); len(all) != 0 {
+		t.Fatalf("list after delete returned %v", ids(all))
+	}
+}
+
+func testFind(t *testing.T, s Store) {
+	kitchen := mustRegister(t, s, newRecord("thermo", "kitchen/temperature", "temperature", "192.168.1.10", map[string][]string{"Location": {"Kitchen"}, "Unit": {"Celsius"}}))
+	attic := mustRegister(t, s, newRecord("thermo", "attic/temperature", "temperature", "192.168.1.10", map[string][]string{"Location": {"Attic"}, "Unit": {"Kelvin"}, "Deprecated": {"true"}}))
+	valve := mustRegister(t, s, newRecord("heater", "valve/setpoint", "setpoint", "192.168.1.20", map[string][]string{"Location": {"Kitchen"}}))
+
+	tests := []struct {
+		name       string
+		definition string
+		details    map[string][]string
+		want       []Record
+	}{
+		{"definition", "temperature", nil, []Record{kitchen, attic}},
+		{"other definition", "setpoint", nil, []Record{valve}},
+		{"unknown definition", "pressure", nil, nil},
+		{"detail", "temperature", map[string][]string{"Location": {"Kitchen"}}, []Record{kitchen}},
+		{"wildcard", "temperature", map[string][]string{"Location": {"Att*"}}, []Record{attic}},
+		{"any of the values", "temperature", map[string][]string{"Unit": {"Celsius", "Kelvin"}}, []Record{kitchen, attic}},
+		{"absent key", "temperature", map[string][]string{"!Deprecated": {}}, []Record{kitchen}},
+		{"query", "temperature", map[string][]string{"Query": {"SystemName=thermo AND NOT Location=Kitchen"}}, []Record{attic}},
+	}
+	for _, tt := range tests {
+		found, err := s.Find(tt.definition, tt.details)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got, want := ids(found), ids(tt.want); !sameIds(got, want) {
+			t.Fatalf("%s: found %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func testStoreBatch(t *testing.T, s Store) {
+	known := mustRegister(t, s, newRecord("modbus", "coil1/state", "state", "192.168.1.30", nil))
+	batch := []Record{known, newRecord("modbus", "coil2/state", "state", "192.168.1.30", nil)}
+	now := start.Add(10 * time.Second)
+	renewed, retired, err := s.StoreBatch(batch, false, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(renewed) != 2 || !renewed[0] || renewed[1] {
+		t.Fatalf("renewed %v, want [true false]", renewed)
+	}
+	if len(retired) != 0 {
+		t.Fatalf("retired %v, want none", ids(retired))
+	}
+	if batch[0].Id != known.Id || batch[1].Id == 0 || batch[1].Id == known.Id {
+		t.Fatalf("batch ids %d and %d, want %d and a new id", batch[0].Id, batch[1].Id, known.Id)
+	}
+	want := now.Add(30 * time.Second).Format(time.RFC3339)
+	for _, rec := range batch {
+		if stored := mustGet(t, s, rec.Id); stored.EndOfValidity != want {
+			t.Fatalf("record %d valid until %s, want %s", rec.Id, stored.EndOfValidity, want)
+		}
+	}
+}
+
+func testStoreBatchReplace(t *testing.T, s Store) {
+	kept := mustRegister(t, s, newRecord("modbus", "coil1/state", "state", "192.168.1.30", nil))
+	dropped := mustRegister(t, s, newRecord("modbus", "coil2/state", "state", "192.168.1.30", nil))
+	other := mustRegister(t, s, newRecord("thermo", "t1/temperature", "temperature", "192.168.1.10", nil))
+	batch := []Record{kept, newRecord("modbus", "coil3/state", "state", "192.168.1.30", nil)}
+	_, retired, err := s.StoreBatch(batch, true, start.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameIds(ids(retired), []int{dropped.Id}) {
+		t.Fatalf("retired %v, want [%d]", ids(retired), dropped.Id)
+	}
+	all, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(all), ids([]Record{kept, batch[1], other}); !sameIds(got, want) {
+		t.Fatalf("registry holds %v, want %v", got, want)
+	}
+}
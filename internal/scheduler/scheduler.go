@@ -0,0 +1,266 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+// Package scheduler is the expiration scheduler shared by the service registrars (sregistrar and esr).
+// All the changes to the queue (add, reschedule and cancel by record id) are made by its run loop,
+// which sleeps on a timer until the earliest deadline or the next change.
+package scheduler
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+//*********************Expired services cleaning scheduler*********************
+
+// Clock provides the time to the scheduler, so that it can be replaced by a simulated clock in tests
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the timer of a Clock
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// systemClock is the wall clock
+type systemClock struct{}
+
+// Now returns the current time
+func (systemClock) Now() time.Time { return time.Now() }
+
+// NewTimer starts a timer of the wall clock
+func (systemClock) NewTimer(d time.Duration) Timer { return systemTimer{time.NewTimer(d)} }
+
+// systemTimer wraps a timer of the time package
+type systemTimer struct{ t *time.Timer }
+
+// C returns the channel on which the time is delivered
+func (st systemTimer) C() <-chan time.Time { return st.t.C }
+
+// Stop prevents the timer from firing
+func (st systemTimer) Stop() bool { return st.t.Stop() }
+
+// cleaningTask holds the time for the next time a service is due to expire
+type cleaningTask struct {
+	Deadline time.Time // the time when job has to be executed
+	Job      func()    // call to check expiration of a record
+	Id       int       // the job Id is the record id and is used to reschedule or cancel a scheduled task
+	index    int       // position of the task in the heap
+}
+
+// cleaningQueue the list of schedlued check on service expiration
+type cleaningQueue []*cleaningTask
+
+// Len returns the length of the service list and their expiration time
+func (cq cleaningQueue) Len() int { return len(cq) }
+
+// Less checks if a task is due sooner than another
+func (cq cleaningQueue) Less(i, j int) bool {
+	return cq[i].Deadline.Before(cq[j].Deadline)
+}
+
+// Swap exchanges the order of task if one is due before the other
+func (cq cleaningQueue) Swap(i, j int) {
+	cq[i], cq[j] = cq[j], cq[i]
+	cq[i].index = i
+	cq[j].index = j
+}
+
+// Push adds a task to the task list or queue
+func (cq *cleaningQueue) Push(x interface{}) {
+	task := x.(*cleaningTask)
+	task.index = len(*cq)
+	*cq = append(*cq, task)
+}
+
+// Pop remove a task from the cleaning queue
+func (cq *cleaningQueue) Pop() interface{} {
+	old := *cq
+	n := len(old)
+	task := old[n-1]
+	old[n-1] = nil
+	task.index = -1
+	*cq = old[0 : n-1]
+	return task
+}
+
+// command is a change of the queue sent to the run loop
+type command struct {
+	action   string // add, reschedule or cancel
+	id       int
+	deadline time.Time
+	job      func()
+	found    chan bool // reply telling if the task was in the queue
+}
+
+// Metrics describes the state of the scheduler
+type Metrics struct {
+	QueueLength int           // number of scheduled tasks
+	Lag         time.Duration // delay between the deadline and the execution of the last task
+	MaxLag      time.Duration // largest delay observed
+	Executed    uint64        // number of tasks executed
+}
+
+// Scheduler struct type with the queue, the tasks indexed by id and the command channel of the run loop
+type Scheduler struct {
+	clock     Clock
+	taskQueue cleaningQueue
+	tasks     map[int]*cleaningTask
+	commands  chan command
+	stopChan  chan struct{}
+	stopOnce  sync.Once
+	mu        sync.Mutex // protects the metrics
+	metrics   Metrics
+}
+
+// New creates a new scheduler that follows the wall clock
+func New() *Scheduler {
+	return NewWithClock(systemClock{})
+}
+
+// NewWithClock creates a new scheduler that follows the given clock
+func NewWithClock(clock Clock) *Scheduler {
+	return &Scheduler{
+		clock:    clock,
+		tasks:    make(map[int]*cleaningTask),
+		commands: make(chan command),
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Add schedules the job of a record at its deadline, replacing the task already scheduled for that record
+func (s *Scheduler) Add(deadline time.Time, job func(), id int) {
+	s.send(command{action: "add", id: id, deadline: deadline, job: job})
+}
+
+// Reschedule moves the deadline of the task of a record and returns false if there is no such task
+func (s *Scheduler) Reschedule(id int, deadline time.Time) bool {
+	return s.send(command{action: "reschedule", id: id, deadline: deadline})
+}
+
+// Cancel removes the task of a record and returns false if there is no such task
+func (s *Scheduler) Cancel(id int) bool {
+	return s.send(command{action: "cancel", id: id})
+}
+
+// Metrics returns the queue length and the lag of the scheduler
+func (s *Scheduler) Metrics() Metrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metrics
+}
+
+// send passes a command to the run loop and waits for its reply (false once the scheduler is stopped)
+func (s *Scheduler) send(cmd command) bool {
+	cmd.found = make(chan bool, 1)
+	select {
+	case <-s.stopChan: // the run loop could otherwise still pick the command after Stop
+		return false
+	default:
+	}
+	select {
+	case s.commands <- cmd:
+		return <-cmd.found
+	case <-s.stopChan:
+		return false
+	}
+}
+
+// apply carries out a command on the queue
+func (s *Scheduler) apply(cmd command) {
+	task, found := s.tasks[cmd.id]
+	switch cmd.action {
+	case "add":
+		if found {
+			task.Deadline = cmd.deadline
+			task.Job = cmd.job
+			heap.Fix(&s.taskQueue, task.index)
+		} else {
+			task = &cleaningTask{Deadline: cmd.deadline, Job: cmd.job, Id: cmd.id}
+			heap.Push(&s.taskQueue, task)
+			s.tasks[cmd.id] = task
+		}
+	case "reschedule":
+		if found {
+			task.Deadline = cmd.deadline
+			heap.Fix(&s.taskQueue, task.index)
+		}
+	case "cancel":
+		if found {
+			heap.Remove(&s.taskQueue, task.index)
+			delete(s.tasks, cmd.id)
+		}
+	}
+	cmd.found <- found
+}
+
+// execute starts the jobs whose deadline has passed
+func (s *Scheduler) execute() {
+	now := s.clock.Now()
+	for len(s.taskQueue) > 0 && !s.taskQueue[0].Deadline.After(now) {
+		task := heap.Pop(&s.taskQueue).(*cleaningTask)
+		delete(s.tasks, task.Id)
+		lag := now.Sub(task.Deadline)
+		s.mu.Lock()
+		s.metrics.Lag = lag
+		if lag > s.metrics.MaxLag {
+			s.metrics.MaxLag = lag
+		}
+		s.metrics.Executed++
+		s.mu.Unlock()
+		go task.Job()
+	}
+}
+
+// Run is the goroutine that owns the queue: it applies the changes and executes the tasks when they are due
+func (s *Scheduler) Run() {
+	for {
+		s.mu.Lock()
+		s.metrics.QueueLength = len(s.taskQueue)
+		s.mu.Unlock()
+
+		var timer Timer
+		var due <-chan time.Time
+		if len(s.taskQueue) > 0 {
+			timer = s.clock.NewTimer(s.taskQueue[0].Deadline.Sub(s.clock.Now()))
+			due = timer.C()
+		}
+
+		select {
+		case cmd := <-s.commands:
+			s.apply(cmd)
+		case <-due:
+			s.execute()
+		case <-s.stopChan:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Stop terminates the scheduler
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+}
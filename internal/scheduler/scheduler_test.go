@@ -0,0 +1,239 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package scheduler
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a simulated clock that only moves when the test advances it
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// fakeTimer is a timer of the fake clock
+type fakeTimer struct {
+	clock    *fakeClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+// NewTimer fires at once when the duration is not positive, as the timers of the time package do
+func (fc *fakeClock) NewTimer(d time.Duration) Timer {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	ft := &fakeTimer{clock: fc, deadline: fc.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		ft.c <- fc.now
+		return ft
+	}
+	fc.timers = append(fc.timers, ft)
+	return ft
+}
+
+// Advance moves the clock forward and fires the timers that are due
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.now = fc.now.Add(d)
+	pending := fc.timers[:0]
+	for _, ft := range fc.timers {
+		if ft.deadline.After(fc.now) {
+			pending = append(pending, ft)
+			continue
+		}
+		ft.c <- fc.now
+	}
+	fc.timers = pending
+}
+
+func (ft *fakeTimer) C() <-chan time.Time { return ft.c }
+
+func (ft *fakeTimer) Stop() bool {
+	ft.clock.mu.Lock()
+	defer ft.clock.mu.Unlock()
+	for i, other := range ft.clock.timers {
+		if other == ft {
+			ft.clock.timers = append(ft.clock.timers[:i], ft.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// harness runs a scheduler on a fake clock and collects the ids of the executed jobs
+type harness struct {
+	clock    *fakeClock
+	sched    *Scheduler
+	executed chan int
+}
+
+func newHarness(t *testing.T) *harness {
+	h := &harness{clock: newFakeClock(), executed: make(chan int, 16)}
+	h.sched = NewWithClock(h.clock)
+	go h.sched.Run()
+	t.Cleanup(h.sched.Stop)
+	return h
+}
+
+// add schedules a job reporting its id after the given delay from the current fake time
+func (h *harness) add(id int, after time.Duration) {
+	h.sched.Add(h.clock.Now().Add(after), func() { h.executed <- id }, id)
+}
+
+// expect waits for the next executed job and checks its id
+func (h *harness) expect(t *testing.T, id int) {
+	t.Helper()
+	select {
+	case got := <-h.executed:
+		if got != id {
+			t.Fatalf("executed job %d, want %d", got, id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("job %d was not executed", id)
+	}
+}
+
+// pending checks that the task of a record is still in the queue (its deadline has not passed)
+// by moving it to the same deadline, which is a synchronous call to the run loop
+func (h *harness) pending(t *testing.T, id int, deadline time.Time) {
+	t.Helper()
+	if !h.sched.Reschedule(id, deadline) {
+		t.Fatalf("task %d is no longer scheduled", id)
+	}
+}
+
+func TestAddExecutesAtDeadline(t *testing.T) {
+	h := newHarness(t)
+	h.add(1, 10*time.Second)
+	deadline := h.clock.Now().Add(10 * time.Second)
+
+	h.clock.Advance(9 * time.Second)
+	h.pending(t, 1, deadline)
+
+	h.clock.Advance(time.Second)
+	h.expect(t, 1)
+	if h.sched.Cancel(1) {
+		t.Fatal("an executed task can still be cancelled")
+	}
+	if m := h.sched.Metrics(); m.Executed != 1 || m.Lag != 0 {
+		t.Fatalf("metrics = %+v, want one task executed without lag", m)
+	}
+}
+
+func TestAddReplacesTaskOfSameId(t *testing.T) {
+	h := newHarness(t)
+	h.add(1, 5*time.Second)
+	h.add(1, 20*time.Second)
+	deadline := h.clock.Now().Add(20 * time.Second)
+
+	h.clock.Advance(10 * time.Second)
+	h.pending(t, 1, deadline)
+
+	h.clock.Advance(10 * time.Second)
+	h.expect(t, 1)
+}
+
+func TestOrderOfExecution(t *testing.T) {
+	h := newHarness(t)
+	h.add(3, 30*time.Second)
+	h.add(1, 10*time.Second)
+	h.add(2, 20*time.Second)
+
+	for _, id := range []int{1, 2, 3} {
+		h.clock.Advance(10 * time.Second)
+		h.expect(t, id)
+	}
+}
+
+func TestReschedule(t *testing.T) {
+	h := newHarness(t)
+	start := h.clock.Now()
+	h.add(1, 10*time.Second)
+	h.add(2, 20*time.Second)
+
+	// the renewal of record 1 moves it after record 2
+	if !h.sched.Reschedule(1, start.Add(30*time.Second)) {
+		t.Fatal("the task of record 1 was not found")
+	}
+	if h.sched.Reschedule(9, start.Add(time.Second)) {
+		t.Fatal("an unknown task was rescheduled")
+	}
+
+	h.clock.Advance(10 * time.Second)
+	h.pending(t, 1, start.Add(30*time.Second))
+	h.clock.Advance(10 * time.Second)
+	h.expect(t, 2)
+	h.clock.Advance(10 * time.Second)
+	h.expect(t, 1)
+}
+
+func TestCancel(t *testing.T) {
+	h := newHarness(t)
+	h.add(1, 10*time.Second)
+	h.add(2, 20*time.Second)
+
+	if !h.sched.Cancel(1) {
+		t.Fatal("the task of record 1 was not found")
+	}
+	if h.sched.Cancel(1) {
+		t.Fatal("the task of record 1 was cancelled twice")
+	}
+
+	h.clock.Advance(20 * time.Second)
+	h.expect(t, 2)
+	select {
+	case id := <-h.executed:
+		t.Fatalf("cancelled job %d was executed", id)
+	default:
+	}
+}
+
+func TestLagMetrics(t *testing.T) {
+	h := newHarness(t)
+	h.add(1, 10*time.Second)
+	h.clock.Advance(15 * time.Second)
+	h.expect(t, 1)
+	m := h.sched.Metrics()
+	if m.Lag != 5*time.Second || m.MaxLag != 5*time.Second || m.Executed != 1 {
+		t.Fatalf("metrics = %+v, want a lag of 5s", m)
+	}
+}
+
+func TestStoppedScheduler(t *testing.T) {
+	h := newHarness(t)
+	h.add(1, 10*time.Second)
+	h.sched.Stop()
+	h.sched.Stop() // stopping twice is harmless
+	if h.sched.Reschedule(1, h.clock.Now()) || h.sched.Cancel(1) {
+		t.Fatal("a stopped scheduler accepted a change")
+	}
+}
@@ -0,0 +1,236 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Jan van Deventer
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-2.0/
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/mbaigo/usecases"
+	"github.com/sdoque/systems/internal/loadgen"
+)
+
+// loadtest drives the load generator of internal/loadgen against a service registrar (sregistrar or esr) and an orchestrator over HTTP.
+// The registrars run the same simulation in process against their storage backends (see the README).
+
+func main() {
+	var s loadgen.Settings
+	var registrar, orchestrator, mix string
+	flag.StringVar(&registrar, "registrar", "http://localhost:20102/serviceregistrar/registry", "URL of the registrar's unit asset")
+	flag.StringVar(&orchestrator, "orchestrator", "http://localhost:20103/orchestrator/orchestration", "URL of the orchestrator's unit asset")
+	flag.IntVar(&s.Systems, "systems", 100, "number of simulated systems")
+	flag.IntVar(&s.Services, "services", 3, "number of services of each system")
+	flag.DurationVar(&s.Duration, "duration", time.Minute, "duration of the test")
+	flag.DurationVar(&s.RegPeriod, "regperiod", 10*time.Second, "time between two renewals of a service")
+	flag.DurationVar(&s.RegLife, "reglife", 20*time.Second, "registration life of the services")
+	flag.Float64Var(&s.Rate, "rate", 20, "service quests per second")
+	flag.StringVar(&mix, "mix", "query=7,squest=3", "weights of the quests: query (registrar), squest (orchestrator) and list (filtered listing)")
+	flag.Float64Var(&s.Crash, "crash", 0.1, "fraction of the systems that stop renewing without unregistering")
+	out := flag.String("out", "", "file of the JSON report (standard output if empty)")
+	flag.Parse()
+
+	var err error
+	if s.Mix, err = loadgen.ParseMix(mix); err != nil {
+		log.Fatalf("invalid mix: %v\n", err)
+	}
+	if s.RegPeriod >= s.RegLife {
+		log.Fatalf("the registration period (%v) must be shorter than the registration life (%v)\n", s.RegPeriod, s.RegLife)
+	}
+	if s.Systems < 1 || s.Services < 1 {
+		log.Fatalf("at least one system with one service is needed\n")
+	}
+
+	target := &httpTarget{registrar: registrar, orchestrator: orchestrator, client: &http.Client{Timeout: 5 * time.Second}}
+	report := loadgen.Run(s, target)
+	report.Registrar, report.Orchestrator = registrar, orchestrator
+	payload, err := report.Marshal()
+	if err != nil {
+		log.Fatalf("error encoding the report: %v\n", err)
+	}
+	if *out == "" {
+		fmt.Println(string(payload))
+		return
+	}
+	if err := os.WriteFile(*out, payload, 0o644); err != nil {
+		log.Fatalf("error writing the report: %v\n", err)
+	}
+}
+
+// httpTarget is a registrar (and an orchestrator) reached over HTTP
+type httpTarget struct {
+	registrar    string // URL of the registrar's unit asset
+	orchestrator string // URL of the orchestrator's unit asset
+	client       *http.Client
+}
+
+// serviceRecord describes a simulated service
+func serviceRecord(svc loadgen.Service) *forms.ServiceRecord_v1 {
+	return &forms.ServiceRecord_v1{
+		ServiceDefinition: svc.Definition,
+		SystemName:        svc.System,
+		IPAddresses:       []string{svc.Address},
+		ProtoPort:         map[string]int{"http": svc.Port},
+		Details:           map[string][]string{"Location": {svc.Location}},
+		SubPath:           svc.SubPath,
+		RegLife:           int(svc.RegLife.Seconds()),
+		Version:           "ServiceRecord_v1",
+	}
+}
+
+// Register registers (POST) a service and keeps the record returned by the registrar
+func (h *httpTarget) Register(svc loadgen.Service) (loadgen.Registration, error) {
+	return h.store(http.MethodPost, serviceRecord(svc))
+}
+
+// Renew renews (PUT) a service with the record returned by the registrar
+func (h *httpTarget) Renew(svc loadgen.Service, reg loadgen.Registration) (loadgen.Registration, error) {
+	rec, ok := reg.Record.(*forms.ServiceRecord_v1)
+	if !ok {
+		return reg, fmt.Errorf("the record of %s is unknown", svc.SubPath)
+	}
+	return h.store(http.MethodPut, rec)
+}
+
+// store sends a record to the register service of the registrar
+func (h *httpTarget) store(method string, rec *forms.ServiceRecord_v1) (loadgen.Registration, error) {
+	form, err := h.exchange(method, h.registrar+"/register", rec)
+	if err != nil {
+		return loadgen.Registration{}, err
+	}
+	updated, ok := form.(*forms.ServiceRecord_v1)
+	if !ok {
+		return loadgen.Registration{}, fmt.Errorf("a ServiceRecord_v1 form is expected")
+	}
+	end, _ := time.Parse(time.RFC3339, updated.EndOfValidity)
+	return loadgen.Registration{Id: updated.Id, EndOfValidity: end, Record: updated}, nil
+}
+
+// Unregister deletes the record of a service
+func (h *httpTarget) Unregister(reg loadgen.Registration) error {
+	req, err := http.NewRequest(http.MethodDelete, h.registrar+"/unregister/"+strconv.Itoa(reg.Id), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the registrar answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Quest sends a service quest to the registrar or to the orchestrator
+func (h *httpTarget) Quest(op string, q loadgen.Quest) error {
+	quest := forms.ServiceQuest_v1{
+		RequesterName:     "loadtest",
+		ServiceDefinition: q.Definition,
+		Protocol:          "http",
+		Details:           map[string][]string{"Location": {q.Location}},
+		Version:           "ServiceQuest_v1",
+	}
+	var err error
+	switch op {
+	case "query":
+		_, err = h.exchange(http.MethodPost, h.registrar+"/query", &quest)
+	case "squest":
+		_, err = h.exchange(http.MethodPost, h.orchestrator+"/squest", &quest)
+	case "list":
+		_, err = h.fetch(h.registrar + "/query?definition=" + url.QueryEscape(q.Definition) + "&limit=20")
+	default:
+		err = fmt.Errorf("unknown quest %s", op)
+	}
+	return err
+}
+
+// Records returns the ids of the records of a system from the filtered listing of the registrar
+func (h *httpTarget) Records(system string) ([]int, error) {
+	recList, err := h.fetch(h.registrar + "/query?system=" + url.QueryEscape(system))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(recList.List))
+	for _, rec := range recList.List {
+		ids = append(ids, rec.Id)
+	}
+	return ids, nil
+}
+
+//-------------------------------------HTTP exchanges
+
+// exchange sends a form and unpacks the form of the reply
+func (h *httpTarget) exchange(method, url string, form forms.Form) (forms.Form, error) {
+	payload, err := usecases.Pack(form, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return h.send(req)
+}
+
+// fetch gets a list of service records
+func (h *httpTarget) fetch(url string) (*forms.ServiceRecordList_v1, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	form, err := h.send(req)
+	if err != nil {
+		return nil, err
+	}
+	recList, ok := form.(*forms.ServiceRecordList_v1)
+	if !ok {
+		return nil, fmt.Errorf("a ServiceRecordList_v1 form is expected")
+	}
+	return recList, nil
+}
+
+// send carries out a request and unpacks the form of the reply
+func (h *httpTarget) send(req *http.Request) (forms.Form, error) {
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", req.URL.Path, resp.Status)
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	return usecases.Unpack(bodyBytes, mediaType)
+}
@@ -30,6 +30,7 @@ import (
 	"github.com/sdoque/mbaigo/components"
 	"github.com/sdoque/mbaigo/forms"
 	"github.com/sdoque/mbaigo/usecases"
+	"github.com/sdoque/systems/internal/leadership"
 )
 
 //-------------------------------------Define the unit asset
@@ -122,18 +123,12 @@ func (ua *UnitAsset) assembleOntologies(w http.ResponseWriter) {
 	for _, cSys := range ua.Owner.CoreS {
 		core := cSys
 		if core.Name == "serviceregistrar" {
-			resp, err := http.Get(core.Url + "/status")
+			leads, err := leadership.Leads(core.Url)
 			if err != nil {
 				fmt.Println("Error checking service registrar status:", err)
 				continue
 			}
-			bodyBytes, err := io.ReadAll(resp.Body)
-			resp.Body.Close()
-			if err != nil {
-				fmt.Println("Error reading service registrar response body:", err)
-				continue
-			}
-			if strings.HasPrefix(string(bodyBytes), "lead Service Registrar since") {
+			if leads {
 				leadingRegistrar = core
 			}
 		}
@@ -280,3 +275,4 @@ func (ua *UnitAsset) assembleOntologies(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "text/turtle")
 	w.Write([]byte(graph))
 }
+
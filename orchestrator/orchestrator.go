@@ -26,6 +26,7 @@ import (
 	"github.com/sdoque/mbaigo/components"
 	"github.com/sdoque/mbaigo/forms"
 	"github.com/sdoque/mbaigo/usecases"
+	"github.com/sdoque/systems/internal/coapserver"
 )
 
 func main() {
@@ -74,6 +75,7 @@ func main() {
 
 	// start the http handler and server
 	go usecases.SetoutServers(&sys)
+	go coapserver.Setout(sys.Ctx, sys.Name, sys.Husk.ProtoPort["coap"], coapserver.Assets(sys.UAssets), nil) // serves the same services over CoAP if the system has a coap port
 
 	// wait for shutdown signal, and gracefully close properly goroutines with context
 	<-sys.Sigs // wait for a SIGINT (Ctrl+C) signal
@@ -87,6 +89,8 @@ func (ua *UnitAsset) Serving(w http.ResponseWriter, r *http.Request, servicePath
 	switch servicePath {
 	case "squest":
 		ua.orchestrate(w, r)
+	case "sfailure":
+		ua.recordFailure(w, r)
 
 	default:
 		http.Error(w, "Invalid service request [Do not modify the services subpath in the configuration file]", http.StatusBadRequest)
@@ -140,3 +144,37 @@ func (ua *UnitAsset) orchestrate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method is not supported.", http.StatusNotFound)
 	}
 }
+
+// recordFailure receives the service point of a provider that a consumer could not consume (least-recently-failed strategy)
+func (ua *UnitAsset) recordFailure(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, "Invalid Content-Type", http.StatusUnsupportedMediaType)
+			return
+		}
+		defer r.Body.Close()
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("error reading failure report body: %v\n", err)
+			http.Error(w, "Error reading request body", http.StatusBadRequest)
+			return
+		}
+		pointForm, err := usecases.Unpack(bodyBytes, mediaType)
+		if err != nil {
+			http.Error(w, "Error extracting the service point form", http.StatusBadRequest)
+			return
+		}
+		sp, ok := pointForm.(*forms.ServicePoint_v1)
+		if !ok || sp.ServLocation == "" {
+			http.Error(w, "A ServicePoint_v1 form with a service URL is expected", http.StatusBadRequest)
+			return
+		}
+		ua.selector.recordFailure(sp.ServLocation, time.Now())
+		log.Printf("the service %s at %s has been reported as failing\n", sp.ServiceDefinition, sp.ServLocation)
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+	}
+}
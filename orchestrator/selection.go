@@ -0,0 +1,316 @@
+/*******************************************************************************
+ * Copyright (c) 2023 Jan van Deventer
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-2.0/
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+//*********************Provider-selection strategies*********************
+
+// The registrar answers a quest with every matching provider, and the orchestrator picks the one it hands out.
+// The strategy is taken from the "Strategy" detail of the quest if present, otherwise from the strategy configured
+// for the service definition, otherwise from the default strategy of the configuration (defaultStrategy if none, which
+// is also the one of a generated configuration file).
+// The "Strategy" hint of the quest is removed from its details before it is forwarded to the registrar.
+// The strategies that take the providers in turn keep one turn per strategy and service definition.
+//
+//   - first:                 the first provider of the registrar's list
+//   - round-robin:           each provider in turn
+//   - random:                any provider
+//   - lowest-cost:           the provider with the lowest activity cost (each in turn if several)
+//   - locality:              the provider that shares most details with the requesting system, e.g., "Location": ["Kitchen"],
+//                            as registered by its services (each in turn if several)
+//   - weighted:              a random provider in proportion to its "Weight" detail (1 if it has none)
+//   - least-recently-failed: a provider that never failed, otherwise the one whose last failure is the oldest.
+//                            The consumers report the service points they could not consume to the sfailure service.
+
+// candidate is a provider that can be reached with the protocol of the quest
+type candidate struct {
+	rec      forms.ServiceRecord_v1
+	location string // service URL handed out to the consumer
+}
+
+// turnKey identifies the turns of a strategy for a service definition
+type turnKey struct {
+	strategy   string
+	definition string
+}
+
+// strategy picks a provider among the candidates (there is at least one) for the quest of a service definition
+type strategy func(s *selector, key turnKey, hints selectionHints, candidates []candidate) candidate
+
+// strategies are the provider-selection strategies by name
+var strategies = map[string]strategy{
+	"first":                 first,
+	"round-robin":           roundRobin,
+	"random":                anyOne,
+	"lowest-cost":           lowestCost,
+	"locality":              locality,
+	"weighted":              weighted,
+	"least-recently-failed": leastRecentlyFailed,
+}
+
+// defaultStrategy hands out the first provider, as the orchestrator did before the strategies
+const defaultStrategy = "first"
+
+// failureMemory is how long the failure of a provider is remembered
+const failureMemory = time.Hour
+
+// selectionHints are the selection details of a quest
+type selectionHints struct {
+	strategy  string
+	requester map[string][]string // details of the requesting system (locality strategy)
+}
+
+// selector holds the configured strategies and the state of the selections
+type selector struct {
+	mu         sync.Mutex
+	fallback   string               // default strategy
+	byService  map[string]string    // strategy by service definition
+	turns      map[turnKey]int      // next turn by strategy and service definition
+	failures   map[string]time.Time // last reported failure by service location
+	randomizer *rand.Rand
+}
+
+// newSelector creates a selector with the configured strategies
+func newSelector(fallback string, byService map[string]string) (*selector, error) {
+	if fallback == "" {
+		fallback = defaultStrategy
+	}
+	if _, known := strategies[fallback]; !known {
+		return nil, fmt.Errorf("unknown provider-selection strategy %q", fallback)
+	}
+	for definition, name := range byService {
+		if _, known := strategies[name]; !known {
+			return nil, fmt.Errorf("unknown provider-selection strategy %q for the service %s", name, definition)
+		}
+	}
+	return &selector{
+		fallback:   fallback,
+		byService:  byService,
+		turns:      make(map[turnKey]int),
+		failures:   make(map[string]time.Time),
+		randomizer: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// takeHints removes the selection hints from the details of a quest and returns them
+func takeHints(quest *forms.ServiceQuest_v1) selectionHints {
+	var hints selectionHints
+	details := make(map[string][]string, len(quest.Details))
+	for key, values := range quest.Details {
+		if key != "Strategy" {
+			details[key] = values
+		} else if len(values) > 0 {
+			hints.strategy = values[0]
+		}
+	}
+	quest.Details = details
+	return hints
+}
+
+// strategyOf names the strategy of a quest for a service definition: its hint, the strategy of the definition or the default one
+func (s *selector) strategyOf(definition string, hints selectionHints) string {
+	if hints.strategy != "" {
+		return hints.strategy
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if name := s.byService[definition]; name != "" {
+		return name
+	}
+	return s.fallback
+}
+
+// pick selects a provider among the candidates with the strategy of the quest
+func (s *selector) pick(definition string, hints selectionHints, candidates []candidate) (candidate, error) {
+	name := s.strategyOf(definition, hints)
+	choose, known := strategies[name]
+	if !known {
+		return candidate{}, fmt.Errorf("unknown provider-selection strategy %q", name)
+	}
+	return choose(s, turnKey{strategy: name, definition: definition}, hints, candidates), nil
+}
+
+// next returns the candidate whose turn it is for a strategy and a service definition
+func (s *selector) next(key turnKey, candidates []candidate) candidate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	turn := s.turns[key] % len(candidates)
+	s.turns[key] = turn + 1
+	return candidates[turn]
+}
+
+// random returns any of the candidates
+func (s *selector) random(candidates []candidate) candidate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return candidates[s.randomizer.Intn(len(candidates))]
+}
+
+// first takes the first candidate, as listed by the registrar
+func first(s *selector, key turnKey, hints selectionHints, candidates []candidate) candidate {
+	return candidates[0]
+}
+
+// roundRobin takes each candidate in turn
+func roundRobin(s *selector, key turnKey, hints selectionHints, candidates []candidate) candidate {
+	return s.next(key, candidates)
+}
+
+// anyOne takes a random candidate
+func anyOne(s *selector, key turnKey, hints selectionHints, candidates []candidate) candidate {
+	return s.random(candidates)
+}
+
+// lowestCost takes in turn the candidates with the lowest activity cost
+func lowestCost(s *selector, key turnKey, hints selectionHints, candidates []candidate) candidate {
+	var cheapest []candidate
+	for _, c := range candidates {
+		switch {
+		case len(cheapest) == 0 || c.rec.ACost < cheapest[0].rec.ACost:
+			cheapest = []candidate{c}
+		case c.rec.ACost == cheapest[0].rec.ACost:
+			cheapest = append(cheapest, c)
+		}
+	}
+	return s.next(key, cheapest)
+}
+
+// locality takes in turn the candidates that share most details with the requesting system
+func locality(s *selector, key turnKey, hints selectionHints, candidates []candidate) candidate {
+	best, nearest := -1, []candidate{}
+	for _, c := range candidates {
+		matches := 0
+		for detail, values := range hints.requester {
+			if sharesValue(c.rec.Details[detail], values) {
+				matches++
+			}
+		}
+		switch {
+		case matches > best:
+			best, nearest = matches, []candidate{c}
+		case matches == best:
+			nearest = append(nearest, c)
+		}
+	}
+	return s.next(key, nearest)
+}
+
+// sharesValue checks if two lists of detail values have a value in common (regardless of case)
+func sharesValue(values, others []string) bool {
+	for _, value := range values {
+		for _, other := range others {
+			if strings.EqualFold(value, other) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sharedDetails returns the details that all the registered services of a system have, with their common values
+func sharedDetails(records []forms.ServiceRecord_v1) map[string][]string {
+	if len(records) == 0 {
+		return nil
+	}
+	shared := make(map[string][]string)
+	for detail, values := range records[0].Details {
+		common := values
+		for _, rec := range records[1:] {
+			var kept []string
+			for _, value := range common {
+				if sharesValue(rec.Details[detail], []string{value}) {
+					kept = append(kept, value)
+				}
+			}
+			common = kept
+		}
+		if len(common) > 0 {
+			shared[detail] = common
+		}
+	}
+	return shared
+}
+
+// weighted draws a candidate in proportion to its "Weight" detail (1 if it has none, or a uniform draw if all weigh 0)
+func weighted(s *selector, key turnKey, hints selectionHints, candidates []candidate) candidate {
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	for i, c := range candidates {
+		weights[i] = 1
+		if values := c.rec.Details["Weight"]; len(values) > 0 {
+			if w, err := strconv.ParseFloat(values[0], 64); err == nil && w >= 0 {
+				weights[i] = w
+			}
+		}
+		total += weights[i]
+	}
+	if total == 0 {
+		return s.random(candidates)
+	}
+	s.mu.Lock()
+	draw := s.randomizer.Float64() * total
+	s.mu.Unlock()
+	for i, w := range weights {
+		if draw < w {
+			return candidates[i]
+		}
+		draw -= w
+	}
+	return candidates[len(candidates)-1]
+}
+
+// leastRecentlyFailed takes in turn the candidates that never failed, otherwise the one whose last failure is the oldest
+func leastRecentlyFailed(s *selector, key turnKey, hints selectionHints, candidates []candidate) candidate {
+	s.mu.Lock()
+	var healthy []candidate
+	failed := make([]candidate, 0, len(candidates))
+	lastFailure := make(map[string]time.Time)
+	for _, c := range candidates {
+		if at, exists := s.failures[c.location]; exists {
+			failed = append(failed, c)
+			lastFailure[c.location] = at
+		} else {
+			healthy = append(healthy, c)
+		}
+	}
+	s.mu.Unlock()
+	if len(healthy) > 0 {
+		return s.next(key, healthy)
+	}
+	sort.SliceStable(failed, func(i, j int) bool { return lastFailure[failed[i].location].Before(lastFailure[failed[j].location]) })
+	return failed[0]
+}
+
+// recordFailure remembers that a service location could not be consumed, and forgets the old failures
+func (s *selector) recordFailure(location string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[location] = at
+	for loc, last := range s.failures {
+		if at.Sub(last) > failureMemory {
+			delete(s.failures, loc)
+		}
+	}
+}
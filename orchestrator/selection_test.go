@@ -0,0 +1,241 @@
+/*******************************************************************************
+ * Copyright (c) 2023 Jan van Deventer
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-2.0/
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sdoque/mbaigo/components"
+	"github.com/sdoque/mbaigo/forms"
+)
+
+func TestNewSelector(t *testing.T) {
+	tests := []struct {
+		name         string
+		fallback     string
+		byService    map[string]string
+		wantFallback string
+		wantErr      bool
+	}{
+		{"default", "", nil, "first", false},
+		{"generated configuration", initTemplate().(*UnitAsset).Strategy, nil, "first", false},
+		{"configured", "round-robin", map[string]string{"temperature": "locality"}, "round-robin", false},
+		{"unknown default", "cheapest", nil, "", true},
+		{"unknown by service", "first", map[string]string{"temperature": "nearest"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newSelector(tt.fallback, tt.byService)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want an error: %t", err, tt.wantErr)
+			}
+			if err == nil && s.fallback != tt.wantFallback {
+				t.Fatalf("default strategy %q, want %q", s.fallback, tt.wantFallback)
+			}
+		})
+	}
+}
+
+// provider creates a candidate at a location with an activity cost and details
+func provider(location string, cost float64, details map[string][]string) candidate {
+	return candidate{rec: forms.ServiceRecord_v1{ACost: cost, Details: details}, location: location}
+}
+
+func TestStrategyOrder(t *testing.T) {
+	kitchen := map[string][]string{"Location": {"Kitchen"}}
+	candidates := []candidate{
+		provider("a", 3, map[string][]string{"Location": {"Garage"}}),
+		provider("b", 1, kitchen),
+		provider("c", 2, map[string][]string{"Weight": {"0"}}),
+		provider("d", 1, kitchen),
+	}
+	tests := []struct {
+		strategy  string
+		requester map[string][]string // details of the requesting system
+		failed    []string            // locations that failed, the oldest first
+		want      []string            // locations of the successive picks
+	}{
+		{"first", nil, nil, []string{"a", "a", "a"}},
+		{"round-robin", nil, nil, []string{"a", "b", "c", "d", "a"}},
+		{"lowest-cost", nil, nil, []string{"b", "d", "b"}},
+		{"locality", map[string][]string{"Location": {"kitchen"}, "Unit": {"Celsius"}}, nil, []string{"b", "d", "b"}},
+		{"locality", map[string][]string{"Location": {"Attic"}}, nil, []string{"a", "b", "c", "d"}},
+		{"locality", nil, nil, []string{"a", "b", "c", "d"}}, // an unregistered requester
+		{"least-recently-failed", nil, []string{"a", "c"}, []string{"b", "d", "b"}},
+		{"least-recently-failed", nil, []string{"c", "a", "d", "b"}, []string{"c", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			s, err := newSelector(tt.strategy, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			at := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+			for i, location := range tt.failed {
+				s.recordFailure(location, at.Add(time.Duration(i)*time.Minute))
+			}
+			var got []string
+			for range tt.want {
+				c, err := s.pick("temperature", selectionHints{requester: tt.requester}, candidates)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, c.location)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("picks %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestTurnsByStrategy alternates the strategies of the quests for one service definition, each of which keeps its own turn
+func TestTurnsByStrategy(t *testing.T) {
+	candidates := []candidate{provider("a", 1, nil), provider("b", 1, nil), provider("c", 2, nil)}
+	s, err := newSelector("round-robin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for i := 0; i < 3; i++ {
+		for _, hint := range []string{"", "lowest-cost"} {
+			c, err := s.pick("temperature", selectionHints{strategy: hint}, candidates)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, c.location)
+		}
+	}
+	if want := []string{"a", "a", "b", "b", "c", "a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("picks %v, want %v", got, want)
+	}
+}
+
+func TestSharedDetails(t *testing.T) {
+	record := func(details map[string][]string) forms.ServiceRecord_v1 {
+		return forms.ServiceRecord_v1{Details: details}
+	}
+	tests := []struct {
+		name    string
+		records []forms.ServiceRecord_v1
+		want    map[string][]string
+	}{
+		{"unregistered", nil, nil},
+		{"one service", []forms.ServiceRecord_v1{record(map[string][]string{"Location": {"Kitchen"}, "Unit": {"Celsius"}})},
+			map[string][]string{"Location": {"Kitchen"}, "Unit": {"Celsius"}}},
+		{"several services", []forms.ServiceRecord_v1{
+			record(map[string][]string{"Location": {"Kitchen", "Floor1"}, "Unit": {"Celsius"}}),
+			record(map[string][]string{"Location": {"kitchen"}, "Unit": {"Percent"}}),
+		}, map[string][]string{"Location": {"Kitchen"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sharedDetails(tt.records); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("shared details %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRequesterDetails looks up the services of the requesting system at a registrar
+func TestRequesterDetails(t *testing.T) {
+	registrar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/query" || r.URL.Query().Get("system") != "thermostat" || r.Header.Get("Accept") != "application/json" {
+			http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		list := forms.ServiceRecordList_v1{Version: "ServiceRecordList_v1", List: []forms.ServiceRecord_v1{
+			{SystemName: "thermostat", Details: map[string][]string{"Location": {"Kitchen"}}},
+		}}
+		json.NewEncoder(w).Encode(list)
+	}))
+	defer registrar.Close()
+	ua := &UnitAsset{leadingRegistrar: &components.CoreSystem{Name: "serviceregistrar", Url: registrar.URL}}
+
+	if got := ua.requesterDetails(context.Background(), "thermostat"); !reflect.DeepEqual(got, map[string][]string{"Location": {"Kitchen"}}) {
+		t.Errorf("details %v of the requester, want its location", got)
+	}
+	if got := ua.requesterDetails(context.Background(), "hygrometer"); got != nil {
+		t.Errorf("details %v of a requester the registrar refuses, want none", got)
+	}
+}
+
+func TestRandomStrategies(t *testing.T) {
+	candidates := []candidate{
+		provider("a", 0, map[string][]string{"Weight": {"0"}}),
+		provider("b", 0, map[string][]string{"Weight": {"3"}}),
+		provider("c", 0, nil), // weighs 1
+	}
+	tests := []struct {
+		strategy string
+		want     map[string]int // picks out of 4000 by location, within 10%
+	}{
+		{"random", map[string]int{"a": 1333, "b": 1333, "c": 1333}},
+		{"weighted", map[string]int{"b": 3000, "c": 1000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			s, err := newSelector(tt.strategy, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.randomizer = rand.New(rand.NewSource(1))
+			picks := make(map[string]int)
+			for i := 0; i < 4000; i++ {
+				c, _ := s.pick("temperature", selectionHints{}, candidates)
+				picks[c.location]++
+			}
+			for location, n := range picks {
+				if want := tt.want[location]; n < want*9/10 || n > want*11/10 {
+					t.Errorf("%s was picked %d times, want about %d", location, n, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPickPrecedence(t *testing.T) {
+	candidates := []candidate{provider("a", 2, nil), provider("b", 1, nil)}
+	s, err := newSelector("first", map[string]string{"temperature": "lowest-cost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		definition string
+		hint       string
+		want       string
+		wantErr    bool
+	}{
+		{"humidity", "", "a", false},         // the default strategy
+		{"temperature", "", "b", false},      // the strategy of the service definition
+		{"temperature", "first", "a", false}, // the hint of the quest
+		{"temperature", "nearest", "", true},
+	}
+	for _, tt := range tests {
+		c, err := s.pick(tt.definition, selectionHints{strategy: tt.hint}, candidates)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s with the hint %q: error %v, want an error: %t", tt.definition, tt.hint, err, tt.wantErr)
+		}
+		if c.location != tt.want {
+			t.Errorf("%s with the hint %q picked %q, want %q", tt.definition, tt.hint, c.location, tt.want)
+		}
+	}
+}
@@ -21,13 +21,14 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/sdoque/mbaigo/components"
 	"github.com/sdoque/mbaigo/forms"
 	"github.com/sdoque/mbaigo/usecases"
+	"github.com/sdoque/systems/internal/leadership"
 )
 
 //-------------------------------------Define the Thing's resource
@@ -39,8 +40,11 @@ type UnitAsset struct {
 	Details     map[string][]string `json:"details"`
 	ServicesMap components.Services `json:"-"`
 	CervicesMap components.Cervices `json:"-"`
+	Strategy    string              `json:"strategy"`   // default provider-selection strategy (see selection.go)
+	Strategies  map[string]string   `json:"strategies"` // provider-selection strategy by service definition
 	//
 	leadingRegistrar *components.CoreSystem
+	selector         *selector // picks a provider among those found by the registrar
 }
 
 // GetName returns the name of the Resource.
@@ -77,13 +81,22 @@ func initTemplate() components.UnitAsset {
 		Details:     map[string][]string{"DefaultForm": {"ServiceRecord_v1"}, "Location": {"LocalCloud"}},
 		Description: "looks for the desired service described in a quest form (POST)",
 	}
+	sfailure := components.Service{
+		Definition:  "sfailure",
+		SubPath:     "sfailure",
+		Details:     map[string][]string{"DefaultForm": {"ServicePoint_v1"}, "Location": {"LocalCloud"}},
+		Description: "records that the service point of a form could not be consumed (POST)",
+	}
 
 	// var uat components.UnitAsset // this is an interface, which we then initialize
 	uat := &UnitAsset{
-		Name:    "orchestration",
-		Details: map[string][]string{"Platform": {"Independent"}},
+		Name:       "orchestration",
+		Details:    map[string][]string{"Platform": {"Independent"}},
+		Strategy:   defaultStrategy,
+		Strategies: map[string]string{},
 		ServicesMap: components.Services{
-			squest.SubPath: &squest, // Inline assignment of the temperature service
+			squest.SubPath:   &squest, // Inline assignment of the temperature service
+			sfailure.SubPath: &sfailure,
 		},
 	}
 	return uat
@@ -99,6 +112,14 @@ func newResource(uac UnitAsset, sys *components.System, servs []components.Servi
 		Owner:       sys,
 		Details:     uac.Details,
 		ServicesMap: components.CloneServices(servs),
+		Strategy:    uac.Strategy,
+		Strategies:  uac.Strategies,
+	}
+
+	// Pick the providers with the configured strategies
+	var err error
+	if ua.selector, err = newSelector(uac.Strategy, uac.Strategies); err != nil {
+		panic(err)
 	}
 
 	// start the unit asset(s)
@@ -127,28 +148,17 @@ func (ua *UnitAsset) getServiceURL(newQuest forms.ServiceQuest_v1) (servLoc []by
 	defer cancel()
 	sys := ua.Owner
 	if ua.leadingRegistrar != nil {
-
 		// verify that this leading registrar is still leading
-		resp, errs := http.Get(ua.leadingRegistrar.Url + "/status")
+		leads, errs := leadership.Leads(ua.leadingRegistrar.Url)
 		if errs != nil {
 			log.Println("lost leading registrar status:", errs)
 			ua.leadingRegistrar = nil
 			err = errs
-			return // Skip to the next iteration of the loop
-		}
-
-		// Read from status resp.Body and then close it directly after
-		bodyBytes, errs := io.ReadAll(resp.Body)
-		resp.Body.Close() // Close the body directly after reading from it
-		if errs != nil {
-			log.Println("\rError reading response from leading registrar:", errs)
-			ua.leadingRegistrar = nil
-			err = errs
-			return // Skip to the next iteration of the loop
+			return
 		}
 
 		// reset the pointer if the registrar lost its leading status
-		if !strings.HasPrefix(string(bodyBytes), "lead Service Registrar since") {
+		if !leads {
 			ua.leadingRegistrar = nil
 			log.Println("lost previous leading registrar")
 		}
@@ -156,22 +166,12 @@ func (ua *UnitAsset) getServiceURL(newQuest forms.ServiceQuest_v1) (servLoc []by
 		for _, cSys := range sys.CoreS {
 			core := cSys
 			if core.Name == "serviceregistrar" {
-				resp, err := http.Get(core.Url + "/status")
+				leads, err := leadership.Leads(core.Url)
 				if err != nil {
 					fmt.Println("Error checking service registrar status:", err)
-					ua.leadingRegistrar = nil // clear the leading registrar record
-					continue                  // Skip to the next iteration of the loop
-				}
-
-				// Read from resp.Body and then close it directly after
-				bodyBytes, err := io.ReadAll(resp.Body)
-				resp.Body.Close() // Close the body directly after reading from it
-				if err != nil {
-					fmt.Println("Error reading service registrar response body:", err)
 					continue // Skip to the next iteration of the loop
 				}
-
-				if strings.HasPrefix(string(bodyBytes), "lead Service Registrar since") {
+				if leads {
 					ua.leadingRegistrar = core
 					fmt.Printf("\nlead registrar found at: %s\n", ua.leadingRegistrar.Url)
 				}
@@ -179,6 +179,9 @@ func (ua *UnitAsset) getServiceURL(newQuest forms.ServiceQuest_v1) (servLoc []by
 		}
 	}
 
+	// Take the selection hints out of the quest before forwarding it
+	hints := takeHints(&newQuest)
+
 	// Create a new HTTP request to the the Service Registrar
 
 	// Create buffer to save a copy of the request body
@@ -230,19 +233,97 @@ func (ua *UnitAsset) getServiceURL(newQuest forms.ServiceQuest_v1) (servLoc []by
 	}
 
 	fmt.Printf("/n the length of the service list is: %d\n", len(serviceList.List))
-	serviceLocation := selectService(*serviceList)
+	if ua.selector.strategyOf(newQuest.ServiceDefinition, hints) == "locality" {
+		hints.requester = ua.requesterDetails(ctx, newQuest.RequesterName)
+	}
+	serviceLocation, err := ua.selectService(*serviceList, newQuest, hints)
+	if err != nil {
+		return
+	}
 	payload, err := json.MarshalIndent(serviceLocation, "", "  ")
 	fmt.Printf("the service location is %+v\n", serviceLocation)
 	return payload, err
 }
 
-func selectService(serviceList forms.ServiceRecordList_v1) (sp forms.ServicePoint_v1) {
-	rec := serviceList.List[0]
+// requesterDetails asks the leading registrar for the services of the requesting system and returns the details they share
+// (none if the system is not registered or the registrar cannot be reached, in which case the locality strategy takes each provider in turn)
+func (ua *UnitAsset) requesterDetails(ctx context.Context, requester string) map[string][]string {
+	if requester == "" {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ua.leadingRegistrar.Url+"/query?system="+url.QueryEscape(requester), nil)
+	if err != nil {
+		return nil
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("error looking up the services of the requester %s: %v\n", requester, err)
+		return nil
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("error looking up the services of the requester %s: %v (status %d)\n", requester, err, resp.StatusCode)
+		return nil
+	}
+	listForm, err := usecases.Unpack(body, "application/json")
+	if err != nil {
+		log.Printf("error extracting the services of the requester %s: %v\n", requester, err)
+		return nil
+	}
+	list, ok := listForm.(*forms.ServiceRecordList_v1)
+	if !ok {
+		return nil
+	}
+	return sharedDetails(list.List)
+}
+
+// selectService picks a provider among the services of the list that can be reached with the protocol of the quest.
+// A quest for coap gets a coap:// location, any other quest an http:// location, or a coap:// one if the provider only serves CoAP.
+func (ua *UnitAsset) selectService(serviceList forms.ServiceRecordList_v1, quest forms.ServiceQuest_v1, hints selectionHints) (sp forms.ServicePoint_v1, err error) {
+	var candidates []candidate
+	for _, rec := range serviceList.List {
+		scheme, port := serviceScheme(rec, quest.Protocol)
+		if port == 0 || len(rec.IPAddresses) == 0 {
+			continue
+		}
+		location := scheme + "://" + rec.IPAddresses[0] + ":" + strconv.Itoa(port) + "/" + rec.SystemName + "/" + rec.SubPath
+		candidates = append(candidates, candidate{rec: rec, location: location})
+	}
+	if len(candidates) == 0 {
+		err = fmt.Errorf("none of the %d services found can be reached with %s", len(serviceList.List), protocolName(quest.Protocol))
+		return
+	}
+	chosen, err := ua.selector.pick(quest.ServiceDefinition, hints, candidates)
+	if err != nil {
+		return
+	}
+	rec := chosen.rec
 	sp.NewForm()
 	sp.ProviderName = rec.SystemName
 	sp.ServiceDefinition = rec.ServiceDefinition
 	sp.Details = rec.Details
-	sp.ServLocation = "http://" + rec.IPAddresses[0] + ":" + strconv.Itoa(rec.ProtoPort["http"]) + "/" + rec.SystemName + "/" + rec.SubPath
+	sp.ServLocation = chosen.location
 	sp.ServNode = rec.ServiceNode
-	return
+	return sp, nil
+}
+
+// serviceScheme returns the scheme and the port with which a service is located for a quest's protocol (a zero port if none)
+func serviceScheme(rec forms.ServiceRecord_v1, protocol string) (string, int) {
+	if protocol == "coap" {
+		return "coap", rec.ProtoPort["coap"]
+	}
+	if port := rec.ProtoPort["http"]; port != 0 {
+		return "http", port
+	}
+	return "coap", rec.ProtoPort["coap"]
+}
+
+// protocolName names the protocol of a quest in error messages
+func protocolName(protocol string) string {
+	if protocol == "coap" {
+		return "coap"
+	}
+	return "http or coap"
 }
@@ -15,190 +15,174 @@ package main
 
 import (
 	"database/sql"
-	"errors"
 	"fmt"
-	"log"
 	"os"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/systems/internal/registrar"
 	_ "modernc.org/sqlite"
 )
 
-// createDB initializes the database by deleting any existing file and creating a new one.
-func createDB() (*sql.DB, error) {
-	os.Remove("serviceRegistry.db")
-	fmt.Println("Creating serviceRegistry.db...")
-	file, err := os.Create("serviceRegistry.db")
-	if err != nil {
-		return nil, err
+// sqliteStore keeps the registry in the SQLite database serviceRegistry.db
+type sqliteStore struct {
+	db  *sql.DB
+	mtx sync.RWMutex // ensures that only one record is open at the time
+}
+
+// openSQLiteStore initializes the database. Unless the registry is persistent, any existing file is deleted and a new one created.
+func openSQLiteStore(persistent bool) (*sqliteStore, error) {
+	_, statErr := os.Stat("serviceRegistry.db")
+	if !persistent || os.IsNotExist(statErr) {
+		os.Remove("serviceRegistry.db")
+		fmt.Println("Creating serviceRegistry.db...")
+		file, err := os.Create("serviceRegistry.db")
+		if err != nil {
+			return nil, err
+		}
+		file.Close()
+		fmt.Println("serviceRegistry.db created")
+	} else {
+		fmt.Println("Reopening the persistent serviceRegistry.db")
 	}
-	file.Close()
-	fmt.Println("serviceRegistry.db created")
-	db, err := sql.Open("sqlite", "./serviceRegistry.db")
+	// the foreign keys are enforced on every connection so that deleting a service cascades to its related data
+	db, err := sql.Open("sqlite", "file:serviceRegistry.db?_pragma=foreign_keys(1)")
 	if err != nil {
 		return nil, fmt.Errorf("error opening database: %w", err)
 	}
 
-	if err = createTables(db); err != nil {
+	if err = migrate(db); err != nil {
 		return nil, err
 	}
-	fmt.Println("Database Ready")
-	return db, nil
-}
-
-// createTables creates the necessary tables in the SQLite database.
-func createTables(db *sql.DB) error {
-	tableStatements := []string{
-		`CREATE TABLE Services (
-			Id INTEGER PRIMARY KEY,
-			Definition TEXT,
-			SystemName TEXT,
-			Certificate TEXT,
-			SubPath TEXT,
-			Version TEXT,
-			Created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-			Updated TEXT,
-			RegLife TEXT,
-			EndOfValidity TIMESTAMP,
-			SubscribeAble BOOLEAN,
-			ACost REAL,
-			CUnit TEXT
-		);`,
-		`CREATE TABLE IPAddresses (
-			Id INTEGER PRIMARY KEY,
-			IPAddress TEXT
-		);`,
-		`CREATE TABLE ProtoPorts (
-			Id INTEGER PRIMARY KEY,
-			Proto TEXT,
-			Port INTEGER
-		);`,
-		`CREATE TABLE Details (
-			Id INTEGER PRIMARY KEY,
-			DetailKey TEXT,
-			DetailValue TEXT
-		);`,
-		`CREATE TABLE ServicesXIP (
-			ServiceId INTEGER,
-			IPAddressId INTEGER,
-			FOREIGN KEY(ServiceId) REFERENCES Services(Id),
-			FOREIGN KEY(IPAddressId) REFERENCES IPAddresses(Id)
-		);`,
-		`CREATE TABLE ServicesXPP (
-			ServiceId INTEGER,
-			ProtoPortId INTEGER,
-			FOREIGN KEY(ServiceId) REFERENCES Services(Id),
-			FOREIGN KEY(ProtoPortId) REFERENCES ProtoPorts(Id)
-		);`,
-		`CREATE TABLE ServicesXDetails (
-			ServiceId INTEGER,
-			DetailId INTEGER,
-			FOREIGN KEY(ServiceId) REFERENCES Services(Id),
-			FOREIGN KEY(DetailId) REFERENCES Details(Id)
-		);`,
-	}
-
-	for _, stmt := range tableStatements {
-		if _, err := db.Exec(stmt); err != nil {
-			return err
-		}
+	if err = checkIntegrity(db); err != nil {
+		return nil, err
 	}
-	return nil
+	fmt.Println("Database Ready")
+	return &sqliteStore{db: db}, nil
 }
 
-// registerService registers a new service in the database.
-func registerService(rsc *UnitAsset, rec *forms.ServiceRecord_v1) error {
-	now := time.Now()
-	rec.Created = now.Format(time.RFC3339)
-	rec.Updated = now.Format(time.RFC3339)
-	rec.EndOfValidity = now.Add(time.Duration(rec.RegLife) * time.Second).Format(time.RFC3339)
-
-	rsc.mtx.Lock()
-	defer rsc.mtx.Unlock()
-	tx, err := rsc.db.Begin()
+// Register inserts a complete service record in the database within one transaction.
+// The records of the same service (see registrar.SameService) are deleted in that transaction and returned.
+// A record with an Id (e.g., replicated from the leading registrar) keeps it, otherwise the database assigns a new one.
+func (s *sqliteStore) Register(rec *forms.ServiceRecord_v1) (replaced []forms.ServiceRecord_v1, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	tx, err := s.db.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer func() {
 		if err != nil {
 			tx.Rollback()
+			replaced = nil
 		} else {
-			tx.Commit()
+			err = tx.Commit()
 		}
 	}()
 
-	result, err := rsc.db.Exec(`
+	return insertRecord(tx, rec)
+}
+
+// insertRecord inserts a complete service record within a transaction and deletes the records of the same service
+func insertRecord(tx *sql.Tx, rec *forms.ServiceRecord_v1) (replaced []forms.ServiceRecord_v1, err error) {
+	// Replace the previous record(s) of the same service
+	rows, err := tx.Query(`SELECT Id FROM Services WHERE SystemName = ? AND SubPath = ? AND Id != ?`, rec.SystemName, rec.SubPath, rec.Id)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []int
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, id)
+	}
+	rows.Close()
+	for _, id := range candidates {
+		old, err := readRecord(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		if !registrar.SameService(*old, *rec) {
+			continue
+		}
+		if err = deleteService(tx, id); err != nil {
+			return nil, err
+		}
+		replaced = append(replaced, *old)
+	}
+
+	recordId := sql.NullInt64{Int64: int64(rec.Id), Valid: rec.Id != 0}
+	result, err := tx.Exec(`
 		INSERT INTO Services (
-			Definition, SystemName, Certificate, SubPath, Version,
+			Id, Definition, SystemName, ServiceNode, Certificate, SubPath, Version,
 			Created, Updated, RegLife, EndOfValidity, SubscribeAble, ACost, CUnit
-		) VALUES (?, ?, ?, ?, ?, datetime('now'), ?, ?, ?, ?, ?, ?)
-	`, rec.ServiceDefinition, rec.SystemName, rec.Certificate, rec.SubPath, rec.Version, rec.Updated, rec.RegLife, rec.EndOfValidity, rec.SubscribeAble, rec.ACost, rec.CUnit)
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, recordId, rec.ServiceDefinition, rec.SystemName, rec.ServiceNode, rec.Certificate, rec.SubPath, rec.Version, rec.Created, rec.Updated, rec.RegLife, rec.EndOfValidity, rec.SubscribeAble, rec.ACost, rec.CUnit)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	sRecordId, err := result.LastInsertId()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	rec.Id = int(sRecordId)
 
-	rsc.sched.AddTask(now.Add(time.Duration(rec.RegLife)*time.Second), func() { checkExpiration(rsc, rec.Id) }, rec.Id)
-
 	for _, ipAddress := range rec.IPAddresses {
-		result, err := rsc.db.Exec(`INSERT INTO IPAddresses (IPAddress) VALUES (?)`, ipAddress)
+		result, err := tx.Exec(`INSERT INTO IPAddresses (IPAddress) VALUES (?)`, ipAddress)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		ipAddressId, err := result.LastInsertId()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if _, err = rsc.db.Exec(`INSERT INTO ServicesXIP (ServiceId, IPAddressId) VALUES (?, ?)`, sRecordId, ipAddressId); err != nil {
-			return err
+		if _, err = tx.Exec(`INSERT INTO ServicesXIP (ServiceId, IPAddressId) VALUES (?, ?)`, sRecordId, ipAddressId); err != nil {
+			return nil, err
 		}
 	}
 
 	for proto, port := range rec.ProtoPort {
-		result, err := rsc.db.Exec(`INSERT INTO ProtoPorts (Proto, Port) VALUES (?, ?)`, proto, port)
+		result, err := tx.Exec(`INSERT INTO ProtoPorts (Proto, Port) VALUES (?, ?)`, proto, port)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		protoPortId, err := result.LastInsertId()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if _, err = rsc.db.Exec(`INSERT INTO ServicesXPP (ServiceId, ProtoPortId) VALUES (?, ?)`, sRecordId, protoPortId); err != nil {
-			return err
+		if _, err = tx.Exec(`INSERT INTO ServicesXPP (ServiceId, ProtoPortId) VALUES (?, ?)`, sRecordId, protoPortId); err != nil {
+			return nil, err
 		}
 	}
 
 	for key, values := range rec.Details {
 		for _, value := range values {
-			result, err := rsc.db.Exec(`INSERT INTO Details (DetailKey, DetailValue) VALUES (?, ?)`, key, value)
+			result, err := tx.Exec(`INSERT INTO Details (DetailKey, DetailValue) VALUES (?, ?)`, key, value)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			detailId, err := result.LastInsertId()
 			if err != nil {
-				return err
+				return nil, err
 			}
-			if _, err = rsc.db.Exec(`INSERT INTO ServicesXDetails (ServiceId, DetailId) VALUES (?, ?)`, sRecordId, detailId); err != nil {
-				return err
+			if _, err = tx.Exec(`INSERT INTO ServicesXDetails (ServiceId, DetailId) VALUES (?, ?)`, sRecordId, detailId); err != nil {
+				return nil, err
 			}
 		}
 	}
-	return nil
+	return replaced, nil
 }
 
-// extendServiceValidity extends the validity of an existing service record.
-func extendServiceValidity(rsc *UnitAsset, rec *forms.ServiceRecord_v1) error {
-	rsc.mtx.Lock()
-	defer rsc.mtx.Unlock()
-	tx, err := rsc.db.Begin()
+// Extend renews an existing record and updates its validity.
+func (s *sqliteStore) Extend(rec *forms.ServiceRecord_v1, now time.Time) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
@@ -206,74 +190,180 @@ func extendServiceValidity(rsc *UnitAsset, rec *forms.ServiceRecord_v1) error {
 		if err != nil {
 			tx.Rollback()
 		} else {
-			tx.Commit()
+			err = tx.Commit()
 		}
 	}()
 
-	var regLife int
-	var systemName, created string
-	if err = rsc.db.QueryRow(`SELECT RegLife, SystemName, Created FROM Services WHERE Id = ?`, rec.Id).Scan(&regLife, &systemName, &created); err != nil {
+	var renewed bool
+	if renewed, err = renewRecord(tx, rec, now); err != nil {
 		return err
 	}
+	if !renewed {
+		err = registrar.ErrUnknownRecord
+	}
+	return err
+}
+
+// renewRecord extends the validity of an existing record within a transaction, it returns false if the record is unknown or does not match
+func renewRecord(tx *sql.Tx, rec *forms.ServiceRecord_v1, now time.Time) (bool, error) {
+	var stored forms.ServiceRecord_v1
+	var regLife int
+	err := tx.QueryRow(`SELECT RegLife, SystemName, Definition, SubPath, Created FROM Services WHERE Id = ?`, rec.Id).Scan(&regLife, &stored.SystemName, &stored.ServiceDefinition, &stored.SubPath, &stored.Created)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !registrar.SameCreation(*rec, stored) || stored.SystemName != rec.SystemName || stored.ServiceDefinition != rec.ServiceDefinition || stored.SubPath != rec.SubPath {
+		return false, nil
+	}
+	rec.RegLife = regLife
+	rec.Updated = now.Format(time.RFC3339)
+	rec.EndOfValidity = now.Add(time.Duration(regLife) * time.Second).Format(time.RFC3339)
+	_, err = tx.Exec(`UPDATE Services SET Updated = ?, EndOfValidity = ?, Confirmed = 1 WHERE Id = ?`, rec.Updated, rec.EndOfValidity, rec.Id)
+	return err == nil, err
+}
 
-	recCreated, err := time.Parse(time.RFC3339, rec.Created)
+// SetValidity applies the validity of a renewal made by the leading registrar.
+func (s *sqliteStore) SetValidity(id int, updated, endOfValidity string) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	result, err := s.db.Exec(`UPDATE Services SET Updated = ?, EndOfValidity = ?, Confirmed = 1 WHERE Id = ?`, updated, endOfValidity, id)
 	if err != nil {
-		return err
+		return false, err
 	}
-	dbCreated, err := time.Parse(time.RFC3339, created)
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// StoreBatch registers or renews the records of a system in one transaction and returns which ones were renewed and the records it retired
+func (s *sqliteStore) StoreBatch(records []forms.ServiceRecord_v1, replace bool, now time.Time) (renewed []bool, retired []forms.ServiceRecord_v1, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	tx, err := s.db.Begin()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	if !recCreated.Equal(dbCreated) {
-		return errors.New("mismatch between received record and database record")
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			renewed, retired = nil, nil
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	renewed = make([]bool, len(records))
+	kept := make(map[int]bool)
+	for i := range records {
+		rec := &records[i]
+		if rec.Id != 0 {
+			if renewed[i], err = renewRecord(tx, rec, now); err != nil {
+				return nil, nil, err
+			}
+		}
+		if !renewed[i] {
+			rec.Id = 0 // the database assigns the record id
+			rec.Created = now.Format(time.RFC3339)
+			rec.Updated = now.Format(time.RFC3339)
+			rec.EndOfValidity = now.Add(time.Duration(rec.RegLife) * time.Second).Format(time.RFC3339)
+			replaced, err := insertRecord(tx, rec)
+			if err != nil {
+				return nil, nil, err
+			}
+			retired = append(retired, replaced...)
+		}
+		kept[rec.Id] = true
 	}
 
-	now := time.Now()
-	expirationTime := now.Add(time.Duration(regLife) * time.Second).Format(time.RFC3339)
-	stmt, err := rsc.db.Prepare(`UPDATE Services SET Updated = datetime('now'), EndOfValidity = ? WHERE Id = ?`)
+	if !replace {
+		return renewed, retired, nil
+	}
+	rows, err := tx.Query(`SELECT Id FROM Services WHERE SystemName = ?`, records[0].SystemName)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer stmt.Close()
-	if _, err = stmt.Exec(expirationTime, rec.Id); err != nil {
-		return err
+	var others []int
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		if !kept[id] {
+			others = append(others, id)
+		}
 	}
+	rows.Close()
+	for _, id := range others {
+		old, err := readRecord(tx, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = deleteService(tx, id); err != nil {
+			return nil, nil, err
+		}
+		retired = append(retired, *old)
+	}
+	return renewed, retired, nil
+}
 
-	rec.RegLife = regLife
-	rec.EndOfValidity = expirationTime
-	rsc.sched.AddTask(now.Add(time.Duration(rec.RegLife)*time.Second), func() { checkExpiration(rsc, rec.Id) }, rec.Id)
-	return nil
+// Unconfirmed returns the ids of the records inherited from a previous run that have not yet been renewed.
+func (s *sqliteStore) Unconfirmed() (map[int]bool, error) {
+	unconfirmed := make(map[int]bool)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	rows, err := s.db.Query(`SELECT Id FROM Services WHERE Confirmed = 0`)
+	if err != nil {
+		return unconfirmed, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return unconfirmed, err
+		}
+		unconfirmed[id] = true
+	}
+	return unconfirmed, rows.Err()
 }
 
-// listCurrentServices lists all current services in the registry.
-func listCurrentServices(rsc *UnitAsset) []string {
-	allServices, err := getAllRecords(rsc)
+// Reload goes through the records inherited from a previous run of a persistent registry.
+// Expired records are deleted, the others are marked as unconfirmed until their owner renews them.
+func (s *sqliteStore) Reload(now time.Time) ([]forms.ServiceRecord_v1, error) {
+	records, err := s.List()
 	if err != nil {
-		fmt.Println("Error in querying all services")
+		return nil, err
 	}
-	sList := make([]string, 0)
-	for _, serRec := range allServices {
-		metaservice := ""
-		for key, values := range serRec.Details {
-			metaservice += key + ": " + fmt.Sprintf("%v", values) + " "
+	var kept []forms.ServiceRecord_v1
+	for _, rec := range records {
+		expiration, err := time.Parse(time.RFC3339, rec.EndOfValidity)
+		if err != nil || now.After(expiration) {
+			if err := s.Delete(rec.Id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		s.mtx.Lock()
+		_, err = s.db.Exec(`UPDATE Services SET Confirmed = 0 WHERE Id = ?`, rec.Id)
+		s.mtx.Unlock()
+		if err != nil {
+			return nil, err
 		}
-		hyperlink := "http://" + serRec.IPAddresses[0] + ":" + strconv.Itoa(int(serRec.ProtoPort["http"])) + "/" + serRec.SystemName + "/" + serRec.SubPath
-		parts := strings.Split(serRec.SubPath, "/")
-		uaName := parts[0]
-		sLine := "<p>Service ID: " + strconv.Itoa(int(serRec.Id)) + " with definition <b><a href=\"" + hyperlink + "\">" + serRec.ServiceDefinition + "</b></a> from the <b>" + serRec.SystemName + "/" + uaName + "</b> with details " + metaservice + " will expire at: " + serRec.EndOfValidity + "</p>"
-		sList = append(sList, sLine)
+		kept = append(kept, rec)
 	}
-	return sList
+	return kept, nil
 }
 
-// getAllRecords retrieves all service records from the database.
-func getAllRecords(rsc *UnitAsset) ([]forms.ServiceRecord_v1, error) {
+// List retrieves all service records from the database.
+func (s *sqliteStore) List() ([]forms.ServiceRecord_v1, error) {
 	var records []forms.ServiceRecord_v1
 
-	rsc.mtx.RLock()
-	defer rsc.mtx.RUnlock()
-	rows, err := rsc.db.Query(`
-		SELECT Id, Definition, SystemName, Certificate, SubPath, Version, Created, Updated, RegLife, EndOfValidity, SubscribeAble, ACost, CUnit
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	rows, err := s.db.Query(`
+		SELECT Id, Definition, SystemName, ServiceNode, Certificate, SubPath, Version, Created, Updated, RegLife, EndOfValidity, SubscribeAble, ACost, CUnit
 		FROM Services
 	`)
 	if err != nil {
@@ -283,17 +373,17 @@ func getAllRecords(rsc *UnitAsset) ([]forms.ServiceRecord_v1, error) {
 
 	for rows.Next() {
 		var rec forms.ServiceRecord_v1
-		if err := rows.Scan(&rec.Id, &rec.ServiceDefinition, &rec.SystemName, &rec.Certificate, &rec.SubPath, &rec.Version, &rec.Created, &rec.Updated, &rec.RegLife, &rec.EndOfValidity, &rec.SubscribeAble, &rec.ACost, &rec.CUnit); err != nil {
+		if err := rows.Scan(&rec.Id, &rec.ServiceDefinition, &rec.SystemName, &rec.ServiceNode, &rec.Certificate, &rec.SubPath, &rec.Version, &rec.Created, &rec.Updated, &rec.RegLife, &rec.EndOfValidity, &rec.SubscribeAble, &rec.ACost, &rec.CUnit); err != nil {
 			return nil, err
 		}
 
-		if rec.IPAddresses, err = getIPAddresses(rsc, rec.Id); err != nil {
+		if rec.IPAddresses, err = getIPAddresses(s.db, rec.Id); err != nil {
 			return nil, err
 		}
-		if rec.ProtoPort, err = getProtoPorts(rsc, rec.Id); err != nil {
+		if rec.ProtoPort, err = getProtoPorts(s.db, rec.Id); err != nil {
 			return nil, err
 		}
-		if rec.Details, err = getDetails(rsc, rec.Id); err != nil {
+		if rec.Details, err = getDetails(s.db, rec.Id); err != nil {
 			return nil, err
 		}
 		records = append(records, rec)
@@ -301,28 +391,116 @@ func getAllRecords(rsc *UnitAsset) ([]forms.ServiceRecord_v1, error) {
 	return records, rows.Err()
 }
 
-// getRecord retrieves a specific service record by its ID.
-func getRecord(rsc *UnitAsset, id int) (*forms.ServiceRecord_v1, error) {
+// RecordsOf retrieves the records of a system and those announcing an IP address, using the indexes of the system names and of the addresses
+func (s *sqliteStore) RecordsOf(system, ip string) ([]forms.ServiceRecord_v1, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	rows, err := s.db.Query(`
+		SELECT Id FROM Services WHERE SystemName = ?
+		UNION
+		SELECT x.ServiceId FROM ServicesXIP x JOIN IPAddresses a ON a.Id = x.IPAddressId WHERE a.IPAddress = ?
+	`, system, ip)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	records := make([]forms.ServiceRecord_v1, 0, len(ids))
+	for _, id := range ids {
+		rec, err := readRecord(s.db, id)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *rec)
+	}
+	return records, nil
+}
+
+// Find retrieves the records with the service definition that pass the matcher.
+func (s *sqliteStore) Find(definition string, matcher *registrar.QuestMatcher) ([]forms.ServiceRecord_v1, error) {
+	// The database narrows the search to the service definition, the matching engine checks the details
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	rows, err := s.db.Query(`SELECT Id FROM Services WHERE Definition = ?`, definition)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var serviceRecords []forms.ServiceRecord_v1
+	for _, id := range ids {
+		record, err := readRecord(s.db, id)
+		if err != nil {
+			continue // the record was deleted in the meantime
+		}
+		if matcher.Matches(*record) {
+			serviceRecords = append(serviceRecords, *record)
+		}
+	}
+	return serviceRecords, nil
+}
+
+// Get retrieves a specific service record by its ID.
+func (s *sqliteStore) Get(id int) (*forms.ServiceRecord_v1, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	rec, err := readRecord(s.db, id)
+	if err == sql.ErrNoRows {
+		return nil, registrar.ErrUnknownRecord
+	}
+	return rec, err
+}
+
+// querier is implemented by the database and by its transactions
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// readRecord reads a service record with its IP addresses, protocol ports and details (the caller holds the lock)
+func readRecord(q querier, id int) (*forms.ServiceRecord_v1, error) {
 	var err error
 	rec := &forms.ServiceRecord_v1{}
-	rsc.mtx.RLock()
-	defer rsc.mtx.RUnlock()
-	row := rsc.db.QueryRow(`
-		SELECT Definition, SystemName, Certificate, SubPath, Version, Created, Updated, RegLife, EndOfValidity, SubscribeAble, ACost, CUnit
+	row := q.QueryRow(`
+		SELECT Definition, SystemName, ServiceNode, Certificate, SubPath, Version, Created, Updated, RegLife, EndOfValidity, SubscribeAble, ACost, CUnit
 		FROM Services WHERE Id = ?
 	`, id)
-	if err := row.Scan(&rec.ServiceDefinition, &rec.SystemName, &rec.Certificate, &rec.SubPath, &rec.Version, &rec.Created, &rec.Updated, &rec.RegLife, &rec.EndOfValidity, &rec.SubscribeAble, &rec.ACost, &rec.CUnit); err != nil {
+	if err := row.Scan(&rec.ServiceDefinition, &rec.SystemName, &rec.ServiceNode, &rec.Certificate, &rec.SubPath, &rec.Version, &rec.Created, &rec.Updated, &rec.RegLife, &rec.EndOfValidity, &rec.SubscribeAble, &rec.ACost, &rec.CUnit); err != nil {
 		return nil, err
 	}
 	rec.Id = id
 
-	if rec.IPAddresses, err = getIPAddresses(rsc, id); err != nil {
+	if rec.IPAddresses, err = getIPAddresses(q, id); err != nil {
 		return nil, err
 	}
-	if rec.ProtoPort, err = getProtoPorts(rsc, id); err != nil {
+	if rec.ProtoPort, err = getProtoPorts(q, id); err != nil {
 		return nil, err
 	}
-	if rec.Details, err = getDetails(rsc, id); err != nil {
+	if rec.Details, err = getDetails(q, id); err != nil {
 		return nil, err
 	}
 
@@ -330,9 +508,9 @@ func getRecord(rsc *UnitAsset, id int) (*forms.ServiceRecord_v1, error) {
 }
 
 // getIPAddresses retrieves IP addresses linked to a service.
-func getIPAddresses(rsc *UnitAsset, serviceId int) ([]string, error) {
+func getIPAddresses(q querier, serviceId int) ([]string, error) {
 	var ips []string
-	rows, err := rsc.db.Query(`
+	rows, err := q.Query(`
 		 SELECT IPAddress FROM IPAddresses 
 		 INNER JOIN ServicesXIP ON IPAddresses.Id = ServicesXIP.IPAddressId
 		 WHERE ServicesXIP.ServiceId = ?
@@ -352,9 +530,9 @@ func getIPAddresses(rsc *UnitAsset, serviceId int) ([]string, error) {
 }
 
 // getProtoPorts retrieves protocol-port pairs linked to a service.
-func getProtoPorts(rsc *UnitAsset, serviceId int) (map[string]int, error) {
+func getProtoPorts(q querier, serviceId int) (map[string]int, error) {
 	protoPorts := make(map[string]int)
-	rows, err := rsc.db.Query(`
+	rows, err := q.Query(`
 		 SELECT Proto, Port FROM ProtoPorts 
 		 INNER JOIN ServicesXPP ON ProtoPorts.Id = ServicesXPP.ProtoPortId
 		 WHERE ServicesXPP.ServiceId = ?
@@ -375,9 +553,9 @@ func getProtoPorts(rsc *UnitAsset, serviceId int) (map[string]int, error) {
 }
 
 // getDetails retrieves details linked to a service.
-func getDetails(rsc *UnitAsset, serviceId int) (map[string][]string, error) {
+func getDetails(q querier, serviceId int) (map[string][]string, error) {
 	details := make(map[string][]string)
-	rows, err := rsc.db.Query(`
+	rows, err := q.Query(`
 		 SELECT DetailKey, DetailValue FROM Details 
 		 INNER JOIN ServicesXDetails ON Details.Id = ServicesXDetails.DetailId
 		 WHERE ServicesXDetails.ServiceId = ?
@@ -396,62 +574,19 @@ func getDetails(rsc *UnitAsset, serviceId int) (map[string][]string, error) {
 	return details, rows.Err()
 }
 
-// checkExpiration checks if a service has expired and deletes it if it has.
-func checkExpiration(rsc *UnitAsset, servId int) {
-	var expiration time.Time
-	rsc.mtx.RLock()
-	err := rsc.db.QueryRow(`SELECT EndOfValidity FROM Services WHERE Id = ?`, servId).Scan(&expiration)
-	rsc.mtx.RUnlock()
-	if err != nil {
-		log.Printf("The service record with id %d is already deleted, %s\n", servId, err)
-		return
-	}
-	if time.Now().After(expiration) {
-		deleteCompleteServiceById(rsc, servId)
-	}
-}
-
-// deleteCompleteServiceById deletes a service record and all related information.
-func deleteCompleteServiceById(rsc *UnitAsset, serviceId int) error {
-	rsc.mtx.Lock()
-	defer rsc.mtx.Unlock()
-	tx, err := rsc.db.Begin()
+// Delete deletes a service record and all related information.
+func (s *sqliteStore) Delete(serviceId int) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	if _, err = tx.Exec("DELETE FROM ServicesXIP WHERE ServiceId = ?", serviceId); err != nil {
-		return err
-	}
-	if _, err = tx.Exec("DELETE FROM ServicesXPP WHERE ServiceId = ?", serviceId); err != nil {
-		return err
-	}
-	if _, err = tx.Exec("DELETE FROM ServicesXDetails WHERE ServiceId = ?", serviceId); err != nil {
-		return err
-	}
-	if _, err = tx.Exec(`
-		 DELETE FROM IPAddresses
-		 WHERE Id NOT IN (SELECT IPAddressId FROM ServicesXIP)
-	 `); err != nil {
+	if err = deleteService(tx, serviceId); err != nil {
 		return err
 	}
-	if _, err = tx.Exec(`
-		 DELETE FROM ProtoPorts
-		 WHERE Id NOT IN (SELECT ProtoPortId FROM ServicesXPP)
-	 `); err != nil {
-		return err
-	}
-	if _, err = tx.Exec(`
-		 DELETE FROM Details
-		 WHERE Id NOT IN (SELECT DetailId FROM ServicesXDetails)
-	 `); err != nil {
-		return err
-	}
-	if _, err = tx.Exec("DELETE FROM Services WHERE Id = ?", serviceId); err != nil {
-		return err
-	}
-
 	if err = tx.Commit(); err != nil {
 		return err
 	}
@@ -460,65 +595,49 @@ func deleteCompleteServiceById(rsc *UnitAsset, serviceId int) error {
 	return nil
 }
 
-// findServices finds services based on the provided service description.
-func findServices(rsc *UnitAsset, serviceDescription forms.ServiceQuest_v1) ([]forms.ServiceRecord_v1, error) {
-	query := `
-		SELECT Id FROM Services
-		WHERE Definition = ?`
-	params := []interface{}{serviceDescription.ServiceDefinition}
-
-	// If there are details to filter by, we add conditions for them
-	if len(serviceDescription.Details) > 0 {
-		query += " AND Id IN (SELECT ServiceId FROM ServicesXDetails WHERE DetailId IN (SELECT Id FROM Details WHERE"
-		first := true
-		for key, values := range serviceDescription.Details {
-			for _, value := range values {
-				if !first {
-					query += " OR "
-				}
-				query += " (DetailKey = ? AND DetailValue = ?)"
-				params = append(params, key, value)
-				first = false
-			}
-		}
-		query += "))"
+// Expire deletes a record whose validity ended before now within one transaction and returns it.
+func (s *sqliteStore) Expire(id int, now time.Time) (*forms.ServiceRecord_v1, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
 	}
+	defer tx.Rollback()
 
-	// Debugging: Print the query and params to verify them
-	// fmt.Printf("Query: %s\nParams: %v\n", query, params)
-
-	rsc.mtx.RLock()
-	defer rsc.mtx.RUnlock()
-
-	rows, err := rsc.db.Query(query, params...)
+	rec, err := readRecord(tx, id)
+	if err == sql.ErrNoRows {
+		return nil, nil // already deleted
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var serviceRecords []forms.ServiceRecord_v1
-	for rows.Next() {
-		var id int
-		if err := rows.Scan(&id); err != nil {
-			return nil, err
-		}
-		record, err := getRecord(rsc, id)
-		if err != nil {
-			return nil, err
-		}
-		serviceRecords = append(serviceRecords, *record)
+	expiration, err := time.Parse(time.RFC3339, rec.EndOfValidity)
+	if err != nil {
+		return nil, err
+	}
+	if !now.After(expiration) {
+		return nil, nil // renewed in the meantime
 	}
+	if err = deleteService(tx, id); err != nil {
+		return nil, err
+	}
+	return rec, tx.Commit()
+}
 
-	return serviceRecords, rows.Err()
+// deleteService deletes a service record within a transaction, its IP addresses, protocol ports and details being deleted by cascade
+func deleteService(tx *sql.Tx, serviceId int) error {
+	_, err := tx.Exec("DELETE FROM Services WHERE Id = ?", serviceId)
+	return err
 }
 
-// getUniqueSystems populates the list of systems in a local cloud
-func getUniqueSystems(rsc *UnitAsset) (*forms.SystemRecordList_v1, error) {
+// ListSystems populates the list of systems in a local cloud
+func (s *sqliteStore) ListSystems() (*forms.SystemRecordList_v1, error) {
 	uniqueSystems := make(map[string]forms.SystemRecord_v1)
 
-	rsc.mtx.RLock()
-	defer rsc.mtx.RUnlock()
-	rows, err := rsc.db.Query(`
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	rows, err := s.db.Query(`
 		SELECT s.SystemName, ip.IPAddress, pp.Port
 		FROM Services s
 		INNER JOIN ServicesXIP sip ON s.Id = sip.ServiceId
@@ -572,3 +691,87 @@ func getUniqueSystems(rsc *UnitAsset) (*forms.SystemRecordList_v1, error) {
 		Version: "SystemRecordList_v1",
 	}, nil
 }
+
+// AppendEvent appends an event to the audit trail.
+func (s *sqliteStore) AppendEvent(e registrar.HistoryEvent) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, err := s.db.Exec(`
+		INSERT INTO Events (Time, Event, RecordId, SystemName, Definition, SubPath, SourceIP, Note)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, e.Time, e.Event, e.RecordId, e.SystemName, e.Definition, e.SubPath, e.SourceIP, e.Note)
+	return err
+}
+
+// PruneEvents deletes the events older than the cutoff time.
+func (s *sqliteStore) PruneEvents(before time.Time) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, err := s.db.Exec(`DELETE FROM Events WHERE Time < ?`, before.UTC().Format(registrar.HistoryTimeFormat))
+	return err
+}
+
+// QueryEvents retrieves the events of the audit trail that pass the filter, the newest first.
+// With an after id, the page holds the events right after it (the oldest ones of the range), still the newest first.
+func (s *sqliteStore) QueryEvents(f registrar.HistoryFilter) ([]registrar.HistoryEvent, error) {
+	query := `SELECT Id, Time, Event, RecordId, SystemName, Definition, SubPath, SourceIP, Note FROM Events WHERE 1 = 1`
+	var params []interface{}
+	if f.SystemName != "" {
+		query += " AND SystemName = ?"
+		params = append(params, f.SystemName)
+	}
+	if f.Definition != "" {
+		query += " AND Definition = ?"
+		params = append(params, f.Definition)
+	}
+	if f.Event != "" {
+		query += " AND Event = ?"
+		params = append(params, f.Event)
+	}
+	if !f.From.IsZero() {
+		query += " AND Time >= ?"
+		params = append(params, f.From.UTC().Format(registrar.HistoryTimeFormat))
+	}
+	if !f.To.IsZero() {
+		query += " AND Time <= ?"
+		params = append(params, f.To.UTC().Format(registrar.HistoryTimeFormat))
+	}
+	if f.Before > 0 {
+		query += " AND Id < ?"
+		params = append(params, f.Before)
+	}
+	if f.After > 0 {
+		query += " AND Id > ? ORDER BY Id ASC LIMIT ?"
+		params = append(params, f.After)
+	} else {
+		query += " ORDER BY Id DESC LIMIT ?"
+	}
+	params = append(params, f.Limit)
+
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	rows, err := s.db.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := make([]registrar.HistoryEvent, 0)
+	for rows.Next() {
+		var e registrar.HistoryEvent
+		if err := rows.Scan(&e.Id, &e.Time, &e.Event, &e.RecordId, &e.SystemName, &e.Definition, &e.SubPath, &e.SourceIP, &e.Note); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	if f.After > 0 { // read from the oldest one, the page is put in the newest first order of the history service
+		for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+			events[i], events[j] = events[j], events[i]
+		}
+	}
+	return events, rows.Err()
+}
+
+// Close closes the database.
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,70 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Jan van Deventer
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-2.0/
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sdoque/systems/internal/loadgen"
+	"github.com/sdoque/systems/internal/registrar"
+)
+
+// The in-process load test runs the simulation of the loadtest tool against each storage backend, without HTTP:
+//
+//	go test -run Load -load 1m -loadsystems 500 -loadout reports
+var (
+	loadDuration = flag.Duration("load", 0, "duration of the in-process load test (skipped if 0)")
+	loadSystems  = flag.Int("loadsystems", 100, "number of simulated systems of the in-process load test")
+	loadOut      = flag.String("loadout", "", "directory of the JSON reports of the in-process load test (logged if empty)")
+)
+
+func TestLoad(t *testing.T) {
+	if *loadDuration == 0 {
+		t.Skip("the in-process load test runs with -load, e.g., -load 1m")
+	}
+	settings := loadgen.Settings{
+		Systems:   *loadSystems,
+		Services:  3,
+		Duration:  *loadDuration,
+		RegPeriod: 10 * time.Second,
+		RegLife:   20 * time.Second,
+		Rate:      50,
+		Mix:       map[string]float64{"query": 7, "list": 3},
+		Crash:     0.1,
+	}
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			target, cleanup := registrar.NewLoadTarget(b.open(t))
+			defer cleanup()
+
+			report := loadgen.Run(settings, target)
+			report.Registrar = "sregistrar in process (" + b.name + ")"
+			payload, err := report.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *loadOut == "" {
+				t.Log(string(payload))
+				return
+			}
+			if err := os.WriteFile(filepath.Join(*loadOut, "sregistrar-"+b.name+".json"), payload, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Jan van Deventer
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-2.0/
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+//*********************Schema versions of the SQLite database*********************
+
+// The schema of a persistent database evolves with ordered up-migrations instead of being recreated.
+// The schema_version table records the migrations applied to the database, each of them in its own transaction,
+// so that a registrar opening an older database brings it up to date and one opening a newer database refuses it.
+// A change of the schema is made by appending a migration to the list, never by editing an applied one.
+
+// migration is a change of the database schema
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// joinTable rebuilds a join table with cascaded deletions, so that deleting a service also deletes its linked rows
+func joinTable(table, column, linked string) []string {
+	return []string{
+		fmt.Sprintf(`DELETE FROM %s WHERE ServiceId NOT IN (SELECT Id FROM Services) OR %s NOT IN (SELECT Id FROM %s);`, table, column, linked),
+		fmt.Sprintf(`DELETE FROM %s WHERE Id NOT IN (SELECT %s FROM %s);`, linked, column, table),
+		fmt.Sprintf(`CREATE TABLE %s_new (
+			ServiceId INTEGER NOT NULL REFERENCES Services(Id) ON DELETE CASCADE,
+			%s INTEGER NOT NULL REFERENCES %s(Id) ON DELETE CASCADE
+		);`, table, column, linked),
+		fmt.Sprintf(`INSERT INTO %s_new (ServiceId, %s) SELECT ServiceId, %s FROM %s;`, table, column, column, table),
+		fmt.Sprintf(`DROP TABLE %s;`, table),
+		fmt.Sprintf(`ALTER TABLE %s_new RENAME TO %s;`, table, table),
+		fmt.Sprintf(`CREATE INDEX %s_ServiceId ON %s(ServiceId);`, table, table),
+		fmt.Sprintf(`CREATE TRIGGER %s_Cleanup AFTER DELETE ON %s BEGIN DELETE FROM %s WHERE Id = OLD.%s; END;`, table, table, linked, column),
+	}
+}
+
+// cascadeDeletion rebuilds the join tables with cascaded deletions and indexes the frequent lookups
+func cascadeDeletion() []string {
+	var statements []string
+	statements = append(statements, joinTable("ServicesXIP", "IPAddressId", "IPAddresses")...)
+	statements = append(statements, joinTable("ServicesXPP", "ProtoPortId", "ProtoPorts")...)
+	statements = append(statements, joinTable("ServicesXDetails", "DetailId", "Details")...)
+	return append(statements,
+		`CREATE INDEX Services_Definition ON Services(Definition);`,
+		`CREATE INDEX Services_SystemName ON Services(SystemName, SubPath);`,
+		`CREATE INDEX Events_Time ON Events(Time);`,
+	)
+}
+
+// migrations are the schema changes in order of version
+var migrations = []migration{
+	{
+		version:     1,
+		description: "initial schema",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS Services (
+				Id INTEGER PRIMARY KEY,
+				Definition TEXT,
+				SystemName TEXT,
+				Certificate TEXT,
+				SubPath TEXT,
+				Version TEXT,
+				Created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				Updated TEXT,
+				RegLife TEXT,
+				EndOfValidity TIMESTAMP,
+				SubscribeAble BOOLEAN,
+				ACost REAL,
+				CUnit TEXT,
+				Confirmed BOOLEAN NOT NULL DEFAULT 1
+			);`,
+			`CREATE TABLE IF NOT EXISTS IPAddresses (
+				Id INTEGER PRIMARY KEY,
+				IPAddress TEXT
+			);`,
+			`CREATE TABLE IF NOT EXISTS ProtoPorts (
+				Id INTEGER PRIMARY KEY,
+				Proto TEXT,
+				Port INTEGER
+			);`,
+			`CREATE TABLE IF NOT EXISTS Details (
+				Id INTEGER PRIMARY KEY,
+				DetailKey TEXT,
+				DetailValue TEXT
+			);`,
+			`CREATE TABLE IF NOT EXISTS ServicesXIP (
+				ServiceId INTEGER,
+				IPAddressId INTEGER,
+				FOREIGN KEY(ServiceId) REFERENCES Services(Id),
+				FOREIGN KEY(IPAddressId) REFERENCES IPAddresses(Id)
+			);`,
+			`CREATE TABLE IF NOT EXISTS ServicesXPP (
+				ServiceId INTEGER,
+				ProtoPortId INTEGER,
+				FOREIGN KEY(ServiceId) REFERENCES Services(Id),
+				FOREIGN KEY(ProtoPortId) REFERENCES ProtoPorts(Id)
+			);`,
+			`CREATE TABLE IF NOT EXISTS Events (
+				Id INTEGER PRIMARY KEY,
+				Time TEXT NOT NULL,
+				Event TEXT NOT NULL,
+				RecordId INTEGER,
+				SystemName TEXT,
+				Definition TEXT,
+				SubPath TEXT,
+				SourceIP TEXT,
+				Note TEXT
+			);`,
+			`CREATE TABLE IF NOT EXISTS ServicesXDetails (
+				ServiceId INTEGER,
+				DetailId INTEGER,
+				FOREIGN KEY(ServiceId) REFERENCES Services(Id),
+				FOREIGN KEY(DetailId) REFERENCES Details(Id)
+			);`,
+		},
+	},
+	{
+		version:     2,
+		description: "cascaded deletion of the services and indexes",
+		statements:  cascadeDeletion(),
+	},
+	{
+		version:     3,
+		description: "service node of the records",
+		statements: []string{
+			`ALTER TABLE Services ADD COLUMN ServiceNode TEXT NOT NULL DEFAULT '';`,
+		},
+	},
+	{
+		version:     4,
+		description: "index of the IP addresses for the registration quotas",
+		statements: []string{
+			`CREATE INDEX IPAddresses_Address ON IPAddresses(IPAddress);`,
+		},
+	},
+}
+
+// schemaVersion returns the latest migration applied to the database (0 for a new database)
+func schemaVersion(db *sql.DB) (int, error) {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		Version INTEGER PRIMARY KEY,
+		Description TEXT,
+		Applied TEXT NOT NULL
+	);`); err != nil {
+		return 0, err
+	}
+	var version int
+	err := db.QueryRow(`SELECT COALESCE(MAX(Version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// migrate applies the migrations that the database is missing, each one in its own transaction
+func migrate(db *sql.DB) error {
+	current, err := schemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("error reading the schema version: %w", err)
+	}
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("the database schema version %d is newer than the version %d of this registrar", current, latest)
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("error migrating the database to version %d (%s): %w", m.version, m.description, err)
+		}
+		log.Printf("database migrated to schema version %d: %s\n", m.version, m.description)
+	}
+	return nil
+}
+
+// applyMigration executes the statements of a migration and records it
+func applyMigration(db *sql.DB, m migration) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	for _, stmt := range m.statements {
+		if _, err = tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO schema_version (Version, Description, Applied) VALUES (?, ?, ?)`, m.version, m.description, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// checkIntegrity verifies the structure of the database and its foreign keys
+func checkIntegrity(db *sql.DB) error {
+	var result string
+	if err := db.QueryRow(`PRAGMA integrity_check`).Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("the database is corrupt: %s", result)
+	}
+	rows, err := db.Query(`PRAGMA foreign_key_check`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		return fmt.Errorf("the database has rows with broken references")
+	}
+	return rows.Err()
+}
@@ -0,0 +1,168 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Jan van Deventer
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-2.0/
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// openFixture opens a new database file loaded with a fixture of testdata (none if empty)
+func openFixture(t *testing.T, fixture string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "serviceRegistry.db")+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if fixture == "" {
+		return db
+	}
+	script, err := os.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(script)); err != nil {
+		t.Fatalf("loading %s: %v", fixture, err)
+	}
+	return db
+}
+
+// count returns the result of a counting query
+func count(t *testing.T, db *sql.DB, query string, args ...interface{}) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+// fixtureServices are the services of the fixtures as the registrar reads them after the migrations
+var fixtureServices = map[int]struct {
+	definition, system, subPath, cUnit string
+	aCost                              float64
+	ips                                []string
+	ports                              map[string]int
+	details                            map[string][]string
+}{
+	1: {"temperature", "thermo", "kitchen/temperature", "", 0, []string{"192.168.1.10"}, map[string]int{"http": 20150}, map[string][]string{"Location": {"Kitchen"}, "Unit": {"Celsius"}}},
+	2: {"setpoint", "heater", "valve/setpoint", "kWh", 2.5, []string{"192.168.1.20"}, map[string]int{"http": 20152}, map[string][]string{"Location": {"Kitchen"}}},
+}
+
+func TestMigrations(t *testing.T) {
+	latest := migrations[len(migrations)-1].version
+	tests := []struct {
+		name     string
+		fixture  string
+		services []int // ids of the services that must survive the migrations
+	}{
+		{"empty database", "", nil},
+		{"version 1", "schema_v1.sql", []int{1, 2}},
+		{"version 2", "schema_v2.sql", []int{1, 2}},
+		{"version 3", "schema_v3.sql", []int{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openFixture(t, tt.fixture)
+			if err := migrate(db); err != nil {
+				t.Fatal(err)
+			}
+
+			// the schema is at the latest version with every migration recorded once
+			version, err := schemaVersion(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != latest {
+				t.Fatalf("schema version %d, want %d", version, latest)
+			}
+			if n := count(t, db, `SELECT COUNT(*) FROM schema_version`); n != len(migrations) {
+				t.Fatalf("%d migrations recorded, want %d", n, len(migrations))
+			}
+			if err := migrate(db); err != nil {
+				t.Fatalf("migrating an up to date database: %v", err)
+			}
+			if err := checkIntegrity(db); err != nil {
+				t.Fatal(err)
+			}
+
+			// the join tables clean up their linked rows
+			for _, trigger := range []string{"ServicesXIP_Cleanup", "ServicesXPP_Cleanup", "ServicesXDetails_Cleanup"} {
+				if count(t, db, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = ?`, trigger) != 1 {
+					t.Fatalf("the trigger %s is missing", trigger)
+				}
+			}
+
+			// the services survive with their addresses, ports and details, and the orphans are gone
+			store := &sqliteStore{db: db}
+			for _, id := range tt.services {
+				rec, err := store.Get(id)
+				if err != nil {
+					t.Fatalf("service %d: %v", id, err)
+				}
+				want := fixtureServices[id]
+				sort.Strings(rec.Details["Location"])
+				if rec.ServiceDefinition != want.definition || rec.SystemName != want.system || rec.SubPath != want.subPath ||
+					rec.ACost != want.aCost || rec.CUnit != want.cUnit || rec.ServiceNode != "" ||
+					!reflect.DeepEqual(rec.IPAddresses, want.ips) || !reflect.DeepEqual(rec.ProtoPort, want.ports) || !reflect.DeepEqual(rec.Details, want.details) {
+					t.Fatalf("service %d read as %+v, want %+v", id, *rec, want)
+				}
+			}
+			if n := count(t, db, `SELECT COUNT(*) FROM IPAddresses`); n != len(tt.services) {
+				t.Fatalf("%d IP addresses, want %d (the orphans are removed)", n, len(tt.services))
+			}
+			if tt.fixture != "" && count(t, db, `SELECT COUNT(*) FROM Events`) != 1 {
+				t.Fatal("the audit trail was not kept")
+			}
+
+			// deleting a service cascades to its linked rows
+			if len(tt.services) == 0 {
+				return
+			}
+			if err := store.Delete(1); err != nil {
+				t.Fatal(err)
+			}
+			for table, query := range map[string]string{
+				"ServicesXIP":      `SELECT COUNT(*) FROM ServicesXIP WHERE ServiceId = 1`,
+				"ServicesXPP":      `SELECT COUNT(*) FROM ServicesXPP WHERE ServiceId = 1`,
+				"ServicesXDetails": `SELECT COUNT(*) FROM ServicesXDetails WHERE ServiceId = 1`,
+				"IPAddresses":      `SELECT COUNT(*) FROM IPAddresses WHERE IPAddress = '192.168.1.10'`,
+				"ProtoPorts":       `SELECT COUNT(*) FROM ProtoPorts WHERE Port = 20150`,
+				"Details":          `SELECT COUNT(*) FROM Details WHERE DetailValue = 'Celsius'`,
+			} {
+				if n := count(t, db, query); n != 0 {
+					t.Fatalf("%d rows of %s left after deleting their service", n, table)
+				}
+			}
+			if _, err := store.Get(2); err != nil {
+				t.Fatalf("the other service was deleted: %v", err)
+			}
+		})
+	}
+}
+
+func TestMigrationRefusesNewerSchema(t *testing.T) {
+	db := openFixture(t, "schema_v2.sql")
+	if _, err := db.Exec(`INSERT INTO schema_version VALUES (99, 'from the future', '2030-01-01T00:00:00Z')`); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db); err == nil {
+		t.Fatal("a database with a newer schema was accepted")
+	}
+}
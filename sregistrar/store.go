@@ -0,0 +1,37 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Jan van Deventer
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-2.0/
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/sdoque/systems/internal/registrar"
+)
+
+//*********************Storage backend of the registry*********************
+
+// The service registry (package internal/registrar) only uses the registrar.Store interface, so that a new backend
+// (e.g., a key-value store or a snapshot file) is added by implementing it and naming it in openStore.
+
+// openStore opens the storage backend named in the configuration
+func openStore(storage string, persistent bool) (registrar.Store, error) {
+	switch storage {
+	case "", "sqlite":
+		return openSQLiteStore(persistent)
+	case "memory":
+		return registrar.NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q (sqlite or memory)", storage)
+	}
+}
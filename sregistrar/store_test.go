@@ -0,0 +1,59 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Jan van Deventer
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-2.0/
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/sdoque/systems/internal/registrar"
+	"github.com/sdoque/systems/internal/registrar/registrartest"
+)
+
+// backends are the storage backends that must pass the conformance suite
+var backends = []struct {
+	name string
+	open func(t *testing.T) registrar.Store
+}{
+	{"sqlite", func(t *testing.T) registrar.Store {
+		inTempDir(t) // the database file is created in the working directory
+		s, err := openSQLiteStore(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}},
+	{"memory", func(t *testing.T) registrar.Store { return registrar.NewMemoryStore() }},
+}
+
+func TestStoreConformance(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			registrartest.Run(t, b.open)
+		})
+	}
+}
+
+// inTempDir runs the rest of the test in a temporary working directory
+func inTempDir(t *testing.T) {
+	t.Helper()
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+}
@@ -0,0 +1,68 @@
+-- A persistent registry written by a registrar at schema version 1 (initial schema):
+-- two services with their addresses, ports and details, and the orphan rows that the version 2 migration removes.
+
+CREATE TABLE Services (
+	Id INTEGER PRIMARY KEY,
+	Definition TEXT,
+	SystemName TEXT,
+	Certificate TEXT,
+	SubPath TEXT,
+	Version TEXT,
+	Created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	Updated TEXT,
+	RegLife TEXT,
+	EndOfValidity TIMESTAMP,
+	SubscribeAble BOOLEAN,
+	ACost REAL,
+	CUnit TEXT,
+	Confirmed BOOLEAN NOT NULL DEFAULT 1
+);
+CREATE TABLE IPAddresses (Id INTEGER PRIMARY KEY, IPAddress TEXT);
+CREATE TABLE ProtoPorts (Id INTEGER PRIMARY KEY, Proto TEXT, Port INTEGER);
+CREATE TABLE Details (Id INTEGER PRIMARY KEY, DetailKey TEXT, DetailValue TEXT);
+CREATE TABLE ServicesXIP (
+	ServiceId INTEGER,
+	IPAddressId INTEGER,
+	FOREIGN KEY(ServiceId) REFERENCES Services(Id),
+	FOREIGN KEY(IPAddressId) REFERENCES IPAddresses(Id)
+);
+CREATE TABLE ServicesXPP (
+	ServiceId INTEGER,
+	ProtoPortId INTEGER,
+	FOREIGN KEY(ServiceId) REFERENCES Services(Id),
+	FOREIGN KEY(ProtoPortId) REFERENCES ProtoPorts(Id)
+);
+CREATE TABLE Events (
+	Id INTEGER PRIMARY KEY,
+	Time TEXT NOT NULL,
+	Event TEXT NOT NULL,
+	RecordId INTEGER,
+	SystemName TEXT,
+	Definition TEXT,
+	SubPath TEXT,
+	SourceIP TEXT,
+	Note TEXT
+);
+CREATE TABLE ServicesXDetails (
+	ServiceId INTEGER,
+	DetailId INTEGER,
+	FOREIGN KEY(ServiceId) REFERENCES Services(Id),
+	FOREIGN KEY(DetailId) REFERENCES Details(Id)
+);
+CREATE TABLE schema_version (Version INTEGER PRIMARY KEY, Description TEXT, Applied TEXT NOT NULL);
+INSERT INTO schema_version VALUES (1, 'initial schema', '2024-05-01T08:00:00Z');
+
+INSERT INTO Services VALUES (1, 'temperature', 'thermo', '', 'kitchen/temperature', 'SignalA_v1a', '2024-05-01T08:00:00Z', '2024-05-01T08:00:00Z', '30', '2099-01-01T00:00:00Z', 0, 0, '', 1);
+INSERT INTO Services VALUES (2, 'setpoint', 'heater', '', 'valve/setpoint', 'SignalA_v1a', '2024-05-01T08:00:00Z', '2024-05-01T08:00:00Z', '30', '2099-01-01T00:00:00Z', 0, 2.5, 'kWh', 1);
+INSERT INTO IPAddresses VALUES (1, '192.168.1.10'), (2, '192.168.1.20');
+INSERT INTO ProtoPorts VALUES (1, 'http', 20150), (2, 'http', 20152);
+INSERT INTO Details VALUES (1, 'Location', 'Kitchen'), (2, 'Unit', 'Celsius'), (3, 'Location', 'Kitchen');
+INSERT INTO ServicesXIP VALUES (1, 1), (2, 2);
+INSERT INTO ServicesXPP VALUES (1, 1), (2, 2);
+INSERT INTO ServicesXDetails VALUES (1, 1), (1, 2), (2, 3);
+INSERT INTO Events VALUES (1, '2024-05-01T08:00:00.000Z', 'register', 1, 'thermo', 'temperature', 'kitchen/temperature', '192.168.1.10', '');
+
+-- orphans left by the registrars that deleted a service without its linked rows
+INSERT INTO IPAddresses VALUES (3, '192.168.1.99');
+INSERT INTO ServicesXIP VALUES (99, 3);
+INSERT INTO Details VALUES (4, 'Location', 'Attic');
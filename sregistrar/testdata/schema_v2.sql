@@ -0,0 +1,67 @@
+-- A persistent registry written by a registrar at schema version 2 (cascaded deletion of the services and indexes):
+-- two services with their addresses, ports and details.
+
+CREATE TABLE Services (
+	Id INTEGER PRIMARY KEY,
+	Definition TEXT,
+	SystemName TEXT,
+	Certificate TEXT,
+	SubPath TEXT,
+	Version TEXT,
+	Created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	Updated TEXT,
+	RegLife TEXT,
+	EndOfValidity TIMESTAMP,
+	SubscribeAble BOOLEAN,
+	ACost REAL,
+	CUnit TEXT,
+	Confirmed BOOLEAN NOT NULL DEFAULT 1
+);
+CREATE TABLE IPAddresses (Id INTEGER PRIMARY KEY, IPAddress TEXT);
+CREATE TABLE ProtoPorts (Id INTEGER PRIMARY KEY, Proto TEXT, Port INTEGER);
+CREATE TABLE Details (Id INTEGER PRIMARY KEY, DetailKey TEXT, DetailValue TEXT);
+CREATE TABLE Events (
+	Id INTEGER PRIMARY KEY,
+	Time TEXT NOT NULL,
+	Event TEXT NOT NULL,
+	RecordId INTEGER,
+	SystemName TEXT,
+	Definition TEXT,
+	SubPath TEXT,
+	SourceIP TEXT,
+	Note TEXT
+);
+CREATE TABLE ServicesXIP (
+	ServiceId INTEGER NOT NULL REFERENCES Services(Id) ON DELETE CASCADE,
+	IPAddressId INTEGER NOT NULL REFERENCES IPAddresses(Id) ON DELETE CASCADE
+);
+CREATE INDEX ServicesXIP_ServiceId ON ServicesXIP(ServiceId);
+CREATE TRIGGER ServicesXIP_Cleanup AFTER DELETE ON ServicesXIP BEGIN DELETE FROM IPAddresses WHERE Id = OLD.IPAddressId; END;
+CREATE TABLE ServicesXPP (
+	ServiceId INTEGER NOT NULL REFERENCES Services(Id) ON DELETE CASCADE,
+	ProtoPortId INTEGER NOT NULL REFERENCES ProtoPorts(Id) ON DELETE CASCADE
+);
+CREATE INDEX ServicesXPP_ServiceId ON ServicesXPP(ServiceId);
+CREATE TRIGGER ServicesXPP_Cleanup AFTER DELETE ON ServicesXPP BEGIN DELETE FROM ProtoPorts WHERE Id = OLD.ProtoPortId; END;
+CREATE TABLE ServicesXDetails (
+	ServiceId INTEGER NOT NULL REFERENCES Services(Id) ON DELETE CASCADE,
+	DetailId INTEGER NOT NULL REFERENCES Details(Id) ON DELETE CASCADE
+);
+CREATE INDEX ServicesXDetails_ServiceId ON ServicesXDetails(ServiceId);
+CREATE TRIGGER ServicesXDetails_Cleanup AFTER DELETE ON ServicesXDetails BEGIN DELETE FROM Details WHERE Id = OLD.DetailId; END;
+CREATE INDEX Services_Definition ON Services(Definition);
+CREATE INDEX Services_SystemName ON Services(SystemName, SubPath);
+CREATE INDEX Events_Time ON Events(Time);
+CREATE TABLE schema_version (Version INTEGER PRIMARY KEY, Description TEXT, Applied TEXT NOT NULL);
+INSERT INTO schema_version VALUES (1, 'initial schema', '2024-05-01T08:00:00Z');
+INSERT INTO schema_version VALUES (2, 'cascaded deletion of the services and indexes', '2024-06-01T08:00:00Z');
+
+INSERT INTO Services VALUES (1, 'temperature', 'thermo', '', 'kitchen/temperature', 'SignalA_v1a', '2024-05-01T08:00:00Z', '2024-05-01T08:00:00Z', '30', '2099-01-01T00:00:00Z', 0, 0, '', 1);
+INSERT INTO Services VALUES (2, 'setpoint', 'heater', '', 'valve/setpoint', 'SignalA_v1a', '2024-05-01T08:00:00Z', '2024-05-01T08:00:00Z', '30', '2099-01-01T00:00:00Z', 0, 2.5, 'kWh', 1);
+INSERT INTO IPAddresses VALUES (1, '192.168.1.10'), (2, '192.168.1.20');
+INSERT INTO ProtoPorts VALUES (1, 'http', 20150), (2, 'http', 20152);
+INSERT INTO Details VALUES (1, 'Location', 'Kitchen'), (2, 'Unit', 'Celsius'), (3, 'Location', 'Kitchen');
+INSERT INTO ServicesXIP VALUES (1, 1), (2, 2);
+INSERT INTO ServicesXPP VALUES (1, 1), (2, 2);
+INSERT INTO ServicesXDetails VALUES (1, 1), (1, 2), (2, 3);
+INSERT INTO Events VALUES (1, '2024-05-01T08:00:00.000Z', 'register', 1, 'thermo', 'temperature', 'kitchen/temperature', '192.168.1.10', '');